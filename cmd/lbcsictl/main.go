@@ -0,0 +1,176 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	flag "github.com/spf13/pflag"
+
+	"github.com/lightbitslabs/los-csi/pkg/driver"
+	"github.com/lightbitslabs/los-csi/pkg/lb"
+)
+
+const usage = `USAGE: lbcsictl [flags] <command> [command flags]
+
+lbcsictl performs LightOS-specific operations on volumes provisioned by the
+LB CSI plugin that have no equivalent in the CSI spec. volumes and snapshots
+are specified by their CSI IDs, e.g. as found in the 'spec.csi.volumeHandle'
+field of a K8s PV or the 'status.snapshotHandle' field of a K8s
+VolumeSnapshotContent.
+
+Commands:
+  rollback  - roll a volume back in place to one of its snapshots. the volume
+        must not be published to any node, e.g. in K8s all the pods using the
+        volume must be deleted or scaled down beforehand. all the data written
+        to the volume after the snapshot was taken is lost!
+
+Global flags:
+`
+
+const (
+	defaultJWTPath = "/etc/lb-csi/jwt"
+
+	statusOk      = 0
+	statusFailed  = 1
+	statusBadArgs = 2
+)
+
+var (
+	jwtPath = flag.StringP("jwt-path", "j", "",
+		"Path to LightOS API auth JWT, see $LB_CSI_JWT_PATH. (default: "+
+			defaultJWTPath+")")
+	mgmtCAPath = flag.String("mgmt-ca-path", "",
+		"Path to PEM CA bundle to verify LightOS API server certs against, "+
+			"see $LB_CSI_MGMT_CA_PATH. (default: system roots)")
+	mgmtClientCertPath = flag.String("mgmt-client-cert-path", "",
+		"Path to PEM client cert for LightOS API mTLS, see "+
+			"$LB_CSI_MGMT_CLIENT_CERT_PATH.")
+	mgmtClientKeyPath = flag.String("mgmt-client-key-path", "",
+		"Path to PEM client key for LightOS API mTLS, see "+
+			"$LB_CSI_MGMT_CLIENT_KEY_PATH.")
+	mgmtServerName = flag.String("mgmt-server-name", "",
+		"Name to verify LightOS API server certs against, see "+
+			"$LB_CSI_MGMT_SERVER_NAME. (default: server address)")
+	mgmtTLSSkipVerify = flag.Bool("mgmt-tls-skip-verify", false,
+		"DANGEROUS: don't verify LightOS API server certs.")
+	timeout = flag.DurationP("timeout", "t", 5*time.Minute,
+		"Max time to wait for the command to complete.")
+	logLevel = flag.StringP("log-level", "l", "info",
+		"Log severity, one of: {debug, info, warning, error}.")
+	help = flag.BoolP("help", "h", false, "Print help and exit.")
+)
+
+//revive:disable:deep-exit,unhandled-error // er... DIE funcs?
+
+func usageAndDie() {
+	fmt.Fprint(os.Stderr, usage)
+	fmt.Fprint(os.Stderr, flag.CommandLine.FlagUsagesWrapped(80))
+	os.Exit(statusBadArgs)
+}
+
+func errorAndDie(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "ERROR: "+format+"\n", args...)
+	fmt.Fprintf(os.Stderr, "\nTry 'lbcsictl --help' for more information.\n")
+	os.Exit(statusBadArgs)
+}
+
+//revive:enable:deep-exit,unhandled-error
+
+func readJWT() string {
+	path := *jwtPath
+	if path == "" {
+		path = os.Getenv("LB_CSI_JWT_PATH")
+		if path == "" {
+			path = defaultJWTPath
+		}
+	}
+	jwt, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		errorAndDie("failed to read JWT: %s", err)
+	}
+	return strings.TrimSpace(string(jwt))
+}
+
+func flagOrEnv(val, envVar string) string {
+	if val == "" {
+		return os.Getenv(envVar)
+	}
+	return val
+}
+
+func readMgmtTLS() *lb.TLSConfig {
+	tlsCfg, err := driver.LoadMgmtTLSConfig(
+		flagOrEnv(*mgmtCAPath, "LB_CSI_MGMT_CA_PATH"),
+		flagOrEnv(*mgmtClientCertPath, "LB_CSI_MGMT_CLIENT_CERT_PATH"),
+		flagOrEnv(*mgmtClientKeyPath, "LB_CSI_MGMT_CLIENT_KEY_PATH"),
+		flagOrEnv(*mgmtServerName, "LB_CSI_MGMT_SERVER_NAME"),
+		*mgmtTLSSkipVerify,
+	)
+	if err != nil {
+		errorAndDie("failed to load LightOS API TLS settings: %s", err)
+	}
+	return tlsCfg
+}
+
+func rollback(ctx context.Context, log *logrus.Entry, args []string) error {
+	fs := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	volID := fs.String("volume-id", "", "CSI ID of the volume to roll back.")
+	snapID := fs.String("snapshot-id", "", "CSI ID of the snapshot to roll "+
+		"the volume back to.")
+	if err := fs.Parse(args); err != nil {
+		errorAndDie(err.Error())
+	}
+	if *volID == "" || *snapID == "" {
+		errorAndDie("both --volume-id and --snapshot-id must be specified")
+	}
+
+	return driver.RollbackVolume(ctx, log, *volID, *snapID, readJWT(),
+		readMgmtTLS())
+}
+
+func main() {
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	flag.SetInterspersed(false)
+	err := flag.CommandLine.Parse(os.Args[1:])
+	if err != nil {
+		errorAndDie(err.Error())
+	}
+	if *help {
+		usageAndDie()
+	}
+	if flag.NArg() == 0 {
+		errorAndDie("no command specified")
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(os.Stderr)
+	level, err := logrus.ParseLevel(*logLevel)
+	if err != nil {
+		errorAndDie("invalid log level '%s'", *logLevel)
+	}
+	logger.SetLevel(level)
+	log := logger.WithField("cmd", flag.Arg(0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	switch flag.Arg(0) {
+	case "rollback":
+		err = rollback(ctx, log, flag.Args()[1:])
+	default:
+		errorAndDie("unknown command '%s'", flag.Arg(0))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		os.Exit(statusFailed) //nolint:gocritic
+	}
+	os.Exit(statusOk)
+}
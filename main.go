@@ -36,6 +36,11 @@ Supported environment variables:
   LB_CSI_DEFAULT_FS - one of: {ext4, xfs}. Unless otherwise specified, volumes
         with no FS on them will be formatted to this FS before being mounted.
         (default: {{.DefaultFS}})
+  LB_CSI_TRANSPORT  - one of: {tcp, rdma}. NVMe-oF transport of the volumes
+        whose StorageClass doesn't specify one (and of the volumes created
+        before the 'transport' StorageClass param was introduced, whose IDs
+        don't record it). must be the same for the controller and all the
+        nodes. (default: {{.DefaultTransport}})
   LB_CSI_LOG_LEVEL  - one of: {debug, info, warning, error}. Minimal entry
         severity level to log. (default: {{.LogLevel}})
   LB_CSI_LOG_ROLE   - one of: {node, controller}. Aids monitoring by allowing
@@ -62,6 +67,48 @@ Supported environment variables:
         by specifying using deployment config. If specified file does not exist -
         sane defaults will be used. Runtime configuration changes are not
         supported, to reload the config - restart the plugin.
+  LB_CSI_TOPOLOGY_CONFIG_PATH - path to the node topology configuration file,
+        in YAML format. the 'cluster' key holds the UUID of the LightOS cluster
+        reachable from this node, the 'failureDomain' key - the LightOS failure
+        domain this node resides in. both are optional, and are published to
+        the CO as topology segments by the node plugin. if the specified file
+        does not exist - no topology will be published. runtime configuration
+        changes are not supported. (default: {{.TopologyCfgPath}})
+  LB_CSI_MGMT_ENDPOINT      - comma-separated list of LightOS mgmt API
+        endpoints (<host>:<port>) of the cluster to use when serving the CSI
+        API calls that don't specify the target cluster explicitly in any way,
+        such as ListVolumes() or unfiltered ListSnapshots(). these calls also
+        require the global JWT to be configured (see LB_CSI_JWT_PATH), if
+        either is missing - they will not be available. (default: none)
+  LB_CSI_MGMT_SCHEME        - one of: {grpcs, grpc}. transport scheme to use
+        with LB_CSI_MGMT_ENDPOINT. (default: grpcs)
+  LB_CSI_PROJECT_NAME       - LightOS project to limit the calls mentioned
+        under LB_CSI_MGMT_ENDPOINT to. if empty - all the projects accessible
+        with the global JWT will be included. (default: none)
+  LB_CSI_MGMT_CA_PATH       - path to the file storing the PEM-encoded bundle
+        of CA certs to verify the LightOS mgmt API server certs against when
+        using the 'grpcs' scheme. if empty - the system CA certs are used.
+        (default: none)
+  LB_CSI_MGMT_CLIENT_CERT_PATH, LB_CSI_MGMT_CLIENT_KEY_PATH - paths to the
+        files storing the PEM-encoded client cert and key to present to the
+        LightOS mgmt API servers (mTLS). both or neither must be specified.
+        (default: none)
+  LB_CSI_MGMT_SERVER_NAME   - name to verify the LightOS mgmt API server
+        certs against. if empty - the host part of the endpoint being
+        connected to is used. (default: none)
+        the TLS settings files above are monitored and reloaded on change,
+        same as the JWT. all the TLS settings can be overridden per-call
+        through the CSI API secrets, see the docs for details.
+  LB_CSI_MGMT_TLS_SKIP_VERIFY - one of: {true, false}. DANGEROUS: don't
+        verify the LightOS mgmt API server certs at all. this is the legacy
+        behaviour, and leaves the plugin open to MITM attacks. (default: false)
+  LB_CSI_METRICS_ADDR       - <host>:<port> to serve Prometheus metrics on,
+        over plain HTTP at '/metrics'. e.g. ':9090' to listen on all the
+        addresses. if empty - no metrics are served. (default: none)
+  LB_CSI_OTLP_ENDPOINT      - URL of the OpenTelemetry collector to export
+        traces of the CSI calls and the LightOS API calls to, using OTLP/HTTP,
+        e.g. 'http://otel-collector:4318'. if empty - tracing is disabled.
+        (default: none)
 
 Command line flags:
 `
@@ -80,11 +127,14 @@ var defaults = driver.Config{
 	BackendCfgPath: filepath.Join(defaultCfgDirPath, defaultBackendCfgFileName),
 	JWTPath:        filepath.Join(defaultCfgDirPath, defaultJWTFileName),
 	LUKSCfgPath:    filepath.Join(defaultCfgDirPath, driver.DefaultLUKSCfgFileName),
+	TopologyCfgPath: filepath.Join(defaultCfgDirPath,
+		driver.DefaultTopologyCfgFileName),
 
 	NodeID:   "",
 	Endpoint: "unix:///tmp/csi.sock",
 
-	DefaultFS: driver.Ext4FS,
+	DefaultFS:        driver.Ext4FS,
+	DefaultTransport: "tcp",
 
 	LogLevel:      "info",
 	LogRole:       "node",
@@ -93,7 +143,6 @@ var defaults = driver.Config{
 
 	// hidden, dev-only options:
 	BinaryName:    "lb-csi-plugin",
-	Transport:     "tcp",
 	SquelchPanics: false,
 	PrettyJSON:    false,
 }
@@ -121,12 +170,36 @@ var (
 		"Backend config path, see $LB_CSI_BE_CONFIG_PATH.")
 	luksCfgPath = flag.StringP("luks-cfg-path", "L", "",
 		"LUKS config path, see $LB_CSI_LUKS_CONFIG_PATH.")
+	topologyCfgPath = flag.String("topology-cfg-path", "",
+		"Node topology config path, see $LB_CSI_TOPOLOGY_CONFIG_PATH.")
+	mgmtEndpoint = flag.String("mgmt-endpoint", "",
+		"Default LightOS mgmt API endpoints, see $LB_CSI_MGMT_ENDPOINT.")
+	mgmtScheme = flag.String("mgmt-scheme", "",
+		"Default LightOS mgmt API scheme, see $LB_CSI_MGMT_SCHEME.")
+	projectName = flag.String("project-name", "",
+		"Default LightOS project, see $LB_CSI_PROJECT_NAME.")
+	metricsAddr = flag.String("metrics-addr", "",
+		"Prometheus metrics listen address, see $LB_CSI_METRICS_ADDR.")
+	otlpEndpoint = flag.String("otlp-endpoint", "",
+		"OpenTelemetry collector URL, see $LB_CSI_OTLP_ENDPOINT.")
+	mgmtCAPath = flag.String("mgmt-ca-path", "",
+		"LightOS mgmt API CA bundle path, see $LB_CSI_MGMT_CA_PATH.")
+	mgmtClientCertPath = flag.String("mgmt-client-cert-path", "",
+		"LightOS mgmt API client cert path, see $LB_CSI_MGMT_CLIENT_CERT_PATH.")
+	mgmtClientKeyPath = flag.String("mgmt-client-key-path", "",
+		"LightOS mgmt API client key path, see $LB_CSI_MGMT_CLIENT_KEY_PATH.")
+	mgmtServerName = flag.String("mgmt-server-name", "",
+		"LightOS mgmt API server name override, see $LB_CSI_MGMT_SERVER_NAME.")
+	mgmtTLSSkipVerify = flag.Bool("mgmt-tls-skip-verify", false,
+		"Don't verify LightOS mgmt API server certs, see "+
+			"$LB_CSI_MGMT_TLS_SKIP_VERIFY.")
 	version = flag.Bool("version", false, "Print the version and exit.")
 	help    = flag.BoolP("help", "h", false, "Print help and exit.")
 
+	transport = flag.StringP("transport", "t", "",
+		"Default NVMe-oF transport, see $LB_CSI_TRANSPORT.")
+
 	// hidden, dev-only options:
-	transport = flag.StringP("transport", "t", "tcp",
-		"Transport to use for connection to storage. One of: {tcp, rdma}.")
 	squelchPanics = flag.BoolP("squelch-panics", "P", defaults.SquelchPanics,
 		"Recover panics and return them to the remote client as gRPC "+
 			"errors. NOT safe for use in production environments!")
@@ -176,7 +249,6 @@ func pickStr(flagVal string, envVar string, def string) string {
 
 func main() {
 	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
-	flag.CommandLine.MarkHidden("transport")      //nolint
 	flag.CommandLine.MarkHidden("squelch-panics") //nolint
 	flag.CommandLine.MarkHidden("pretty-json")    //nolint
 	flag.SetInterspersed(false)
@@ -220,12 +292,28 @@ func main() {
 		}
 	}
 
+	if !*mgmtTLSSkipVerify {
+		val := os.Getenv("LB_CSI_MGMT_TLS_SKIP_VERIFY")
+		switch strings.ToLower(strings.TrimSpace(val)) {
+		case "true":
+			*mgmtTLSSkipVerify = true
+		case "false":
+			*mgmtTLSSkipVerify = false
+		case "":
+			*mgmtTLSSkipVerify = defaults.MgmtTLSSkipVerify
+		default:
+			errorAndDie("invalid LB_CSI_MGMT_TLS_SKIP_VERIFY value: '%s'", val)
+		}
+	}
+
 	cfg := driver.Config{
 		DefaultBackend: defaults.DefaultBackend, // not user configurable.
 		BackendCfgPath: pickStr(*backendCfgPath, "LB_CSI_BE_CONFIG_PATH",
 			defaults.BackendCfgPath),
 		LUKSCfgPath: pickStr(*luksCfgPath, "LB_CSI_LUKS_CONFIG_PATH",
 			defaults.LUKSCfgPath),
+		TopologyCfgPath: pickStr(*topologyCfgPath, "LB_CSI_TOPOLOGY_CONFIG_PATH",
+			defaults.TopologyCfgPath),
 		JWTPath:       pickStr(*jwtPath, "LB_CSI_JWT_PATH", defaults.JWTPath),
 		NodeID:        pickStr(*nodeID, "LB_CSI_NODE_ID", defaults.NodeID),
 		Endpoint:      pickStr(*endpoint, "CSI_ENDPOINT", defaults.Endpoint),
@@ -234,10 +322,26 @@ func main() {
 		LogRole:       pickStr(*logRole, "LB_CSI_LOG_ROLE", defaults.LogRole),
 		LogFormat:     pickStr(*logFormat, "LB_CSI_LOG_FMT", defaults.LogFormat),
 		LogTimestamps: *logTimestamps,
-		Transport:     *transport,
+		MgmtEndpoint:  pickStr(*mgmtEndpoint, "LB_CSI_MGMT_ENDPOINT", defaults.MgmtEndpoint),
+		MgmtScheme:    pickStr(*mgmtScheme, "LB_CSI_MGMT_SCHEME", defaults.MgmtScheme),
+		ProjectName:   pickStr(*projectName, "LB_CSI_PROJECT_NAME", defaults.ProjectName),
+		MetricsAddr:   pickStr(*metricsAddr, "LB_CSI_METRICS_ADDR", defaults.MetricsAddr),
+		OTLPEndpoint:  pickStr(*otlpEndpoint, "LB_CSI_OTLP_ENDPOINT", defaults.OTLPEndpoint),
 		SquelchPanics: *squelchPanics,
 		PrettyJSON:    *prettyJSON,
 		RWX:           *rwx,
+
+		DefaultTransport: pickStr(*transport, "LB_CSI_TRANSPORT",
+			defaults.DefaultTransport),
+
+		MgmtCAPath: pickStr(*mgmtCAPath, "LB_CSI_MGMT_CA_PATH", defaults.MgmtCAPath),
+		MgmtClientCertPath: pickStr(*mgmtClientCertPath, "LB_CSI_MGMT_CLIENT_CERT_PATH",
+			defaults.MgmtClientCertPath),
+		MgmtClientKeyPath: pickStr(*mgmtClientKeyPath, "LB_CSI_MGMT_CLIENT_KEY_PATH",
+			defaults.MgmtClientKeyPath),
+		MgmtServerName: pickStr(*mgmtServerName, "LB_CSI_MGMT_SERVER_NAME",
+			defaults.MgmtServerName),
+		MgmtTLSSkipVerify: *mgmtTLSSkipVerify,
 	}
 
 	d, err := driver.New(cfg)
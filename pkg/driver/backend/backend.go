@@ -13,6 +13,12 @@ import (
 	"github.com/lightbitslabs/los-csi/pkg/util/endpoint"
 )
 
+// NVMe-oF transports, as spelled by the kernel (and `nvme-cli`).
+const (
+	TransportTCP  = "tcp"
+	TransportRDMA = "rdma"
+)
+
 // targetEnv describes the LightOS cluster environment that will be providing
 // the underlying storage for a given CSI volume in terms of NVMe/NVMe-oF
 // protocol level details. this information should be sufficient for a compliant
@@ -20,9 +26,43 @@ import (
 // appropriate NVMe-oF targets exposed by the LightOS cluster and present a
 // block device on the local node for the rest of the CSI plugin to work with.
 type TargetEnv struct {
+	// Transport is one of the Transport* constants above. the discovery
+	// and NVMe endpoints are the same regardless of the transport.
+	Transport    string
 	SubsysNQN    string
 	DiscoveryEPs endpoint.Slice
 	NvmeEPs      endpoint.Slice
+
+	// NVMe in-band authentication (DH-HMAC-CHAP) secrets of this host, if
+	// any, q.v. lb.TrustedHostSecrets. HostSecret authenticates the host
+	// to the targets, CtrlSecret (optional) - the targets to the host.
+	// mind these when logging TargetEnv!
+	HostSecret string
+	CtrlSecret string
+
+	// NVMe/TCP TLS. if TLS is set, backends must only ever connect to the
+	// targets with TLS, and must not use pre-existing cleartext connections
+	// either. TLSKey is the configured PSK, in the NVMe TLS PSK interchange
+	// format, if one was supplied through the CSI secrets, otherwise the
+	// PSK is expected to be provisioned in the node keyring. just like the
+	// DH-HMAC-CHAP secrets, mind TLSKey when logging TargetEnv!
+	TLS    bool
+	TLSKey string
+}
+
+// Reconciler is an optional interface that Backend implementations keeping
+// state of their own that survives LB CSI plugin restarts (e.g. config files
+// of an external agent) can implement to clean up after volumes that were
+// left behind by the previous incarnation of the plugin.
+type Reconciler interface {
+	// Reconcile() is called once on start-up, before any volumes are
+	// attached or detached. `vols` lists all the volumes found on the
+	// node, the value being whether the volume is currently in use (i.e.
+	// mounted). NOTE: a volume that is still staged, but whose NVMe
+	// namespace is temporarily gone (e.g. during a target outage), is
+	// absent from `vols` as well, so absence alone doesn't mean its state
+	// is fair game for clean up.
+	Reconcile(ctx context.Context, vols map[guuid.UUID]bool) *status.Status
 }
 
 // the LB CSI plugin delegates the handling of the local Linux block devices
@@ -47,8 +87,17 @@ type TargetEnv struct {
 // the LB CSI plugin guarantees that there will be only one outstanding call per
 // Attach()/Detach() method for a given `nguid` within this instance of the LB
 // CSI plugin at a time, however multiple calls for different NGUID-s might be
-// in-flight simultaneously. backends are expected to handle such concurrency
-// gracefully.
+// in-flight simultaneously. Attach() and Detach() calls for different NGUID-s
+// are further serialised if they share the same NVMe-oF connection set
+// (SubNQN and HostNQN, whatever the transport) - for Detach() that is as long as the volume
+// is known to the ConnTracker shared with the backend, i.e. was attached
+// through a preceding call to Attach() or found attached on start-up. backends
+// are expected to handle such concurrency gracefully.
+//
+// backends that connect to the targets themselves (or through some agent)
+// should record the successfully attached volumes with ConnTracker.Hold(), and
+// have ConnTracker.Release() disconnect from the targets on Detach() when the
+// last volume attached through them goes away.
 //
 // Backend methods are expected to return gRPC-compatible Status objects
 // encapsulating the error on failures or nil on success. the resultant errors
@@ -66,18 +115,23 @@ type Backend interface {
 
 	// LBVolEligible() SHALL return nil if the backend assesses that it will
 	// be able to successfully attach the volume described by `vol` to this
-	// CO host, currently - based on the information contained in `vol`
-	// (properties of the volume itself), in the future - possibly based on
-	// additional criteria as well. otherwise LBVolEligible() SHALL return
-	// an error describing why attaching the volume will be impossible.
-	// see also Attach() below.
+	// CO host over NVMe-oF transport `transport` (one of the Transport*
+	// constants), with the NVMe/TCP TLS PSK supplied through the CSI
+	// secrets if `tlsKey` is set (q.v. TargetEnv.TLSKey), currently - based
+	// on the information contained in `vol` (properties of the volume
+	// itself) and the capabilities of the node and the backend, in the
+	// future - possibly based on additional criteria as well. otherwise LBVolEligible() SHALL return an error
+	// describing why attaching the volume will be impossible. see also
+	// Attach() below.
 	//
 	// LBVolEligible() allows to rule out impossible scenarios early on. it
 	// is called by Driver.lbVolEligible() as part of the `NodeStageVolume`
 	// flow, assuming the other, backend-agnostic eligibility conditions
 	// were met. e.g. if the backend doesn't support replicated/striped/etc.
 	// volumes the backend can abort the attachment process.
-	LBVolEligible(ctx context.Context, vol *lb.Volume) *status.Status
+	LBVolEligible(
+		ctx context.Context, vol *lb.Volume, transport string, tlsKey bool,
+	) *status.Status
 
 	// Attach() SHALL result in a block device '/dev/nvmeXnY' corresponding
 	// to the remote namespace with NGUID `nguid` being present on the local
@@ -103,5 +157,11 @@ type Backend interface {
 	// the controller, potentially losing data already submitted for writes
 	// to the 2nd NS, and certainly effectively Detach()-ing the 2nd NS -
 	// which should not have been Detach()-ed.
+	//
+	// within the LB CSI plugin this race is avoided by the connection-set
+	// lock serialising Attach() and Detach() of volumes sharing the same
+	// subsystem, and by ConnTracker refcounting the volumes attached
+	// through it. of course, any other party on the node messing with the
+	// same NVMe-oF controllers is still fair game for the race.
 	Detach(ctx context.Context, nguid guuid.UUID) *status.Status
 }
@@ -0,0 +1,248 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	guuid "github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mountutils "k8s.io/mount-utils"
+)
+
+// ConnTracker keeps track of which of the locally attached volumes are
+// accessed through which NVMe-oF subsystems, so that the backends can tell
+// when it's safe to disconnect from a subsystem: only once no namespace from
+// it is attached any more. LightOS exposes all the volumes of a cluster
+// through a single subsystem, so the connections are shared by the unrelated
+// volumes and connect/disconnect must be done per subsystem, NOT per volume.
+//
+// a single ConnTracker is shared by the backend and the rest of the LB CSI
+// plugin. the plugin has no persistent state of its own, so the ConnTracker
+// is rebuilt on start-up from the kernel NVMe host state and the mounts on
+// the node, see Rebuild().
+//
+// ConnTracker only protects its own internal state. callers are expected to
+// hold the connection-set lock of the relevant subsystem across Hold() and
+// Release(), which serialises attaching and detaching of volumes to/from the
+// same subsystem - that's what makes disconnecting race-free.
+type ConnTracker struct {
+	sysfsRoot string
+	hostNQN   string
+	log       *logrus.Entry
+
+	mu   sync.Mutex
+	vols map[guuid.UUID]string // vol NGUID -> SubNQN.
+	refs map[string]int        // SubNQN -> number of attached vols.
+}
+
+func NewConnTracker(log *logrus.Entry, sysfsRoot, hostNQN string) *ConnTracker {
+	return &ConnTracker{
+		sysfsRoot: sysfsRoot,
+		hostNQN:   hostNQN,
+		log:       log.WithField("hostnqn", hostNQN),
+		vols:      make(map[guuid.UUID]string),
+		refs:      make(map[string]int),
+	}
+}
+
+// Subsys returns the SubNQN of the subsystem volume `nguid` was attached
+// through, if it's attached.
+func (t *ConnTracker) Subsys(nguid guuid.UUID) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	subsysNQN, ok := t.vols[nguid]
+	return subsysNQN, ok
+}
+
+// Refs returns the number of volumes attached through subsystem `subsysNQN`.
+func (t *ConnTracker) Refs(subsysNQN string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.refs[subsysNQN]
+}
+
+func (t *ConnTracker) unrefLocked(nguid guuid.UUID) {
+	subsysNQN, ok := t.vols[nguid]
+	if !ok {
+		return
+	}
+	delete(t.vols, nguid)
+	t.refs[subsysNQN]--
+	if t.refs[subsysNQN] <= 0 {
+		delete(t.refs, subsysNQN)
+	}
+}
+
+// Hold records volume `nguid` as attached through subsystem `subsysNQN`. it
+// should be called by the backends on successful Attach(). idempotent.
+func (t *ConnTracker) Hold(subsysNQN string, nguid guuid.UUID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if cur, ok := t.vols[nguid]; ok {
+		if cur == subsysNQN {
+			return
+		}
+		// shouldn't really happen, but the latest Attach() wins...
+		t.log.Warnf("volume %s moved from subsystem '%s' to '%s'",
+			nguid, cur, subsysNQN)
+		t.unrefLocked(nguid)
+	}
+	t.vols[nguid] = subsysNQN
+	t.refs[subsysNQN]++
+}
+
+// Release forgets about volume `nguid` being attached. if it was the last
+// volume attached through its subsystem, Release disconnects from that
+// subsystem first. it should be called by the backends on Detach(), once the
+// volume is otherwise detached. if disconnecting fails, the volume is still
+// considered attached, so that a retry of Detach() will retry disconnecting
+// as well. idempotent.
+func (t *ConnTracker) Release(nguid guuid.UUID) *status.Status {
+	t.mu.Lock()
+	subsysNQN, ok := t.vols[nguid]
+	last := ok && t.refs[subsysNQN] == 1
+	t.mu.Unlock()
+
+	if !ok {
+		t.log.Debugf("volume %s is not known to be attached, "+
+			"NOT disconnecting from its subsystem", nguid)
+		return nil
+	}
+	if last {
+		if err := t.disconnect(subsysNQN, nguid); err != nil {
+			return status.Newf(codes.Unknown,
+				"failed to disconnect from subsystem '%s': %s", subsysNQN, err)
+		}
+	}
+
+	t.mu.Lock()
+	t.unrefLocked(nguid)
+	t.mu.Unlock()
+	return nil
+}
+
+// disconnect() deletes all the controllers of this host connected to
+// subsystem `subsysNQN`, unless it's still exposing namespaces other than
+// `nguid` to this host.
+//
+// the latter check covers volumes that are published to this node but not
+// attached yet (e.g. ControllerPublishVolume() was already done, but not
+// NodeStageVolume()), as well as attached volumes that the ConnTracker
+// failed to notice on Rebuild(). the namespace of volume `nguid` itself is
+// still normally exposed at this stage, as it's only removed from the volume
+// ACL by ControllerUnpublishVolume() after NodeUnstageVolume().
+func (t *ConnTracker) disconnect(subsysNQN string, nguid guuid.UUID) error {
+	ctrls, err := ListCtrls(t.sysfsRoot)
+	if err != nil {
+		return fmt.Errorf("failed to list NVMe controllers: %s", err)
+	}
+	victims := []*Ctrl{}
+	for i := range ctrls {
+		c := &ctrls[i]
+		if c.SubsysNQN != subsysNQN || !c.IsHostNQN(t.hostNQN) || c.IsDying() {
+			continue
+		}
+		for _, id := range ctrlNamespaces(c) {
+			if id != nguid {
+				t.log.Infof("NOT disconnecting from subsystem '%s': namespace "+
+					"%s is still exposed through '%s'", subsysNQN, id, c.Name)
+				return nil
+			}
+		}
+		victims = append(victims, c)
+	}
+
+	for _, c := range victims {
+		t.log.Infof("disconnecting '%s' from %s:%s:%s of subsystem '%s'",
+			c.Name, c.Transport, c.Traddr, c.Trsvcid, subsysNQN)
+		if err := DeleteCtrl(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rebuild re-populates the ConnTracker from the namespaces of the subsystems
+// this host is currently connected to and the mounts on the node, as listed in
+// `mountsPath` (normally `/proc/mounts`). it should be called once, on start-up,
+// before any volumes are attached.
+//
+// a namespace counts as attached if its block device is mounted, or is held
+// by another block device (e.g. a LUKS device-mapper one). unencrypted block
+// volumes that are attached but not mounted anywhere can't be told apart from
+// the merely published ones, but disconnect() won't disconnect from
+// subsystems that still expose them anyway.
+func (t *ConnTracker) Rebuild(mountsPath string) error {
+	ctrls, err := ListCtrls(t.sysfsRoot)
+	if err != nil {
+		return fmt.Errorf("failed to list NVMe controllers: %s", err)
+	}
+	subsystems := map[string]bool{}
+	for i := range ctrls {
+		if ctrls[i].IsHostNQN(t.hostNQN) && !ctrls[i].IsDying() {
+			subsystems[ctrls[i].SubsysNQN] = true
+		}
+	}
+
+	mounts, err := mountutils.ListProcMounts(mountsPath)
+	if err != nil {
+		return fmt.Errorf("failed to list mounts: %s", err)
+	}
+	mounted := map[string]bool{}
+	for _, m := range mounts {
+		if !strings.HasPrefix(m.Device, "/dev/") {
+			continue
+		}
+		dev := m.Device
+		if realDev, err := filepath.EvalSymlinks(dev); err == nil {
+			dev = realDev
+		}
+		mounted[filepath.Base(dev)] = true
+	}
+
+	heads, err := filepath.Glob(filepath.Join(t.sysfsRoot, "block", "nvme*"))
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.vols = make(map[guuid.UUID]string)
+	t.refs = make(map[string]int)
+	for _, dir := range heads {
+		name := filepath.Base(dir)
+		if !NSDevRegex.MatchString(name) {
+			continue
+		}
+		// `device` is either the NVMe subsystem (native multipath) or
+		// the controller, both have `subsysnqn`.
+		subsysNQN := ReadAttr(dir, filepath.Join("device", "subsysnqn"))
+		if !subsystems[subsysNQN] {
+			continue
+		}
+		nguid := ReadNSID(dir)
+		if nguid == guuid.Nil {
+			continue
+		}
+		holders, _ := filepath.Glob(filepath.Join(dir, "holders", "*"))
+		if !mounted[name] && len(holders) == 0 {
+			t.log.Debugf("volume %s ('%s') doesn't seem to be in use", nguid, name)
+			continue
+		}
+		t.vols[nguid] = subsysNQN
+		t.refs[subsysNQN]++
+	}
+
+	for subsysNQN, refs := range t.refs {
+		t.log.Infof("found %d volume(s) attached through subsystem '%s'",
+			refs, subsysNQN)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	guuid "github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testHostNQN   = "nqn.2019-09.com.lightbitslabs:host:node00"
+	testSubsysNQN = "nqn.2016-01.com.lightbitslabs:uuid:46cdc5c2-e13d-4bc8-9d35-1c6ef6e4fbb0"
+	otherNQN      = "nqn.2016-01.com.lightbitslabs:uuid:8a5b7bd4-4a4d-4a4c-8f65-24ebcf0f1b1a"
+)
+
+var (
+	vol1 = guuid.MustParse("6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66")
+	vol2 = guuid.MustParse("0cf0a5c4-7ec8-4a1c-a52e-1d5a3cbf6f0c")
+	vol3 = guuid.MustParse("a1a1a1a1-0000-4000-8000-000000000001")
+)
+
+type fakeSysfs struct {
+	t    *testing.T
+	root string
+}
+
+func (fs *fakeSysfs) write(path, content string) {
+	path = filepath.Join(fs.root, path)
+	require.NoError(fs.t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(fs.t, os.WriteFile(path, []byte(content+"\n"), 0o644))
+}
+
+func (fs *fakeSysfs) addCtrl(name, subsysNQN, hostNQN string, nss ...guuid.UUID) {
+	dir := filepath.Join("class", "nvme", name)
+	fs.write(filepath.Join(dir, "transport"), "tcp")
+	fs.write(filepath.Join(dir, "address"), "traddr=10.0.0.1,trsvcid=4420")
+	fs.write(filepath.Join(dir, "subsysnqn"), subsysNQN)
+	fs.write(filepath.Join(dir, "hostnqn"), hostNQN)
+	fs.write(filepath.Join(dir, "state"), "live")
+	fs.write(filepath.Join(dir, "delete_controller"), "")
+	for i, ns := range nss {
+		fs.write(filepath.Join(dir, fmt.Sprintf("%sc0n%d", name, i+1), "nguid"), ns.String())
+	}
+}
+
+func (fs *fakeSysfs) addHead(name, subsysNQN string, nguid guuid.UUID) {
+	dir := filepath.Join("block", name)
+	fs.write(filepath.Join(dir, "nguid"), nguid.String())
+	fs.write(filepath.Join(dir, "device", "subsysnqn"), subsysNQN)
+}
+
+func (fs *fakeSysfs) deleted(ctrl string) bool {
+	return ReadAttr(filepath.Join(fs.root, "class", "nvme", ctrl), "delete_controller") == "1"
+}
+
+func newFakeSysfs(t *testing.T) (*fakeSysfs, *ConnTracker) {
+	fs := &fakeSysfs{t: t, root: t.TempDir()}
+	log := logrus.New().WithField("test", t.Name())
+	return fs, NewConnTracker(log, fs.root, testHostNQN)
+}
+
+func TestParseCtrlAddress(t *testing.T) {
+	traddr, trsvcid := ParseCtrlAddress("traddr=10.0.0.1,trsvcid=4420,src_addr=10.0.0.100")
+	require.Equal(t, "10.0.0.1", traddr)
+	require.Equal(t, "4420", trsvcid)
+	traddr, trsvcid = ParseCtrlAddress("traddr=10.0.0.2,trsvcid=4421")
+	require.Equal(t, "10.0.0.2", traddr)
+	require.Equal(t, "4421", trsvcid)
+}
+
+func TestConnTrackerRefcount(t *testing.T) {
+	fs, ct := newFakeSysfs(t)
+	fs.addCtrl("nvme0", testSubsysNQN, testHostNQN, vol1)
+	fs.addCtrl("nvme1", testSubsysNQN, testHostNQN, vol1)
+	fs.addCtrl("nvme2", otherNQN, testHostNQN, vol3)
+
+	ct.Hold(testSubsysNQN, vol1)
+	ct.Hold(testSubsysNQN, vol1) // idempotent
+	ct.Hold(testSubsysNQN, vol2)
+	ct.Hold(otherNQN, vol3)
+	require.Equal(t, 2, ct.Refs(testSubsysNQN))
+	subsys, ok := ct.Subsys(vol2)
+	require.True(t, ok)
+	require.Equal(t, testSubsysNQN, subsys)
+
+	require.Nil(t, ct.Release(vol2))
+	require.False(t, fs.deleted("nvme0"))
+	require.False(t, fs.deleted("nvme1"))
+	_, ok = ct.Subsys(vol2)
+	require.False(t, ok)
+
+	require.Nil(t, ct.Release(vol1))
+	require.True(t, fs.deleted("nvme0"))
+	require.True(t, fs.deleted("nvme1"))
+	require.False(t, fs.deleted("nvme2"))
+	require.Equal(t, 0, ct.Refs(testSubsysNQN))
+	require.Equal(t, 1, ct.Refs(otherNQN))
+
+	// releasing an unknown volume is a NOP.
+	require.Nil(t, ct.Release(vol1))
+}
+
+func TestConnTrackerKeepsSubsysWithExposedNS(t *testing.T) {
+	fs, ct := newFakeSysfs(t)
+	// vol2 is published to the node, but not attached.
+	fs.addCtrl("nvme0", testSubsysNQN, testHostNQN, vol1, vol2)
+
+	ct.Hold(testSubsysNQN, vol1)
+	require.Nil(t, ct.Release(vol1))
+	require.False(t, fs.deleted("nvme0"))
+	require.Equal(t, 0, ct.Refs(testSubsysNQN))
+}
+
+func TestConnTrackerRebuild(t *testing.T) {
+	fs, ct := newFakeSysfs(t)
+	fs.addCtrl("nvme0", testSubsysNQN, testHostNQN, vol1, vol2, vol3)
+	fs.addCtrl("nvme1", otherNQN, "nqn.2019-09.com.lightbitslabs:host:other")
+	fs.addHead("nvme0n1", testSubsysNQN, vol1) // mounted.
+	fs.addHead("nvme0n2", testSubsysNQN, vol2) // held by LUKS.
+	fs.write(filepath.Join("block", "nvme0n2", "holders", "dm-0", "dev"), "253:0")
+	fs.addHead("nvme0n3", testSubsysNQN, vol3) // published, not in use.
+	fs.addHead("nvme1n1", otherNQN, guuid.New())
+
+	mounts := filepath.Join(t.TempDir(), "mounts")
+	require.NoError(t, os.WriteFile(mounts, []byte(
+		"/dev/nvme0n1 /var/lib/kubelet/plugins/x/globalmount ext4 rw,relatime 0 0\n"+
+			"/dev/nvme1n1 /mnt xfs rw 0 0\n"+
+			"proc /proc proc rw 0 0\n"), 0o644))
+
+	require.NoError(t, ct.Rebuild(mounts))
+	require.Equal(t, 2, ct.Refs(testSubsysNQN))
+	require.Equal(t, 0, ct.Refs(otherNQN))
+	for _, vol := range []guuid.UUID{vol1, vol2} {
+		subsys, ok := ct.Subsys(vol)
+		require.True(t, ok, "volume %s", vol)
+		require.Equal(t, testSubsysNQN, subsys)
+	}
+	_, ok := ct.Subsys(vol3)
+	require.False(t, ok)
+}
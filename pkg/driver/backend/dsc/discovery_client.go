@@ -9,6 +9,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	guuid "github.com/google/uuid"
@@ -24,23 +25,33 @@ const (
 	beType = "dsc"
 
 	defaultDSCConfigPath = "/etc/discovery-client/discovery.d"
+	defaultSysfsRoot     = "/sys"
 	dscReservedPrefix    = "tmp.dc."
 	dscWarnPeriod        = 10 * time.Minute // to avoid log spam
 )
 
 type Backend struct {
 	hostNQN string
+	conns   *backend.ConnTracker
 
-	dscCfgPath      string
+	dscCfgPath string
+	sysfsRoot  string // overridden in tests only.
+
+	// Attach()/Detach() on different volumes may run concurrently.
+	warnLock        sync.Mutex
 	lastDSCWarnTime time.Time
 
 	log *logrus.Entry
 }
 
-func New(log *logrus.Entry, hostNQN string) (*Backend, error) { //nolint:unparam
+func New( //nolint:unparam
+	log *logrus.Entry, hostNQN string, conns *backend.ConnTracker,
+) (*Backend, error) {
 	be := Backend{
 		hostNQN:    hostNQN,
+		conns:      conns,
 		dscCfgPath: defaultDSCConfigPath,
+		sysfsRoot:  defaultSysfsRoot,
 		log:        log,
 	}
 
@@ -55,8 +66,10 @@ func New(log *logrus.Entry, hostNQN string) (*Backend, error) { //nolint:unparam
 
 func init() {
 	backend.RegisterBackend(beType,
-		func(log *logrus.Entry, hostNQN string, rawCfg []byte) (backend.Backend, error) {
-			return New(log, hostNQN)
+		func(
+			log *logrus.Entry, hostNQN string, conns *backend.ConnTracker, rawCfg []byte,
+		) (backend.Backend, error) {
+			return New(log, hostNQN, conns)
 		})
 }
 
@@ -64,15 +77,21 @@ func (be *Backend) Type() string { //revive:disable-line:unused-receiver
 	return beType
 }
 
-func (be *Backend) LBVolEligible( //revive:disable-line:unused-receiver
-	_ context.Context, _ *lb.Volume,
+// LBVolEligible() only checks the node side of things: whether the DSC itself
+// supports the transport is anybody's guess.
+func (be *Backend) LBVolEligible(
+	_ context.Context, _ *lb.Volume, transport string, _ bool,
 ) *status.Status {
+	if err := backend.CheckTransport(be.sysfsRoot, transport); err != nil {
+		return status.New(codes.FailedPrecondition, err.Error())
+	}
 	return nil
 }
 
 func (be *Backend) checkDSCCfgPath() error {
 	fi, err := os.Stat(be.dscCfgPath)
 	if err != nil || fi == nil || !fi.IsDir() {
+		be.warnLock.Lock()
 		now := time.Now()
 		if now.After(be.lastDSCWarnTime.Add(dscWarnPeriod)) {
 			be.log.Errorf("can't communicate with the DSC through config dir '%s', "+
@@ -80,6 +99,7 @@ func (be *Backend) checkDSCCfgPath() error {
 				"and running on this node", be.dscCfgPath)
 			be.lastDSCWarnTime = now
 		}
+		be.warnLock.Unlock()
 	}
 	if os.IsNotExist(err) {
 		return fmt.Errorf("DSC config dir is missing")
@@ -94,7 +114,14 @@ func (be *Backend) checkDSCCfgPath() error {
 }
 
 func (be *Backend) writeDSCCfgFile(finalPath string, tgtEnv *backend.TargetEnv) error {
-	transport := "tcp" // currently only NVMe/TCP is supported by the DSC BE
+	// the DSC takes `nvme discover`-style args: raw IP addresses, IPv6 ones
+	// without the brackets (and with the optional zone, if any). it doesn't
+	// resolve hostnames, the caller is supposed to have done that.
+	for _, ep := range tgtEnv.DiscoveryEPs {
+		if !ep.IsIP() {
+			return fmt.Errorf("discovery EP '%s' is not an IP address", ep)
+		}
+	}
 
 	f, err := os.CreateTemp(be.dscCfgPath, dscReservedPrefix)
 	if err != nil {
@@ -103,10 +130,29 @@ func (be *Backend) writeDSCCfgFile(finalPath string, tgtEnv *backend.TargetEnv)
 	tmpPath := f.Name()
 	defer os.Remove(tmpPath) // should only work if the Rename() below failed
 
+	// `nvme connect`-style NVMe in-band authentication args, if any. the
+	// temp file is created 0600, so the secrets are not world-readable.
+	auth := ""
+	if tgtEnv.HostSecret != "" {
+		auth = " --dhchap-secret=" + tgtEnv.HostSecret
+		if tgtEnv.CtrlSecret != "" {
+			auth += " --dhchap-ctrl-secret=" + tgtEnv.CtrlSecret
+		}
+	}
+
+	// ditto for NVMe/TCP TLS. without an explicit PSK the DSC looks it up
+	// in the node keyring, same as `nvme connect --tls` does.
+	if tgtEnv.TLS {
+		auth += " --tls"
+		if tgtEnv.TLSKey != "" {
+			auth += " --tls-key=" + tgtEnv.TLSKey
+		}
+	}
+
 	var b strings.Builder
 	for _, ep := range tgtEnv.DiscoveryEPs {
-		_, err := fmt.Fprintf(&b, "-t %s -a %s -s %d -q %s -n %s\n",
-			transport, ep.Host(), ep.Port(), be.hostNQN, tgtEnv.SubsysNQN)
+		_, err := fmt.Fprintf(&b, "-t %s -a %s -s %d -q %s -n %s%s\n",
+			tgtEnv.Transport, ep.Host(), ep.Port(), be.hostNQN, tgtEnv.SubsysNQN, auth)
 		// builder's "Write always returns len(p), nil", but 'revive' insists...
 		if err != nil {
 			return fmt.Errorf("failed to format discovery EP string, of all things")
@@ -141,6 +187,49 @@ func (be *Backend) Attach(
 		return status.Newf(codes.Unknown, "failed to create DSC config entries file: %s",
 			err)
 	}
+	// strictly speaking, the DSC might not have connected yet, but as far
+	// as refcounting goes - it will.
+	be.conns.Hold(tgtEnv.SubsysNQN, nguid)
+	return nil
+}
+
+// Reconcile cleans up temp files left behind by interrupted Attach()-es. the
+// DSC config files of volumes are left alone even if the volumes are nowhere
+// to be found on the node: a staged volume whose NVMe namespace is gone for
+// the time being (e.g. ctrl_loss_tmo expired during a target outage) looks
+// just the same, and deleting its config file would keep the DSC from ever
+// reconnecting it. the CO will get around to unstaging such volumes, and
+// Detach() will take care of their config files then.
+func (be *Backend) Reconcile(
+	_ context.Context, vols map[guuid.UUID]bool,
+) *status.Status {
+	entries, err := os.ReadDir(be.dscCfgPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // no DSC around, nothing to clean up.
+		}
+		return status.Newf(codes.Unknown, "failed to list DSC config dir '%s': %s",
+			be.dscCfgPath, err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		p := path.Join(be.dscCfgPath, name)
+		if !strings.HasPrefix(name, dscReservedPrefix) {
+			nguid, err := guuid.Parse(name)
+			if err != nil {
+				continue // not ours.
+			}
+			if _, ok := vols[nguid]; !ok {
+				be.log.Infof("found DSC config file '%s' of volume not on "+
+					"node, keeping it in case the volume is still staged", p)
+			}
+			continue
+		}
+		be.log.Infof("deleting leftover DSC temp file '%s'", p)
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			be.log.Warnf("failed to delete '%s': %s", p, err)
+		}
+	}
 	return nil
 }
 
@@ -149,28 +238,8 @@ func (be *Backend) Detach(_ context.Context, nguid guuid.UUID) *status.Status {
 		return status.New(codes.Unknown, err.Error())
 	}
 
-	// TODO: CSI spec mandates that it is effectively CO's sacred duty to
-	// do the refcounting on volumes (which is facilitated by mandating
-	// idempotent semantics of the plugins). unfortunately, COs are totally
-	// oblivious of the LB "all volumes grow off the same subsystem, and
-	// connect/disconnect must be done per subsystem, NOT volume" semantics.
-	// which means we need to devise a way of detecting when and how to
-	// disconnect the subsystem, in the face of:
-	// 1. CSI plugin being ephemeral and with no persistent state - that's
-	//    a bit hard to track, and:
-	// 2. watch out for the races: the whole connect/disconnect machinery
-	//    will need to be protected by a lock, because even if we trust
-	//    k8s not to run more than one instance of this plugin in the same
-	//    role on the same node (do expect Node+Controller side by side,
-	//    though), k8s is only too eager to invoke the gRPC calls
-	//    concurrently. and, apparently, NVMe-oF does NOT track block device
-	//    usage by mounts (which still sounds very odd to me!!), so in a
-	//    race you can easily end up disconnecting a volume that just got
-	//    mounted - with a corresponding data loss (tried it, works).
-	//  so i foresee some GetDeviceNameFromMount() under lock (that func
-	//  and its ilk in k8s.io-land have odd notion of TOCTTOU) around here...
-	be.log.Debugf("NOT disconnecting from from the target to avoid races!")
-
+	// the config file must go first, lest the DSC reconnect right after
+	// we disconnect...
 	p := path.Join(be.dscCfgPath, nguid.String())
 	be.log.Debugf("deleting DSC config file '%s'...", p)
 	err := os.Remove(p)
@@ -178,5 +247,13 @@ func (be *Backend) Detach(_ context.Context, nguid guuid.UUID) *status.Status {
 		return status.Newf(codes.Unknown,
 			"failed to delete DSC config entries file '%s': %s", p, err)
 	}
-	return nil
+
+	// CSI spec mandates that it is effectively CO's sacred duty to do the
+	// refcounting on volumes, but COs are totally oblivious of the LB "all
+	// volumes grow off the same subsystem, and connect/disconnect must be
+	// done per subsystem, NOT volume" semantics. so the refcounting per
+	// subsystem is done by the ConnTracker, and the whole thing is
+	// protected by the connection-set lock held by the caller. the DSC
+	// itself doesn't disconnect, so it's on us.
+	return be.conns.Release(nguid)
 }
@@ -0,0 +1,144 @@
+// Copyright (C) 2016--2021 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package dsc
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	guuid "github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/lightbitslabs/los-csi/pkg/driver/backend"
+	"github.com/lightbitslabs/los-csi/pkg/lb"
+	"github.com/lightbitslabs/los-csi/pkg/util/endpoint"
+)
+
+const (
+	testHostNQN   = "nqn.2019-09.com.lightbitslabs:host:node00"
+	testSubsysNQN = "nqn.2016-01.com.lightbitslabs:uuid:46cdc5c2-e13d-4bc8-9d35-1c6ef6e4fbb0"
+)
+
+func TestWriteDSCCfgFile(t *testing.T) {
+	be, err := New(logrus.New().WithField("test", t.Name()), testHostNQN, nil)
+	require.NoError(t, err)
+	be.dscCfgPath = t.TempDir()
+	cfgPath := filepath.Join(be.dscCfgPath, "vol")
+
+	tgtEnv := &backend.TargetEnv{
+		Transport: backend.TransportTCP,
+		SubsysNQN: testSubsysNQN,
+		DiscoveryEPs: endpoint.MustParseCSV(
+			"10.0.0.1:8009,[2001:db8::1]:8009,[fe80::1%eth0]:8009"),
+	}
+	require.NoError(t, be.writeDSCCfgFile(cfgPath, tgtEnv))
+	cfg, err := os.ReadFile(cfgPath)
+	require.NoError(t, err)
+	require.Equal(t,
+		"-t tcp -a 10.0.0.1 -s 8009 -q "+testHostNQN+" -n "+testSubsysNQN+"\n"+
+			"-t tcp -a 2001:db8::1 -s 8009 -q "+testHostNQN+" -n "+testSubsysNQN+"\n"+
+			"-t tcp -a fe80::1%eth0 -s 8009 -q "+testHostNQN+" -n "+testSubsysNQN+"\n",
+		string(cfg))
+
+	// in-band auth:
+	tgtEnv.DiscoveryEPs = endpoint.MustParseCSV("10.0.0.1:8009")
+	tgtEnv.HostSecret = "DHHC-1:00:aG9zdA==:"
+	tgtEnv.CtrlSecret = "DHHC-1:00:Y3RybA==:"
+	require.NoError(t, be.writeDSCCfgFile(cfgPath, tgtEnv))
+	cfg, err = os.ReadFile(cfgPath)
+	require.NoError(t, err)
+	require.Equal(t,
+		"-t tcp -a 10.0.0.1 -s 8009 -q "+testHostNQN+" -n "+testSubsysNQN+
+			" --dhchap-secret=DHHC-1:00:aG9zdA==: --dhchap-ctrl-secret=DHHC-1:00:Y3RybA==:\n",
+		string(cfg))
+
+	tgtEnv.HostSecret, tgtEnv.CtrlSecret = "", ""
+	tgtEnv.TLS = true
+	require.NoError(t, be.writeDSCCfgFile(cfgPath, tgtEnv))
+	cfg, err = os.ReadFile(cfgPath)
+	require.NoError(t, err)
+	require.Equal(t,
+		"-t tcp -a 10.0.0.1 -s 8009 -q "+testHostNQN+" -n "+testSubsysNQN+" --tls\n",
+		string(cfg))
+	tgtEnv.TLSKey = "NVMeTLSkey-1:01:VRLbtnN9AQb2WXW3c9+wEf/DRLz0QuLdbYvEhwtdWwNf9LrZ:"
+	require.NoError(t, be.writeDSCCfgFile(cfgPath, tgtEnv))
+	cfg, err = os.ReadFile(cfgPath)
+	require.NoError(t, err)
+	require.Equal(t,
+		"-t tcp -a 10.0.0.1 -s 8009 -q "+testHostNQN+" -n "+testSubsysNQN+" --tls "+
+			"--tls-key=NVMeTLSkey-1:01:VRLbtnN9AQb2WXW3c9+wEf/DRLz0QuLdbYvEhwtdWwNf9LrZ:\n",
+		string(cfg))
+	tgtEnv.TLS, tgtEnv.TLSKey = false, ""
+	tgtEnv.Transport = backend.TransportRDMA
+	require.NoError(t, be.writeDSCCfgFile(cfgPath, tgtEnv))
+	cfg, err = os.ReadFile(cfgPath)
+	require.NoError(t, err)
+	require.Equal(t,
+		"-t rdma -a 10.0.0.1 -s 8009 -q "+testHostNQN+" -n "+testSubsysNQN+"\n",
+		string(cfg))
+	fi, err := os.Stat(cfgPath)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	// unresolved hostnames are a bug, don't feed them to the DSC:
+	tgtEnv.DiscoveryEPs = endpoint.MustParseCSV("lb01:8009")
+	require.ErrorContains(t, be.writeDSCCfgFile(cfgPath, tgtEnv), "not an IP address")
+	entries, err := os.ReadDir(be.dscCfgPath)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "temp file left behind")
+}
+
+func TestLBVolEligible(t *testing.T) {
+	be, err := New(logrus.New().WithField("test", t.Name()), testHostNQN, nil)
+	require.NoError(t, err)
+	be.sysfsRoot = t.TempDir()
+	ctx := context.Background()
+	vol := &lb.Volume{ReplicaCount: 3}
+
+	require.Nil(t, be.LBVolEligible(ctx, vol, backend.TransportTCP, false))
+	st := be.LBVolEligible(ctx, vol, backend.TransportRDMA, false)
+	require.NotNil(t, st)
+	require.Equal(t, codes.FailedPrecondition, st.Code())
+
+	dev := filepath.Join(be.sysfsRoot, "class", "infiniband", "mlx5_0")
+	require.NoError(t, os.MkdirAll(dev, 0o755))
+	require.Nil(t, be.LBVolEligible(ctx, vol, backend.TransportRDMA, false))
+}
+
+func TestReconcile(t *testing.T) {
+	be, err := New(logrus.New().WithField("test", t.Name()), testHostNQN, nil)
+	require.NoError(t, err)
+	be.dscCfgPath = t.TempDir()
+	ctx := context.Background()
+
+	inUse := guuid.New()
+	idle := guuid.New()
+	// staged, but its NVMe namespace is gone until the target is back:
+	missing := guuid.New()
+	files := []string{
+		inUse.String(), idle.String(), missing.String(), dscReservedPrefix + "123", "README",
+	}
+	for _, name := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(be.dscCfgPath, name), nil, 0o600))
+	}
+
+	require.Nil(t, be.Reconcile(ctx, map[guuid.UUID]bool{inUse: true, idle: false}))
+	entries, err := os.ReadDir(be.dscCfgPath)
+	require.NoError(t, err)
+	var left []string
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	require.ElementsMatch(t, []string{
+		inUse.String(), idle.String(), missing.String(), "README",
+	}, left)
+
+	// no DSC around at all:
+	be.dscCfgPath = filepath.Join(be.dscCfgPath, "nonexistent")
+	require.Nil(t, be.Reconcile(ctx, nil))
+}
@@ -0,0 +1,524 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package nvmetcp implements a backend that drives the Linux kernel NVMe/TCP
+// (and, despite the name, NVMe/RDMA) host directly, by writing connect strings
+// to `/dev/nvme-fabrics` and inspecting the NVMe controllers and namespaces
+// through sysfs, without any help from the discovery-client daemon.
+package nvmetcp
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	guuid "github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v2"
+
+	"github.com/lightbitslabs/los-csi/pkg/driver/backend"
+	"github.com/lightbitslabs/los-csi/pkg/lb"
+	"github.com/lightbitslabs/los-csi/pkg/util/endpoint"
+)
+
+const (
+	beType = "nvme-tcp"
+
+	defaultSysfsRoot = "/sys"
+	defaultDevRoot   = "/dev"
+	defaultNSTimeout = 10 * time.Second
+
+	fabricsDevName = "nvme-fabrics"
+	nsPollInterval = 100 * time.Millisecond
+)
+
+// Config is the `backend.yaml` config of the nvme-tcp backend, e.g.:
+//
+//	backend: nvme-tcp
+//	ctrl-loss-tmo: -1
+//	nr-io-queues: 8
+//	ns-timeout: 20s
+//	tls-keyring: 123456789
+type Config struct {
+	backend.ConfigBase `yaml:",inline"`
+
+	// CtrlLossTmo is passed on verbatim as the `ctrl_loss_tmo` connect
+	// option (in seconds, -1 for "reconnect forever"), if specified.
+	// otherwise the kernel default is used.
+	CtrlLossTmo *int `yaml:"ctrl-loss-tmo"`
+	// NrIOQueues is passed on verbatim as the `nr_io_queues` connect
+	// option, if non-zero.
+	NrIOQueues int `yaml:"nr-io-queues"`
+	// NSTimeout is the max time Attach() will wait for the namespace block
+	// device to show up once the controllers are connected.
+	NSTimeout time.Duration `yaml:"ns-timeout"`
+
+	// TLSKeyring and TLSKey are the serials of the kernel keyring to look
+	// the NVMe/TCP TLS PSKs up in (instead of the default `.nvme` one) and
+	// of the specific PSK to use, respectively, passed on verbatim as the
+	// `keyring` and `tls_key` connect options, if non-zero. only used for
+	// volumes that require TLS.
+	TLSKeyring int `yaml:"tls-keyring"`
+	TLSKey     int `yaml:"tls-key"`
+
+	// SysfsRoot and DevRoot are primarily useful for running tests against
+	// a fake tree, there should normally be no reason to override them.
+	SysfsRoot string `yaml:"sysfs-root"`
+	DevRoot   string `yaml:"dev-root"`
+}
+
+type Backend struct {
+	hostNQN string
+	cfg     Config
+	conns   *backend.ConnTracker
+
+	// native NVMe multipath state, as reported by `nvme_core` at start-up.
+	multipath bool
+
+	log *logrus.Entry
+}
+
+func parseConfig(rawCfg []byte) (*Config, error) {
+	cfg := Config{
+		NSTimeout: defaultNSTimeout,
+		SysfsRoot: defaultSysfsRoot,
+		DevRoot:   defaultDevRoot,
+	}
+	if err := yaml.UnmarshalStrict(rawCfg, &cfg); err != nil {
+		return nil, fmt.Errorf("bad '%s' backend config: %s",
+			beType, backend.FmtYAMLError(err))
+	}
+	if cfg.CtrlLossTmo != nil && *cfg.CtrlLossTmo < -1 {
+		return nil, fmt.Errorf("bad '%s' backend config: invalid ctrl-loss-tmo: %d",
+			beType, *cfg.CtrlLossTmo)
+	}
+	if cfg.NrIOQueues < 0 {
+		return nil, fmt.Errorf("bad '%s' backend config: invalid nr-io-queues: %d",
+			beType, cfg.NrIOQueues)
+	}
+	if cfg.TLSKeyring < 0 || cfg.TLSKey < 0 {
+		return nil, fmt.Errorf("bad '%s' backend config: invalid TLS keyring/key "+
+			"serial: %d/%d", beType, cfg.TLSKeyring, cfg.TLSKey)
+	}
+	if cfg.NSTimeout <= 0 {
+		return nil, fmt.Errorf("bad '%s' backend config: invalid ns-timeout: %s",
+			beType, cfg.NSTimeout)
+	}
+	return &cfg, nil
+}
+
+func New(
+	log *logrus.Entry, hostNQN string, conns *backend.ConnTracker, rawCfg []byte,
+) (*Backend, error) {
+	cfg, err := parseConfig(rawCfg)
+	if err != nil {
+		return nil, err
+	}
+	be := Backend{
+		hostNQN: hostNQN,
+		cfg:     *cfg,
+		conns:   conns,
+		log:     log,
+	}
+
+	ctrlLossTmo := "<kernel default>"
+	if be.cfg.CtrlLossTmo != nil {
+		ctrlLossTmo = strconv.Itoa(*be.cfg.CtrlLossTmo)
+	}
+	be.log.WithFields(logrus.Fields{
+		"ctrl-loss-tmo": ctrlLossTmo,
+		"nr-io-queues":  be.cfg.NrIOQueues,
+		"ns-timeout":    be.cfg.NSTimeout.String(),
+		"tls-keyring":   be.cfg.TLSKeyring,
+		"tls-key":       be.cfg.TLSKey,
+		"sysfs-root":    be.cfg.SysfsRoot,
+		"dev-root":      be.cfg.DevRoot,
+	}).Info("starting")
+
+	// the NVMe/TCP kernel module might legitimately not be loaded yet (it
+	// will be auto-loaded on first connect on most distros), but without
+	// the fabrics control device there's nothing we can do.
+	if _, err := os.Stat(be.fabricsPath()); err != nil {
+		be.log.Warnf("NVMe-oF control device is inaccessible: %s. make sure "+
+			"the 'nvme-fabrics' and 'nvme-tcp' kernel modules are loaded", err)
+	}
+
+	// LightOS exposes each volume through all the replicas' targets, using
+	// ANA to designate the optimized path. without native NVMe multipath
+	// each of the paths would show up as a separate block device and no
+	// failover would take place.
+	mp, err := os.ReadFile(filepath.Join(be.cfg.SysfsRoot,
+		"module", "nvme_core", "parameters", "multipath"))
+	switch {
+	case err != nil:
+		be.log.Warnf("failed to detect native NVMe multipath support: %s", err)
+	case strings.TrimSpace(string(mp)) == "Y":
+		be.multipath = true
+	default:
+		be.log.Warnf("native NVMe multipath is disabled, replicated volumes " +
+			"will be rejected. see 'nvme_core.multipath' kernel module param")
+	}
+
+	return &be, nil
+}
+
+func init() {
+	backend.RegisterBackend(beType,
+		func(
+			log *logrus.Entry, hostNQN string, conns *backend.ConnTracker, rawCfg []byte,
+		) (backend.Backend, error) {
+			return New(log, hostNQN, conns, rawCfg)
+		})
+}
+
+func (be *Backend) Type() string { //revive:disable-line:unused-receiver
+	return beType
+}
+
+func (be *Backend) LBVolEligible(
+	_ context.Context, vol *lb.Volume, transport string, tlsKey bool,
+) *status.Status {
+	if err := backend.CheckTransport(be.cfg.SysfsRoot, transport); err != nil {
+		return status.New(codes.FailedPrecondition, err.Error())
+	}
+	if tlsKey {
+		return errTLSKeyUnsupported()
+	}
+	if vol.ReplicaCount > 1 && !be.multipath {
+		return status.Newf(codes.FailedPrecondition,
+			"volume has %d replicas, but native NVMe multipath is disabled "+
+				"on this node", vol.ReplicaCount)
+	}
+	return nil
+}
+
+// errTLSKeyUnsupported: the kernel wants the derived TLS PSK in a keyring,
+// rather than the configured one, and the derivation is best left to the
+// tools that know how, e.g. `nvme check-tls-key --insert`.
+func errTLSKeyUnsupported() *status.Status {
+	return status.Newf(codes.FailedPrecondition, "'%s' backend doesn't support "+
+		"NVMe/TCP TLS PSKs passed in through CSI secrets, provision the PSK "+
+		"in the node keyring instead", beType)
+}
+
+func (be *Backend) fabricsPath() string {
+	return filepath.Join(be.cfg.DevRoot, fabricsDevName)
+}
+
+// findCtrl() returns the controller connected (or reconnecting) to target `ep`
+// over `transport` on behalf of this host, if any. controllers on their way out
+// don't count.
+func (be *Backend) findCtrl(
+	ctrls []backend.Ctrl, transport, subsysNQN string, ep endpoint.EP,
+) *backend.Ctrl {
+	port := ep.PortString()
+	for i := range ctrls {
+		c := &ctrls[i]
+		if c.Transport != transport || c.SubsysNQN != subsysNQN ||
+			!sameTraddr(c.Traddr, ep.Host()) || c.Trsvcid != port {
+			continue
+		}
+		if !c.IsHostNQN(be.hostNQN) || c.IsDying() {
+			continue
+		}
+		return c
+	}
+	return nil
+}
+
+// findOtherXportCtrl() returns a controller of this host connected to
+// subsystem `subsysNQN` over a transport other than `transport`, if any.
+func (be *Backend) findOtherXportCtrl(
+	ctrls []backend.Ctrl, transport, subsysNQN string,
+) *backend.Ctrl {
+	for i := range ctrls {
+		c := &ctrls[i]
+		if c.SubsysNQN == subsysNQN && c.Transport != transport &&
+			c.IsHostNQN(be.hostNQN) && !c.IsDying() {
+			return c
+		}
+	}
+	return nil
+}
+
+// sameTraddr() compares transport addresses semantically if they are both IP
+// addresses, so that IPv6 addresses spelled differently (e.g. by whoever
+// connected the controller out from under us) still match.
+func sameTraddr(a, b string) bool {
+	if a == b {
+		return true
+	}
+	ipA, errA := netip.ParseAddr(a)
+	ipB, errB := netip.ParseAddr(b)
+	return errA == nil && errB == nil && ipA == ipB
+}
+
+func (be *Backend) connectOpts(tgtEnv *backend.TargetEnv, ep endpoint.EP) string {
+	opts := fmt.Sprintf("nqn=%s,transport=%s,traddr=%s,trsvcid=%d,hostnqn=%s",
+		tgtEnv.SubsysNQN, tgtEnv.Transport, ep.Host(), ep.Port(), be.hostNQN)
+	if be.cfg.CtrlLossTmo != nil {
+		opts += ",ctrl_loss_tmo=" + strconv.Itoa(*be.cfg.CtrlLossTmo)
+	}
+	if be.cfg.NrIOQueues > 0 {
+		opts += ",nr_io_queues=" + strconv.Itoa(be.cfg.NrIOQueues)
+	}
+	return opts
+}
+
+// tlsOpts() returns the NVMe/TCP TLS connect options for `tgtEnv`, if any. the
+// kernel looks the PSK up in the keyring by the TLS PSK identity, which is
+// derived from the host and subsystem NQNs, unless told which one to use.
+func (be *Backend) tlsOpts(tgtEnv *backend.TargetEnv) string {
+	if !tgtEnv.TLS {
+		return ""
+	}
+	opts := ",tls"
+	if be.cfg.TLSKeyring != 0 {
+		opts += ",keyring=" + strconv.Itoa(be.cfg.TLSKeyring)
+	}
+	if be.cfg.TLSKey != 0 {
+		opts += ",tls_key=" + strconv.Itoa(be.cfg.TLSKey)
+	}
+	return opts
+}
+
+// authOpts() returns the NVMe in-band authentication connect options for
+// `tgtEnv`, if any. the controller secret is only of use along with the host
+// one: bidirectional authentication is initiated by the host.
+func authOpts(tgtEnv *backend.TargetEnv) string {
+	if tgtEnv.HostSecret == "" {
+		return ""
+	}
+	opts := ",dhchap_secret=" + tgtEnv.HostSecret
+	if tgtEnv.CtrlSecret != "" {
+		opts += ",dhchap_ctrl_secret=" + tgtEnv.CtrlSecret
+	}
+	return opts
+}
+
+// connect() asks the kernel to create a new controller connected to target
+// `ep`. this blocks until the connection is established or fails.
+func (be *Backend) connect(log *logrus.Entry, tgtEnv *backend.TargetEnv, ep endpoint.EP) error {
+	opts := be.connectOpts(tgtEnv, ep) + be.tlsOpts(tgtEnv)
+	// the secrets are appended after logging, for obvious reasons.
+	if auth := authOpts(tgtEnv); auth != "" {
+		log.Debugf("connecting: '%s' with DH-HMAC-CHAP", opts)
+		opts += auth
+	} else {
+		log.Debugf("connecting: '%s'", opts)
+	}
+
+	// the response must be read back from the same open file.
+	f, err := os.OpenFile(be.fabricsPath(), os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.WriteString(opts); err != nil {
+		return err
+	}
+	buf := make([]byte, 256)
+	n, _ := f.Read(buf)
+	if resp := strings.TrimSpace(string(buf[:n])); resp != "" {
+		log.Debugf("connected: '%s'", resp)
+	}
+	return nil
+}
+
+// findNS() returns the name of the namespace block device with NGUID `nguid`,
+// or an empty string if there's none. LightOS sets both the NS UUID and NGUID
+// to the volume UUID, but older kernels only expose the former.
+func (be *Backend) findNS(nguid guuid.UUID) (string, error) {
+	devs, err := filepath.Glob(filepath.Join(be.cfg.SysfsRoot, "block", "nvme*"))
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range devs {
+		name := filepath.Base(dir)
+		if !backend.NSDevRegex.MatchString(name) || backend.ReadNSID(dir) != nguid {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(be.cfg.DevRoot, name)); err != nil {
+			// sysfs is there, udev/devtmpfs isn't yet...
+			return "", nil
+		}
+		return name, nil
+	}
+	return "", nil
+}
+
+// logANAStates() is purely informational: with native NVMe multipath the
+// kernel will pick the optimized path by itself.
+func (be *Backend) logANAStates(log *logrus.Entry, nsDev string) {
+	paths, _ := filepath.Glob(filepath.Join(be.cfg.SysfsRoot, "block", nsDev, "multipath", "*"))
+	states := []string{}
+	for _, p := range paths {
+		states = append(states,
+			fmt.Sprintf("%s:%s", filepath.Base(p), backend.ReadAttr(p, "ana_state")))
+	}
+	if len(states) > 0 {
+		log.Debugf("namespace paths: %s", strings.Join(states, ", "))
+	}
+}
+
+func (be *Backend) waitForNS(ctx context.Context, nguid guuid.UUID) (string, error) {
+	timeout := time.NewTimer(be.cfg.NSTimeout)
+	defer timeout.Stop()
+	tick := time.NewTicker(nsPollInterval)
+	defer tick.Stop()
+	for {
+		nsDev, err := be.findNS(nguid)
+		if err != nil || nsDev != "" {
+			return nsDev, err
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-timeout.C:
+			return "", nil
+		case <-tick.C:
+		}
+	}
+}
+
+// disconnectNew() deletes the controllers of subsystem `tgtEnv.SubsysNQN` that
+// are not among `before`, i.e. the ones a failed Attach() has just connected,
+// lest they linger with nothing holding them. it's up to the callers to hold
+// the connection-set lock of the subsystem, so that those are really ours.
+// if some volumes are attached through the subsystem already, the controllers
+// are left alone for them to use.
+func (be *Backend) disconnectNew(
+	log *logrus.Entry, tgtEnv *backend.TargetEnv, before []backend.Ctrl,
+) {
+	if be.conns.Refs(tgtEnv.SubsysNQN) > 0 {
+		return
+	}
+	ctrls, err := backend.ListCtrls(be.cfg.SysfsRoot)
+	if err != nil {
+		log.Warnf("failed to list NVMe controllers to disconnect: %s", err)
+		return
+	}
+	old := map[string]bool{}
+	for i := range before {
+		// the names of the dying ones might be reused already.
+		if !before[i].IsDying() {
+			old[before[i].Name] = true
+		}
+	}
+	for i := range ctrls {
+		c := &ctrls[i]
+		if old[c.Name] || c.SubsysNQN != tgtEnv.SubsysNQN ||
+			c.Transport != tgtEnv.Transport || !c.IsHostNQN(be.hostNQN) || c.IsDying() {
+			continue
+		}
+		log.Infof("disconnecting '%s' from %s:%s", c.Name, c.Traddr, c.Trsvcid)
+		if err := backend.DeleteCtrl(c); err != nil {
+			log.Warnf("failed to disconnect '%s': %s", c.Name, err)
+		}
+	}
+}
+
+func (be *Backend) Attach(
+	ctx context.Context, tgtEnv *backend.TargetEnv, nguid guuid.UUID,
+) *status.Status {
+	log := be.log.WithField("vol-uuid", nguid)
+	if len(tgtEnv.NvmeEPs) == 0 {
+		return status.New(codes.Internal, "no NVMe target endpoints specified")
+	}
+	if _, err := os.Stat(be.fabricsPath()); err != nil {
+		return status.Newf(codes.FailedPrecondition,
+			"NVMe-oF control device is inaccessible: %s", err)
+	}
+	if tgtEnv.TLS && tgtEnv.TLSKey != "" {
+		// normally ruled out by LBVolEligible() already.
+		return errTLSKeyUnsupported()
+	}
+
+	ctrls, err := backend.ListCtrls(be.cfg.SysfsRoot)
+	if err != nil {
+		return status.Newf(codes.Unknown, "failed to list NVMe controllers: %s", err)
+	}
+	// native NVMe multipath would happily mix the paths over different
+	// transports into the same namespace heads, and the connections are
+	// shared by all the volumes of the subsystem, so it's one transport per
+	// subsystem at a time.
+	if c := be.findOtherXportCtrl(ctrls, tgtEnv.Transport, tgtEnv.SubsysNQN); c != nil {
+		return status.Newf(codes.FailedPrecondition, "volume requires NVMe-oF "+
+			"transport '%s', but the node is already connected to subsystem '%s' "+
+			"over '%s' through '%s'", tgtEnv.Transport, tgtEnv.SubsysNQN,
+			c.Transport, c.Name)
+	}
+
+	// connect to ALL the targets, the kernel native NVMe multipath will
+	// take care of the ANA-based path selection and failover. connecting
+	// to just some of them is good enough to go on with, the missing ones
+	// will be retried on the next Attach() sharing the same targets.
+	//
+	// TODO: the kernel won't keep retrying connections that failed to be
+	// established in the first place, so until the next Attach() the
+	// volume might be left with fewer paths than it could have had.
+	numConnected := 0
+	for _, ep := range tgtEnv.NvmeEPs {
+		epLog := log.WithField("target", ep.String())
+		if c := be.findCtrl(ctrls, tgtEnv.Transport, tgtEnv.SubsysNQN, ep); c != nil {
+			if tgtEnv.TLS && c.TLSKey == "" {
+				// the connections are shared by all the volumes of
+				// the subsystem, can't just yank this one.
+				return status.Newf(codes.FailedPrecondition, "volume requires "+
+					"NVMe/TCP TLS, but the node is already connected to target "+
+					"%s without TLS through '%s'", ep, c.Name)
+			}
+			epLog.Debugf("already connected through '%s', state: %s", c.Name, c.State)
+			numConnected++
+			continue
+		}
+		if err := be.connect(epLog, tgtEnv, ep); err != nil {
+			epLog.Warnf("failed to connect: %s", err)
+			continue
+		}
+		numConnected++
+	}
+	if numConnected == 0 {
+		return status.Newf(codes.Unavailable,
+			"failed to connect to any of the NVMe targets %s of subsystem '%s'",
+			tgtEnv.NvmeEPs, tgtEnv.SubsysNQN)
+	} else if numConnected < len(tgtEnv.NvmeEPs) {
+		log.Warnf("connected to only %d out of %d NVMe targets",
+			numConnected, len(tgtEnv.NvmeEPs))
+	}
+
+	nsDev, err := be.waitForNS(ctx, nguid)
+	if err != nil || nsDev == "" {
+		be.disconnectNew(log, tgtEnv, ctrls)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return status.FromContextError(err)
+		}
+		return status.Newf(codes.Unknown, "failed waiting for namespace %s: %s",
+			nguid, err)
+	}
+	if nsDev == "" {
+		return status.Newf(codes.Unavailable, "namespace %s didn't show up "+
+			"within %s after connecting to the targets", nguid, be.cfg.NSTimeout)
+	}
+	log.Debugf("namespace is available as '%s'", nsDev)
+	be.logANAStates(log, nsDev)
+	be.conns.Hold(tgtEnv.SubsysNQN, nguid)
+	return nil
+}
+
+func (be *Backend) Detach(_ context.Context, nguid guuid.UUID) *status.Status {
+	// the namespace block device itself stays around until the volume is
+	// unmapped on the LightOS side (i.e. ControllerUnpublishVolume()
+	// removes the host from the volume ACL), unless this was the last
+	// volume attached through the subsystem - then we disconnect.
+	return be.conns.Release(nguid)
+}
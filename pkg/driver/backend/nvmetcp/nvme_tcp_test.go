@@ -0,0 +1,453 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package nvmetcp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	guuid "github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/lightbitslabs/los-csi/pkg/driver/backend"
+	"github.com/lightbitslabs/los-csi/pkg/lb"
+	"github.com/lightbitslabs/los-csi/pkg/util/endpoint"
+)
+
+const (
+	testHostNQN   = "nqn.2019-09.com.lightbitslabs:host:node00"
+	testSubsysNQN = "nqn.2016-01.com.lightbitslabs:uuid:46cdc5c2-e13d-4bc8-9d35-1c6ef6e4fbb0"
+)
+
+var testNGUID = guuid.MustParse("6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66")
+
+type fakeTree struct {
+	t     *testing.T
+	sysfs string
+	dev   string
+}
+
+func newFakeTree(t *testing.T, multipath bool) *fakeTree {
+	root := t.TempDir()
+	ft := &fakeTree{
+		t:     t,
+		sysfs: filepath.Join(root, "sys"),
+		dev:   filepath.Join(root, "dev"),
+	}
+	mp := "N"
+	if multipath {
+		mp = "Y"
+	}
+	ft.write(filepath.Join(ft.sysfs, "module", "nvme_core", "parameters", "multipath"), mp)
+	ft.write(filepath.Join(ft.dev, fabricsDevName), "")
+	return ft
+}
+
+func (ft *fakeTree) write(path, content string) {
+	require.NoError(ft.t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(ft.t, os.WriteFile(path, []byte(content+"\n"), 0o644))
+}
+
+func (ft *fakeTree) addCtrl(name, ep, hostNQN, state string) {
+	e := endpoint.MustParse(ep)
+	dir := filepath.Join(ft.sysfs, "class", "nvme", name)
+	ft.write(filepath.Join(dir, "transport"), "tcp")
+	ft.write(filepath.Join(dir, "address"),
+		fmt.Sprintf("traddr=%s,trsvcid=%d,src_addr=10.0.0.100", e.Host(), e.Port()))
+	ft.write(filepath.Join(dir, "subsysnqn"), testSubsysNQN)
+	ft.write(filepath.Join(dir, "hostnqn"), hostNQN)
+	ft.write(filepath.Join(dir, "state"), state)
+}
+
+func (ft *fakeTree) setCtrlTLSKey(name, serial string) {
+	ft.write(filepath.Join(ft.sysfs, "class", "nvme", name, "tls_key"), serial)
+}
+
+func (ft *fakeTree) setCtrlTransport(name, transport string) {
+	ft.write(filepath.Join(ft.sysfs, "class", "nvme", name, "transport"), transport)
+}
+
+func (ft *fakeTree) addRDMADev(name string) {
+	ft.write(filepath.Join(ft.sysfs, "class", "infiniband", name, "node_type"), "1: CA")
+}
+
+func (ft *fakeTree) addNS(name string, nguid guuid.UUID) {
+	ft.write(filepath.Join(ft.sysfs, "block", name, "nguid"), nguid.String())
+	ft.write(filepath.Join(ft.dev, name), "")
+}
+
+func (ft *fakeTree) connectLog() string {
+	b, err := os.ReadFile(filepath.Join(ft.dev, fabricsDevName))
+	require.NoError(ft.t, err)
+	return strings.TrimSpace(string(b))
+}
+
+// connectCtrls() plays the kernel: it creates controller `ctrls[ep]` once a
+// connection to target `ep` shows up in the connect log, until the returned
+// func is called.
+func (ft *fakeTree) connectCtrls(ctrls map[string]string) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		created := map[string]bool{}
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			b, _ := os.ReadFile(filepath.Join(ft.dev, fabricsDevName))
+			for ep, name := range ctrls {
+				traddr := "traddr=" + endpoint.MustParse(ep).Host() + ","
+				if created[name] || !strings.Contains(string(b), traddr) {
+					continue
+				}
+				ft.addCtrl(name, ep, testHostNQN, "live")
+				ft.write(filepath.Join(ft.sysfs, "class", "nvme", name, "delete_controller"), "")
+				created[name] = true
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func (ft *fakeTree) newBackend(extraCfg string) *Backend {
+	cfg := fmt.Sprintf("backend: nvme-tcp\nsysfs-root: %s\ndev-root: %s\nns-timeout: 300ms\n%s",
+		ft.sysfs, ft.dev, extraCfg)
+	log := logrus.New().WithField("test", ft.t.Name())
+	conns := backend.NewConnTracker(log, ft.sysfs, testHostNQN)
+	be, err := New(log, testHostNQN, conns, []byte(cfg))
+	require.NoError(ft.t, err)
+	return be
+}
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := parseConfig([]byte("backend: nvme-tcp\n"))
+	require.NoError(t, err)
+	require.Equal(t, defaultSysfsRoot, cfg.SysfsRoot)
+	require.Equal(t, defaultDevRoot, cfg.DevRoot)
+	require.Equal(t, defaultNSTimeout, cfg.NSTimeout)
+	require.Nil(t, cfg.CtrlLossTmo)
+
+	cfg, err = parseConfig([]byte("backend: nvme-tcp\nctrl-loss-tmo: -1\nns-timeout: 1m\n"))
+	require.NoError(t, err)
+	require.Equal(t, -1, *cfg.CtrlLossTmo)
+	require.Equal(t, "1m0s", cfg.NSTimeout.String())
+
+	bad := []string{
+		"backend: nvme-tcp\nctrl-loss-tmo: -2\n",
+		"backend: nvme-tcp\nnr-io-queues: -1\n",
+		"backend: nvme-tcp\nns-timeout: 0s\n",
+		"backend: nvme-tcp\ntls-keyring: -1\n",
+		"backend: nvme-tcp\nno-such-option: 1\n",
+	}
+	for _, c := range bad {
+		_, err = parseConfig([]byte(c))
+		require.Error(t, err, "config: %q", c)
+	}
+}
+
+func TestAttach(t *testing.T) {
+	tgtEnv := &backend.TargetEnv{
+		Transport: backend.TransportTCP,
+		SubsysNQN: testSubsysNQN,
+		NvmeEPs:   endpoint.MustParseCSV("10.0.0.1:4420,10.0.0.2:4420,10.0.0.3:4420"),
+	}
+
+	t.Run("connects missing paths", func(t *testing.T) {
+		ft := newFakeTree(t, true)
+		ft.addCtrl("nvme0", "10.0.0.1:4420", testHostNQN, "live")
+		ft.addCtrl("nvme1", "10.0.0.2:4420", testHostNQN, "deleting")
+		ft.addCtrl("nvme2", "10.0.0.3:4420", "nqn.2019-09.com.lightbitslabs:host:other", "live")
+		ft.addNS("nvme0n1", testNGUID)
+		be := ft.newBackend("ctrl-loss-tmo: -1\n")
+
+		st := be.Attach(context.Background(), tgtEnv, testNGUID)
+		require.Nil(t, st)
+		require.Equal(t, 1, be.conns.Refs(testSubsysNQN))
+		connects := ft.connectLog()
+		require.NotContains(t, connects, "traddr=10.0.0.1,")
+		require.Contains(t, connects, fmt.Sprintf("nqn=%s,transport=tcp,traddr=10.0.0.2,"+
+			"trsvcid=4420,hostnqn=%s,ctrl_loss_tmo=-1", testSubsysNQN, testHostNQN))
+		require.Contains(t, connects, "traddr=10.0.0.3,")
+	})
+
+	t.Run("all paths connected", func(t *testing.T) {
+		ft := newFakeTree(t, true)
+		for i, ep := range tgtEnv.NvmeEPs {
+			ft.addCtrl(fmt.Sprintf("nvme%d", i), ep.String(), testHostNQN, "live")
+		}
+		// hidden per-path devices must not be mistaken for the NS head.
+		ft.write(filepath.Join(ft.sysfs, "block", "nvme0c0n1", "nguid"), testNGUID.String())
+		ft.addNS("nvme0n1", testNGUID)
+		be := ft.newBackend("")
+
+		st := be.Attach(context.Background(), tgtEnv, testNGUID)
+		require.Nil(t, st)
+		require.Empty(t, ft.connectLog())
+		nsDev, err := be.findNS(testNGUID)
+		require.NoError(t, err)
+		require.Equal(t, "nvme0n1", nsDev)
+	})
+
+	t.Run("IPv6 paths", func(t *testing.T) {
+		ft := newFakeTree(t, true)
+		ft.addCtrl("nvme0", "[2001:0db8:0:0::1]:4420", testHostNQN, "live")
+		ft.addNS("nvme0n1", testNGUID)
+		be := ft.newBackend("")
+
+		tgtEnv := &backend.TargetEnv{
+			Transport: backend.TransportTCP,
+			SubsysNQN: testSubsysNQN,
+			NvmeEPs:   endpoint.MustParseCSV("[2001:db8::1]:4420,[2001:db8::2]:4420"),
+		}
+		st := be.Attach(context.Background(), tgtEnv, testNGUID)
+		require.Nil(t, st)
+		connects := ft.connectLog()
+		require.NotContains(t, connects, "traddr=2001:db8::1,")
+		require.Contains(t, connects, fmt.Sprintf("nqn=%s,transport=tcp,traddr=2001:db8::2,"+
+			"trsvcid=4420,hostnqn=%s", testSubsysNQN, testHostNQN))
+	})
+
+	t.Run("in-band auth", func(t *testing.T) {
+		ft := newFakeTree(t, true)
+		ft.addNS("nvme0n1", testNGUID)
+		be := ft.newBackend("")
+
+		tgtEnv := &backend.TargetEnv{
+			Transport:  backend.TransportTCP,
+			SubsysNQN:  testSubsysNQN,
+			NvmeEPs:    endpoint.MustParseCSV("10.0.0.1:4420"),
+			HostSecret: "DHHC-1:00:aG9zdA==:",
+			CtrlSecret: "DHHC-1:00:Y3RybA==:",
+		}
+		st := be.Attach(context.Background(), tgtEnv, testNGUID)
+		require.Nil(t, st)
+		require.Contains(t, ft.connectLog(), fmt.Sprintf("hostnqn=%s,"+
+			"dhchap_secret=DHHC-1:00:aG9zdA==:,dhchap_ctrl_secret=DHHC-1:00:Y3RybA==:",
+			testHostNQN))
+	})
+
+	t.Run("TLS", func(t *testing.T) {
+		ft := newFakeTree(t, true)
+		ft.addCtrl("nvme0", "10.0.0.1:4420", testHostNQN, "live")
+		ft.setCtrlTLSKey("nvme0", "1a2b3c4d")
+		ft.addNS("nvme0n1", testNGUID)
+		be := ft.newBackend("tls-keyring: 123\n")
+
+		tgtEnv := &backend.TargetEnv{
+			Transport: backend.TransportTCP,
+			SubsysNQN: testSubsysNQN,
+			NvmeEPs:   endpoint.MustParseCSV("10.0.0.1:4420,10.0.0.2:4420"),
+			TLS:       true,
+		}
+		st := be.Attach(context.Background(), tgtEnv, testNGUID)
+		require.Nil(t, st)
+		connects := ft.connectLog()
+		require.NotContains(t, connects, "traddr=10.0.0.1,")
+		require.Contains(t, connects, fmt.Sprintf("traddr=10.0.0.2,trsvcid=4420,"+
+			"hostnqn=%s,tls,keyring=123", testHostNQN))
+
+		// PSKs must be in the keyring already:
+		tgtEnv.TLSKey = "NVMeTLSkey-1:01:VRLbtnN9AQb2WXW3c9+wEf/DRLz0QuLdbYvEhwtdWwNf9LrZ:"
+		st = be.Attach(context.Background(), tgtEnv, testNGUID)
+		require.NotNil(t, st)
+		require.Equal(t, codes.FailedPrecondition, st.Code())
+		require.NotContains(t, st.Message(), tgtEnv.TLSKey)
+	})
+
+	t.Run("TLS over cleartext paths", func(t *testing.T) {
+		ft := newFakeTree(t, true)
+		ft.addCtrl("nvme0", "10.0.0.1:4420", testHostNQN, "live")
+		ft.addNS("nvme0n1", testNGUID)
+		be := ft.newBackend("")
+
+		tgtEnv := &backend.TargetEnv{
+			Transport: backend.TransportTCP,
+			SubsysNQN: testSubsysNQN,
+			NvmeEPs:   endpoint.MustParseCSV("10.0.0.1:4420"),
+			TLS:       true,
+		}
+		st := be.Attach(context.Background(), tgtEnv, testNGUID)
+		require.NotNil(t, st)
+		require.Equal(t, codes.FailedPrecondition, st.Code())
+		require.Empty(t, ft.connectLog())
+		require.Zero(t, be.conns.Refs(testSubsysNQN))
+	})
+
+	t.Run("RDMA", func(t *testing.T) {
+		ft := newFakeTree(t, true)
+		ft.addCtrl("nvme0", "10.0.0.1:4420", testHostNQN, "live")
+		ft.setCtrlTransport("nvme0", backend.TransportRDMA)
+		ft.addNS("nvme0n1", testNGUID)
+		be := ft.newBackend("")
+
+		tgtEnv := &backend.TargetEnv{
+			Transport: backend.TransportRDMA,
+			SubsysNQN: testSubsysNQN,
+			NvmeEPs:   endpoint.MustParseCSV("10.0.0.1:4420,10.0.0.2:4420"),
+		}
+		st := be.Attach(context.Background(), tgtEnv, testNGUID)
+		require.Nil(t, st)
+		connects := ft.connectLog()
+		require.NotContains(t, connects, "traddr=10.0.0.1,")
+		require.Contains(t, connects, fmt.Sprintf("nqn=%s,transport=rdma,traddr=10.0.0.2,"+
+			"trsvcid=4420,hostnqn=%s", testSubsysNQN, testHostNQN))
+	})
+
+	t.Run("mixed transports", func(t *testing.T) {
+		ft := newFakeTree(t, true)
+		ft.addCtrl("nvme0", "10.0.0.1:4420", testHostNQN, "live")
+		ft.addNS("nvme0n1", testNGUID)
+		be := ft.newBackend("")
+
+		tgtEnv := &backend.TargetEnv{
+			Transport: backend.TransportRDMA,
+			SubsysNQN: testSubsysNQN,
+			NvmeEPs:   endpoint.MustParseCSV("10.0.0.1:4420,10.0.0.2:4420"),
+		}
+		st := be.Attach(context.Background(), tgtEnv, testNGUID)
+		require.NotNil(t, st)
+		require.Equal(t, codes.FailedPrecondition, st.Code())
+		require.Empty(t, ft.connectLog())
+		require.Zero(t, be.conns.Refs(testSubsysNQN))
+	})
+
+	t.Run("namespace doesn't show up", func(t *testing.T) {
+		ft := newFakeTree(t, true)
+		ft.addCtrl("nvme0", "10.0.0.1:4420", testHostNQN, "live")
+		ft.write(filepath.Join(ft.sysfs, "class", "nvme", "nvme0", "delete_controller"), "")
+		ft.addNS("nvme0n1", guuid.MustParse("0cf0a5c4-7ec8-4a1c-a52e-1d5a3cbf6f0c"))
+		be := ft.newBackend("")
+		defer ft.connectCtrls(map[string]string{
+			"10.0.0.2:4420": "nvme1",
+			"10.0.0.3:4420": "nvme2",
+		})()
+
+		st := be.Attach(context.Background(), tgtEnv, testNGUID)
+		require.NotNil(t, st)
+		require.Equal(t, codes.Unavailable, st.Code())
+		require.Equal(t, 0, be.conns.Refs(testSubsysNQN))
+		ctrlDir := func(name string) string {
+			return filepath.Join(ft.sysfs, "class", "nvme", name)
+		}
+		// only the controllers connected by the failed Attach() must go:
+		require.Empty(t, backend.ReadAttr(ctrlDir("nvme0"), "delete_controller"))
+		require.Equal(t, "1", backend.ReadAttr(ctrlDir("nvme1"), "delete_controller"))
+		require.Equal(t, "1", backend.ReadAttr(ctrlDir("nvme2"), "delete_controller"))
+	})
+
+	t.Run("namespace doesn't show up, subsystem in use", func(t *testing.T) {
+		ft := newFakeTree(t, true)
+		ft.addCtrl("nvme0", "10.0.0.1:4420", testHostNQN, "live")
+		ft.write(filepath.Join(ft.sysfs, "class", "nvme", "nvme0", "delete_controller"), "")
+		be := ft.newBackend("")
+		be.conns.Hold(testSubsysNQN, guuid.New())
+		defer ft.connectCtrls(map[string]string{"10.0.0.2:4420": "nvme1"})()
+
+		st := be.Attach(context.Background(), tgtEnv, testNGUID)
+		require.NotNil(t, st)
+		require.Equal(t, codes.Unavailable, st.Code())
+		require.Equal(t, 1, be.conns.Refs(testSubsysNQN))
+		for _, name := range []string{"nvme0", "nvme1"} {
+			dir := filepath.Join(ft.sysfs, "class", "nvme", name)
+			require.Equal(t, "live", backend.ReadAttr(dir, "state"))
+			require.Empty(t, backend.ReadAttr(dir, "delete_controller"))
+		}
+	})
+
+	t.Run("no fabrics device", func(t *testing.T) {
+		ft := newFakeTree(t, true)
+		require.NoError(t, os.Remove(filepath.Join(ft.dev, fabricsDevName)))
+		be := ft.newBackend("")
+
+		st := be.Attach(context.Background(), tgtEnv, testNGUID)
+		require.NotNil(t, st)
+		require.Equal(t, codes.FailedPrecondition, st.Code())
+	})
+}
+
+func TestLBVolEligible(t *testing.T) {
+	vol := &lb.Volume{ReplicaCount: 3}
+
+	tcp := backend.TransportTCP
+	ctx := context.Background()
+
+	be := newFakeTree(t, true).newBackend("")
+	require.Nil(t, be.LBVolEligible(ctx, vol, tcp, false))
+
+	be = newFakeTree(t, false).newBackend("")
+	st := be.LBVolEligible(ctx, vol, tcp, false)
+	require.NotNil(t, st)
+	require.Equal(t, codes.FailedPrecondition, st.Code())
+	vol.ReplicaCount = 1
+	require.Nil(t, be.LBVolEligible(ctx, vol, tcp, false))
+
+	// RDMA needs the hardware:
+	ft := newFakeTree(t, true)
+	be = ft.newBackend("")
+	st = be.LBVolEligible(ctx, vol, backend.TransportRDMA, false)
+	require.NotNil(t, st)
+	require.Equal(t, codes.FailedPrecondition, st.Code())
+	ft.addRDMADev("mlx5_0")
+	require.Nil(t, be.LBVolEligible(ctx, vol, backend.TransportRDMA, false))
+	st = be.LBVolEligible(ctx, vol, "fc", false)
+	require.NotNil(t, st)
+	require.Equal(t, codes.FailedPrecondition, st.Code())
+
+	// the PSK has to come from the node keyring:
+	st = be.LBVolEligible(ctx, vol, tcp, true)
+	require.NotNil(t, st)
+	require.Equal(t, codes.FailedPrecondition, st.Code())
+}
+
+func TestDetach(t *testing.T) {
+	tgtEnv := &backend.TargetEnv{
+		Transport: backend.TransportTCP,
+		SubsysNQN: testSubsysNQN,
+		NvmeEPs:   endpoint.MustParseCSV("10.0.0.1:4420,10.0.0.2:4420"),
+	}
+	otherNGUID := guuid.MustParse("0cf0a5c4-7ec8-4a1c-a52e-1d5a3cbf6f0c")
+
+	ft := newFakeTree(t, true)
+	ctrlDirs := []string{}
+	for i, ep := range tgtEnv.NvmeEPs {
+		name := fmt.Sprintf("nvme%d", i)
+		ft.addCtrl(name, ep.String(), testHostNQN, "live")
+		dir := filepath.Join(ft.sysfs, "class", "nvme", name)
+		ft.write(filepath.Join(dir, "delete_controller"), "")
+		ft.write(filepath.Join(dir, fmt.Sprintf("nvme0c%dn1", i), "nguid"), testNGUID.String())
+		ctrlDirs = append(ctrlDirs, dir)
+	}
+	ft.addNS("nvme0n1", testNGUID)
+	ft.addNS("nvme0n2", otherNGUID)
+	be := ft.newBackend("")
+
+	require.Nil(t, be.Attach(context.Background(), tgtEnv, testNGUID))
+	require.Nil(t, be.Attach(context.Background(), tgtEnv, otherNGUID))
+	require.Equal(t, 2, be.conns.Refs(testSubsysNQN))
+
+	// other volume is still attached, the controllers must stay.
+	require.Nil(t, be.Detach(context.Background(), otherNGUID))
+	for _, dir := range ctrlDirs {
+		require.Empty(t, backend.ReadAttr(dir, "delete_controller"))
+	}
+
+	require.Nil(t, be.Detach(context.Background(), testNGUID))
+	require.Equal(t, 0, be.conns.Refs(testSubsysNQN))
+	for _, dir := range ctrlDirs {
+		require.Equal(t, "1", backend.ReadAttr(dir, "delete_controller"))
+	}
+}
@@ -7,7 +7,11 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-type MakerFn func(log *logrus.Entry, hostNQN string, rawCfg []byte) (Backend, error)
+// MakerFn constructs a backend instance. `conns` is the ConnTracker shared by
+// the backend with the rest of the LB CSI plugin, see ConnTracker docs.
+type MakerFn func(
+	log *logrus.Entry, hostNQN string, conns *ConnTracker, rawCfg []byte,
+) (Backend, error)
 
 type regEntry struct {
 	beType string
@@ -45,9 +49,11 @@ func RegisterBackend(beType string, maker MakerFn) {
 	beRegistry[beType] = regEntry{beType, maker}
 }
 
-func Make(beType string, log *logrus.Entry, hostNQN string, rawCfg []byte) (Backend, error) {
+func Make(
+	beType string, log *logrus.Entry, hostNQN string, conns *ConnTracker, rawCfg []byte,
+) (Backend, error) {
 	if re, ok := beRegistry[beType]; ok {
-		return NewWrapper(beType, re.maker, log, hostNQN, rawCfg)
+		return NewWrapper(beType, re.maker, log, hostNQN, conns, rawCfg)
 	}
 	return nil, fmt.Errorf("unsupported backend type: '%s'", beType)
 }
@@ -0,0 +1,178 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	guuid "github.com/google/uuid"
+)
+
+// helpers for poking at the Linux kernel NVMe host state through sysfs,
+// shared by the backends that rely on the kernel NVMe-oF host in one way or
+// another. all of them take the sysfs root as a param to allow running the
+// tests against a fake tree.
+
+var (
+	// namespace "head" block devices only, skipping the hidden per-path
+	// devices of native NVMe multipath (nvmeXcYnZ) and partitions.
+	NSDevRegex = regexp.MustCompile(`^nvme[0-9]+n[0-9]+$`)
+
+	// namespace block devices hanging off a controller, either the NS
+	// "head" ones (non-multipath) or the per-path ones (native multipath).
+	ctrlNSDevRegex = regexp.MustCompile(`^nvme[0-9]+(c[0-9]+)?n[0-9]+$`)
+)
+
+// Ctrl describes an NVMe-oF controller, as seen under `/sys/class/nvme`.
+type Ctrl struct {
+	Name      string // e.g. "nvme3".
+	Dir       string // sysfs dir of the controller.
+	Transport string
+	Traddr    string
+	Trsvcid   string
+	SubsysNQN string
+	HostNQN   string
+	State     string
+	// TLSKey is the serial of the TLS PSK the controller was connected
+	// with, empty for cleartext controllers (or kernels that know not of
+	// NVMe/TCP TLS).
+	TLSKey string
+}
+
+// IsDying returns true if the controller is on its way out and should not be
+// considered as providing a connection to the target any more.
+func (c *Ctrl) IsDying() bool {
+	return strings.HasPrefix(c.State, "deleting") || c.State == "dead"
+}
+
+// DeleteCtrl asks the kernel to disconnect and delete controller `c`. a
+// controller that is already gone is not an error.
+func DeleteCtrl(c *Ctrl) error {
+	f, err := os.OpenFile(filepath.Join(c.Dir, "delete_controller"), os.O_WRONLY, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // beaten to it...
+		}
+		return err
+	}
+	_, err = f.WriteString("1")
+	f.Close()
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete controller '%s': %s", c.Name, err)
+	}
+	return nil
+}
+
+// IsHostNQN returns true if the controller was connected on behalf of host
+// `hostNQN`. older kernels don't expose `hostnqn`, so give them the benefit of
+// the doubt.
+func (c *Ctrl) IsHostNQN(hostNQN string) bool {
+	return c.HostNQN == "" || c.HostNQN == hostNQN
+}
+
+// ReadAttr returns the trimmed contents of sysfs attr `name` under `dir`, or an
+// empty string if it can't be read.
+func ReadAttr(dir, name string) string {
+	val, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(val))
+}
+
+// ParseCtrlAddress parses the sysfs `address` attr of an NVMe-oF controller,
+// e.g.: "traddr=10.0.0.1,trsvcid=4420,src_addr=10.0.0.100".
+func ParseCtrlAddress(addr string) (traddr, trsvcid string) {
+	for _, kv := range strings.Split(addr, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "traddr":
+			traddr = v
+		case "trsvcid":
+			trsvcid = v
+		}
+	}
+	return traddr, trsvcid
+}
+
+// ListCtrls returns all the NVMe controllers currently known to the kernel.
+func ListCtrls(sysfsRoot string) ([]Ctrl, error) {
+	dirs, err := filepath.Glob(filepath.Join(sysfsRoot, "class", "nvme", "nvme*"))
+	if err != nil {
+		return nil, err
+	}
+	res := []Ctrl{}
+	for _, dir := range dirs {
+		c := Ctrl{
+			Name:      filepath.Base(dir),
+			Dir:       dir,
+			Transport: ReadAttr(dir, "transport"),
+			SubsysNQN: ReadAttr(dir, "subsysnqn"),
+			HostNQN:   ReadAttr(dir, "hostnqn"),
+			State:     ReadAttr(dir, "state"),
+			TLSKey:    ReadAttr(dir, "tls_key"),
+		}
+		c.Traddr, c.Trsvcid = ParseCtrlAddress(ReadAttr(dir, "address"))
+		res = append(res, c)
+	}
+	return res, nil
+}
+
+// CheckTransport returns an error if the node is obviously incapable of NVMe-oF
+// transport `transport`. the kernel modules are auto-loaded on first connect
+// on most distros, so the only thing worth checking for upfront is the RDMA
+// hardware (RoCE NICs show up as RDMA devices too).
+func CheckTransport(sysfsRoot, transport string) error {
+	switch transport {
+	case TransportTCP:
+		return nil
+	case TransportRDMA:
+		devs, _ := filepath.Glob(filepath.Join(sysfsRoot, "class", "infiniband", "*"))
+		if len(devs) == 0 {
+			return fmt.Errorf("no RDMA devices found on the node")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported NVMe-oF transport '%s'", transport)
+	}
+}
+
+// ReadNSID returns the NGUID of the namespace whose sysfs block device dir is
+// `dir`. LightOS sets both the NS UUID and NGUID to the volume UUID, but older
+// kernels only expose the former. returns a nil UUID if neither is available.
+func ReadNSID(dir string) guuid.UUID {
+	for _, attr := range []string{"nguid", "uuid"} {
+		id, err := guuid.Parse(ReadAttr(dir, attr))
+		if err == nil && id != guuid.Nil {
+			return id
+		}
+	}
+	return guuid.Nil
+}
+
+// ctrlNamespaces returns the NGUIDs of the namespaces currently exposed to the
+// host through controller `c`.
+func ctrlNamespaces(c *Ctrl) []guuid.UUID {
+	entries, err := os.ReadDir(c.Dir)
+	if err != nil {
+		return nil
+	}
+	res := []guuid.UUID{}
+	for _, e := range entries {
+		if !ctrlNSDevRegex.MatchString(e.Name()) {
+			continue
+		}
+		if id := ReadNSID(filepath.Join(c.Dir, e.Name())); id != guuid.Nil {
+			res = append(res, id)
+		}
+	}
+	return res
+}
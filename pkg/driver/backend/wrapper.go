@@ -28,14 +28,12 @@ type Wrapper struct {
 	// external entities that have no integral protection (e.g. SPDK managed
 	// through the basic JSON-RPC API).
 	//
-	// currently the entire LB CSI plugin Node instance is protected by a
-	// single huge and aptly named "bdl" mutex that serialises all the
-	// relevant CSI API entrypoints. as one of the side effects - this also
-	// protects the Backend instances from races.
-	//
-	// however, once the "bdl" is replaced by something more fine-grained,
-	// there will be cases where the granularity of the Node instance
-	// locking will not match that required by the various backends.
+	// the LB CSI plugin Node instance serialises the ops on any given
+	// volume, and Attach()/Detach() calls to the same NVMe-oF connection
+	// set, but there are cases where the granularity of the Node instance
+	// locking will not match that required by the various backends (e.g.
+	// Detach() of volumes unknown to the ConnTracker is only serialised
+	// per volume).
 	//
 	// a new NewWrapper() param should specify whether a given Backend being
 	// wrapped requires locking or not. backend.RegisterBackend() should
@@ -46,13 +44,13 @@ type Wrapper struct {
 
 func NewWrapper(
 	beType string, mkBE MakerFn,
-	log *logrus.Entry, hostNQN string, rawCfg []byte,
+	log *logrus.Entry, hostNQN string, conns *ConnTracker, rawCfg []byte,
 ) (Backend, error) {
 	log = log.WithFields(logrus.Fields{
 		"backend": beType,
 		"hostnqn": hostNQN,
 	})
-	be, err := mkBE(log, hostNQN, rawCfg)
+	be, err := mkBE(log, hostNQN, conns, rawCfg)
 	if err != nil {
 		return nil, err
 	}
@@ -89,9 +87,11 @@ func (w *Wrapper) wrapCall(method string, nguid guuid.UUID, f beFn, errMsg strin
 	return nil
 }
 
-func (w *Wrapper) LBVolEligible(ctx context.Context, vol *lb.Volume) *status.Status {
+func (w *Wrapper) LBVolEligible(
+	ctx context.Context, vol *lb.Volume, transport string, tlsKey bool,
+) *status.Status {
 	return w.wrapCall("LBVolEligible", vol.UUID, func() *status.Status {
-		return w.be.LBVolEligible(ctx, vol)
+		return w.be.LBVolEligible(ctx, vol, transport, tlsKey)
 	}, "volume likely not eligible to be attached")
 }
 
@@ -103,6 +103,18 @@ func (w *Wrapper) Attach(
 	}, "likely failed to attach volume to node")
 }
 
+// Reconcile implements Reconciler for backends that implement it themselves,
+// and is a NOP for the rest.
+func (w *Wrapper) Reconcile(ctx context.Context, vols map[guuid.UUID]bool) *status.Status {
+	r, ok := w.be.(Reconciler)
+	if !ok {
+		return nil
+	}
+	return w.wrapCall("Reconcile", guuid.Nil, func() *status.Status {
+		return r.Reconcile(ctx, vols)
+	}, "failed to reconcile backend state")
+}
+
 func (w *Wrapper) Detach(ctx context.Context, nguid guuid.UUID) (st *status.Status) {
 	return w.wrapCall("Detach", nguid, func() *status.Status {
 		return w.be.Detach(ctx, nguid)
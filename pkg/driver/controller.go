@@ -6,6 +6,7 @@ package driver
 import (
 	"context"
 	"fmt"
+	"maps"
 	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -15,6 +16,7 @@ import (
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
+	"github.com/lightbitslabs/los-csi/pkg/driver/backend"
 	"github.com/lightbitslabs/los-csi/pkg/lb"
 	"github.com/lightbitslabs/los-csi/pkg/util/endpoint"
 	"github.com/lightbitslabs/los-csi/pkg/util/strlist"
@@ -40,6 +42,8 @@ var (
 		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
 		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
 	}
 	capsCache []*csi.ControllerServiceCapability
 )
@@ -51,15 +55,7 @@ var (
 func init() {
 	// ah, the wonders of flat structuring and concise naming...
 	for _, cap := range controllerCaps {
-		capsCache = append(capsCache,
-			&csi.ControllerServiceCapability{
-				Type: &csi.ControllerServiceCapability_Rpc{
-					Rpc: &csi.ControllerServiceCapability_RPC{
-						Type: cap,
-					},
-				},
-			},
-		)
+		capsCache = append(capsCache, mkControllerCap(cap))
 	}
 }
 
@@ -85,21 +81,49 @@ func (d *Driver) ControllerGetCapabilities(
 	//
 	// the whole secrets/credentials story both in CSI and K8s could
 	// certainly use some fixing...
+	//
+	// the same goes for ControllerGetVolume() and, by extension, for the
+	// volume health reporting that relies on it.
+	//
+	// ListVolumes() is even worse off, as it doesn't even get the
+	// `parameters` to figure out which LightOS cluster to ask, so it also
+	// relies on the plugin-wide "default" cluster being configured.
 	caps := capsCache
 	if d.jwt != "" {
 		caps = append([]*csi.ControllerServiceCapability{
-			&csi.ControllerServiceCapability{ //nolint:gofumpt // tool version diffs
-				Type: &csi.ControllerServiceCapability_Rpc{
-					Rpc: &csi.ControllerServiceCapability_RPC{
-						Type: csi.ControllerServiceCapability_RPC_GET_CAPACITY,
-					},
-				},
-			},
+			mkControllerCap(csi.ControllerServiceCapability_RPC_GET_CAPACITY),
+			mkControllerCap(csi.ControllerServiceCapability_RPC_GET_VOLUME),
+			mkControllerCap(csi.ControllerServiceCapability_RPC_VOLUME_CONDITION),
 		}, caps...)
+		if d.haveDefaultCluster() {
+			caps = append([]*csi.ControllerServiceCapability{
+				mkControllerCap(csi.ControllerServiceCapability_RPC_LIST_VOLUMES),
+			}, caps...)
+		}
 	}
 	return &csi.ControllerGetCapabilitiesResponse{Capabilities: caps}, nil
 }
 
+func mkControllerCap(
+	cap csi.ControllerServiceCapability_RPC_Type,
+) *csi.ControllerServiceCapability {
+	return &csi.ControllerServiceCapability{
+		Type: &csi.ControllerServiceCapability_Rpc{
+			Rpc: &csi.ControllerServiceCapability_RPC{
+				Type: cap,
+			},
+		},
+	}
+}
+
+// haveDefaultCluster() returns true if the plugin was configured with the
+// plugin-wide "default" LightOS cluster to use for CSI entrypoints that
+// carry no other hints as to which cluster to talk to, q.v.
+// Config.MgmtEndpoint.
+func (d *Driver) haveDefaultCluster() bool {
+	return len(d.mgmtEPs) > 0
+}
+
 func getReqCapacity(capRange *csi.CapacityRange) (uint64, error) {
 	// potentially those two might be cluster-specific in the future, so we'd
 	// need to grab them using the LightOS mgmt API first:
@@ -139,7 +163,8 @@ func getReqCapacity(capRange *csi.CapacityRange) (uint64, error) {
 }
 
 func mkVolumeResponse(
-	mgmtEPs endpoint.Slice, vol *lb.Volume, hostEncryption string, mgmtScheme string, volSrc *csi.VolumeContentSource,
+	mgmtEPs endpoint.Slice, vol *lb.Volume, hostEncryption string, mgmtScheme string, nvmeTLS string,
+	transport string, volSrc *csi.VolumeContentSource,
 ) *csi.CreateVolumeResponse {
 	volID := lbResourceID{
 		mgmtEPs:    mgmtEPs,
@@ -147,6 +172,8 @@ func mkVolumeResponse(
 		projName:   vol.ProjectName,
 		scheme:     mgmtScheme,
 		hostCrypto: hostEncryption,
+		nvmeTLS:    nvmeTLS,
+		transport:  transport,
 	}
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
@@ -193,6 +220,28 @@ func chkContentSourceCompat(
 	return nil
 }
 
+// inheritLUKSLabels() copies the reserved LUKS labels of the content source
+// with labels `srcLabels` (the wrapped data key and the format settings, if
+// any) onto the volume `req` that's about to be created from it. the clone
+// inherits the LUKS header of its source, and without the wrapped data key it
+// would be staged with the static passphrase, which doesn't unlock the header.
+// LightOS might well copy the labels over on its own, but that's nothing the
+// clone being usable should hinge on.
+func inheritLUKSLabels(req *lb.Volume, srcLabels map[string]string) {
+	labels := maps.Clone(req.Labels) // might be shared with the caller.
+	for _, key := range []string{lbLabelLUKSKey, lbLabelLUKSFormat} {
+		val, ok := srcLabels[key]
+		if !ok {
+			continue
+		}
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[key] = val
+	}
+	req.Labels = labels
+}
+
 // chkSourceSnapCompat() checks whether the source snapshot specified by UUID
 // in the `req` volume description:
 // * exists on the LightOS cluster,
@@ -201,8 +250,9 @@ func chkContentSourceCompat(
 //   except for the capacity, which is taken directly from the CSI request
 //   `reqCapacity` param piped through to here.
 // if so - it UPDATES the `req` volume capacity in-situ to match that of the
-// source snapshot and returns nil, otherwise returns a gRPC Status error
-// suitable for direct return to the callers of CreateVolume().
+// source snapshot, as well as the LUKS labels (see inheritLUKSLabels()), and
+// returns nil, otherwise returns a gRPC Status error suitable for direct return
+// to the callers of CreateVolume().
 func chkSourceSnapCompat(
 	ctx context.Context, log *logrus.Entry, clnt lb.Client, req *lb.Volume,
 	reqCapacity csi.CapacityRange, srcSid lbResourceID,
@@ -235,6 +285,7 @@ func chkSourceSnapCompat(
 		return err
 	}
 	req.Capacity = snap.Capacity
+	inheritLUKSLabels(req, snap.Labels)
 	return nil
 }
 
@@ -243,9 +294,10 @@ func chkSourceSnapCompat(
 // specified by `req` - except for the explicit `reqCapacity`. for more details
 // see chkSourceSnapCompat().
 //
-// if the two are compatible, it UPDATES the `req` volume capacity in-situ to
-// match that of the source volume and returns nil, otherwise returns a gRPC
-// Status error suitable for direct return to the callers of CreateVolume().
+// if the two are compatible, it UPDATES the `req` volume capacity and LUKS
+// labels in-situ to match those of the source volume and returns nil, otherwise
+// returns a gRPC Status error suitable for direct return to the callers of
+// CreateVolume().
 func chkSourceVolCompat(
 	ctx context.Context, log *logrus.Entry, clnt lb.Client, req *lb.Volume,
 	reqCapacity csi.CapacityRange, srcVid lbResourceID,
@@ -268,6 +320,8 @@ func chkSourceVolCompat(
 			"is in the process of being deleted", vol.UUID)
 	case lb.VolumeUpdating:
 		return mkEagain("content source volume %s is being updated", vol.UUID)
+	case lb.VolumeRollback:
+		return mkEagain("content source volume %s is being rolled back", vol.UUID)
 	default:
 		return mkInternal("found snapshot '%s' (%s) in unexpected state '%s' (%d)",
 			vol.Name, vol.UUID, vol.State, vol.State)
@@ -279,6 +333,7 @@ func chkSourceVolCompat(
 		return err
 	}
 	req.Capacity = vol.Capacity
+	inheritLUKSLabels(req, vol.Labels)
 	return nil
 }
 
@@ -310,7 +365,8 @@ func findExistingVolume(
 	case lb.VolumeAvailable,
 		lb.VolumeUpdating,
 		lb.VolumeCreating,
-		lb.VolumeMigrating:
+		lb.VolumeMigrating,
+		lb.VolumeRollback:
 		// might be usable, now or later - if it otherwise matches.
 		// see a second check down below.
 	case lb.VolumeDeleting:
@@ -515,7 +571,7 @@ func (d *Driver) doCreateVolume( //revive:disable-line:unused-receiver
 
 	vol, err := clnt.CreateVolume(ctx, req.Name, req.Capacity, req.ReplicaCount,
 		req.Compression, req.ACL, req.ProjectName, req.SnapshotUUID, req.QosPolicyName,
-		true)
+		req.FailureDomains, req.Labels, true)
 	if err != nil {
 		return nil, mungeLBErr(log, err, "failed to create volume '%s'", req.Name)
 	}
@@ -524,6 +580,24 @@ func (d *Driver) doCreateVolume( //revive:disable-line:unused-receiver
 	return vol, nil
 }
 
+// resolveTransport() returns the NVMe-oF transport to record in the ID of a
+// volume of a StorageClass with `transport` param `xport` (empty if
+// unspecified): the transport is only left out of the ID if it's "tcp" and so
+// is the plugin default, otherwise the nodes would have no way of telling.
+func (d *Driver) resolveTransport(xport string, nvmeTLS string) (string, error) {
+	if xport == "" {
+		xport = d.defaultTransport
+	}
+	if xport == backend.TransportRDMA && nvmeTLS != "" {
+		return "", mkEbadOp("mismatch", volNvmeTLSKey,
+			"NVMe/TCP TLS is only supported with the 'tcp' transport")
+	}
+	if xport == backend.TransportTCP && d.defaultTransport == backend.TransportTCP {
+		return "", nil
+	}
+	return xport, nil
+}
+
 // CreateVolume uses info extracted from request `parameters` field to connect
 // to LB and attempt to create the volume specified by `name` field (or return
 // info on an existing volume if one matches, for idempotency). see
@@ -545,10 +619,6 @@ func (d *Driver) CreateVolume(
 	if req.Name == "" {
 		return nil, mkEinvalMissing("name")
 	}
-	if req.AccessibilityRequirements != nil {
-		return nil, mkEinval("accessibility_requirements",
-			"accessibility constraints are not supported")
-	}
 	// `capacity` will be used for creating new free-standing volumes:
 	capacity, err := getReqCapacity(req.CapacityRange)
 	if err != nil {
@@ -566,6 +636,19 @@ func (d *Driver) CreateVolume(
 	if err != nil {
 		return nil, err
 	}
+	// the CO may pass in the initial values of the mutable volume params
+	// separately (e.g. K8s VolumeAttributesClass), these take precedence:
+	mutParams, err := parseCSIModifyVolumeParams(req.MutableParameters)
+	if err != nil {
+		return nil, err
+	}
+	if err = mutParams.applyTo(&params); err != nil {
+		return nil, err
+	}
+	params.transport, err = d.resolveTransport(params.transport, params.nvmeTLS)
+	if err != nil {
+		return nil, err
+	}
 
 	hostEncryption := defaultLuksNone
 	if params.hostCrypto != "" {
@@ -625,6 +708,36 @@ func (d *Driver) CreateVolume(
 	}
 	// from here on: if volSrc != nil - it's definitely a clone request.
 
+	if _, ok := params.labels[lbLabelLUKSFormat]; ok && volSrc != nil {
+		// clones inherit the LUKS header (if any) and the labels of their
+		// source, whatever the SC says:
+		log.WithField("luks-format", params.labels[lbLabelLUKSFormat]).Warn(
+			"ignoring host-encryption settings of the clone, using the source ones")
+		delete(params.labels, lbLabelLUKSFormat)
+		if len(params.labels) == 0 {
+			params.labels = nil
+		}
+	}
+
+	// record the volume ID attributes LightOS knows nothing about for the
+	// benefit of ListVolumes(), that has only the volume itself to go by:
+	idLabel, ok := lbResourceID{
+		mgmtEPs:    params.mgmtEPs,
+		projName:   params.projectName,
+		scheme:     params.mgmtScheme,
+		hostCrypto: params.hostCrypto,
+		nvmeTLS:    params.nvmeTLS,
+		transport:  params.transport,
+	}.volIDLabel()
+	if !ok || len(params.labels) >= labelLimit(params.hostCrypto, params.labels) {
+		log.Warn("no room for volume ID label, volume won't be reported by ListVolumes")
+	} else {
+		if params.labels == nil {
+			params.labels = map[string]string{}
+		}
+		params.labels[lbLabelVolID] = idLabel
+	}
+
 	wantVol := lb.Volume{
 		Name:          req.Name,
 		Capacity:      capacity, // NOTE: might be updated to that of the content source!
@@ -633,6 +746,7 @@ func (d *Driver) CreateVolume(
 		ACL:           []string{lb.ACLAllowNone},
 		ProjectName:   params.projectName,
 		QosPolicyName: params.qosPolicyName,
+		Labels:        params.labels,
 	}
 
 	ctx = d.cloneCtxWithCreds(ctx, req.Secrets)
@@ -642,6 +756,29 @@ func (d *Driver) CreateVolume(
 	}
 	defer d.PutLBClient(clnt)
 
+	var clusterInfo *lb.ClusterInfo
+	if req.AccessibilityRequirements != nil {
+		clusterInfo, err = clnt.GetClusterInfo(ctx)
+		if err != nil {
+			return nil, mungeLBErr(log, err, "failed to get LightOS cluster info")
+		}
+	}
+
+	var accessible []*csi.Topology
+	wantVol.FailureDomains = params.failureDomains
+	if req.AccessibilityRequirements != nil {
+		// the CO expresses topologies in terms of cluster UUIDs, while
+		// the SC only knows the mgmt endpoints, hence the cluster info...
+		wantVol.FailureDomains, accessible, err = topologyPlacement(
+			req.AccessibilityRequirements, clusterInfo.UUID, &params)
+		if err != nil {
+			return nil, err
+		}
+		if len(wantVol.FailureDomains) > 0 {
+			log = log.WithField("failure-domains", wantVol.FailureDomains)
+		}
+	}
+
 	// check if a matching volume already exists (likely a result of retry from CO):
 	vol, err := findExistingVolume(ctx, log, clnt, wantVol, reqCapacity, srcVid, srcSid)
 	if err != nil {
@@ -654,13 +791,141 @@ func (d *Driver) CreateVolume(
 			return nil, err
 		}
 	}
-	return mkVolumeResponse(params.mgmtEPs, vol, params.hostCrypto, params.mgmtScheme, volSrc), nil
+	resp := mkVolumeResponse(params.mgmtEPs, vol, params.hostCrypto, params.mgmtScheme,
+		params.nvmeTLS, params.transport, volSrc)
+	resp.Volume.AccessibleTopology = accessible
+	return resp, nil
 }
 
-func (d *Driver) ControllerGetVolume( //revive:disable-line:unused-receiver
-	_ context.Context, _ *csi.ControllerGetVolumeRequest,
+// mkVolumeCondition() translates the LightOS volume state and protection
+// state into a CSI VolumeCondition suitable for human consumption (e.g. as
+// K8s events emitted by the external-health-monitor).
+func mkVolumeCondition(vol *lb.Volume) *csi.VolumeCondition {
+	var issues []string
+	abnormal := false
+	note := func(format string, args ...interface{}) {
+		issues = append(issues, fmt.Sprintf(format, args...))
+	}
+	problem := func(format string, args ...interface{}) {
+		abnormal = true
+		note(format, args...)
+	}
+
+	switch vol.State { //nolint:exhaustive
+	case lb.VolumeAvailable, lb.VolumeUpdating:
+		// business as usual...
+	case lb.VolumeCreating:
+		// not a problem as such, but protection state is meaningless:
+		return &csi.VolumeCondition{
+			Abnormal: false,
+			Message:  "volume is still being created",
+		}
+	case lb.VolumeMigrating:
+		// LightOS is moving replicas around (e.g. rebalancing or
+		// evacuating a storage node), the volume remains accessible
+		// throughout, if somewhat slower.
+		note("volume is being migrated between storage nodes")
+	case lb.VolumeRollback:
+		// data is being replaced wholesale, it's not going to end well
+		// for anyone using the volume meanwhile:
+		problem("volume is being rolled back to a snapshot")
+	case lb.VolumeDeleting:
+		problem("volume is being deleted")
+	case lb.VolumeFailed:
+		problem("volume is in failed state and is unusable")
+	default:
+		problem("volume is in unexpected state '%s' (%d)", vol.State, vol.State)
+	}
+
+	switch vol.Protection { //nolint:exhaustive
+	case lb.VolumeProtected:
+	case lb.VolumeDegraded:
+		problem("volume is degraded: some of its %d replicas are unavailable, "+
+			"data redundancy is reduced", vol.ReplicaCount)
+	case lb.VolumeReadOnly:
+		problem("volume is read-only: too few replicas are available to " +
+			"safely accept writes")
+	case lb.VolumeNotAvailable:
+		problem("volume is not available: none of its replicas are accessible")
+	default:
+		problem("volume is in unexpected protection state '%s' (%d)",
+			vol.Protection, vol.Protection)
+	}
+
+	msg := "volume is available and fully protected"
+	if len(issues) > 0 {
+		msg = strings.Join(issues, "; ")
+	}
+	return &csi.VolumeCondition{
+		Abnormal: abnormal,
+		Message:  msg,
+	}
+}
+
+// publishedNodeIDs() returns the IDs of the nodes the volume is published to,
+// as reconstructed from its ACL.
+func publishedNodeIDs(vol *lb.Volume) []string {
+	nodeIDs := []string{}
+	for _, ace := range vol.ACL {
+		// ALLOW_NONE, ALLOW_ANY, or, perhaps, a manually added entry
+		// that's none of our business:
+		if nodeID := hostNQNToNodeID(ace); nodeID != "" {
+			nodeIDs = append(nodeIDs, nodeID)
+		}
+	}
+	return nodeIDs
+}
+
+func (d *Driver) ControllerGetVolume(
+	ctx context.Context, req *csi.ControllerGetVolumeRequest,
 ) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	vid, err := parseCSIResourceIDEnoent(volIDField, req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+
+	log := d.log.WithFields(logrus.Fields{
+		"op":       "ControllerGetVolume",
+		"mgmt-ep":  vid.mgmtEPs,
+		"vol-uuid": vid.uuid,
+		"project":  vid.projName,
+	})
+
+	// no `secrets` param here, so global JWT or bust, q.v.
+	// ControllerGetCapabilities().
+	ctx = d.cloneCtxWithCreds(ctx, map[string]string{})
+	clnt, err := d.GetLBClient(ctx, vid.mgmtEPs, vid.scheme)
+	if err != nil {
+		return nil, err
+	}
+	defer d.PutLBClient(clnt)
+
+	vol, err := clnt.GetVolume(ctx, vid.uuid, vid.projName)
+	if err != nil {
+		if isStatusNotFound(err) {
+			return nil, mkEnoent("volume '%s' doesn't exist", vid)
+		}
+		return nil, mungeLBErr(log, err, "failed to get volume '%s' from LB", vid)
+	}
+
+	cond := mkVolumeCondition(vol)
+	if cond.Abnormal {
+		log.WithFields(logrus.Fields{
+			"state":      vol.State,
+			"protection": vol.Protection,
+		}).Warnf("volume condition: %s", cond.Message)
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			CapacityBytes: int64(vol.Capacity),
+			VolumeId:      req.VolumeId,
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: publishedNodeIDs(vol),
+			VolumeCondition:  cond,
+		},
+	}, nil
 }
 
 func (d *Driver) DeleteVolume(
@@ -731,6 +996,8 @@ func (d *Driver) DeleteVolume(
 		return nil, mkEagain("volume %s is still being created", vol.UUID)
 	case lb.VolumeUpdating:
 		return nil, mkEagain("volume %s is being updated", vol.UUID)
+	case lb.VolumeRollback:
+		return nil, mkEagain("volume %s is being rolled back", vol.UUID)
 	default:
 		return nil, mkInternal("found volume '%s' (%s) in unexpected state '%s' (%d)",
 			vol.Name, vol.UUID, vol.State, vol.State)
@@ -805,6 +1072,10 @@ func (d *Driver) ControllerPublishVolume(
 	}
 	defer d.PutLBClient(clnt)
 
+	if err := ensureTrustedHost(ctx, log, clnt, vid, req.NodeId); err != nil {
+		return nil, err
+	}
+
 	if d.rwx {
 		return d.doPublishVolumeRWX(ctx, clnt, log, vid, req.NodeId)
 	} else {
@@ -1195,12 +1466,140 @@ func (d *Driver) ValidateVolumeCapabilities(
 	}, nil
 }
 
-func (d *Driver) ListVolumes( //revive:disable-line:unused-receiver
-	_ context.Context, _ *csi.ListVolumesRequest,
+// parseListToken() parses the opaque `starting_token` of the CSI List*()
+// entrypoints. the tokens this plugin hands out are simply the UUIDs of the
+// last LightOS resource returned in the previous page, as LightOS List*()
+// APIs paginate by resource UUID offset. empty token means "from the start".
+func parseListToken(token string) (guuid.UUID, error) {
+	if token == "" {
+		return guuid.Nil, nil
+	}
+	offset, err := guuid.Parse(token)
+	if err != nil || offset == guuid.Nil {
+		return guuid.Nil, mkAbort("bad value of 'starting_token': '%s'", token)
+	}
+	return offset, nil
+}
+
+// getListLimit() returns the number of entries to request from LightOS given
+// the CSI `max_entries` value: 0 means "as many as you like", but LightOS
+// caps the size of a single page anyway.
+func getListLimit(maxEntries int32) (uint32, error) {
+	if maxEntries < 0 {
+		return 0, mkEinvalf("max_entries", "%d", maxEntries)
+	}
+	if maxEntries == 0 || maxEntries > lb.MaxListLimit {
+		return lb.MaxListLimit, nil
+	}
+	return uint32(maxEntries), nil
+}
+
+func (d *Driver) ListVolumes(
+	ctx context.Context, req *csi.ListVolumesRequest,
 ) (*csi.ListVolumesResponse, error) {
-	// TODO: er... impl?
+	// q.v. ControllerGetCapabilities() for the gory details.
+	if !d.haveDefaultCluster() {
+		return nil, status.Error(codes.Unimplemented,
+			"no default LightOS cluster configured, listing volumes is not supported")
+	}
+	limit, err := getListLimit(req.MaxEntries)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := parseListToken(req.StartingToken)
+	if err != nil {
+		return nil, err
+	}
+
+	log := d.log.WithFields(logrus.Fields{
+		"op":      "ListVolumes",
+		"mgmt-ep": d.mgmtEPs,
+		"project": d.projName,
+		"offset":  req.StartingToken,
+		"limit":   limit,
+	})
+
+	// no `secrets` param here either, q.v. GetCapacity().
+	ctx = d.cloneCtxWithCreds(ctx, map[string]string{})
+	clnt, err := d.GetLBClient(ctx, d.mgmtEPs, d.mgmtScheme)
+	if err != nil {
+		return nil, err
+	}
+	defer d.PutLBClient(clnt)
+
+	vols, err := clnt.ListVolumes(ctx, d.projName, offset, limit)
+	if err != nil {
+		if offset != guuid.Nil && (isStatusNotFound(err) ||
+			status.Code(err) == codes.InvalidArgument) {
+			// most likely the volume the token refers to is gone...
+			return nil, mkAbort("'starting_token' '%s' is no longer valid: %s",
+				req.StartingToken, status.Convert(err).Message())
+		}
+		return nil, mungeLBErr(log, err, "failed to list volumes on LB")
+	}
 
-	return nil, status.Error(codes.Unimplemented, "")
+	entries := make([]*csi.ListVolumesResponse_Entry, 0, len(vols))
+	for _, vol := range vols {
+		if vol.State == lb.VolumeFailed {
+			// as far as CSI is concerned, these are as good as gone,
+			// q.v. DeleteVolume().
+			continue
+		}
+		// LightOS has no idea whether the volume was created with
+		// host-side encryption, NVMe/TCP TLS, etc., so the ID can only be
+		// rebuilt exactly from the label recorded by CreateVolume().
+		// volumes without one (e.g. created by older plugin versions)
+		// still get listed, just with a best-effort ID.
+		vlog := log.WithField("vol-uuid", vol.UUID)
+		var vid lbResourceID
+		if label, ok := vol.Labels[lbLabelVolID]; !ok {
+			vid = d.guessVolID(vol)
+			vlog.Infof("volume has no ID label, listing it as '%s'", vid)
+		} else if vid, err = parseVolIDLabel(label, vol.UUID, vol.ProjectName); err != nil {
+			vid = d.guessVolID(vol)
+			vlog.Warnf("%s, listing volume as '%s'", err, vid)
+		}
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				CapacityBytes: int64(vol.Capacity),
+				VolumeId:      vid.String(),
+			},
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				VolumeCondition: mkVolumeCondition(vol),
+			},
+		})
+	}
+
+	// a short page is a sure sign of there being nothing more to fetch,
+	// a full one - might or might not be...
+	nextToken := ""
+	if len(vols) == int(limit) {
+		nextToken = vols[len(vols)-1].UUID.String()
+	}
+	return &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+// guessVolID() makes up a best-effort ID for volume `vol` that lacks a
+// usable lbLabelVolID label, assuming it lives on the default cluster and
+// uses the plugin default transport. host-side encryption can be inferred
+// from the LUKS labels, NVMe/TCP TLS can't, so such volumes will be
+// reported without it.
+func (d *Driver) guessVolID(vol *lb.Volume) lbResourceID {
+	vid := lbResourceID{
+		mgmtEPs:  d.mgmtEPs,
+		uuid:     vol.UUID,
+		projName: vol.ProjectName,
+		scheme:   d.mgmtScheme,
+	}
+	for _, key := range []string{lbLabelLUKSKey, lbLabelLUKSFormat} {
+		if _, ok := vol.Labels[key]; ok {
+			vid.hostCrypto = defaultLuksFormat
+		}
+	}
+	return vid
 }
 
 func (d *Driver) GetCapacity(
@@ -1341,6 +1740,78 @@ func (d *Driver) ControllerExpandVolume(
 	}, nil
 }
 
+// ControllerModifyVolume applies the `mutable_parameters` (q.v.
+// lbModifyVolumeParams) to an existing volume in place, e.g. to move it to
+// a different QoS policy without having to re-provision it.
+func (d *Driver) ControllerModifyVolume(
+	ctx context.Context, req *csi.ControllerModifyVolumeRequest,
+) (*csi.ControllerModifyVolumeResponse, error) {
+	vid, err := parseCSIResourceIDEinval(volIDField, req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.MutableParameters) == 0 {
+		return nil, mkEinvalMissing(mutParRoot)
+	}
+	params, err := parseCSIModifyVolumeParams(req.MutableParameters)
+	if err != nil {
+		return nil, err
+	}
+	if vid.hostCrypto != "" && params.compression != nil && *params.compression {
+		return nil, mkEbadOp("mismatch", mutParKey(volParCompressKey),
+			"host-encryption and compression are both enabled")
+	}
+
+	log := d.log.WithFields(logrus.Fields{
+		"op":       "ControllerModifyVolume",
+		"mgmt-ep":  vid.mgmtEPs,
+		"vol-uuid": vid.uuid,
+		"project":  vid.projName,
+	})
+
+	ctx = d.cloneCtxWithCreds(ctx, req.Secrets)
+	clnt, err := d.GetLBClient(ctx, vid.mgmtEPs, vid.scheme)
+	if err != nil {
+		return nil, err
+	}
+	defer d.PutLBClient(clnt)
+
+	modifyVolumeHook := func(vol *lb.Volume) (*lb.VolumeUpdate, error) {
+		update := &lb.VolumeUpdate{}
+		required := false
+		if params.qosPolicyName != "" && params.qosPolicyName != vol.QosPolicyName {
+			update.QosPolicyName = params.qosPolicyName
+			required = true
+		}
+		if params.compression != nil && *params.compression != vol.Compression {
+			update.Compression = params.compression
+			required = true
+		}
+		if params.labels != nil {
+			labels, err := withLabels(mutParKey(volParLabelsKey), vol.Labels,
+				params.labels, vid.hostCrypto)
+			if err != nil {
+				return nil, err
+			}
+			if !maps.Equal(labels, vol.Labels) {
+				update.Labels = labels
+				required = true
+			}
+		}
+		if !required {
+			log.Info("volume has the requested params")
+			return nil, nil
+		}
+		return update, nil
+	}
+
+	_, err = clnt.UpdateVolume(ctx, vid.uuid, vid.projName, modifyVolumeHook)
+	if err != nil {
+		return nil, err
+	}
+	return &csi.ControllerModifyVolumeResponse{}, nil
+}
+
 func doCreateSnapshot(
 	ctx context.Context, log *logrus.Entry, clnt lb.Client, name string, srcVid lbResourceID,
 	descr string,
@@ -1416,6 +1887,19 @@ func doCreateSnapshot(
 	return snap, nil
 }
 
+// mkSnapshotDescr() returns the description to attach to the LightOS snapshot
+// being created. LightOS snapshots can't be explicitly labelled (they inherit
+// the labels of the source volume instead), so to allow tracing them back to
+// the K8s VolumeSnapshot, stash its name in the description, if the CO passed
+// it in as K8s-specific extra-create-metadata.
+func mkSnapshotDescr(params map[string]string) string {
+	descr := "by: LB CSI"
+	if name := params[k8sVSNameKey]; name != "" {
+		descr += fmt.Sprintf(", for: VolumeSnapshot %s/%s", params[k8sVSNamespaceKey], name)
+	}
+	return descr
+}
+
 func (d *Driver) CreateSnapshot(
 	ctx context.Context, req *csi.CreateSnapshotRequest,
 ) (*csi.CreateSnapshotResponse, error) {
@@ -1438,8 +1922,9 @@ func (d *Driver) CreateSnapshot(
 		"host-encryption": hostEncryption,
 	})
 
-	// TODO: initially the LB CSI plugin supports no custom `req.parameters`
-	// entries. if it becomes necessary, their parsing should be added HERE.
+	// TODO: the LB CSI plugin supports no custom `req.parameters` entries
+	// yet, only the K8s-specific metadata ones, q.v. mkSnapshotDescr(). if
+	// it becomes necessary, their parsing should be added HERE.
 
 	ctx = d.cloneCtxWithCreds(ctx, req.Secrets)
 	clnt, err := d.GetLBClient(ctx, srcVid.mgmtEPs, srcVid.scheme)
@@ -1448,7 +1933,8 @@ func (d *Driver) CreateSnapshot(
 	}
 	defer d.PutLBClient(clnt)
 
-	snap, err := doCreateSnapshot(ctx, log, clnt, req.Name, srcVid, "by: LB CSI")
+	snap, err := doCreateSnapshot(ctx, log, clnt, req.Name, srcVid,
+		mkSnapshotDescr(req.Parameters))
 	if err != nil {
 		return nil, err
 	}
@@ -1547,8 +2033,194 @@ func (d *Driver) DeleteSnapshot(
 	return &csi.DeleteSnapshotResponse{}, nil
 }
 
-func (d *Driver) ListSnapshots( //revive:disable-line:unused-receiver
-	_ context.Context, _ *csi.ListSnapshotsRequest,
+func mkListSnapshotsEntry(
+	snap *lb.Snapshot, mgmtEPs endpoint.Slice, scheme, hostCrypto string,
+) *csi.ListSnapshotsResponse_Entry {
+	snapID := lbResourceID{
+		mgmtEPs:    mgmtEPs,
+		uuid:       snap.UUID,
+		projName:   snap.ProjectName,
+		scheme:     scheme,
+		hostCrypto: hostCrypto,
+	}
+	srcVid := lbResourceID{
+		mgmtEPs:    mgmtEPs,
+		uuid:       snap.SrcVolUUID,
+		projName:   snap.ProjectName,
+		scheme:     scheme,
+		hostCrypto: hostCrypto,
+	}
+	return &csi.ListSnapshotsResponse_Entry{
+		Snapshot: &csi.Snapshot{
+			SnapshotId:     snapID.String(),
+			SourceVolumeId: srcVid.String(),
+			SizeBytes:      int64(snap.Capacity),
+			CreationTime:   timestamppb.New(snap.CreationTime),
+			ReadyToUse:     snap.State == lb.SnapshotAvailable,
+		},
+	}
+}
+
+// isSnapshotListable() filters out the snapshots that, as far as CSI is
+// concerned, are either already gone or will never become usable.
+func isSnapshotListable(snap *lb.Snapshot) bool {
+	return snap.State == lb.SnapshotAvailable || snap.State == lb.SnapshotCreating
+}
+
+func (d *Driver) ListSnapshots(
+	ctx context.Context, req *csi.ListSnapshotsRequest,
+) (*csi.ListSnapshotsResponse, error) {
+	limit, err := getListLimit(req.MaxEntries)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := parseListToken(req.StartingToken)
+	if err != nil {
+		return nil, err
+	}
+
+	// per CSI spec, filtering on IDs that are malformed or refer to
+	// snapshots/volumes that don't exist is not an error, it just yields
+	// an empty list.
+	var sid, srcVid *lbResourceID
+	if req.SnapshotId != "" {
+		id, err := parseCSIResourceID(req.SnapshotId)
+		if err != nil {
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		sid = &id
+	}
+	if req.SourceVolumeId != "" {
+		id, err := parseCSIResourceID(req.SourceVolumeId)
+		if err != nil {
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		srcVid = &id
+	}
+
+	ctx = d.cloneCtxWithCreds(ctx, req.Secrets)
+	switch {
+	case sid != nil:
+		return d.listSnapshotByID(ctx, *sid, srcVid)
+	case srcVid != nil:
+		return d.listSnapshots(ctx, srcVid.mgmtEPs, srcVid.scheme, srcVid.projName,
+			srcVid, offset, limit)
+	case d.haveDefaultCluster():
+		return d.listSnapshots(ctx, d.mgmtEPs, d.mgmtScheme, d.projName,
+			nil, offset, limit)
+	default:
+		// unlike ListVolumes(), this one is advertised unconditionally,
+		// as the filtered flavours are mostly what COs actually use.
+		return nil, mkPrecond("listing snapshots without specifying either " +
+			"'snapshot_id' or 'source_volume_id' requires a default LightOS " +
+			"cluster to be configured")
+	}
+}
+
+// listSnapshotByID() handles the ListSnapshots() flavour filtered by
+// `snapshot_id`, and, optionally, also by `source_volume_id`.
+func (d *Driver) listSnapshotByID(
+	ctx context.Context, sid lbResourceID, srcVid *lbResourceID,
 ) (*csi.ListSnapshotsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	log := d.log.WithFields(logrus.Fields{
+		"op":        "ListSnapshots",
+		"mgmt-ep":   sid.mgmtEPs,
+		"snap-uuid": sid.uuid,
+		"project":   sid.projName,
+	})
+
+	if srcVid != nil && !srcVid.mgmtEPs.Equal(sid.mgmtEPs) {
+		// can't possibly match...
+		return &csi.ListSnapshotsResponse{}, nil
+	}
+
+	clnt, err := d.GetLBClient(ctx, sid.mgmtEPs, sid.scheme)
+	if err != nil {
+		return nil, err
+	}
+	defer d.PutLBClient(clnt)
+
+	snap, err := clnt.GetSnapshot(ctx, sid.uuid, sid.projName)
+	if err != nil {
+		if isStatusNotFound(err) {
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		return nil, mungeLBErr(log, err, "failed to get snapshot %s from LB", sid.uuid)
+	}
+	if !isSnapshotListable(snap) || (srcVid != nil && snap.SrcVolUUID != srcVid.uuid) {
+		return &csi.ListSnapshotsResponse{}, nil
+	}
+
+	return &csi.ListSnapshotsResponse{
+		Entries: []*csi.ListSnapshotsResponse_Entry{
+			mkListSnapshotsEntry(snap, sid.mgmtEPs, sid.scheme, sid.hostCrypto),
+		},
+	}, nil
+}
+
+// listSnapshots() pages through the snapshots of project `projName` on the
+// LightOS cluster at `mgmtEPs`, optionally filtered by source volume `srcVid`.
+// LightOS can't filter snapshots by source volume on its own, so in that case
+// this might take several round-trips to the cluster to fill up a page.
+func (d *Driver) listSnapshots(
+	ctx context.Context, mgmtEPs endpoint.Slice, scheme, projName string,
+	srcVid *lbResourceID, offset guuid.UUID, limit uint32,
+) (*csi.ListSnapshotsResponse, error) {
+	log := d.log.WithFields(logrus.Fields{
+		"op":      "ListSnapshots",
+		"mgmt-ep": mgmtEPs,
+		"project": projName,
+		"offset":  offset,
+		"limit":   limit,
+	})
+	hostCrypto := ""
+	if srcVid != nil {
+		log = log.WithField("src-vol-uuid", srcVid.uuid)
+		hostCrypto = srcVid.hostCrypto
+	}
+
+	clnt, err := d.GetLBClient(ctx, mgmtEPs, scheme)
+	if err != nil {
+		return nil, err
+	}
+	defer d.PutLBClient(clnt)
+
+	entries := []*csi.ListSnapshotsResponse_Entry{}
+	nextToken := ""
+	cursor := offset
+	for nextToken == "" {
+		snaps, err := clnt.ListSnapshots(ctx, projName, cursor, limit)
+		if err != nil {
+			if cursor == offset && offset != guuid.Nil &&
+				(isStatusNotFound(err) || status.Code(err) == codes.InvalidArgument) {
+				// most likely the snapshot the token refers to is gone...
+				return nil, mkAbort("'starting_token' '%s' is no longer valid: %s",
+					offset, status.Convert(err).Message())
+			}
+			return nil, mungeLBErr(log, err, "failed to list snapshots on LB")
+		}
+
+		for _, snap := range snaps {
+			cursor = snap.UUID
+			if !isSnapshotListable(snap) ||
+				(srcVid != nil && snap.SrcVolUUID != srcVid.uuid) {
+				continue
+			}
+			entries = append(entries,
+				mkListSnapshotsEntry(snap, mgmtEPs, scheme, hostCrypto))
+			if len(entries) == int(limit) {
+				nextToken = snap.UUID.String()
+				break
+			}
+		}
+		// a short page means there's nothing more to fetch:
+		if len(snaps) < int(limit) {
+			break
+		}
+	}
+
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
 }
@@ -6,7 +6,9 @@ package driver
 import (
 	"context"
 	"fmt"
+	"maps"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -14,6 +16,7 @@ import (
 	guuid "github.com/google/uuid"
 	"github.com/lightbitslabs/los-csi/pkg/lb"
 	"github.com/lightbitslabs/los-csi/pkg/util/endpoint"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc/codes"
@@ -40,9 +43,9 @@ func (m *ClientPoolMock) PutClient(c lb.Client) {
 }
 
 func (m *ClientPoolMock) GetClient(
-	ctx context.Context, targets endpoint.Slice, mgmtScheme string,
+	ctx context.Context, targets endpoint.Slice, mgmtScheme string, tlsCfg *lb.TLSConfig,
 ) (lb.Client, error) {
-	args := m.Called(ctx, targets, mgmtScheme)
+	args := m.Called(ctx, targets, mgmtScheme, tlsCfg)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
 	}
@@ -90,11 +93,12 @@ func (m *ClientMock) ListNodes(ctx context.Context) ([]*lb.Node, error) {
 
 func (m *ClientMock) CreateVolume(ctx context.Context, name string, capacity uint64,
 	replicaCount uint32, compress bool, acl []string, projectName string,
-	snapshotID guuid.UUID, qosPolicyName string, blocking bool,
+	snapshotID guuid.UUID, qosPolicyName string, failureDomains []string,
+	labels map[string]string, blocking bool,
 ) (*lb.Volume, error) {
 	args := m.Called(ctx, name, capacity,
 		replicaCount, compress, acl, projectName,
-		snapshotID, qosPolicyName, blocking)
+		snapshotID, qosPolicyName, failureDomains, labels, blocking)
 	return args.Get(0).(*lb.Volume), args.Error(1)
 }
 
@@ -123,6 +127,16 @@ func (m *ClientMock) UpdateVolume(
 	return args.Get(0).(*lb.Volume), args.Error(1)
 }
 
+func (m *ClientMock) ListVolumes(
+	ctx context.Context, projectName string, offset guuid.UUID, limit uint32,
+) ([]*lb.Volume, error) {
+	args := m.Called(ctx, projectName, offset, limit)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*lb.Volume), args.Error(1)
+}
+
 func (m *ClientMock) CreateSnapshot(ctx context.Context, name string, projectName string, srcVolUUID guuid.UUID,
 	descr string, blocking bool,
 ) (*lb.Snapshot, error) {
@@ -145,6 +159,75 @@ func (m *ClientMock) GetSnapshotByName(ctx context.Context, name string, project
 	return args.Get(0).(*lb.Snapshot), args.Error(1)
 }
 
+func (m *ClientMock) ListSnapshots(
+	ctx context.Context, projectName string, offset guuid.UUID, limit uint32,
+) ([]*lb.Snapshot, error) {
+	args := m.Called(ctx, projectName, offset, limit)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*lb.Snapshot), args.Error(1)
+}
+
+func (m *ClientMock) RollbackVolume(
+	ctx context.Context, uuid guuid.UUID, projectName string, snapUUID guuid.UUID,
+) (*lb.Volume, error) {
+	args := m.Called(ctx, uuid, projectName, snapUUID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*lb.Volume), args.Error(1)
+}
+
+func (m *ClientMock) ListChangedBlocks(
+	ctx context.Context, snapUUID, baseSnapUUID guuid.UUID, projectName string,
+	offsetLBA uint64, fn lb.ChangedBlocksFunc,
+) error {
+	args := m.Called(ctx, snapUUID, baseSnapUUID, projectName, offsetLBA, fn)
+	return args.Error(0)
+}
+
+func (m *ClientMock) GetTrustedHost(
+	ctx context.Context, name string, projectName string,
+) (*lb.TrustedHost, error) {
+	args := m.Called(ctx, name, projectName)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*lb.TrustedHost), args.Error(1)
+}
+
+func (m *ClientMock) CreateTrustedHost(
+	ctx context.Context, name string, projectName string, hostNQN string,
+) (*lb.TrustedHost, error) {
+	args := m.Called(ctx, name, projectName, hostNQN)
+	if args.Get(0) == nil {
+		if args.Error(1) != nil {
+			return nil, args.Error(1)
+		}
+		// just echo back whatever was asked for:
+		return &lb.TrustedHost{Name: name, ProjectName: projectName, HostNQN: hostNQN}, nil
+	}
+	return args.Get(0).(*lb.TrustedHost), args.Error(1)
+}
+
+func (m *ClientMock) GetTrustedHostSecrets(
+	ctx context.Context, name string, projectName string,
+) (*lb.TrustedHostSecrets, error) {
+	args := m.Called(ctx, name, projectName)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*lb.TrustedHostSecrets), args.Error(1)
+}
+
+func (m *ClientMock) SetTrustedHostSecrets(
+	ctx context.Context, name string, projectName string, secrets *lb.TrustedHostSecrets,
+) error {
+	args := m.Called(ctx, name, projectName, secrets)
+	return args.Error(0)
+}
+
 func getDriver(
 	t *testing.T, nodeID string, rwx bool,
 ) (*Driver, Config, error) {
@@ -165,7 +248,6 @@ func getDriver(
 
 		// hidden, dev-only options:
 		BinaryName:    "lb-csi-plugin",
-		Transport:     "tcp",
 		SquelchPanics: false,
 		PrettyJSON:    false,
 		RWX:           rwx,
@@ -190,6 +272,13 @@ func basicClientMock(ep string) *ClientMock {
 	clientMock.On("Close").Return()
 	clientMock.On("Targets").Return(ep)
 	clientMock.On("RemoteOk", context.Background()).Return(nil)
+	// fresh nodes, as far as the trusted hosts are concerned:
+	clientMock.On("GetTrustedHost", mock.Anything, mock.Anything, mock.Anything).Return(
+		nil, status.Error(codes.NotFound, "no such trusted host"))
+	clientMock.On("CreateTrustedHost", mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything).Return(nil, nil)
+	clientMock.On("SetTrustedHostSecrets", mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything).Return(nil)
 	return clientMock
 }
 
@@ -398,7 +487,10 @@ func TestControllerPublishVolume(t *testing.T) {
 			clientMock := tc.clientMock()
 			driver, _ := tc.driver()
 			driver.lbclients = lb.NewClientPoolWithOptions(
-				func(ctx context.Context, targets endpoint.Slice, mgmtScheme string) (lb.Client, error) {
+				func(
+					ctx context.Context, targets endpoint.Slice, mgmtScheme string,
+					_ *lb.TLSConfig,
+				) (lb.Client, error) {
 					return clientMock, nil
 				},
 				poolOpts,
@@ -498,7 +590,10 @@ func TestControllerUnpublishVolume(t *testing.T) {
 			clientMock := tc.clientMock()
 			driver, _ := tc.driver()
 			driver.lbclients = lb.NewClientPoolWithOptions(
-				func(ctx context.Context, targets endpoint.Slice, mgmtScheme string) (lb.Client, error) {
+				func(
+					ctx context.Context, targets endpoint.Slice, mgmtScheme string,
+					_ *lb.TLSConfig,
+				) (lb.Client, error) {
 					return clientMock, nil
 				},
 				poolOpts,
@@ -518,3 +613,737 @@ func TestControllerUnpublishVolume(t *testing.T) {
 		})
 	}
 }
+
+func TestListVolumes(t *testing.T) {
+	ep := "10.19.151.24:443,10.19.151.6:443"
+	projectName := "default"
+	nguid1 := guuid.MustParse("6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66")
+	nguid2 := guuid.MustParse("0cf0a5c4-7ec8-4a1c-a52e-1d5a3cbf6f0c")
+	nguid3 := guuid.MustParse("e4b3a8a4-1b0e-4f43-9a8b-2bf1e0d9b6a1")
+	nguid0 := guuid.MustParse("1d3c5f0e-5a8e-4f8b-8d1c-0b7e9f2a6c44")
+	nguid4 := guuid.MustParse("9f6e2b1a-3c4d-4e5f-a6b7-c8d9e0f1a2b3")
+	volID := func(nguid guuid.UUID) string {
+		return fmt.Sprintf("mgmt:%s|nguid:%s|proj:%s|scheme:grpcs", ep, nguid, projectName)
+	}
+	// listed() returns a volume labelled the way CreateVolume() would have
+	// labelled it, had it handed out `id` for it.
+	listed := func(name, id string) *lb.Volume {
+		vid, err := parseCSIResourceID(id)
+		require.NoError(t, err)
+		vol := basicVolume(name, vid.uuid, nil)
+		label, ok := vid.volIDLabel()
+		require.True(t, ok)
+		vol.Labels = map[string]string{lbLabelVolID: label}
+		return vol
+	}
+	fancyID := fmt.Sprintf("mgmt:10.0.0.1:443,[2001:db8::1]:443|nguid:%s|proj:%s|"+
+		"scheme:grpcs|hostcrypto:luks2|tls:psk|xport:tcp", nguid3, projectName)
+
+	testCases := []struct {
+		name       string
+		req        *csi.ListVolumesRequest
+		clientMock func() *ClientMock
+		volIDs     []string
+		nextToken  string
+		code       codes.Code
+	}{
+		{
+			name: "first page, more to come",
+			req:  &csi.ListVolumesRequest{MaxEntries: 2},
+			clientMock: func() *ClientMock {
+				clientMock := basicClientMock(ep)
+				clientMock.On("ListVolumes", context.Background(), "", guuid.Nil, uint32(2)).
+					Return([]*lb.Volume{
+						listed("v1", volID(nguid1)),
+						listed("v2", volID(nguid2)),
+					}, nil).Once()
+				return clientMock
+			},
+			volIDs:    []string{volID(nguid1), volID(nguid2)},
+			nextToken: nguid2.String(),
+		},
+		{
+			name: "last page, failed volumes skipped",
+			req:  &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: nguid1.String()},
+			clientMock: func() *ClientMock {
+				clientMock := basicClientMock(ep)
+				vol := basicVolume("v3", nguid3, nil)
+				vol.State = lb.VolumeFailed
+				clientMock.On("ListVolumes", context.Background(), "", nguid1, uint32(2)).
+					Return([]*lb.Volume{listed("v2", volID(nguid2)), vol}, nil).Once()
+				return clientMock
+			},
+			volIDs:    []string{volID(nguid2)},
+			nextToken: nguid3.String(),
+		},
+		{
+			name: "no max_entries, short page",
+			req:  &csi.ListVolumesRequest{},
+			clientMock: func() *ClientMock {
+				clientMock := basicClientMock(ep)
+				clientMock.On("ListVolumes", context.Background(), "", guuid.Nil,
+					uint32(lb.MaxListLimit)).
+					Return([]*lb.Volume{listed("v1", volID(nguid1))}, nil).Once()
+				return clientMock
+			},
+			volIDs: []string{volID(nguid1)},
+		},
+		{
+			name: "ID attributes LightOS doesn't know of",
+			req:  &csi.ListVolumesRequest{},
+			clientMock: func() *ClientMock {
+				clientMock := basicClientMock(ep)
+				clientMock.On("ListVolumes", context.Background(), "", guuid.Nil,
+					uint32(lb.MaxListLimit)).
+					Return([]*lb.Volume{listed("v3", fancyID)}, nil).Once()
+				return clientMock
+			},
+			volIDs: []string{fancyID},
+		},
+		{
+			name: "volumes without usable ID labels get best-effort IDs",
+			req:  &csi.ListVolumesRequest{},
+			clientMock: func() *ClientMock {
+				clientMock := basicClientMock(ep)
+				otherProj := listed("v2", volID(nguid2))
+				otherProj.ProjectName = "other"
+				garbage := listed("v3", volID(nguid3))
+				garbage.Labels[lbLabelVolID] = "bm90LWFuLWlk"
+				encrypted := basicVolume("v4", nguid4, nil)
+				encrypted.Labels = map[string]string{lbLabelLUKSKey: "some-key"}
+				clientMock.On("ListVolumes", context.Background(), "", guuid.Nil,
+					uint32(lb.MaxListLimit)).
+					Return([]*lb.Volume{
+						basicVolume("v0", nguid0, nil),
+						listed("v1", volID(nguid1)),
+						otherProj,
+						garbage,
+						encrypted,
+					}, nil).Once()
+				return clientMock
+			},
+			volIDs: []string{
+				volID(nguid0),
+				volID(nguid1),
+				fmt.Sprintf("mgmt:%s|nguid:%s|proj:other|scheme:grpcs", ep, nguid2),
+				volID(nguid3),
+				volID(nguid4) + "|hostcrypto:luks2",
+			},
+		},
+		{
+			name:       "negative max_entries",
+			req:        &csi.ListVolumesRequest{MaxEntries: -1},
+			clientMock: func() *ClientMock { return basicClientMock(ep) },
+			code:       codes.InvalidArgument,
+		},
+		{
+			name:       "garbage starting_token",
+			req:        &csi.ListVolumesRequest{StartingToken: "not-a-uuid"},
+			clientMock: func() *ClientMock { return basicClientMock(ep) },
+			code:       codes.Aborted,
+		},
+		{
+			name: "stale starting_token",
+			req:  &csi.ListVolumesRequest{StartingToken: nguid3.String()},
+			clientMock: func() *ClientMock {
+				clientMock := basicClientMock(ep)
+				clientMock.On("ListVolumes", context.Background(), "", nguid3,
+					uint32(lb.MaxListLimit)).
+					Return(nil, status.Error(codes.NotFound, "no such volume")).Once()
+				return clientMock
+			},
+			code: codes.Aborted,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientMock := tc.clientMock()
+			driver, _, _ := getDriver(t, "rack01-server01", false)
+			driver.mgmtEPs = endpoint.MustParseCSV(ep)
+			driver.lbclients = lb.NewClientPoolWithOptions(
+				func(
+					ctx context.Context, targets endpoint.Slice, mgmtScheme string,
+					_ *lb.TLSConfig,
+				) (lb.Client, error) {
+					return clientMock, nil
+				},
+				poolOpts,
+			)
+			resp, err := driver.ListVolumes(context.Background(), tc.req)
+			if tc.code != codes.OK {
+				require.Equal(t, tc.code, status.Code(err), "wrong error: %v", err)
+				return
+			}
+			require.NoError(t, err)
+			volIDs := []string{}
+			for _, entry := range resp.Entries {
+				volIDs = append(volIDs, entry.Volume.VolumeId)
+			}
+			require.Equal(t, tc.volIDs, volIDs)
+			require.Equal(t, tc.nextToken, resp.NextToken)
+			clientMock.AssertNumberOfCalls(t, "ListVolumes", 1)
+		})
+	}
+}
+
+func TestListSnapshots(t *testing.T) {
+	ep := "10.19.151.24:443,10.19.151.6:443"
+	projectName := "default"
+	volUUID1 := guuid.MustParse("6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66")
+	volUUID2 := guuid.MustParse("0cf0a5c4-7ec8-4a1c-a52e-1d5a3cbf6f0c")
+	snapUUIDs := []guuid.UUID{
+		guuid.MustParse("a1a1a1a1-0000-4000-8000-000000000001"),
+		guuid.MustParse("a1a1a1a1-0000-4000-8000-000000000002"),
+		guuid.MustParse("a1a1a1a1-0000-4000-8000-000000000003"),
+		guuid.MustParse("a1a1a1a1-0000-4000-8000-000000000004"),
+	}
+	resID := func(nguid guuid.UUID) string {
+		return fmt.Sprintf("mgmt:%s|nguid:%s|proj:%s|scheme:grpcs", ep, nguid, projectName)
+	}
+	snap := func(i int, srcVol guuid.UUID) *lb.Snapshot {
+		return &lb.Snapshot{
+			Name:        fmt.Sprintf("snap%d", i),
+			UUID:        snapUUIDs[i],
+			Capacity:    2 * uint64(GiB),
+			State:       lb.SnapshotAvailable,
+			SrcVolUUID:  srcVol,
+			ProjectName: projectName,
+		}
+	}
+
+	testCases := []struct {
+		name        string
+		defCluster  bool
+		req         *csi.ListSnapshotsRequest
+		clientMock  func() *ClientMock
+		snapIDs     []string
+		nextToken   string
+		code        codes.Code
+		numLBCalls  int
+		lbCallsName string
+	}{
+		{
+			name: "by source volume, spanning several LB pages",
+			req:  &csi.ListSnapshotsRequest{SourceVolumeId: resID(volUUID1), MaxEntries: 2},
+			clientMock: func() *ClientMock {
+				clientMock := basicClientMock(ep)
+				clientMock.On("ListSnapshots", context.Background(), projectName,
+					guuid.Nil, uint32(2)).
+					Return([]*lb.Snapshot{snap(0, volUUID1), snap(1, volUUID2)}, nil).Once()
+				clientMock.On("ListSnapshots", context.Background(), projectName,
+					snapUUIDs[1], uint32(2)).
+					Return([]*lb.Snapshot{snap(2, volUUID2), snap(3, volUUID1)}, nil).Once()
+				return clientMock
+			},
+			snapIDs:     []string{resID(snapUUIDs[0]), resID(snapUUIDs[3])},
+			nextToken:   snapUUIDs[3].String(),
+			numLBCalls:  2,
+			lbCallsName: "ListSnapshots",
+		},
+		{
+			name: "by source volume, last short page",
+			req: &csi.ListSnapshotsRequest{
+				SourceVolumeId: resID(volUUID1),
+				StartingToken:  snapUUIDs[3].String(),
+			},
+			clientMock: func() *ClientMock {
+				clientMock := basicClientMock(ep)
+				clientMock.On("ListSnapshots", context.Background(), projectName,
+					snapUUIDs[3], uint32(lb.MaxListLimit)).
+					Return([]*lb.Snapshot{}, nil).Once()
+				return clientMock
+			},
+			snapIDs:     []string{},
+			numLBCalls:  1,
+			lbCallsName: "ListSnapshots",
+		},
+		{
+			name: "by snapshot ID",
+			req:  &csi.ListSnapshotsRequest{SnapshotId: resID(snapUUIDs[2])},
+			clientMock: func() *ClientMock {
+				clientMock := basicClientMock(ep)
+				clientMock.On("GetSnapshot", context.Background(), snapUUIDs[2], projectName).
+					Return(snap(2, volUUID2), nil).Once()
+				return clientMock
+			},
+			snapIDs:     []string{resID(snapUUIDs[2])},
+			numLBCalls:  1,
+			lbCallsName: "GetSnapshot",
+		},
+		{
+			name: "by snapshot ID, wrong source volume",
+			req: &csi.ListSnapshotsRequest{
+				SnapshotId:     resID(snapUUIDs[2]),
+				SourceVolumeId: resID(volUUID1),
+			},
+			clientMock: func() *ClientMock {
+				clientMock := basicClientMock(ep)
+				clientMock.On("GetSnapshot", context.Background(), snapUUIDs[2], projectName).
+					Return(snap(2, volUUID2), nil).Once()
+				return clientMock
+			},
+			snapIDs:     []string{},
+			numLBCalls:  1,
+			lbCallsName: "GetSnapshot",
+		},
+		{
+			name: "by nonexistent snapshot ID",
+			req:  &csi.ListSnapshotsRequest{SnapshotId: resID(snapUUIDs[0])},
+			clientMock: func() *ClientMock {
+				clientMock := basicClientMock(ep)
+				clientMock.On("GetSnapshot", context.Background(), snapUUIDs[0], projectName).
+					Return((*lb.Snapshot)(nil), status.Error(codes.NotFound, "nope")).Once()
+				return clientMock
+			},
+			snapIDs:     []string{},
+			numLBCalls:  1,
+			lbCallsName: "GetSnapshot",
+		},
+		{
+			name:        "by malformed snapshot ID",
+			req:         &csi.ListSnapshotsRequest{SnapshotId: "whatever"},
+			clientMock:  func() *ClientMock { return basicClientMock(ep) },
+			snapIDs:     []string{},
+			lbCallsName: "GetSnapshot",
+		},
+		{
+			name:       "unfiltered, no default cluster",
+			req:        &csi.ListSnapshotsRequest{},
+			clientMock: func() *ClientMock { return basicClientMock(ep) },
+			code:       codes.FailedPrecondition,
+		},
+		{
+			name:       "unfiltered, default cluster",
+			defCluster: true,
+			req:        &csi.ListSnapshotsRequest{MaxEntries: 1},
+			clientMock: func() *ClientMock {
+				clientMock := basicClientMock(ep)
+				clientMock.On("ListSnapshots", context.Background(), "",
+					guuid.Nil, uint32(1)).
+					Return([]*lb.Snapshot{snap(1, volUUID2)}, nil).Once()
+				return clientMock
+			},
+			snapIDs:     []string{resID(snapUUIDs[1])},
+			nextToken:   snapUUIDs[1].String(),
+			numLBCalls:  1,
+			lbCallsName: "ListSnapshots",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientMock := tc.clientMock()
+			driver, _, _ := getDriver(t, "rack01-server01", false)
+			if tc.defCluster {
+				driver.mgmtEPs = endpoint.MustParseCSV(ep)
+			}
+			driver.lbclients = lb.NewClientPoolWithOptions(
+				func(
+					ctx context.Context, targets endpoint.Slice, mgmtScheme string,
+					_ *lb.TLSConfig,
+				) (lb.Client, error) {
+					return clientMock, nil
+				},
+				poolOpts,
+			)
+			resp, err := driver.ListSnapshots(context.Background(), tc.req)
+			if tc.code != codes.OK {
+				require.Equal(t, tc.code, status.Code(err), "wrong error: %v", err)
+				return
+			}
+			require.NoError(t, err)
+			snapIDs := []string{}
+			for _, entry := range resp.Entries {
+				snapIDs = append(snapIDs, entry.Snapshot.SnapshotId)
+			}
+			require.Equal(t, tc.snapIDs, snapIDs)
+			require.Equal(t, tc.nextToken, resp.NextToken)
+			clientMock.AssertNumberOfCalls(t, tc.lbCallsName, tc.numLBCalls)
+		})
+	}
+}
+
+func TestControllerGetVolume(t *testing.T) {
+	nodeID1 := "rack01-server01"
+	nodeID2 := "rack01-server02"
+	ep := "10.19.151.24:443,10.19.151.6:443"
+	projectName := "default"
+	nguid := guuid.MustParse("6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66")
+	volID := fmt.Sprintf("mgmt:%s|nguid:%s|proj:%s|scheme:grpcs", ep, nguid, projectName)
+
+	testCases := []struct {
+		name     string
+		vol      func() *lb.Volume
+		lbErr    error
+		code     codes.Code
+		nodeIDs  []string
+		abnormal bool
+		msg      string
+	}{
+		{
+			name: "healthy volume published to two nodes",
+			vol: func() *lb.Volume {
+				vol := basicVolume("v1", nguid, []string{
+					nodeIDToHostNQN(nodeID1), nodeIDToHostNQN(nodeID2)})
+				vol.State = lb.VolumeAvailable
+				vol.Protection = lb.VolumeProtected
+				return vol
+			},
+			nodeIDs: []string{nodeID1, nodeID2},
+			msg:     "fully protected",
+		},
+		{
+			name: "degraded unpublished volume",
+			vol: func() *lb.Volume {
+				vol := basicVolume("v1", nguid, []string{lb.ACLAllowNone})
+				vol.State = lb.VolumeAvailable
+				vol.Protection = lb.VolumeDegraded
+				return vol
+			},
+			nodeIDs:  []string{},
+			abnormal: true,
+			msg:      "degraded",
+		},
+		{
+			name: "migrating volume",
+			vol: func() *lb.Volume {
+				vol := basicVolume("v1", nguid, []string{nodeIDToHostNQN(nodeID1)})
+				vol.State = lb.VolumeMigrating
+				vol.Protection = lb.VolumeProtected
+				return vol
+			},
+			nodeIDs: []string{nodeID1},
+			msg:     "migrated",
+		},
+		{
+			name: "failed read-only volume",
+			vol: func() *lb.Volume {
+				vol := basicVolume("v1", nguid, []string{lb.ACLAllowNone})
+				vol.State = lb.VolumeFailed
+				vol.Protection = lb.VolumeReadOnly
+				return vol
+			},
+			nodeIDs:  []string{},
+			abnormal: true,
+			msg:      "failed state and is unusable; volume is read-only",
+		},
+		{
+			name:  "nonexistent volume",
+			vol:   func() *lb.Volume { return nil },
+			lbErr: status.Error(codes.NotFound, "no such volume"),
+			code:  codes.NotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientMock := basicClientMock(ep)
+			clientMock.On("GetVolume", context.Background(), nguid, projectName).
+				Return(tc.vol(), tc.lbErr).Once()
+			driver, _, _ := getDriver(t, nodeID1, false)
+			driver.lbclients = lb.NewClientPoolWithOptions(
+				func(
+					ctx context.Context, targets endpoint.Slice, mgmtScheme string,
+					_ *lb.TLSConfig,
+				) (lb.Client, error) {
+					return clientMock, nil
+				},
+				poolOpts,
+			)
+			resp, err := driver.ControllerGetVolume(context.Background(),
+				&csi.ControllerGetVolumeRequest{VolumeId: volID})
+			if tc.code != codes.OK {
+				require.Equal(t, tc.code, status.Code(err), "wrong error: %v", err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, volID, resp.Volume.VolumeId)
+			require.Equal(t, tc.nodeIDs, resp.Status.PublishedNodeIds)
+			require.Equal(t, tc.abnormal, resp.Status.VolumeCondition.Abnormal)
+			require.Contains(t, resp.Status.VolumeCondition.Message, tc.msg)
+		})
+	}
+}
+
+func TestResolveTransport(t *testing.T) {
+	d, _, _ := getDriver(t, "rack01-server01", false)
+	testCases := []struct {
+		name    string
+		defXprt string
+		xport   string
+		tls     string
+		res     string
+		code    codes.Code
+	}{
+		{name: "tcp default", defXprt: "tcp", xport: "", res: ""},
+		{name: "tcp default, tcp", defXprt: "tcp", xport: "tcp", res: ""},
+		{name: "tcp default, rdma", defXprt: "tcp", xport: "rdma", res: "rdma"},
+		{name: "tcp default, tls", defXprt: "tcp", xport: "", tls: nvmeTLSPSK, res: ""},
+		{name: "rdma default", defXprt: "rdma", xport: "", res: "rdma"},
+		{name: "rdma default, tcp", defXprt: "rdma", xport: "tcp", res: "tcp"},
+		{name: "rdma default, tls", defXprt: "rdma", xport: "", tls: nvmeTLSPSK,
+			code: codes.FailedPrecondition},
+		{name: "rdma default, tcp tls", defXprt: "rdma", xport: "tcp", tls: nvmeTLSPSK,
+			res: "tcp"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d.defaultTransport = tc.defXprt
+			res, err := d.resolveTransport(tc.xport, tc.tls)
+			require.Equal(t, tc.code, status.Code(err), "error: %s", err)
+			require.Equal(t, tc.res, res)
+		})
+	}
+}
+
+func TestInheritLUKSLabels(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	ctx := context.Background()
+	srcID := lbResourceID{uuid: guuid.New(), projName: "default"}
+	srcLabels := map[string]string{
+		lbLabelLUKSKey:    "secret.c2FsdA.d3JhcHBlZA",
+		lbLabelLUKSFormat: "aes-xts-plain64.512.argon2id",
+		"owner":           "someone-else",
+	}
+	testCases := []struct {
+		name   string
+		labels map[string]string
+		chk    func(m *ClientMock, req *lb.Volume) error
+	}{
+		{
+			name:   "from snapshot",
+			labels: map[string]string{"team": "storage"},
+			chk: func(m *ClientMock, req *lb.Volume) error {
+				m.On("GetSnapshot", mock.Anything, srcID.uuid, srcID.projName).
+					Return(&lb.Snapshot{
+						UUID: srcID.uuid, Capacity: 1 << 30,
+						State: lb.SnapshotAvailable, SrcVolReplicaCount: 2,
+						Labels: srcLabels,
+					}, nil)
+				return chkSourceSnapCompat(ctx, log, m, req,
+					csi.CapacityRange{RequiredBytes: 1 << 30}, srcID)
+			},
+		},
+		{
+			name: "from volume",
+			chk: func(m *ClientMock, req *lb.Volume) error {
+				m.On("GetVolume", mock.Anything, srcID.uuid, srcID.projName).
+					Return(&lb.Volume{
+						UUID: srcID.uuid, Capacity: 1 << 30,
+						State: lb.VolumeAvailable, ReplicaCount: 2,
+						Labels: srcLabels,
+					}, nil)
+				return chkSourceVolCompat(ctx, log, m, req,
+					csi.CapacityRange{RequiredBytes: 1 << 30}, srcID)
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reqLabels := maps.Clone(tc.labels)
+			req := &lb.Volume{ReplicaCount: 2, Labels: reqLabels}
+			err := tc.chk(&ClientMock{}, req)
+			require.NoError(t, err)
+			require.Equal(t, srcLabels[lbLabelLUKSKey], req.Labels[lbLabelLUKSKey])
+			require.Equal(t, srcLabels[lbLabelLUKSFormat], req.Labels[lbLabelLUKSFormat])
+			require.NotContains(t, req.Labels, "owner", "non-LUKS source label copied")
+			for k, v := range tc.labels {
+				require.Equal(t, v, req.Labels[k], "requested label %s lost", k)
+			}
+			require.Equal(t, tc.labels, reqLabels, "caller's labels map modified")
+		})
+	}
+
+	t.Run("unencrypted source", func(t *testing.T) {
+		req := &lb.Volume{}
+		inheritLUKSLabels(req, map[string]string{"owner": "someone-else"})
+		require.Nil(t, req.Labels)
+	})
+}
+
+func TestControllerModifyVolume(t *testing.T) {
+	nodeID1 := "rack01-server01"
+	ep := "10.19.151.24:443,10.19.151.6:443"
+	projectName := "default"
+	nguid := guuid.MustParse("6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66")
+	volID := fmt.Sprintf("mgmt:%s|nguid:%s|proj:%s|scheme:grpcs", ep, nguid, projectName)
+	encVolID := volID + "|hostcrypto:luks2"
+	enabled := true
+	// nLabels() returns `n` user labels, starting with `first`.
+	nLabels := func(first, n int) map[string]string {
+		res := map[string]string{}
+		for i := first; i < first+n; i++ {
+			res[fmt.Sprintf("l%d", i)] = fmt.Sprint(i)
+		}
+		return res
+	}
+	// csv() turns `labels` into a `labels` param value.
+	csv := func(labels map[string]string) string {
+		var kvs []string
+		for k, v := range labels {
+			kvs = append(kvs, k+"="+v)
+		}
+		return strings.Join(kvs, ",")
+	}
+
+	testCases := []struct {
+		name     string
+		volID    string
+		params   map[string]string
+		vol      func() *lb.Volume
+		update   *lb.VolumeUpdate // expected from the hook, nil if none.
+		code     codes.Code
+		hookCode codes.Code // expected from the hook.
+	}{
+		{
+			name:   "change QoS policy",
+			volID:  volID,
+			params: map[string]string{volParQosNameKey: "gold"},
+			vol: func() *lb.Volume {
+				vol := basicVolume("v1", nguid, []string{lb.ACLAllowNone})
+				vol.QosPolicyName = "bronze"
+				return vol
+			},
+			update: &lb.VolumeUpdate{QosPolicyName: "gold"},
+		},
+		{
+			name:  "already modified",
+			volID: volID,
+			params: map[string]string{
+				volParQosNameKey:  "gold",
+				volParCompressKey: "disabled",
+			},
+			vol: func() *lb.Volume {
+				vol := basicVolume("v1", nguid, []string{lb.ACLAllowNone})
+				vol.QosPolicyName = "gold"
+				return vol
+			},
+			update: nil,
+		},
+		{
+			name:   "enable compression",
+			volID:  volID,
+			params: map[string]string{volParCompressKey: "enabled"},
+			vol: func() *lb.Volume {
+				return basicVolume("v1", nguid, []string{lb.ACLAllowNone})
+			},
+			update: &lb.VolumeUpdate{Compression: &enabled},
+		},
+		{
+			name:   "replace labels, preserving K8s metadata",
+			volID:  volID,
+			params: map[string]string{volParLabelsKey: "team=b,tier=gold"},
+			vol: func() *lb.Volume {
+				vol := basicVolume("v1", nguid, []string{lb.ACLAllowNone})
+				vol.Labels = map[string]string{lbLabelPVCName: "data-0", "team": "a"}
+				return vol
+			},
+			update: &lb.VolumeUpdate{Labels: map[string]string{
+				lbLabelPVCName: "data-0", "team": "b", "tier": "gold"}},
+		},
+		{
+			name:   "replace labels, preserving LUKS labels",
+			volID:  encVolID,
+			params: map[string]string{volParLabelsKey: "team=b"},
+			vol: func() *lb.Volume {
+				vol := basicVolume("v1", nguid, []string{lb.ACLAllowNone})
+				vol.Labels = map[string]string{
+					lbLabelLUKSFormat: "_512__argon2id_", lbLabelLUKSKey: "file.x", "team": "a"}
+				return vol
+			},
+			update: &lb.VolumeUpdate{Labels: map[string]string{
+				lbLabelLUKSFormat: "_512__argon2id_", lbLabelLUKSKey: "file.x", "team": "b"}},
+		},
+		{
+			name:   "host-encrypted volume, no room left for LUKS data key",
+			volID:  encVolID,
+			params: map[string]string{volParLabelsKey: csv(nLabels(0, maxLBLabels-1))},
+			vol: func() *lb.Volume {
+				vol := basicVolume("v1", nguid, []string{lb.ACLAllowNone})
+				vol.Labels = nLabels(0, maxLBLabels-2)
+				vol.Labels[lbLabelPVCName] = "data-0"
+				return vol
+			},
+			hookCode: codes.InvalidArgument,
+		},
+		{
+			name:   "host-encrypted volume, LUKS data key already in",
+			volID:  encVolID,
+			params: map[string]string{volParLabelsKey: csv(nLabels(0, maxLBLabels-2))},
+			vol: func() *lb.Volume {
+				vol := basicVolume("v1", nguid, []string{lb.ACLAllowNone})
+				vol.Labels = nLabels(0, maxLBLabels-3)
+				vol.Labels[lbLabelPVCName] = "data-0"
+				vol.Labels[lbLabelLUKSKey] = "file.x"
+				return vol
+			},
+			update: &lb.VolumeUpdate{Labels: func() map[string]string {
+				res := nLabels(0, maxLBLabels-2)
+				res[lbLabelPVCName] = "data-0"
+				res[lbLabelLUKSKey] = "file.x"
+				return res
+			}()},
+		},
+		{
+			name:   "compression on host-encrypted volume",
+			volID:  encVolID,
+			params: map[string]string{volParCompressKey: "enabled"},
+			code:   codes.FailedPrecondition,
+		},
+		{
+			name:   "immutable param",
+			volID:  volID,
+			params: map[string]string{volParRepCntKey: "2"},
+			code:   codes.InvalidArgument,
+		},
+		{
+			name:   "no params",
+			volID:  volID,
+			params: map[string]string{},
+			code:   codes.InvalidArgument,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientMock := basicClientMock(ep)
+			var update *lb.VolumeUpdate
+			var hookErr error
+			if tc.vol != nil {
+				vol := tc.vol()
+				clientMock.On("UpdateVolume", context.Background(), nguid, projectName,
+					mock.AnythingOfType("lb.VolumeUpdateHook")).
+					Run(func(args mock.Arguments) {
+						hook := args.Get(3).(lb.VolumeUpdateHook)
+						update, hookErr = hook(vol)
+					}).
+					Return(vol, nil).Once()
+			}
+			driver, _, _ := getDriver(t, nodeID1, false)
+			driver.lbclients = lb.NewClientPoolWithOptions(
+				func(
+					ctx context.Context, targets endpoint.Slice, mgmtScheme string,
+					_ *lb.TLSConfig,
+				) (lb.Client, error) {
+					return clientMock, nil
+				},
+				poolOpts,
+			)
+			_, err := driver.ControllerModifyVolume(context.Background(),
+				&csi.ControllerModifyVolumeRequest{
+					VolumeId:          tc.volID,
+					MutableParameters: tc.params,
+				})
+			if tc.code != codes.OK {
+				require.Equal(t, tc.code, status.Code(err), "wrong error: %v", err)
+				clientMock.AssertNumberOfCalls(t, "UpdateVolume", 0)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.hookCode, status.Code(hookErr), "wrong error: %v", hookErr)
+			require.Equal(t, tc.update, update)
+			clientMock.AssertNumberOfCalls(t, "UpdateVolume", 1)
+		})
+	}
+}
@@ -5,14 +5,21 @@
 package driver
 
 import (
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	guuid "github.com/google/uuid"
 
+	"github.com/lightbitslabs/los-csi/pkg/driver/backend"
 	"github.com/lightbitslabs/los-csi/pkg/util/endpoint"
+	"github.com/lightbitslabs/los-csi/pkg/util/strlist"
 )
 
 // this file holds the definitions of - and helper functions for handling of -
@@ -54,20 +61,84 @@ const (
 	volParProjNameKey   = "project-name"
 	volParMgmtSchemeKey = "mgmt-scheme"
 	volParQosNameKey    = "qos-policy-name"
+	volParFDsKey        = "failure-domains"
+	volParLabelsKey     = "labels"
+	volParTransportKey  = "transport"
 
 	// volHostEncryptionKey parameter in the storageclass parameter, can be either enabled|disabled
 	volHostEncryptionKey = "host-encryption"
 	// volHostEncryptionPassphraseKey name of the secret for the encryption passphrase
 	volHostEncryptionPassphraseKey = "host-encryption-passphrase"
+	// volHostEncryptionPrevPassphraseKey name of the secret for the previous
+	// encryption passphrase, while the passphrase is being rotated
+	volHostEncryptionPrevPassphraseKey = "host-encryption-passphrase-previous"
 	// volHostEncryptionPassphraseKeyMaxLen defines the maximum len of the encryption passphrase
 	// this is according to the cryptsetup man page
 	volHostEncryptionPassphraseKeyMaxLen = 512
+	// optional LUKS format settings of host-encrypted volumes, see
+	// luksFormatOpts.
+	volHostEncryptionCipherKey    = "host-encryption-cipher"
+	volHostEncryptionKeySizeKey   = "host-encryption-key-size"
+	volHostEncryptionHashKey      = "host-encryption-hash"
+	volHostEncryptionPBKDFKey     = "host-encryption-pbkdf"
+	volHostEncryptionIntegrityKey = "host-encryption-integrity"
+
+	// volNvmeTLSKey parameter in the storageclass parameter, can be either
+	// enabled|disabled. requests NVMe/TCP data plane encryption (TLS 1.3
+	// with pre-shared keys).
+	volNvmeTLSKey = "nvme-tls"
+	// volNvmeTLSPSKKey name of the optional node-stage secret holding the
+	// NVMe/TCP TLS PSK, in the NVMe TLS PSK interchange format. if absent,
+	// the PSK is expected to be provisioned in the node keyring.
+	volNvmeTLSPSKKey = "nvme-tls-psk"
+	// the only NVMe/TCP TLS flavour currently supported:
+	nvmeTLSPSK = "psk"
+
+	// K8s-specific metadata passed by the K8s CSI sidecars along with the
+	// SC/VSC params, if they were started with `--extra-create-metadata`:
+	k8sPVCNameKey      = "csi.storage.k8s.io/pvc/name"
+	k8sPVCNamespaceKey = "csi.storage.k8s.io/pvc/namespace"
+	k8sPVNameKey       = "csi.storage.k8s.io/pv/name"
+	k8sVSNameKey       = "csi.storage.k8s.io/volumesnapshot/name"
+	k8sVSNamespaceKey  = "csi.storage.k8s.io/volumesnapshot/namespace"
+
+	// LightOS volume label keys the K8s metadata above is mapped onto. these
+	// are reserved, and can't be specified explicitly through `labels`.
+	lbLabelPVCName      = "k8s-pvc-name"
+	lbLabelPVCNamespace = "k8s-pvc-namespace"
+	lbLabelPVName       = "k8s-pv-name"
+	// the wrapped per-volume LUKS data key, see luksKeyProvider. reserved
+	// as well, obviously.
+	lbLabelLUKSKey = "lb-csi-luks-key"
+	// the LUKS format settings from the SC, see luksFormatOpts.label().
+	lbLabelLUKSFormat = "lb-csi-luks-format"
+	// the volume ID handed out by CreateVolume(), see volIDLabel(). lets
+	// ListVolumes() report the same IDs, which LightOS can't tell otherwise.
+	lbLabelVolID = "lb-csi-vol-id"
+
+	maxLBLabels = 16 // per volume, LightOS limit.
 )
 
+// k8sMDToLBLabel maps K8s extra-create-metadata keys to LightOS label keys.
+var k8sMDToLBLabel = map[string]string{
+	k8sPVCNameKey:      lbLabelPVCName,
+	k8sPVCNamespaceKey: lbLabelPVCNamespace,
+	k8sPVNameKey:       lbLabelPVName,
+}
+
 var projNameRegex *regexp.Regexp
 
+// fdNameRegex: LightOS failure domain names end up as values of K8s topology
+// labels, so they are held to the K8s label value syntax.
+var fdNameRegex *regexp.Regexp
+
+// lbLabelRegex: LightOS label keys and values syntax.
+var lbLabelRegex *regexp.Regexp
+
 func init() {
 	projNameRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]{0,61}[a-z0-9])?$`)
+	fdNameRegex = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?$`)
+	lbLabelRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,253}$`)
 }
 
 // checkProjectName() checks syntactic validity of the LB "project" name, as
@@ -84,6 +155,125 @@ func checkProjectName(field, proj string) error {
 	return nil
 }
 
+// checkTLSPSK() checks syntactic validity of an NVMe/TCP TLS configured PSK
+// in the NVMe TLS PSK interchange format (as generated by `nvme gen-tls-key`):
+//
+//	NVMeTLSkey-1:<hmac>:<base64 of the PSK followed by its CRC-32>:
+//
+// where <hmac> is "00" (no PSK transformation), "01" (SHA-256, 32-byte PSK)
+// or "02" (SHA-384, 48-byte PSK). the CRC-32 is little-endian. the value
+// of the PSK itself is never included in the error messages.
+func checkTLSPSK(field, psk string) error {
+	if psk == "" {
+		return mkEinvalMissing(field)
+	}
+	parts := strings.Split(psk, ":")
+	if len(parts) != 4 || parts[0] != "NVMeTLSkey-1" || parts[3] != "" {
+		return mkEinvalf(field, "not in NVMe TLS PSK interchange format")
+	}
+	keyLens := map[string][]int{"00": {32, 48}, "01": {32}, "02": {48}}
+	lens, ok := keyLens[parts[1]]
+	if !ok {
+		return mkEinvalf(field, "unsupported PSK hash '%s'", parts[1])
+	}
+	raw, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return mkEinvalf(field, "bad PSK encoding")
+	}
+	keyLen := len(raw) - 4
+	if keyLen != lens[0] && keyLen != lens[len(lens)-1] {
+		return mkEinvalf(field, "bad PSK length %d for hash '%s'", keyLen, parts[1])
+	}
+	if binary.LittleEndian.Uint32(raw[keyLen:]) != crc32.ChecksumIEEE(raw[:keyLen]) {
+		return mkEinvalf(field, "PSK CRC mismatch")
+	}
+	return nil
+}
+
+// checkFailureDomain() checks syntactic validity of a LightOS failure domain
+// name, whether it came from the SC params or from the node topology config.
+func checkFailureDomain(field, fd string) error {
+	if fd == "" {
+		return mkEinvalMissing(field)
+	}
+	if !fdNameRegex.MatchString(fd) {
+		return mkEinvalf(field, "'%s'", fd)
+	}
+	return nil
+}
+
+func isReservedLabel(key string) bool {
+	if key == lbLabelLUKSKey || key == lbLabelLUKSFormat || key == lbLabelVolID {
+		return true
+	}
+	for _, reserved := range k8sMDToLBLabel {
+		if key == reserved {
+			return true
+		}
+	}
+	return false
+}
+
+// labelLimit() returns the number of labels a volume with `labels` and
+// host-side encryption format `hostCrypto` can have. whether a node will need
+// to add lbLabelLUKSKey to an encrypted volume on NodeStageVolume() depends on
+// its LUKS config, which the controller knows nothing about, so a slot is kept
+// free for it until it's there.
+func labelLimit(hostCrypto string, labels map[string]string) int {
+	if _, ok := labels[lbLabelLUKSKey]; hostCrypto != "" && !ok {
+		return maxLBLabels - 1
+	}
+	return maxLBLabels
+}
+
+// withLabels() returns `labels` along with the reserved (K8s metadata) labels
+// out of `curr`, or an error if that ends up being too many labels for a
+// volume with host-side encryption format `hostCrypto`, q.v. labelLimit().
+func withLabels(
+	field string, curr, labels map[string]string, hostCrypto string,
+) (map[string]string, error) {
+	res := map[string]string{}
+	for k, v := range curr {
+		if isReservedLabel(k) {
+			res[k] = v
+		}
+	}
+	for k, v := range labels {
+		res[k] = v
+	}
+	if limit := labelLimit(hostCrypto, res); len(res) > limit {
+		return nil, mkEinvalf(field, "%d labels specified (including the ones derived "+
+			"from K8s metadata), limit is %d", len(res), limit)
+	}
+	return res, nil
+}
+
+// parseLabels() parses the `labels` volume param: a comma-separated list of
+// <key>=<value> LightOS volume labels.
+func parseLabels(field, labels string) (map[string]string, error) {
+	res := map[string]string{}
+	for _, kv := range strings.Split(labels, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return nil, mkEinvalf(field, "'%s' is not in <key>=<value> format", kv)
+		}
+		if !lbLabelRegex.MatchString(k) {
+			return nil, mkEinvalf(field, "bad label key '%s'", k)
+		}
+		if !lbLabelRegex.MatchString(v) {
+			return nil, mkEinvalf(field, "bad label '%s' value '%s'", k, v)
+		}
+		if isReservedLabel(k) {
+			return nil, mkEinvalf(field, "label key '%s' is reserved", k)
+		}
+		if _, ok := res[k]; ok {
+			return nil, mkEinvalf(field, "duplicate label key '%s'", k)
+		}
+		res[k] = v
+	}
+	return res, nil
+}
+
 // lbCreateVolumeParams represents the contents of the `parameters` field
 // (`CreateVolumeRequest.parameters`) passed to the plugin by the CO on
 // CreateVolume() CSI API entrypoint invocation. this supplementary info
@@ -102,6 +292,15 @@ func checkProjectName(field, proj string) error {
 //     compression: <"enabled"|"disabled">
 //     qos-policy-name: <qos-policy-name>
 //     host-encryption: <"enabled"|"disabled">
+//     host-encryption-cipher: <cipher>-<chain mode>-<IV mode>
+//     host-encryption-key-size: <128|192|256|384|512>
+//     host-encryption-hash: <"sha256"|"sha384"|"sha512">
+//     host-encryption-pbkdf: <"pbkdf2"|"argon2i"|"argon2id">
+//     host-encryption-integrity: <"none"|"hmac-sha256"|"hmac-sha512">
+//     nvme-tls: <"enabled"|"disabled">
+//     transport: <"tcp"|"rdma">  (default: the plugin default, see below)
+//     failure-domains: <fd-name>[,<fd-name>...]
+//     labels: <key>=<value>[,<key>=<value>...]
 // e.g.:
 //     mgmt-endpoint: 10.0.0.100:80,10.0.0.101:80
 //     mgmt-scheme: grpcs
@@ -110,6 +309,30 @@ func checkProjectName(field, proj string) error {
 //     compression: enabled
 //     qos-policy-name: "io-limited-policy"
 //     host-encryption: enabled
+//
+// `host-encryption-*` settings override the node-wide LUKS format settings
+// (see luksFormatOpts), and require `host-encryption` to be enabled. the nodes
+// learn of them from the lbLabelLUKSFormat volume label.
+//
+// `nvme-tls` makes the nodes connect to the volume over NVMe/TCP with TLS,
+// and never in cleartext. it's recorded in the volume ID, as the nodes have
+// no other way of knowing. see also volNvmeTLSPSKKey.
+//
+// `transport` is the NVMe-oF transport the nodes use to connect to the volume.
+// if unspecified, the plugin default transport (Config.DefaultTransport) is
+// used. it's recorded in the volume ID, unless it's "tcp" and so is the plugin
+// default, so volumes of SCs with different transports can coexist. NVMe/TCP
+// TLS is TCP-only, duh - q.v. resolveTransport().
+//
+// `failure-domains` restricts the placement of the volume to the specified
+// LightOS failure domains (see also CreateVolume() topology handling). LightOS
+// only supports placement restrictions for single-replica volumes.
+//
+// `labels` are attached to the volume as LightOS labels, along with the PVC
+// name/namespace and PV name (if the CO passed those in as K8s-specific
+// extra-create-metadata), to allow tracing LightOS volumes back to the K8s
+// objects from the LightOS side. the snapshots of the volume inherit its
+// labels on the LightOS side.
 type lbCreateVolumeParams struct {
 	mgmtEPs       endpoint.Slice // LightOS mgmt API server endpoints.
 	replicaCount  uint32         // total number of volume replicas.
@@ -118,6 +341,14 @@ type lbCreateVolumeParams struct {
 	mgmtScheme    string         // currently must be 'grpcs'
 	qosPolicyName string         // qos policy name should exist in the lightos
 	hostCrypto    string         // host-encryption format, currently either empty or luks2
+	luksFormat    luksFormatOpts // LUKS format settings, empty if not specified.
+	nvmeTLS       string         // NVMe/TCP TLS flavour, currently either empty or psk
+	transport     string         // NVMe-oF transport, empty for the plugin default
+	// LightOS FDs to restrict volume placement to, sorted, empty if none.
+	failureDomains []string
+	// LightOS volume labels, including the ones derived from K8s metadata.
+	// nil if none.
+	labels map[string]string
 }
 
 func volParKey(key string) string {
@@ -211,9 +442,209 @@ func parseCSICreateVolumeParams(params map[string]string) (lbCreateVolumeParams,
 			"host-encryption and compression are both enabled")
 	}
 
+	if res.luksFormat, err = parseLUKSFormatParams(params); err != nil {
+		return res, err
+	}
+	if res.luksFormat != (luksFormatOpts{}) && res.hostCrypto == "" {
+		return res, mkEbadOp("mismatch", volHostEncryptionKey,
+			"host-encryption settings specified, but host-encryption is disabled")
+	}
+
+	key = volParKey(volNvmeTLSKey)
+	switch params[volNvmeTLSKey] {
+	case "", "disabled":
+		res.nvmeTLS = ""
+	case "enabled":
+		res.nvmeTLS = nvmeTLSPSK
+	default:
+		return res, mkEinval(key, params[volNvmeTLSKey])
+	}
+
+	key = volParKey(volParTransportKey)
+	switch params[volParTransportKey] {
+	case "", backend.TransportTCP, backend.TransportRDMA:
+		res.transport = params[volParTransportKey]
+	default:
+		return res, mkEinval(key, params[volParTransportKey])
+	}
+
+	if res.transport == backend.TransportRDMA && res.nvmeTLS != "" {
+		return res, mkEbadOp("mismatch", volNvmeTLSKey,
+			"NVMe/TCP TLS is only supported with the 'tcp' transport")
+	}
+
+	key = volParKey(volParFDsKey)
+	if val, ok := params[volParFDsKey]; ok {
+		var fds []string
+		for _, fd := range strings.Split(val, ",") {
+			fd = strings.TrimSpace(fd)
+			if err = checkFailureDomain(key, fd); err != nil {
+				return res, err
+			}
+			fds = append(fds, fd)
+		}
+		if res.replicaCount != 1 {
+			return res, mkEbadOp("mismatch", volParFDsKey, "failure domain "+
+				"placement restrictions are only supported for volumes with "+
+				"a single replica")
+		}
+		res.failureDomains = strlist.CopyUniqueSorted(fds)
+	}
+
+	key = volParKey(volParLabelsKey)
+	labels := map[string]string{}
+	if val, ok := params[volParLabelsKey]; ok {
+		labels, err = parseLabels(key, val)
+		if err != nil {
+			return res, err
+		}
+	}
+	for mdKey, lbKey := range k8sMDToLBLabel {
+		if val := params[mdKey]; val != "" {
+			if !lbLabelRegex.MatchString(val) {
+				return res, mkEinvalf(volParKey(mdKey), "'%s'", val)
+			}
+			labels[lbKey] = val
+		}
+	}
+	if res.luksFormat != (luksFormatOpts{}) {
+		labels[lbLabelLUKSFormat] = res.luksFormat.label()
+	}
+	if limit := labelLimit(res.hostCrypto, labels); len(labels) > limit {
+		return res, mkEinvalf(key, "%d labels specified (including the ones derived "+
+			"from K8s metadata), limit is %d", len(labels), limit)
+	}
+	if len(labels) > 0 {
+		res.labels = labels
+	}
+
+	return res, nil
+}
+
+// parseLUKSFormatParams() parses the optional `host-encryption-*` LUKS format
+// settings out of the CreateVolume() `parameters`.
+func parseLUKSFormatParams(params map[string]string) (luksFormatOpts, error) {
+	res := luksFormatOpts{
+		Cipher:    params[volHostEncryptionCipherKey],
+		Hash:      params[volHostEncryptionHashKey],
+		PBKDF:     params[volHostEncryptionPBKDFKey],
+		Integrity: params[volHostEncryptionIntegrityKey],
+	}
+	if val, ok := params[volHostEncryptionKeySizeKey]; ok {
+		keySize, err := strconv.ParseUint(val, 10, 16)
+		if err != nil || keySize == 0 {
+			return res, mkEinval(volParKey(volHostEncryptionKeySizeKey), val)
+		}
+		res.KeySize = int(keySize)
+	}
+	if key, err := res.check(); err != nil {
+		return res, mkEinvalf(volParKey(key), "%s", err)
+	}
 	return res, nil
 }
 
+// lbModifyVolumeParams: -----------------------------------------------------
+
+const mutParRoot = "mutable_parameters"
+
+// lbModifyVolumeParams represents the contents of the `mutable_parameters`
+// field passed to the plugin by the CO on ControllerModifyVolume() (and,
+// optionally, CreateVolume()) CSI API entrypoint invocation. in K8s these are
+// taken from the VolumeAttributesClass `parameters` stanza.
+//
+// `mutable_parameters` is a string-to-string KV map that may include any of
+// the following subset of the `lbCreateVolumeParams` keys:
+//     qos-policy-name: <qos-policy-name>
+//     compression: <"enabled"|"disabled">
+//     labels: <key>=<value>[,<key>=<value>...]
+// e.g.:
+//     qos-policy-name: "gold"
+//
+// `labels`, if specified, replace all the user-specified labels of the volume
+// (including the ones that came from the SC), only the labels derived from the
+// K8s metadata are preserved.
+type lbModifyVolumeParams struct {
+	qosPolicyName string            // empty if not specified.
+	compression   *bool             // nil if not specified.
+	labels        map[string]string // nil if not specified.
+}
+
+func mutParKey(key string) string {
+	return mutParRoot + "." + key
+}
+
+// parseCSIModifyVolumeParams parses the `mutable_parameters` K:V map passed to
+// ControllerModifyVolume() or CreateVolume() and validates the contents. the
+// returned lbModifyVolumeParams is only valid if the returned error is 'nil'.
+func parseCSIModifyVolumeParams(params map[string]string) (lbModifyVolumeParams, error) {
+	res := lbModifyVolumeParams{}
+	var err error
+
+	// sort to return consistent errors in case of multiple bad keys:
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		val := params[k]
+		key := mutParKey(k)
+		switch k {
+		case volParQosNameKey:
+			if val == "" {
+				return res, mkEinval(key, "QoS policy name must not be empty")
+			}
+			res.qosPolicyName = val
+		case volParCompressKey:
+			var compress bool
+			switch val {
+			case "disabled":
+				compress = false
+			case "enabled":
+				compress = true
+			default:
+				return res, mkEinval(key, val)
+			}
+			res.compression = &compress
+		case volParLabelsKey:
+			res.labels, err = parseLabels(key, val)
+			if err != nil {
+				return res, err
+			}
+		default:
+			return res, mkEinvalf(key, "volume param '%s' can't be modified", k)
+		}
+	}
+	return res, nil
+}
+
+// applyTo() overrides the corresponding `params` fields with the ones
+// specified in `mp`, as long as the result still makes sense.
+func (mp *lbModifyVolumeParams) applyTo(params *lbCreateVolumeParams) error {
+	if mp.qosPolicyName != "" {
+		params.qosPolicyName = mp.qosPolicyName
+	}
+	if mp.compression != nil {
+		params.compression = *mp.compression
+		if params.hostCrypto != "" && params.compression {
+			return mkEbadOp("mismatch", mutParKey(volParCompressKey),
+				"host-encryption and compression are both enabled")
+		}
+	}
+	if mp.labels != nil {
+		labels, err := withLabels(mutParKey(volParLabelsKey), params.labels, mp.labels,
+			params.hostCrypto)
+		if err != nil {
+			return err
+		}
+		params.labels = nil
+		if len(labels) > 0 {
+			params.labels = labels
+		}
+	}
+	return nil
+}
+
 // lbResourceID: ---------------------------------------------------------------
 
 // resIDRegex is used for initial syntactic validation of `lbResourceID`
@@ -228,7 +659,9 @@ func init() {
 			`nguid:([0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})` +
 			`(\|proj:([^[:cntrl:]| ]+))?` + // proj name syntax checked separately
 			`(\|scheme:(grpc|grpcs))?` +
-			`(\|hostcrypto:(luks2))?$`)
+			`(\|hostcrypto:(luks2))?` +
+			`(\|tls:(psk))?` +
+			`(\|xport:(tcp|rdma))?$`)
 }
 
 // lbResourceID uniquely identifies a lightbits resource such as a volume / snapshot / etc.
@@ -239,13 +672,15 @@ func init() {
 //
 // for transmission on the wire, it's serialised into a string with the
 // following fixed format:
-//   mgmt:<host>:<port>[,<host>:<port>...]|nguid:<nguid>[|proj:<proj>][|scheme:<scheme>][|hostcrypto:<format>]
+//   mgmt:<host>:<port>[,<host>:<port>...]|nguid:<nguid>[|proj:<proj>][|scheme:<scheme>][|hostcrypto:<format>][|tls:<tls>][|xport:<xport>]
 // where:
 //    <host>    - mgmt API server endpoint of the LightOS cluster hosting the
-//            volume. can be a hostname or an IP address. more than one
+//            volume. can be a hostname or an IP address. IPv6 addresses are
+//            enclosed in square brackets, as in URLs (RFC 3986), with an
+//            optional zone (e.g. `[fe80::1%eth0]`), so they contain neither
+//            ',' nor '|' and the format stays unambiguous - and unchanged
+//            for the pre-existing IPv4 and hostname volume IDs. more than one
 //            comma-separated <host>:<port> pair can be specified.
-//            TODO: IPv6 support will require amending parsing for bizarre
-//            extra allowed characters.
 //    <port>    - variable-length printable decimal representation of the
 //            uint16 port number, no leading zeroes.
 //    <nguid>   - volume NGUID (see NVMe spec, Identify NS Data Structure)
@@ -262,14 +697,25 @@ func init() {
 //            requests anyway. see below in parseCSIResourceID().
 //    <hostcrypto>  - specifies the crypto format of the hostEncrypted volume, only luks2 is possible.
 //            this is optional and will only exist for host-encrypted volumes.
+//    <tls>     - NVMe/TCP TLS flavour the nodes must use to connect to the
+//            volume, only psk is possible. this is optional and will only
+//            exist for volumes created with `nvme-tls` enabled.
+//    <xport>   - NVMe-oF transport the nodes must use to connect to the
+//            volume, tcp or rdma. if absent, the transport is the plugin
+//            default one (Config.DefaultTransport), which is 'tcp' unless
+//            overridden, as it has always been.
 // e.g.:
 //   mgmt:10.0.0.1:80,10.0.0.2:80|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66|proj:a|scheme:grpcs
 //   mgmt:lb01.net:80|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66|proj:b|scheme:grpcs|hostcrypto:luks2
+//   mgmt:10.0.0.1:443,[2001:db8::1]:443|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66|proj:c|scheme:grpcs
+//   mgmt:10.0.0.1:443|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66|proj:d|scheme:grpcs|tls:psk
+//   mgmt:10.0.0.1:443|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66|proj:e|scheme:grpcs|xport:rdma
 //
 // TODO: the CSI spec mandates that strings "SHALL NOT" exceed 128 bytes.
 // K8s is more lenient (at least 253 bytes, likely more). in any case, with
 // the current `volume_id` format, at most 4 mgmt API server endpoints can
-// be guaranteed to be supported. anything beyond that is at the mercy of
+// be guaranteed to be supported (fewer with IPv6 addresses, which can take up
+// to 47 bytes each). anything beyond that is at the mercy of
 // the CO implementors (and user network admins assigning IP ranges)...
 type lbResourceID struct {
 	mgmtEPs    endpoint.Slice // LightOS mgmt API server endpoints.
@@ -277,6 +723,8 @@ type lbResourceID struct {
 	projName   string
 	scheme     string // currently must be 'grpcs'
 	hostCrypto string
+	nvmeTLS    string // volume IDs only, snapshot IDs never carry it.
+	transport  string // ditto, empty for the plugin default transport.
 }
 
 // String generates the string representation of lbResourceID that will be
@@ -292,9 +740,57 @@ func (vid lbResourceID) String() string {
 	if len(vid.hostCrypto) > 0 {
 		res += fmt.Sprintf("|hostcrypto:%s", vid.hostCrypto)
 	}
+	if len(vid.nvmeTLS) > 0 {
+		res += fmt.Sprintf("|tls:%s", vid.nvmeTLS)
+	}
+	if len(vid.transport) > 0 {
+		res += fmt.Sprintf("|xport:%s", vid.transport)
+	}
 	return res
 }
 
+// nvmeTransport() returns the NVMe-oF transport to access the volume over,
+// `defXport` if the volume ID doesn't specify one.
+func (vid lbResourceID) nvmeTransport(defXport string) string {
+	if vid.transport == "" {
+		return defXport
+	}
+	return vid.transport
+}
+
+// volIDLabel() encodes volume ID `vid` as the lbLabelVolID volume label value:
+// the URL-safe unpadded base64 of its string form, with a nil NGUID, as
+// LightOS only assigns one on volume creation. returns false if the result
+// is too long to fit in a label value.
+func (vid lbResourceID) volIDLabel() (string, bool) {
+	vid.uuid = guuid.Nil
+	label := base64.RawURLEncoding.EncodeToString([]byte(vid.String()))
+	return label, lbLabelRegex.MatchString(label)
+}
+
+// parseVolIDLabel() rebuilds the ID of volume `uuid` in project `projName`
+// out of its lbLabelVolID label value, q.v. volIDLabel().
+func parseVolIDLabel(label string, uuid guuid.UUID, projName string) (lbResourceID, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(label)
+	if err != nil {
+		return lbResourceID{}, fmt.Errorf("bad volume ID label '%s': %s", label, err)
+	}
+	nilNGUID := "|nguid:" + guuid.Nil.String()
+	id := string(raw)
+	if !strings.Contains(id, nilNGUID) {
+		return lbResourceID{}, fmt.Errorf("volume ID label '%s' has no nil NGUID", id)
+	}
+	vid, err := parseCSIResourceID(strings.Replace(id, nilNGUID, "|nguid:"+uuid.String(), 1))
+	if err != nil {
+		return lbResourceID{}, err
+	}
+	if vid.projName != projName {
+		return lbResourceID{}, fmt.Errorf("volume ID label '%s' project name differs "+
+			"from volume project name '%s'", id, projName)
+	}
+	return vid, nil
+}
+
 // parseCSIResourceID parses CSI wire-protocol-level `volume_id` string into its
 // constituents and syntactically validates it. the returned lbResourceID is
 // only valid if the returned error is 'nil'.
@@ -352,6 +848,12 @@ func parseCSIResourceID(id string) (lbResourceID, error) {
 		vid.hostCrypto = match[7][12:]
 	}
 
+	// if empty string, the volume is accessed over cleartext NVMe/TCP.
+	vid.nvmeTLS = match[10]
+
+	// if empty string, the volume is accessed over NVMe/TCP.
+	vid.transport = match[12]
+
 	return vid, nil
 }
 
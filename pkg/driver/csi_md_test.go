@@ -12,6 +12,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/require"
 
+	"github.com/lightbitslabs/los-csi/pkg/driver/backend"
 	"github.com/lightbitslabs/los-csi/pkg/util/endpoint"
 )
 
@@ -20,6 +21,8 @@ type testCase struct {
 	pr string
 	sc string
 	cr string
+	tl string
+	xp string
 }
 
 //nolint:lll
@@ -48,11 +51,30 @@ var goodIDs = []testCase{
 	{id: "mgmt:10.19.151.24:443,10.19.151.6:443|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66|scheme:grpcs", sc: "grpcs"},
 	{id: "mgmt:10.19.151.24:443,10.19.151.6:443|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66|scheme:grpc", sc: "grpc"},
 	{id: "mgmt:10.19.151.24:443,10.19.151.6:443|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66|scheme:grpcs|hostcrypto:luks2", sc: "grpcs", cr: "luks2"},
+
+	{id: "mgmt:[2001:db8::1]:443|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66|proj:a|scheme:grpcs", pr: "a", sc: "grpcs"},
+	{id: "mgmt:[2001:db8::1]:443,[2001:db8::2]:443|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66|proj:a|scheme:grpcs", pr: "a", sc: "grpcs"},
+	{id: "mgmt:10.0.0.1:443,[2001:db8::1]:443,lb01.net:443|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66|proj:a", pr: "a"},
+	{id: "mgmt:[fe80::1%eth0]:443|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66|scheme:grpcs|hostcrypto:luks2", sc: "grpcs", cr: "luks2"},
+	{id: "mgmt:[::ffff:10.0.0.1]:443|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66"},
+
+	{id: "mgmt:10.0.0.1:443|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66|proj:a|scheme:grpcs|tls:psk", pr: "a", sc: "grpcs", tl: "psk"},
+	{id: "mgmt:10.0.0.1:443|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66|scheme:grpcs|hostcrypto:luks2|tls:psk", sc: "grpcs", cr: "luks2", tl: "psk"},
+	{id: "mgmt:[2001:db8::1]:443|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66|tls:psk", tl: "psk"},
+
+	{id: "mgmt:10.0.0.1:443|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66|proj:a|scheme:grpcs|xport:rdma", pr: "a", sc: "grpcs", xp: "rdma"},
+	{id: "mgmt:10.0.0.1:443|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66|scheme:grpcs|hostcrypto:luks2|xport:rdma", sc: "grpcs", cr: "luks2", xp: "rdma"},
+	{id: "mgmt:1.2.3.4:80|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66|tls:psk|xport:tcp", tl: "psk", xp: "tcp"},
 }
 
 //nolint:lll
 var badIDs = []string{
 	"",
+	"mgmt:1.2.3.4:80|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66|tls:",
+	"mgmt:1.2.3.4:80|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66|tls:cert",
+	"mgmt:1.2.3.4:80|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66|tls:psk|hostcrypto:luks2",
+	"mgmt:1.2.3.4:80|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66|xport:",
+	"mgmt:1.2.3.4:80|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66|xport:rdma|tls:psk",
 	"\n",
 	"\\0",
 	"mgmt:1.2.3.4:80||nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66",
@@ -212,6 +234,15 @@ var badIDs = []string{
 	"mgmt:1.2.3.4.:443|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66|proj:-a.|scheme:grpc",
 
 	"mgmt:1.2.3.4:80|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66'); DROP TABLE Students;--",
+
+	"mgmt:2001:db8::1:443|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66",
+	"mgmt:[2001:db8::1]|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66",
+	"mgmt:[2001:db8::1]:|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66",
+	"mgmt:2001:db8::1]:443|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66",
+	"mgmt:[2001:db8::1:443|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66",
+	"mgmt:[2001:db8::g]:443|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66",
+	"mgmt:[lb01:net]:443|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66",
+	"mgmt:[2001:db8::1]:443,,[2001:db8::2]:443|nguid:6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66",
 }
 
 func TestParseCSIResourceID(t *testing.T) {
@@ -236,6 +267,12 @@ func TestParseCSIResourceID(t *testing.T) {
 		} else if tc.cr != "" && vol.hostCrypto != tc.cr {
 			t.Errorf("BUG: botched parsing hostcrypto in '%s':\ngot '%s' instead of '%s'",
 				tc.id, vol.hostCrypto, tc.cr)
+		} else if vol.nvmeTLS != tc.tl {
+			t.Errorf("BUG: botched parsing tls in '%s':\ngot '%s' instead of '%s'",
+				tc.id, vol.nvmeTLS, tc.tl)
+		} else if vol.transport != tc.xp {
+			t.Errorf("BUG: botched parsing xport in '%s':\ngot '%s' instead of '%s'",
+				tc.id, vol.transport, tc.xp)
 		} else if testing.Verbose() {
 			t.Logf("OK: parsed '%s':\nmgmt EPs: '%s', NGUID: '%s'",
 				tc.id, vol.mgmtEPs, vol.uuid)
@@ -305,6 +342,42 @@ func TestParseCSIResourceID(t *testing.T) {
 	}
 }
 
+func TestResourceIDRoundTrip(t *testing.T) {
+	nguid := uuid.MustParse("6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66")
+	for _, eps := range []string{
+		"10.0.0.1:443,10.0.0.2:443",
+		"[2001:db8::1]:443",
+		"[2001:db8::2]:443,[2001:db8::1]:443,10.0.0.1:443,lb01.net:443",
+		"[fe80::1%eth0]:443",
+	} {
+		t.Run(eps, func(t *testing.T) {
+			vid := lbResourceID{
+				mgmtEPs:    endpoint.MustParseCSV(eps),
+				uuid:       nguid,
+				projName:   "a",
+				scheme:     grpcsXport,
+				hostCrypto: "luks2",
+				nvmeTLS:    nvmeTLSPSK,
+			}
+			res, err := parseCSIResourceID(vid.String())
+			require.NoError(t, err)
+			require.Equal(t, vid, res)
+
+			vid.nvmeTLS = ""
+			vid.transport = backend.TransportRDMA
+			res, err = parseCSIResourceID(vid.String())
+			require.NoError(t, err)
+			require.Equal(t, vid, res)
+
+			label, ok := vid.volIDLabel()
+			require.True(t, ok)
+			res, err = parseVolIDLabel(label, nguid, vid.projName)
+			require.NoError(t, err)
+			require.Equal(t, vid, res)
+		})
+	}
+}
+
 func TestParseCSICreateVolumeParams(t *testing.T) {
 	//nolint:lll
 	testCases := []struct {
@@ -390,6 +463,291 @@ func TestParseCSICreateVolumeParams(t *testing.T) {
 				mgmtScheme:   "grpcs",
 			},
 		},
+		{
+			name: "failure domains",
+			params: map[string]string{
+				volParMgmtEPKey: "1.2.3.4:80",
+				volParRepCntKey: "1",
+				volParFDsKey:    " rack-2, rack-1,rack-2",
+			},
+			err: nil,
+			result: lbCreateVolumeParams{
+				mgmtEPs:        endpoint.Slice{endpoint.MustParse("1.2.3.4:80")},
+				replicaCount:   1,
+				mgmtScheme:     "grpcs",
+				failureDomains: []string{"rack-1", "rack-2"},
+			},
+		},
+		{
+			name: "nvme tls",
+			params: map[string]string{
+				volParMgmtEPKey: "1.2.3.4:80",
+				volParRepCntKey: "3",
+				volNvmeTLSKey:   "enabled",
+			},
+			err: nil,
+			result: lbCreateVolumeParams{
+				mgmtEPs:      endpoint.Slice{endpoint.MustParse("1.2.3.4:80")},
+				replicaCount: 3,
+				mgmtScheme:   "grpcs",
+				nvmeTLS:      "psk",
+			},
+		},
+		{
+			name: "invalid nvme tls",
+			params: map[string]string{
+				volParMgmtEPKey: "1.2.3.4:80",
+				volParRepCntKey: "3",
+				volNvmeTLSKey:   "psk",
+			},
+			err: mkEinval(volParKey(volNvmeTLSKey), "psk"),
+		},
+		{
+			name: "rdma transport",
+			params: map[string]string{
+				volParMgmtEPKey:    "1.2.3.4:80",
+				volParRepCntKey:    "3",
+				volParTransportKey: "rdma",
+			},
+			err: nil,
+			result: lbCreateVolumeParams{
+				mgmtEPs:      endpoint.Slice{endpoint.MustParse("1.2.3.4:80")},
+				replicaCount: 3,
+				mgmtScheme:   "grpcs",
+				transport:    "rdma",
+			},
+		},
+		{
+			name: "explicit tcp transport",
+			params: map[string]string{
+				volParMgmtEPKey:    "1.2.3.4:80",
+				volParRepCntKey:    "3",
+				volParTransportKey: "tcp",
+			},
+			err: nil,
+			result: lbCreateVolumeParams{
+				mgmtEPs:      endpoint.Slice{endpoint.MustParse("1.2.3.4:80")},
+				replicaCount: 3,
+				mgmtScheme:   "grpcs",
+				transport:    "tcp",
+			},
+		},
+		{
+			name: "invalid transport",
+			params: map[string]string{
+				volParMgmtEPKey:    "1.2.3.4:80",
+				volParRepCntKey:    "3",
+				volParTransportKey: "fc",
+			},
+			err: mkEinval(volParKey(volParTransportKey), "fc"),
+		},
+		{
+			name: "LUKS format settings",
+			params: map[string]string{
+				volParMgmtEPKey:             "1.2.3.4:80",
+				volParRepCntKey:             "3",
+				volHostEncryptionKey:        "enabled",
+				volHostEncryptionCipherKey:  "aes-xts-plain64",
+				volHostEncryptionKeySizeKey: "512",
+				volHostEncryptionPBKDFKey:   "argon2id",
+			},
+			err: nil,
+			result: lbCreateVolumeParams{
+				mgmtEPs:      endpoint.Slice{endpoint.MustParse("1.2.3.4:80")},
+				replicaCount: 3,
+				mgmtScheme:   "grpcs",
+				hostCrypto:   "luks2",
+				luksFormat: luksFormatOpts{
+					Cipher: "aes-xts-plain64", KeySize: 512, PBKDF: "argon2id",
+				},
+				labels: map[string]string{
+					lbLabelLUKSFormat: "aes-xts-plain64_512__argon2id_",
+				},
+			},
+		},
+		{
+			name: "LUKS format settings w/o host-encryption",
+			params: map[string]string{
+				volParMgmtEPKey:           "1.2.3.4:80",
+				volParRepCntKey:           "3",
+				volHostEncryptionPBKDFKey: "argon2id",
+			},
+			err: mkEbadOp("mismatch", volHostEncryptionKey,
+				"host-encryption settings specified, but host-encryption is disabled"),
+		},
+		{
+			name: "bad LUKS cipher",
+			params: map[string]string{
+				volParMgmtEPKey:            "1.2.3.4:80",
+				volParRepCntKey:            "3",
+				volHostEncryptionKey:       "enabled",
+				volHostEncryptionCipherKey: "aes-cbc-essiv:sha256",
+			},
+			err: mkEinval(volParKey(volHostEncryptionCipherKey), "bad cipher "+
+				"'aes-cbc-essiv:sha256', must be in <cipher>-<chain mode>-<IV mode> "+
+				"format, e.g. aes-xts-plain64"),
+		},
+		{
+			name: "bad LUKS key size",
+			params: map[string]string{
+				volParMgmtEPKey:             "1.2.3.4:80",
+				volParRepCntKey:             "3",
+				volHostEncryptionKey:        "enabled",
+				volHostEncryptionKeySizeKey: "-256",
+			},
+			err: mkEinval(volParKey(volHostEncryptionKeySizeKey), "-256"),
+		},
+		{
+			name: "LUKS XTS key too small",
+			params: map[string]string{
+				volParMgmtEPKey:             "1.2.3.4:80",
+				volParRepCntKey:             "3",
+				volHostEncryptionKey:        "enabled",
+				volHostEncryptionCipherKey:  "aes-xts-plain64",
+				volHostEncryptionKeySizeKey: "128",
+			},
+			err: mkEinval(volParKey(volHostEncryptionKeySizeKey), "key size 128 is too "+
+				"small for XTS cipher 'aes-xts-plain64', use 256 or 512"),
+		},
+		{
+			name: "bad LUKS integrity",
+			params: map[string]string{
+				volParMgmtEPKey:               "1.2.3.4:80",
+				volParRepCntKey:               "3",
+				volHostEncryptionKey:          "enabled",
+				volHostEncryptionIntegrityKey: "crc32c",
+			},
+			err: mkEinval(volParKey(volHostEncryptionIntegrityKey), "bad integrity "+
+				"mode 'crc32c', must be one of: none, hmac-sha256, hmac-sha512"),
+		},
+		{
+			name: "nvme tls over rdma",
+			params: map[string]string{
+				volParMgmtEPKey:    "1.2.3.4:80",
+				volParRepCntKey:    "3",
+				volParTransportKey: "rdma",
+				volNvmeTLSKey:      "enabled",
+			},
+			err: mkEbadOp("mismatch", volNvmeTLSKey,
+				"NVMe/TCP TLS is only supported with the 'tcp' transport"),
+		},
+		{
+			name: "invalid failure domain",
+			params: map[string]string{
+				volParMgmtEPKey: "1.2.3.4:80",
+				volParRepCntKey: "1",
+				volParFDsKey:    "rack-1,rack 2",
+			},
+			err: mkEinval(volParKey(volParFDsKey), "'rack 2'"),
+		},
+		{
+			name: "empty failure domain",
+			params: map[string]string{
+				volParMgmtEPKey: "1.2.3.4:80",
+				volParRepCntKey: "1",
+				volParFDsKey:    "rack-1,",
+			},
+			err: mkEinvalMissing(volParKey(volParFDsKey)),
+		},
+		{
+			name: "failure domains with multiple replicas",
+			params: map[string]string{
+				volParMgmtEPKey: "1.2.3.4:80",
+				volParRepCntKey: "2",
+				volParFDsKey:    "rack-1",
+			},
+			err: mkEbadOp("mismatch", volParFDsKey, "failure domain placement "+
+				"restrictions are only supported for volumes with a single replica"),
+		},
+		{
+			name: "labels and K8s metadata",
+			params: map[string]string{
+				volParMgmtEPKey:    "1.2.3.4:80",
+				volParRepCntKey:    "3",
+				volParLabelsKey:    "team=storage, tier=gold",
+				k8sPVCNameKey:      "data-db-0",
+				k8sPVCNamespaceKey: "prod",
+				k8sPVNameKey:       "pvc-8c7f0b2e-4f0e-4a4e-9b1e-3c4d5e6f7a8b",
+			},
+			err: nil,
+			result: lbCreateVolumeParams{
+				mgmtEPs:      endpoint.Slice{endpoint.MustParse("1.2.3.4:80")},
+				replicaCount: 3,
+				mgmtScheme:   "grpcs",
+				labels: map[string]string{
+					"team":              "storage",
+					"tier":              "gold",
+					lbLabelPVCName:      "data-db-0",
+					lbLabelPVCNamespace: "prod",
+					lbLabelPVName:       "pvc-8c7f0b2e-4f0e-4a4e-9b1e-3c4d5e6f7a8b",
+				},
+			},
+		},
+		{
+			name: "malformed label",
+			params: map[string]string{
+				volParMgmtEPKey: "1.2.3.4:80",
+				volParRepCntKey: "3",
+				volParLabelsKey: "team",
+			},
+			err: mkEinval(volParKey(volParLabelsKey), "'team' is not in <key>=<value> format"),
+		},
+		{
+			name: "bad label value",
+			params: map[string]string{
+				volParMgmtEPKey: "1.2.3.4:80",
+				volParRepCntKey: "3",
+				volParLabelsKey: "team=a/b",
+			},
+			err: mkEinval(volParKey(volParLabelsKey), "bad label 'team' value 'a/b'"),
+		},
+		{
+			name: "reserved label key",
+			params: map[string]string{
+				volParMgmtEPKey: "1.2.3.4:80",
+				volParRepCntKey: "3",
+				volParLabelsKey: lbLabelPVName + "=foo",
+			},
+			err: mkEinval(volParKey(volParLabelsKey), "label key 'k8s-pv-name' is reserved"),
+		},
+		{
+			name: "reserved LUKS key label",
+			params: map[string]string{
+				volParMgmtEPKey: "1.2.3.4:80",
+				volParRepCntKey: "3",
+				volParLabelsKey: lbLabelLUKSKey + "=foo",
+			},
+			err: mkEinval(volParKey(volParLabelsKey), "label key 'lb-csi-luks-key' is reserved"),
+		},
+		{
+			name: "reserved LUKS format label",
+			params: map[string]string{
+				volParMgmtEPKey: "1.2.3.4:80",
+				volParRepCntKey: "3",
+				volParLabelsKey: lbLabelLUKSFormat + "=foo",
+			},
+			err: mkEinval(volParKey(volParLabelsKey), "label key 'lb-csi-luks-format' is reserved"),
+		},
+		{
+			name: "duplicate label key",
+			params: map[string]string{
+				volParMgmtEPKey: "1.2.3.4:80",
+				volParRepCntKey: "3",
+				volParLabelsKey: "a=1,a=2",
+			},
+			err: mkEinval(volParKey(volParLabelsKey), "duplicate label key 'a'"),
+		},
+		{
+			name: "too many labels",
+			params: map[string]string{
+				volParMgmtEPKey: "1.2.3.4:80",
+				volParRepCntKey: "3",
+				volParLabelsKey: "a=1,b=2,c=3,d=4,e=5,f=6,g=7,h=8,i=9,j=10,k=11,l=12,m=13,n=14,o=15,p=16",
+				k8sPVCNameKey:   "data-db-0",
+			},
+			err: mkEinval(volParKey(volParLabelsKey), "17 labels specified (including "+
+				"the ones derived from K8s metadata), limit is 16"),
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -483,3 +841,34 @@ func TestCheckProjectName(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckTLSPSK(t *testing.T) {
+	// `nvme gen-tls-key` samples, and some mangled versions thereof:
+	testCases := []struct {
+		psk string
+		ok  bool
+	}{
+		{"NVMeTLSkey-1:01:VRLbtnN9AQb2WXW3c9+wEf/DRLz0QuLdbYvEhwtdWwNf9LrZ:", true},
+		{"NVMeTLSkey-1:00:VRLbtnN9AQb2WXW3c9+wEf/DRLz0QuLdbYvEhwtdWwNf9LrZ:", true},
+		{"NVMeTLSkey-1:02:VRLbtnN9AQb2WXW3c9+wEf/DRLz0QuLdbYvEhwtdWwNf9LrZ:", false},
+		{"NVMeTLSkey-1:03:VRLbtnN9AQb2WXW3c9+wEf/DRLz0QuLdbYvEhwtdWwNf9LrZ:", false},
+		{"NVMeTLSkey-1:01:VRLbtnN9AQb2WXW3c9+wEf/DRLz0QuLdbYvEhwtdWwNf9LrA:", false},
+		{"NVMeTLSkey-1:01:VRLbtnN9AQb2WXW3c9+wEf/DRLz0QuLdbYvEhwtdWwNf9LrZ", false},
+		{"NVMeTLSkey-1:01:not base64!:", false},
+		{"DHHC-1:01:VRLbtnN9AQb2WXW3c9+wEf/DRLz0QuLdbYvEhwtdWwNf9LrZ:", false},
+		{"", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.psk, func(t *testing.T) {
+			err := checkTLSPSK("secrets.psk", tc.psk)
+			if tc.ok {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				if len(tc.psk) > 16 {
+					require.NotContains(t, err.Error(), tc.psk[16:])
+				}
+			}
+		})
+	}
+}
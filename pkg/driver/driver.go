@@ -13,7 +13,8 @@ import (
 	"regexp"
 	"runtime"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/fsnotify/fsnotify"
@@ -22,6 +23,9 @@ import (
 	grpc_recovery "github.com/grpc-ecosystem/go-grpc-middleware/recovery"
 	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
@@ -30,11 +34,15 @@ import (
 	"k8s.io/utils/exec"
 
 	"github.com/lightbitslabs/los-csi/pkg/driver/backend"
-	_ "github.com/lightbitslabs/los-csi/pkg/driver/backend/dsc" // register backend
+	_ "github.com/lightbitslabs/los-csi/pkg/driver/backend/dsc"     // register backend
+	_ "github.com/lightbitslabs/los-csi/pkg/driver/backend/nvmetcp" // register backend
 	"github.com/lightbitslabs/los-csi/pkg/grpcutil"
 	"github.com/lightbitslabs/los-csi/pkg/lb"
 	"github.com/lightbitslabs/los-csi/pkg/lb/lbgrpc"
+	"github.com/lightbitslabs/los-csi/pkg/metrics"
+	"github.com/lightbitslabs/los-csi/pkg/tracing"
 	"github.com/lightbitslabs/los-csi/pkg/util/endpoint"
+	"github.com/lightbitslabs/los-csi/pkg/util/nlock"
 )
 
 const (
@@ -42,6 +50,9 @@ const (
 	driverName = "csi.lightbitslabs.com"
 
 	logTimestampFmt = "2006-01-02T15:04:05.000000-07:00"
+
+	// plugin instance role of the controller pod, q.v. Config.LogRole.
+	roleController = "controller"
 )
 
 var (
@@ -78,20 +89,53 @@ type Config struct {
 	BackendCfgPath string // if valid - contents override DefaultBackend.
 	JWTPath        string
 	LUKSCfgPath    string
+	// optional, path to the node topology config file, see topologyConfig.
+	TopologyCfgPath string
 
 	NodeID   string
 	Endpoint string // must be a Unix Domain Socket URI
 
 	DefaultFS string // one of: ext4, xfs
+	// NVMe-oF transport of the volumes whose IDs and StorageClasses don't
+	// specify one, one of: tcp, rdma. must be the same for the controller
+	// and all the nodes.
+	DefaultTransport string
+
+	// optional, LightOS cluster to use for servicing the CSI API calls that
+	// carry neither a volume/snapshot ID nor StorageClass params to derive
+	// the target cluster from (e.g. ListVolumes()). same syntax as the
+	// corresponding StorageClass params.
+	MgmtEndpoint string // comma-separated list of <host>:<port>
+	MgmtScheme   string // one of: grpcs, grpc. defaults to grpcs.
+	ProjectName  string // if empty - all projects accessible by the JWT.
+
+	// optional, LightOS API TLS settings for the "grpcs" scheme, see
+	// lb.TLSConfig. the files are monitored for changes and auto-reloaded,
+	// same as the JWT. all of these can be overridden on a per-StorageClass
+	// basis through the secrets, q.v. mgmtCAKey and friends.
+	MgmtCAPath         string // PEM CA bundle, if empty - system roots.
+	MgmtClientCertPath string // PEM client cert, for mTLS.
+	MgmtClientKeyPath  string // PEM client key, for mTLS.
+	MgmtServerName     string // overrides the name the certs are verified against.
+	// legacy behaviour, DANGEROUS: don't verify the LightOS API server certs.
+	MgmtTLSSkipVerify bool
+
+	// optional, <host>:<port> to serve Prometheus metrics over HTTP on. if
+	// empty - metrics are not served.
+	MetricsAddr string
+
+	// optional, URL of the OpenTelemetry collector to export the traces to
+	// over OTLP/HTTP, e.g. "http://otel-collector:4318". if empty - tracing
+	// is disabled.
+	OTLPEndpoint string
 
 	LogLevel      string // one of: debug/info/warn/error
-	LogRole       string
+	LogRole       string // "node" or "controller", q.v. servesNode().
 	LogTimestamps bool
 	LogFormat     string
 
 	// hidden, dev-only options:
 	BinaryName    string
-	Transport     string // one of: tcp/rdma
 	SquelchPanics bool
 	PrettyJSON    bool
 	RWX           bool
@@ -103,7 +147,27 @@ type Driver struct {
 	luksCfgFile string // path to luks configuration yaml file.
 	nodeID      string
 	hostNQN     string
+	role        string
 	defaultFS   string
+	// NVMe-oF transport of the volumes that don't specify one, never empty.
+	defaultTransport string
+
+	// "default" LightOS cluster, q.v. Config.MgmtEndpoint.
+	mgmtEPs    endpoint.Slice
+	mgmtScheme string
+	projName   string
+
+	// global LightOS API TLS settings, see reloadMgmtTLS(). never nil
+	// once New() is done.
+	mgmtTLSFiles mgmtTLSFiles
+	mgmtTLS      atomic.Pointer[lb.TLSConfig]
+
+	metricsAddr string                   // if empty - metrics are disabled.
+	tracer      *sdktrace.TracerProvider // if nil - tracing is disabled.
+
+	// node topology, as published by NodeGetInfo(). never nil, but may
+	// be empty.
+	topology *topologyConfig
 
 	srv *grpc.Server
 	log *logrus.Entry
@@ -113,9 +177,11 @@ type Driver struct {
 	mounter *mountutils.SafeFormatAndMount
 
 	be backend.Backend
-
-	// only 'tcp' is properly supported, 'rdma' is a dev/test-only hack
-	transport string
+	// conns is shared with `be`, and keeps track of which volumes are
+	// attached through which NVMe-oF subsystems.
+	conns *backend.ConnTracker
+	// inventory of the volumes on the node, see reconcileNodeState().
+	inventory nodeInventory
 
 	// this should be used for dev/test only: if the driver tanked with a
 	// panic, all bets on its internal state are off. the only reason to
@@ -123,16 +189,11 @@ type Driver struct {
 	// the gRPC level so you can spot them from remote.
 	squelchPanics bool
 
-	// TODO: a gross hack, obviously. a more sensible thing to do would be
-	// to have a set of named per-volume_id GLocks, and a set of per-NVMe-oF
-	// connection-set (transport/addr/port/SubNQN/HostNQN) GLocks, locked
-	// in that order. that would allow for concurrent local-only ops on
-	// unrelated volumes and concurrent ops involving network on unrelated
-	// targets. since quite a few of the ops the driver does might block
-	// for significant amounts of time (think NVMe-oF network timeouts,
-	// mgmt API timeouts, the time it takes to fsck a 4TB ext4, etc.), a
-	// single huge lock is unfortunate, but safety first...
-	bdl sync.Mutex
+	// node-local named locks: per-volume_id ones and per-NVMe-oF
+	// connection-set (SubNQN/HostNQN) ones, locked in that
+	// order. see lockVolume() and lockConnSet() for details.
+	volLocks  nlock.Set
+	connLocks nlock.Set
 
 	// jwt is the JWT loaded from the file specified by `jwtPath`. it is
 	// used for authN/authZ when communicating with the LightOS API service.
@@ -158,6 +219,7 @@ type Driver struct {
 	csi.UnimplementedIdentityServer
 	csi.UnimplementedControllerServer
 	csi.UnimplementedNodeServer
+	csi.UnimplementedSnapshotMetadataServer
 }
 
 const (
@@ -202,7 +264,8 @@ func hostNQNToNodeID(hostNQN string) string {
 }
 
 func createBackend(
-	log *logrus.Entry, hostNQN, cfgPath, defaultBackend string,
+	log *logrus.Entry, hostNQN string, conns *backend.ConnTracker,
+	cfgPath, defaultBackend string,
 ) (backend.Backend, error) {
 	beType := defaultBackend
 	rawCfg, err := os.ReadFile(cfgPath)
@@ -219,7 +282,7 @@ func createBackend(
 			cfgPath, defaultBackend)
 	}
 
-	be, err := backend.Make(beType, log, hostNQN, rawCfg)
+	be, err := backend.Make(beType, log, hostNQN, conns, rawCfg)
 	if err != nil {
 		return nil, fmt.Errorf("can't initialize '%s' backend: %s", beType, err)
 	}
@@ -230,7 +293,7 @@ func New(cfg Config) (*Driver, error) { //nolint:gocritic
 	d := &Driver{
 		jwtPath:       cfg.JWTPath,
 		nodeID:        cfg.NodeID,
-		transport:     cfg.Transport,
+		role:          cfg.LogRole,
 		squelchPanics: cfg.SquelchPanics,
 		luksCfgFile:   filepath.Join(cfg.LUKSCfgPath, DefaultLUKSCfgFileName),
 		rwx:           cfg.RWX,
@@ -259,9 +322,46 @@ func New(cfg Config) (*Driver, error) { //nolint:gocritic
 		return nil, fmt.Errorf("unsupported default FS: '%s'", cfg.DefaultFS)
 	}
 
-	if cfg.Transport != "tcp" && cfg.Transport != "rdma" {
-		return nil, fmt.Errorf("unsupported transport type: '%s'", cfg.Transport)
+	switch cfg.DefaultTransport {
+	case "", backend.TransportTCP:
+		d.defaultTransport = backend.TransportTCP
+	case backend.TransportRDMA:
+		d.defaultTransport = backend.TransportRDMA
+	default:
+		return nil, fmt.Errorf("unsupported default transport: '%s'",
+			cfg.DefaultTransport)
+	}
+
+	if cfg.MgmtEndpoint != "" {
+		d.mgmtEPs, err = endpoint.ParseCSV(cfg.MgmtEndpoint)
+		if err != nil {
+			return nil, fmt.Errorf("bad mgmt endpoint address '%s': %s",
+				cfg.MgmtEndpoint, err)
+		}
+	}
+	switch cfg.MgmtScheme {
+	case "", grpcsXport:
+		d.mgmtScheme = grpcsXport
+	case grpcXport:
+		d.mgmtScheme = grpcXport
+	default:
+		return nil, fmt.Errorf("unsupported mgmt scheme: '%s'", cfg.MgmtScheme)
+	}
+	d.projName = cfg.ProjectName
+	d.metricsAddr = cfg.MetricsAddr
+
+	d.mgmtTLSFiles = mgmtTLSFiles{
+		ca:         cfg.MgmtCAPath,
+		cert:       cfg.MgmtClientCertPath,
+		key:        cfg.MgmtClientKeyPath,
+		serverName: cfg.MgmtServerName,
+		skipVerify: cfg.MgmtTLSSkipVerify,
+	}
+	mgmtTLS, err := d.mgmtTLSFiles.load()
+	if err != nil {
+		return nil, fmt.Errorf("bad LightOS API TLS settings: %s", err)
 	}
+	d.mgmtTLS.Store(mgmtTLS)
 
 	level, err := logrus.ParseLevel(cfg.LogLevel)
 	if err != nil || level < logrus.ErrorLevel || level > logrus.DebugLevel {
@@ -301,8 +401,32 @@ func New(cfg Config) (*Driver, error) { //nolint:gocritic
 		"version-hash":     versionBuildHash,
 		"version-build-id": versionBuildID,
 	}).Info("starting...")
+	if cfg.MgmtTLSSkipVerify {
+		d.log.Warn("LightOS API server cert verification is DISABLED, " +
+			"the plugin is open to MITM attacks on the LightOS API traffic!")
+	}
+
+	if cfg.OTLPEndpoint != "" {
+		exp, err := tracing.NewOTLPExporter(cfg.OTLPEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		d.tracer = tracing.NewTracerProvider(exp,
+			attribute.String("service.name", cfg.BinaryName),
+			attribute.String("service.version", version),
+			attribute.String("service.instance.id", cfg.NodeID),
+			attribute.String("lb.csi.role", cfg.LogRole),
+		)
+	}
+
+	d.topology, err = loadTopologyConfig(d.log, cfg.TopologyCfgPath)
+	if err != nil {
+		return nil, err
+	}
 
-	d.be, err = createBackend(d.log, d.hostNQN, cfg.BackendCfgPath, cfg.DefaultBackend)
+	d.conns = backend.NewConnTracker(d.log, sysfsRoot, d.hostNQN)
+	d.be, err = createBackend(d.log, d.hostNQN, d.conns,
+		cfg.BackendCfgPath, cfg.DefaultBackend)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create backend: %s", err)
 	}
@@ -318,8 +442,9 @@ func New(cfg Config) (*Driver, error) { //nolint:gocritic
 
 	lbdialer := func(
 		ctx context.Context, targets endpoint.Slice, mgmtScheme string,
+		tlsCfg *lb.TLSConfig,
 	) (lb.Client, error) {
-		return lbgrpc.Dial(ctx, d.log, targets, mgmtScheme)
+		return lbgrpc.Dial(ctx, d.log, targets, mgmtScheme, tlsCfg)
 	}
 	d.lbclients = lb.NewClientPool(lbdialer)
 
@@ -350,6 +475,7 @@ func (d *Driver) Run() error {
 	}
 
 	interceptors := []grpc.UnaryServerInterceptor{
+		rpcMetrics.UnaryServerInterceptor(),
 		grpc_ctxtags.UnaryServerInterceptor(ctxTagOpts...),
 		grpc_logrus.UnaryServerInterceptor(d.log, logrusOpts...),
 		grpcutil.RespDetailInterceptor,
@@ -357,19 +483,42 @@ func (d *Driver) Run() error {
 			func(context.Context, string, interface{}) bool { return true },
 		),
 	}
+	// only the SnapshotMetadata service RPCs are streaming, and their
+	// payloads are way too bulky to be logged in full:
+	streamInterceptors := []grpc.StreamServerInterceptor{
+		rpcMetrics.StreamServerInterceptor(),
+		grpc_ctxtags.StreamServerInterceptor(ctxTagOpts...),
+		grpc_logrus.StreamServerInterceptor(d.log, logrusOpts...),
+	}
 	if d.squelchPanics {
 		interceptors = append(interceptors, grpc_recovery.UnaryServerInterceptor())
+		streamInterceptors = append(streamInterceptors,
+			grpc_recovery.StreamServerInterceptor())
 	}
 
-	d.srv = grpc.NewServer(grpc.UnaryInterceptor(
-		grpc_middleware.ChainUnaryServer(interceptors...)))
+	d.srv = grpc.NewServer(
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(interceptors...)),
+		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(streamInterceptors...)),
+	)
 
 	csi.RegisterIdentityServer(d.srv, d)
 	csi.RegisterNodeServer(d.srv, d)
 	csi.RegisterControllerServer(d.srv, d)
+	csi.RegisterSnapshotMetadataServer(d.srv, d)
+	rpcMetrics.InitializeMetrics(d.srv)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+
+	if d.tracer != nil {
+		tracing.SetTracerProvider(d.tracer)
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			d.tracer.Shutdown(ctx) //nolint:errcheck
+		}()
+	}
 	if err := d.monitorJWTVariable(ctx, d.jwtPath); err != nil {
 		// TODO: this is just wrong and it prevents reasonable usage:
 		// K8s secrets or host JWT file deployment becomes racy.
@@ -378,11 +527,36 @@ func (d *Driver) Run() error {
 		d.log.WithError(err).Errorf("failed to watch path '%s', "+
 			"global JWT file monitoring disabled", d.jwtPath)
 	}
+	if err := d.monitorMgmtTLS(ctx); err != nil {
+		d.log.WithError(err).Error("global LightOS API TLS settings " +
+			"monitoring disabled")
+	}
+
+	if d.servesNode() {
+		d.reconcileNodeState(ctx)
+	}
+
+	if d.metricsAddr != "" {
+		if d.servesNode() {
+			d.registerNodeMetrics()
+		}
+		if err := metrics.Serve(ctx, d.log, metrics.Registry, d.metricsAddr); err != nil {
+			return err
+		}
+	}
 
 	d.log.WithField("addr", d.sockPath).Info("server started")
 	return d.srv.Serve(listener)
 }
 
+// servesNode() returns true if this plugin instance serves the CSI Node
+// service, i.e. runs on a K8s node and attaches volumes to it. the controller
+// instance registers the Node service as well, but is never called on it, so
+// it must keep its hands off the node state of whatever host it runs on.
+func (d *Driver) servesNode() bool {
+	return d.role != roleController
+}
+
 func (d *Driver) setJWT(jwtPath string) {
 	log := d.log.WithField("jwt-path", jwtPath)
 	b, err := os.ReadFile(jwtPath)
@@ -398,12 +572,24 @@ func (d *Driver) setJWT(jwtPath string) {
 }
 
 func (d *Driver) monitorJWTVariable(ctx context.Context, jwtPath string) error {
+	err := d.monitorFile(ctx, jwtPath, func() { d.setJWT(jwtPath) })
+	if err != nil {
+		return err
+	}
+	d.setJWT(jwtPath)
+	return nil
+}
+
+// monitorFile calls `reload` whenever the file at `path` is modified or
+// replaced, until `ctx` is done.
+func (d *Driver) monitorFile(ctx context.Context, path string, reload func()) error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return err
 	}
-	err = watcher.Add(jwtPath)
+	err = watcher.Add(path)
 	if err != nil {
+		watcher.Close()
 		return err
 	}
 
@@ -417,12 +603,12 @@ func (d *Driver) monitorJWTVariable(ctx context.Context, jwtPath string) error {
 					// remove the watcher since the file is removed
 					watcher.Remove(event.Name)
 					// add a new watcher pointing to the new symlink/file
-					watcher.Add(jwtPath)
-					d.setJWT(jwtPath)
+					watcher.Add(path)
+					reload()
 				}
 				// also allow normal files to be modified and reloaded.
 				if event.Op&fsnotify.Write == fsnotify.Write {
-					d.setJWT(jwtPath)
+					reload()
 				}
 			case err, ok := <-watcher.Errors:
 				if !ok {
@@ -430,11 +616,11 @@ func (d *Driver) monitorJWTVariable(ctx context.Context, jwtPath string) error {
 				}
 				d.log.WithError(err).Error("watcher error")
 			case <-ctx.Done():
+				watcher.Close()
 				return
 			}
 		}
 	}()
-	d.setJWT(jwtPath)
 	return nil
 }
 
@@ -443,10 +629,25 @@ func (d *Driver) monitorJWTVariable(ctx context.Context, jwtPath string) error {
 // GetLBClient conjures up a functional LB mgmt API client by whatever means
 // necessary. the errors it returns are gRPC-grade and can be returned directly
 // to the remote CSI API clients.
+//
+// for the "grpcs" scheme, the TLS settings are taken from `ctx` as set up by
+// cloneCtxWithCreds(), falling back to the global ones.
 func (d *Driver) GetLBClient(
 	ctx context.Context, mgmtEPs endpoint.Slice, mgmtScheme string,
 ) (lb.Client, error) {
-	clnt, err := d.lbclients.GetClient(ctx, mgmtEPs, mgmtScheme)
+	var tlsCfg *lb.TLSConfig
+	if mgmtScheme == grpcsXport {
+		tlsCfg = d.mgmtTLSFromContext(ctx)
+		if tlsCfg != nil {
+			// the global ones were validated on load, but the
+			// per-call overrides from the secrets are anybody's guess:
+			if _, err := tlsCfg.Build(); err != nil {
+				return nil, mkEinvalf("secrets",
+					"invalid LightOS API TLS settings: %s", err)
+			}
+		}
+	}
+	clnt, err := d.lbclients.GetClient(ctx, mgmtEPs, mgmtScheme, tlsCfg)
 	if err != nil {
 		msg := fmt.Sprintf("failed to connect to LBs at '%s': %s", mgmtEPs, err.Error())
 		st, ok := status.FromError(err)
@@ -490,6 +691,13 @@ func (d *Driver) cloneCtxWithCreds(ctx context.Context, secrets map[string]strin
 	} else if d.jwt != "" {
 		jwt = d.jwt
 	}
+	if tlsCfg := d.mgmtTLSOverride(secrets); tlsCfg != nil {
+		ctx = context.WithValue(ctx, mgmtTLSCtxKey{}, tlsCfg)
+	}
+	return cloneCtxWithJWT(ctx, jwt)
+}
+
+func cloneCtxWithJWT(ctx context.Context, jwt string) context.Context {
 	if jwt != "" {
 		// many times we see a user passing a jwt with `\n` at the end.
 		// this will result in the following error:
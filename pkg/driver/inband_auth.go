@@ -0,0 +1,211 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/lightbitslabs/los-csi/pkg/lb"
+	"github.com/lightbitslabs/los-csi/pkg/util/wait"
+)
+
+const (
+	// the LightOS trusted hosts the plugin registers for the nodes are
+	// named after the nodes, with this prefix, to tell them apart from the
+	// ones created by the admins.
+	trustedHostPrefix = "lb-csi-"
+
+	// DH-HMAC-CHAP secret key length, in bytes. 32 is the only length
+	// allowed for the untransformed secrets (HMAC ID 00).
+	dhchapKeyLen = 32
+)
+
+// thSecretsPoll is how long to wait for a concurrent publish to the same node
+// that registered the trusted host to set its secrets. a var only to allow
+// the tests to not wait that long.
+var thSecretsPoll = wait.Backoff{
+	Delay:      250 * time.Millisecond,
+	Factor:     2,
+	DelayLimit: 2 * time.Second,
+	Retries:    6,
+}
+
+func trustedHostName(nodeID string) string {
+	return trustedHostPrefix + nodeID
+}
+
+// genDHChapSecret() generates a random DH-HMAC-CHAP secret in the same form as
+// `nvme gen-dhchap-key` does: the key is not transformed (HMAC ID 00), and
+// is followed by its CRC-32, little-endian, before being base64-encoded.
+func genDHChapSecret() (string, error) {
+	key := make([]byte, dhchapKeyLen, dhchapKeyLen+4)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate DH-HMAC-CHAP secret: %w", err)
+	}
+	key = binary.LittleEndian.AppendUint32(key, crc32.ChecksumIEEE(key))
+	return "DHHC-1:00:" + base64.StdEncoding.EncodeToString(key) + ":", nil
+}
+
+// ensureTrustedHost() makes sure node `nodeID` is registered as a LightOS
+// trusted host in the project of volume `vid`, with both host and controller
+// (i.e. bidirectional) DH-HMAC-CHAP secrets set, so that the node could
+// connect to the cluster if (or once) the cluster starts requiring NVMe
+// in-band authentication. the existing secrets are never replaced: the node
+// might already be connected using them, and the kernel would keep using the
+// old ones on reconnects. nor are they set by anyone but the publish that
+// registered the trusted host, unless it looks like it's never going to.
+//
+// failures are only fatal if the cluster already requires in-band auth,
+// otherwise it's not worth failing the volume publishing over, e.g. for lack
+// of permissions or older LightOS versions that know not of trusted hosts.
+func ensureTrustedHost(
+	ctx context.Context, log *logrus.Entry, clnt lb.Client, vid lbResourceID,
+	nodeID string,
+) error {
+	name := trustedHostName(nodeID)
+	log = log.WithField("trusted-host", name)
+	err := doEnsureTrustedHost(ctx, log, clnt, vid.projName, name, nodeIDToHostNQN(nodeID))
+	if err == nil {
+		return nil
+	}
+	ci, ciErr := clnt.GetClusterInfo(ctx)
+	if ciErr != nil {
+		return mungeLBErr(log, ciErr, "failed to get info from LB cluster at '%s'",
+			vid.mgmtEPs[0])
+	}
+	if ci.InBandAuth {
+		return err
+	}
+	log.WithError(err).Warn("failed to register node as LightOS trusted host, " +
+		"it won't be able to connect to the volume if NVMe in-band " +
+		"authentication is enabled on the cluster")
+	return nil
+}
+
+func doEnsureTrustedHost(
+	ctx context.Context, log *logrus.Entry, clnt lb.Client, projName, name, hostNQN string,
+) error {
+	if projName == "" {
+		// trusted hosts are per-project, and these are legacy volumes.
+		return mkPrecond("volume has no project, can't register trusted host '%s'", name)
+	}
+
+	created, lostRace := false, false
+	th, err := clnt.GetTrustedHost(ctx, name, projName)
+	if status.Code(err) == codes.NotFound {
+		th, err = clnt.CreateTrustedHost(ctx, name, projName, hostNQN)
+		switch status.Code(err) {
+		case codes.OK:
+			created = true
+		case codes.AlreadyExists:
+			// lost the race to a concurrent publish to the same node,
+			// let the winner set the secrets.
+			lostRace = true
+			th, err = clnt.GetTrustedHost(ctx, name, projName)
+		}
+	}
+	if err != nil {
+		return mungeLBErr(log, err, "failed to register trusted host '%s' in project '%s'",
+			name, projName)
+	}
+	if th.HostNQN != hostNQN {
+		return mkPrecond("LightOS trusted host '%s' in project '%s' belongs to host "+
+			"NQN '%s' rather than '%s'", name, projName, th.HostNQN, hostNQN)
+	}
+
+	if !created {
+		// whoever registered the trusted host might be about to set
+		// the secrets, give it a chance to:
+		haveSecrets := false
+		err := wait.WithExponentialBackoff(thSecretsPoll, func() (bool, error) {
+			secrets, err := clnt.GetTrustedHostSecrets(ctx, name, projName)
+			if err != nil {
+				return false, mungeLBErr(log, err, "failed to get secrets of "+
+					"trusted host '%s' in project '%s'", name, projName)
+			}
+			haveSecrets = secrets.Host != ""
+			if err := ctx.Err(); err != nil && !haveSecrets {
+				return false, status.FromContextError(err).Err()
+			}
+			return haveSecrets, nil
+		})
+		if haveSecrets {
+			return nil
+		}
+		if status.Code(err) != codes.DeadlineExceeded {
+			return err
+		}
+		if lostRace {
+			// the winner is still around and will get to it, or fail
+			// and have the CO retry. either way, not our call.
+			return mkAbort("secrets of trusted host '%s' in project '%s' are not "+
+				"set yet", name, projName)
+		}
+		// most likely, whoever registered it died before setting them.
+		log.Warn("LightOS trusted host has no secrets set, setting them")
+	}
+
+	secrets := &lb.TrustedHostSecrets{}
+	if secrets.Host, err = genDHChapSecret(); err != nil {
+		return mkInternal("%s", err)
+	}
+	if secrets.Ctrl, err = genDHChapSecret(); err != nil {
+		return mkInternal("%s", err)
+	}
+	if err = clnt.SetTrustedHostSecrets(ctx, name, projName, secrets); err != nil {
+		return mungeLBErr(log, err, "failed to set secrets of trusted host '%s' "+
+			"in project '%s'", name, projName)
+	}
+	log.Info("registered node as LightOS trusted host")
+	return nil
+}
+
+// getTrustedHostSecrets() fetches the DH-HMAC-CHAP secrets of node `nodeID`
+// for connecting to volume `vid`. if the cluster doesn't require in-band
+// auth, the secrets are still used if available (so that the node could
+// reconnect if the cluster starts requiring it later on), but their absence
+// is not an error, and nil secrets are returned.
+func getTrustedHostSecrets(
+	ctx context.Context, log *logrus.Entry, clnt lb.Client, vid lbResourceID,
+	nodeID string, authRequired bool,
+) (*lb.TrustedHostSecrets, error) {
+	name := trustedHostName(nodeID)
+	var secrets *lb.TrustedHostSecrets
+	var err error
+	if vid.projName == "" {
+		err = fmt.Errorf("volume has no project")
+	} else {
+		secrets, err = clnt.GetTrustedHostSecrets(ctx, name, vid.projName)
+		if err == nil && secrets.Host == "" {
+			err = fmt.Errorf("trusted host has no secrets set")
+		}
+	}
+	if err == nil {
+		return secrets, nil
+	}
+
+	log = log.WithField("trusted-host", name)
+	if !authRequired {
+		log.WithError(err).Debug("connecting without NVMe in-band authentication")
+		return nil, nil
+	}
+	if _, isLBErr := status.FromError(err); !isLBErr || status.Code(err) == codes.NotFound {
+		return nil, mkPrecond("LB cluster at '%s' requires NVMe in-band authentication, "+
+			"but node '%s' is not set up as its trusted host '%s' in project '%s' (was "+
+			"the volume published to the node?): %s",
+			vid.mgmtEPs[0], nodeID, name, vid.projName, err)
+	}
+	return nil, mungeLBErr(log, err, "failed to get secrets of trusted host '%s' in "+
+		"project '%s'", name, vid.projName)
+}
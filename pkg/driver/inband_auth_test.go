@@ -0,0 +1,237 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/lightbitslabs/los-csi/pkg/lb"
+	"github.com/lightbitslabs/los-csi/pkg/util/endpoint"
+	"github.com/lightbitslabs/los-csi/pkg/util/wait"
+)
+
+func TestGenDHChapSecret(t *testing.T) {
+	s1, err := genDHChapSecret()
+	require.NoError(t, err)
+	s2, err := genDHChapSecret()
+	require.NoError(t, err)
+	require.NotEqual(t, s1, s2)
+
+	require.True(t, strings.HasPrefix(s1, "DHHC-1:00:"), "bad secret '%s'", s1)
+	require.True(t, strings.HasSuffix(s1, ":"), "bad secret '%s'", s1)
+	raw, err := base64.StdEncoding.DecodeString(
+		strings.TrimSuffix(strings.TrimPrefix(s1, "DHHC-1:00:"), ":"))
+	require.NoError(t, err)
+	require.Len(t, raw, dhchapKeyLen+4)
+	key, crc := raw[:dhchapKeyLen], raw[dhchapKeyLen:]
+	require.Equal(t, crc32.ChecksumIEEE(key), binary.LittleEndian.Uint32(crc))
+}
+
+func TestEnsureTrustedHost(t *testing.T) {
+	const nodeID = "rack01-server01"
+	const thName = "lb-csi-" + nodeID
+	hostNQN := nodeIDToHostNQN(nodeID)
+	d, _, _ := getDriver(t, nodeID, false)
+	vid := lbResourceID{
+		mgmtEPs:  endpoint.MustParseCSV("10.0.0.1:443"),
+		projName: "proj-a",
+	}
+	any3 := []interface{}{mock.Anything, thName, "proj-a"}
+	notFound := status.Error(codes.NotFound, "nope")
+	defer func(poll wait.Backoff) { thSecretsPoll = poll }(thSecretsPoll)
+	thSecretsPoll = wait.Backoff{Delay: time.Millisecond, Retries: 3}
+
+	testCases := []struct {
+		name       string
+		vid        lbResourceID
+		setup      func(m *ClientMock)
+		inBandAuth bool
+		code       codes.Code
+		setSecrets bool
+	}{
+		{
+			name: "new",
+			setup: func(m *ClientMock) {
+				m.On("GetTrustedHost", any3...).Return(nil, notFound)
+				m.On("CreateTrustedHost", mock.Anything, thName, "proj-a", hostNQN).
+					Return(nil, nil)
+			},
+			setSecrets: true,
+		},
+		{
+			name: "lost creation race",
+			setup: func(m *ClientMock) {
+				m.On("GetTrustedHost", any3...).Return(nil, notFound).Once()
+				m.On("CreateTrustedHost", mock.Anything, thName, "proj-a", hostNQN).
+					Return(nil, status.Error(codes.AlreadyExists, "beat you to it"))
+				m.On("GetTrustedHost", any3...).Return(
+					&lb.TrustedHost{Name: thName, ProjectName: "proj-a", HostNQN: hostNQN}, nil)
+				m.On("GetTrustedHostSecrets", any3...).Return(
+					&lb.TrustedHostSecrets{Host: "DHHC-1:00:x:"}, nil)
+			},
+		},
+		{
+			name: "lost creation race, winner sets secrets",
+			setup: func(m *ClientMock) {
+				m.On("GetTrustedHost", any3...).Return(nil, notFound).Once()
+				m.On("CreateTrustedHost", mock.Anything, thName, "proj-a", hostNQN).
+					Return(nil, status.Error(codes.AlreadyExists, "beat you to it"))
+				m.On("GetTrustedHost", any3...).Return(
+					&lb.TrustedHost{Name: thName, ProjectName: "proj-a", HostNQN: hostNQN}, nil)
+				m.On("GetTrustedHostSecrets", any3...).Return(
+					&lb.TrustedHostSecrets{}, nil).Twice()
+				m.On("GetTrustedHostSecrets", any3...).Return(
+					&lb.TrustedHostSecrets{Host: "DHHC-1:00:x:"}, nil)
+			},
+			inBandAuth: true,
+		},
+		{
+			name: "lost creation race, winner never sets secrets",
+			setup: func(m *ClientMock) {
+				m.On("GetTrustedHost", any3...).Return(nil, notFound).Once()
+				m.On("CreateTrustedHost", mock.Anything, thName, "proj-a", hostNQN).
+					Return(nil, status.Error(codes.AlreadyExists, "beat you to it"))
+				m.On("GetTrustedHost", any3...).Return(
+					&lb.TrustedHost{Name: thName, ProjectName: "proj-a", HostNQN: hostNQN}, nil)
+				m.On("GetTrustedHostSecrets", any3...).Return(&lb.TrustedHostSecrets{}, nil)
+			},
+			inBandAuth: true,
+			code:       codes.Aborted,
+		},
+		{
+			name: "existing w/o secrets",
+			setup: func(m *ClientMock) {
+				m.On("GetTrustedHost", any3...).Return(
+					&lb.TrustedHost{Name: thName, ProjectName: "proj-a", HostNQN: hostNQN}, nil)
+				m.On("GetTrustedHostSecrets", any3...).Return(&lb.TrustedHostSecrets{}, nil)
+			},
+			setSecrets: true,
+		},
+		{
+			name: "foreign host NQN",
+			setup: func(m *ClientMock) {
+				m.On("GetTrustedHost", any3...).Return(
+					&lb.TrustedHost{Name: thName, ProjectName: "proj-a", HostNQN: "nqn.x"}, nil)
+			},
+			inBandAuth: true,
+			code:       codes.FailedPrecondition,
+		},
+		{
+			name: "foreign host NQN, no auth",
+			setup: func(m *ClientMock) {
+				m.On("GetTrustedHost", any3...).Return(
+					&lb.TrustedHost{Name: thName, ProjectName: "proj-a", HostNQN: "nqn.x"}, nil)
+			},
+		},
+		{
+			name: "unavailable",
+			setup: func(m *ClientMock) {
+				m.On("GetTrustedHost", any3...).Return(
+					nil, status.Error(codes.Unavailable, "try later"))
+			},
+			inBandAuth: true,
+			code:       codes.Unavailable,
+		},
+		{
+			name: "no permissions, no auth",
+			setup: func(m *ClientMock) {
+				m.On("GetTrustedHost", any3...).Return(
+					nil, status.Error(codes.PermissionDenied, "go away"))
+			},
+		},
+		{
+			name:       "legacy volume",
+			vid:        lbResourceID{mgmtEPs: vid.mgmtEPs},
+			setup:      func(m *ClientMock) {},
+			inBandAuth: true,
+			code:       codes.FailedPrecondition,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &ClientMock{}
+			tc.setup(m)
+			m.On("GetClusterInfo", mock.Anything).Return(
+				&lb.ClusterInfo{InBandAuth: tc.inBandAuth}, nil)
+			m.On("SetTrustedHostSecrets", mock.Anything, thName, "proj-a",
+				mock.MatchedBy(func(s *lb.TrustedHostSecrets) bool {
+					return strings.HasPrefix(s.Host, "DHHC-1:00:") &&
+						strings.HasPrefix(s.Ctrl, "DHHC-1:00:") && s.Host != s.Ctrl
+				})).Return(nil)
+			tcVid := vid
+			if tc.vid.mgmtEPs != nil {
+				tcVid = tc.vid
+			}
+
+			err := ensureTrustedHost(context.Background(), d.log, m, tcVid, nodeID)
+			require.Equal(t, tc.code, status.Code(err), "error: %s", err)
+			if tc.setSecrets {
+				m.AssertCalled(t, "SetTrustedHostSecrets", mock.Anything, thName,
+					"proj-a", mock.Anything)
+			} else {
+				m.AssertNotCalled(t, "SetTrustedHostSecrets", mock.Anything,
+					mock.Anything, mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+func TestGetTrustedHostSecrets(t *testing.T) {
+	const nodeID = "rack01-server01"
+	d, _, _ := getDriver(t, nodeID, false)
+	vid := lbResourceID{
+		mgmtEPs:  endpoint.MustParseCSV("10.0.0.1:443"),
+		projName: "proj-a",
+	}
+	secrets := &lb.TrustedHostSecrets{Host: "DHHC-1:00:h:", Ctrl: "DHHC-1:00:c:"}
+
+	testCases := []struct {
+		name         string
+		secrets      *lb.TrustedHostSecrets
+		err          error
+		authRequired bool
+		code         codes.Code
+		want         *lb.TrustedHostSecrets
+	}{
+		{name: "set", secrets: secrets, want: secrets},
+		{name: "set, required", secrets: secrets, authRequired: true, want: secrets},
+		{name: "unset", secrets: &lb.TrustedHostSecrets{}},
+		{name: "unset, required", secrets: &lb.TrustedHostSecrets{},
+			authRequired: true, code: codes.FailedPrecondition},
+		{name: "no host", err: status.Error(codes.NotFound, "nope")},
+		{name: "no host, required", err: status.Error(codes.NotFound, "nope"),
+			authRequired: true, code: codes.FailedPrecondition},
+		{name: "unavailable", err: status.Error(codes.Unavailable, "later")},
+		{name: "unavailable, required", err: status.Error(codes.Unavailable, "later"),
+			authRequired: true, code: codes.Unavailable},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &ClientMock{}
+			var res interface{}
+			if tc.secrets != nil {
+				res = tc.secrets
+			}
+			m.On("GetTrustedHostSecrets", mock.Anything, "lb-csi-"+nodeID, "proj-a").
+				Return(res, tc.err)
+			got, err := getTrustedHostSecrets(context.Background(), d.log, m, vid,
+				nodeID, tc.authRequired)
+			require.Equal(t, tc.code, status.Code(err), "error: %s", err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
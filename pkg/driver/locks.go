@@ -0,0 +1,95 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	guuid "github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// node-local locking: quite a few of the Node service ops might block for
+// significant amounts of time (think NVMe-oF network timeouts, the time it
+// takes to fsck a 4TB ext4, etc.), so rather than serialising all of them,
+// the Node plugin takes two kinds of named locks:
+//   - per-volume locks, keyed by volume NGUID, serialising all the local ops
+//     on a given volume (stage/unstage, publish/unpublish, expand).
+//   - per-NVMe-oF connection-set locks, keyed by SubNQN and HostNQN,
+//     serialising backend attach/detach to the same subsystem, whatever
+//     the transport and target endpoints.
+//     LightOS exposes all the volumes of a cluster through the same
+//     subsystem, so the connections are shared by the unrelated volumes,
+//     see backend.ConnTracker. whether it's safe to disconnect, or to
+//     connect over another transport, depends on ALL the connections to
+//     the subsystem, so locking them any finer would be racy.
+//
+// to avoid deadlocks, a volume lock is ALWAYS taken before a connection-set
+// lock, and never more than one of each kind at a time.
+
+const (
+	// waiting for a lock for longer than this is worth a warning, it
+	// likely means some other op is stuck.
+	lockWaitWarnThreshold = 10 * time.Second
+)
+
+func logLockWait(log *logrus.Entry, kind, name string, waited time.Duration) {
+	lockWaits.WithLabelValues(kind, "acquired").Observe(waited.Seconds())
+	log = log.WithFields(logrus.Fields{
+		"lock-kind": kind,
+		"lock-name": name,
+		"lock-wait": waited.String(),
+	})
+	if waited >= lockWaitWarnThreshold {
+		log.Warnf("waited for %s lock for %s", kind, waited)
+	} else {
+		log.Debugf("acquired %s lock", kind)
+	}
+}
+
+// lockVolume() acquires the node-local lock of volume `uuid`. if `ctx` is done
+// before the lock is acquired, returns Aborted, as the CSI spec mandates for
+// "operation pending for volume" cases. on success, the returned function must
+// be called to release the lock.
+func (d *Driver) lockVolume(
+	ctx context.Context, log *logrus.Entry, uuid guuid.UUID,
+) (func(), error) {
+	name := uuid.String()
+	unlock, waited, err := d.volLocks.Lock(ctx, name)
+	if err != nil {
+		lockWaits.WithLabelValues("volume", "aborted").Observe(waited.Seconds())
+		log.Warnf("gave up waiting for volume lock after %s: %s", waited, err)
+		return nil, mkAbort("another operation on volume %s is in progress", uuid)
+	}
+	logLockWait(log, "volume", name, waited)
+	return unlock, nil
+}
+
+// connSetName() returns the name identifying the set of NVMe-oF connections
+// used to access volumes exposed through subsystem `subsysNQN`. the target
+// endpoints are deliberately left out: the ConnTracker has no way of knowing
+// them for the volumes found attached on start-up, and they only differ for
+// the same subsystem while the LightOS cluster is being reconfigured anyway.
+func (d *Driver) connSetName(subsysNQN string) string {
+	return fmt.Sprintf("%s|%s", subsysNQN, d.hostNQN)
+}
+
+// lockConnSet() is the connection-set counterpart of lockVolume(). the caller
+// must already hold the relevant volume lock.
+func (d *Driver) lockConnSet(
+	ctx context.Context, log *logrus.Entry, subsysNQN string,
+) (func(), error) {
+	name := d.connSetName(subsysNQN)
+	unlock, waited, err := d.connLocks.Lock(ctx, name)
+	if err != nil {
+		lockWaits.WithLabelValues("connection", "aborted").Observe(waited.Seconds())
+		log.Warnf("gave up waiting for connection lock after %s: %s", waited, err)
+		return nil, mkAbort("another operation on targets of subsystem '%s' "+
+			"is in progress", subsysNQN)
+	}
+	logLockWait(log, "connection", name, waited)
+	return unlock, nil
+}
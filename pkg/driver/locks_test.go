@@ -0,0 +1,53 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	guuid "github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func lockWaitCount(t *testing.T, kind, result string) uint64 {
+	m := &dto.Metric{}
+	h := lockWaits.WithLabelValues(kind, result).(prometheus.Histogram)
+	require.NoError(t, h.Write(m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestLockWaitMetrics(t *testing.T) {
+	d, _, _ := getDriver(t, "rack01-server01", false)
+	uuid := guuid.New()
+	const subsysNQN = "nqn.2016-01.com.lightbitslabs:uuid:46cdc5c2-e13d-4bc8-9d35-1c6ef6e4fbb0"
+	acquired := lockWaitCount(t, "volume", "acquired")
+	aborted := lockWaitCount(t, "volume", "aborted")
+	connAcquired := lockWaitCount(t, "connection", "acquired")
+	connAborted := lockWaitCount(t, "connection", "aborted")
+
+	unlock, err := d.lockVolume(context.Background(), d.log, uuid)
+	require.NoError(t, err)
+	require.Equal(t, acquired+1, lockWaitCount(t, "volume", "acquired"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = d.lockVolume(ctx, d.log, uuid)
+	require.Equal(t, codes.Aborted, status.Code(err))
+	require.Equal(t, aborted+1, lockWaitCount(t, "volume", "aborted"))
+	unlock()
+
+	unlock, err = d.lockConnSet(context.Background(), d.log, subsysNQN)
+	require.NoError(t, err)
+	_, err = d.lockConnSet(ctx, d.log, subsysNQN)
+	require.Equal(t, codes.Aborted, status.Code(err))
+	unlock()
+	require.Equal(t, connAcquired+1, lockWaitCount(t, "connection", "acquired"))
+	require.Equal(t, connAborted+1, lockWaitCount(t, "connection", "aborted"))
+}
@@ -3,34 +3,74 @@
 package driver
 
 import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	guuid "github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"gopkg.in/yaml.v2"
+
+	"github.com/lightbitslabs/los-csi/pkg/lb"
 )
 
 const (
-	cryptsetupCmd     = "cryptsetup"
-	defaultLuksHash   = "sha256"
-	defaultLuksCipher = "aes-xts-plain64"
-	defaultLuksKeyize = "256"
-	defaultLuksFormat = "luks2"
-	defaultLuksNone   = "none"
+	cryptsetupCmd      = "cryptsetup"
+	defaultLuksHash    = "sha256"
+	defaultLuksCipher  = "aes-xts-plain64"
+	defaultLuksKeySize = 256
+	defaultLuksFormat  = "luks2"
+	defaultLuksNone    = "none"
+
+	luksPBKDF2 = "pbkdf2"
 
-	diskMapperPath = "/dev/mapper/"
+	diskMapperPath   = "/dev/mapper/"
+	luksMapperPrefix = "lb-csi-" + nvmeUUIDPrefix
 
 	DefaultLUKSCfgFileName = "luks_config.yaml"
+
+	// LUKS key providers, see luksConfig.KeyProvider.
+	luksKeySecret = "secret"
+	luksKeyFile   = "file"
+	luksKeyKMS    = "kms"
+
+	// per-volume LUKS data key length, in bytes.
+	luksDataKeyLen = 32
+
+	defaultKMSMountPath = "transit"
+	defaultKMSTimeout   = 10 * time.Second
 )
 
 // encryptAndOpenDevice encrypts the volume with the given ID with the given passphrase and open it
-// If the device is already encrypted (LUKS header present), it will only open the device
-func (d *Driver) encryptAndOpenDevice(volUUID guuid.UUID, passphrase string) (string, error) {
+// If the device is already encrypted (LUKS header present), it will only open the device, after
+// re-keying it from prevPassphrase to passphrase, if necessary (see luksRekey())
+// volOpts is only consulted when formatting or re-keying the device, as it
+// might cost a round trip to the LB.
+func (d *Driver) encryptAndOpenDevice(
+	log *logrus.Entry, volUUID guuid.UUID, passphrase, prevPassphrase string,
+	volOpts func() (luksFormatOpts, error),
+) (string, error) {
 	d.log.Debugf("encryptAndOpenDevice volume uuid: %q", volUUID)
 	encryptedDevicePath, err := d.getEncryptedDevicePath(volUUID)
 	if err != nil {
@@ -55,10 +95,23 @@ func (d *Driver) encryptAndOpenDevice(volUUID guuid.UUID, passphrase string) (st
 	}
 	if !isLuks {
 		// need to format the device
-		err = d.luksFormat(devicePath, passphrase)
+		opts, err := volOpts()
 		if err != nil {
 			return "", err
 		}
+		err = d.luksFormat(log, devicePath, passphrase, opts)
+		if err != nil {
+			return "", err
+		}
+	} else if prevPassphrase != "" {
+		opts, err := volOpts()
+		if err == nil {
+			err = d.luksRekey(log, devicePath, passphrase, prevPassphrase, opts)
+		}
+		if err != nil {
+			luksRekeys.WithLabelValues("failed").Inc()
+			return "", err
+		}
 	}
 
 	err = d.luksOpen(devicePath, luksMapperFileName(volUUID), passphrase)
@@ -69,7 +122,7 @@ func (d *Driver) encryptAndOpenDevice(volUUID guuid.UUID, passphrase string) (st
 }
 
 func luksMapperFileName(vid guuid.UUID) string {
-	return "lb-csi-" + nvmeUUIDPrefix + vid.String()
+	return luksMapperPrefix + vid.String()
 }
 
 func (d *Driver) resizeEncryptedDevice(volUUID guuid.UUID) error {
@@ -137,6 +190,193 @@ type luksConfig struct {
 	// but cannot opened anymore on a machine with less memory.
 	// limit the memory to 64M, given value is kb according to luksFormat help
 	PbkdfMemory int64 `yaml:"pbkdfMemory,omitempty"`
+
+	// KeyProvider selects the provider of the key-encryption key (KEK) the
+	// random per-volume LUKS data keys of the newly formatted volumes are
+	// wrapped with: "secret", "file" or "kms". if empty, new volumes are
+	// formatted with the static `host-encryption-passphrase` secret as is,
+	// the way it's always been. see luksPassphrase().
+	KeyProvider string `yaml:"keyProvider,omitempty"`
+	// KeyFile is the path to the KEK of the "file" provider: 32 bytes,
+	// hex-encoded. it's re-read on every use.
+	KeyFile string `yaml:"keyFile,omitempty"`
+	// KMS configures the "kms" provider.
+	KMS kmsConfig `yaml:"kms,omitempty"`
+
+	// the node-wide defaults of the format settings of the new volumes,
+	// overridden by the per-volume ones, see luksFormatOpts.
+	luksFormatOpts `yaml:",inline"`
+}
+
+// luksFormatOpts are the `cryptsetup luksFormat` settings of a volume, empty
+// ones standing for "the default". the per-volume ones come from the SC params
+// (see lbCreateVolumeParams) and are recorded in the lbLabelLUKSFormat volume
+// label, so that whichever node gets to format the volume formats it the same
+// way. once formatted, they're in the LUKS header for every node to see.
+type luksFormatOpts struct {
+	Cipher string `yaml:"cipher,omitempty"`
+	// KeySize is in bits, excluding the integrity (HMAC) key, if any.
+	KeySize   int    `yaml:"keySize,omitempty"`
+	Hash      string `yaml:"hash,omitempty"`
+	PBKDF     string `yaml:"pbkdf,omitempty"`
+	Integrity string `yaml:"integrity,omitempty"` // "none" to override the node default.
+}
+
+var (
+	// <cipher>-<chain mode>-<IV mode>, e.g. aes-xts-plain64.
+	luksCipherRegex = regexp.MustCompile(`^[a-z0-9]+-[a-z0-9]+-[a-z0-9]+$`)
+	luksKeySizes    = []int{128, 192, 256, 384, 512}
+	luksHashes      = []string{"sha256", "sha384", "sha512"}
+	luksPBKDFs      = []string{luksPBKDF2, "argon2i", "argon2id"}
+	// integrity mode to integrity key size, in bits.
+	luksIntegrityKeySizes = map[string]int{
+		defaultLuksNone: 0,
+		"hmac-sha256":   256,
+		"hmac-sha512":   512,
+	}
+
+	// built-in defaults, the way the volumes have always been formatted:
+	defaultLUKSFormatOpts = luksFormatOpts{
+		Cipher:  defaultLuksCipher,
+		KeySize: defaultLuksKeySize,
+		Hash:    defaultLuksHash,
+	}
+)
+
+// check() validates the settings that are set, returning the SC param key of
+// the offending one along with the error.
+func (o luksFormatOpts) check() (string, error) {
+	if o.Cipher != "" && !luksCipherRegex.MatchString(o.Cipher) {
+		return volHostEncryptionCipherKey, fmt.Errorf("bad cipher '%s', must be in "+
+			"<cipher>-<chain mode>-<IV mode> format, e.g. %s", o.Cipher, defaultLuksCipher)
+	}
+	if o.KeySize != 0 && !slices.Contains(luksKeySizes, o.KeySize) {
+		return volHostEncryptionKeySizeKey, fmt.Errorf("bad key size %d, must be "+
+			"one of: %v", o.KeySize, luksKeySizes)
+	}
+	if strings.Contains(o.Cipher, "-xts-") && o.KeySize != 0 && o.KeySize < 256 {
+		// XTS splits the key in two, there's no such thing as AES-64...
+		return volHostEncryptionKeySizeKey, fmt.Errorf("key size %d is too small "+
+			"for XTS cipher '%s', use 256 or 512", o.KeySize, o.Cipher)
+	}
+	if o.Hash != "" && !slices.Contains(luksHashes, o.Hash) {
+		return volHostEncryptionHashKey, fmt.Errorf("bad hash '%s', must be one "+
+			"of: %v", o.Hash, luksHashes)
+	}
+	if o.PBKDF != "" && !slices.Contains(luksPBKDFs, o.PBKDF) {
+		return volHostEncryptionPBKDFKey, fmt.Errorf("bad PBKDF '%s', must be one "+
+			"of: %v", o.PBKDF, luksPBKDFs)
+	}
+	if _, ok := luksIntegrityKeySizes[o.Integrity]; o.Integrity != "" && !ok {
+		return volHostEncryptionIntegrityKey, fmt.Errorf("bad integrity mode '%s', "+
+			"must be one of: none, hmac-sha256, hmac-sha512", o.Integrity)
+	}
+	return "", nil
+}
+
+// or() returns `o` with the unset settings taken from `dflt`.
+func (o luksFormatOpts) or(dflt luksFormatOpts) luksFormatOpts {
+	if o.Cipher == "" {
+		o.Cipher = dflt.Cipher
+	}
+	if o.KeySize == 0 {
+		o.KeySize = dflt.KeySize
+	}
+	if o.Hash == "" {
+		o.Hash = dflt.Hash
+	}
+	if o.PBKDF == "" {
+		o.PBKDF = dflt.PBKDF
+	}
+	if o.Integrity == "" {
+		o.Integrity = dflt.Integrity
+	}
+	return o
+}
+
+// pbkdfArgs() returns the cryptsetup args for the PBKDF of the new key slots.
+func (o luksFormatOpts) pbkdfArgs(pbkdfMemory int64) []string {
+	var args []string
+	if o.PBKDF != "" {
+		args = append(args, "--pbkdf", o.PBKDF)
+	}
+	if o.PBKDF != luksPBKDF2 {
+		// cryptsetup refuses memory limits for PBKDF2, as it has none.
+		// for the rest, see luksConfig.PbkdfMemory.
+		args = append(args, fmt.Sprintf("--pbkdf-memory=%d", pbkdfMemory))
+	}
+	return args
+}
+
+// label() encodes `o` as the lbLabelLUKSFormat volume label value:
+// <cipher>_<key size>_<hash>_<PBKDF>_<integrity>, the unset ones left empty.
+// all the valid settings happen to be valid LightOS label values, and none of
+// them contain '_'.
+func (o luksFormatOpts) label() string {
+	keySize := ""
+	if o.KeySize != 0 {
+		keySize = strconv.Itoa(o.KeySize)
+	}
+	return strings.Join([]string{o.Cipher, keySize, o.Hash, o.PBKDF, o.Integrity}, "_")
+}
+
+func parseLUKSFormatLabel(label string) (luksFormatOpts, error) {
+	var o luksFormatOpts
+	fields := strings.Split(label, "_")
+	if len(fields) != 5 {
+		return o, fmt.Errorf("expected 5 '_'-separated fields, got %d", len(fields))
+	}
+	o.Cipher, o.Hash, o.PBKDF, o.Integrity = fields[0], fields[2], fields[3], fields[4]
+	if fields[1] != "" {
+		var err error
+		if o.KeySize, err = strconv.Atoi(fields[1]); err != nil || o.KeySize == 0 {
+			return o, fmt.Errorf("bad key size '%s'", fields[1])
+		}
+	}
+	if _, err := o.check(); err != nil {
+		return o, err
+	}
+	return o, nil
+}
+
+// luksVolFormatOpts() returns the format settings of volume `vid` recorded in
+// its labels at creation time, if any.
+func luksVolFormatOpts(
+	ctx context.Context, log *logrus.Entry, clnt lb.Client, vid lbResourceID,
+) (luksFormatOpts, error) {
+	vol, err := clnt.GetVolume(ctx, vid.uuid, vid.projName)
+	if err != nil {
+		return luksFormatOpts{}, mungeLBErr(log, err, "failed to get volume '%s' from LB", vid)
+	}
+	label, ok := vol.Labels[lbLabelLUKSFormat]
+	if !ok {
+		return luksFormatOpts{}, nil
+	}
+	opts, err := parseLUKSFormatLabel(label)
+	if err != nil {
+		return luksFormatOpts{}, mkPrecond("volume '%s' has bad LUKS format label "+
+			"'%s': %s", vid, label, err)
+	}
+	return opts, nil
+}
+
+// kmsConfig describes a KMS that speaks the HashiCorp Vault transit secrets
+// engine HTTP API (as do OpenBao and a number of KMIP gateways).
+type kmsConfig struct {
+	// URL of the KMS, e.g. https://vault.example.com:8200.
+	URL string `yaml:"url,omitempty"`
+	// MountPath of the transit secrets engine, "transit" by default.
+	MountPath string `yaml:"mountPath,omitempty"`
+	// KeyName of the transit key to wrap the data keys with.
+	KeyName string `yaml:"keyName,omitempty"`
+	// TokenFile holds the token to authenticate to the KMS with. it's
+	// re-read on every use, to pick up the rotated tokens.
+	TokenFile string `yaml:"tokenFile,omitempty"`
+	// CAFile is the PEM bundle to verify the KMS certs with, instead of
+	// the system root CAs.
+	CAFile string `yaml:"caFile,omitempty"`
+	// Timeout of a single KMS request, 10s by default.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
 }
 
 func loadLuksConfig(log *logrus.Entry, luksCfgFile string) (*luksConfig, error) {
@@ -159,39 +399,596 @@ func loadLuksConfig(log *logrus.Entry, luksCfgFile string) (*luksConfig, error)
 	if err := yaml.Unmarshal(rawCfg, luksCfg); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal luks config: %s", err)
 	}
+	switch luksCfg.KeyProvider {
+	case "", luksKeySecret, luksKeyFile, luksKeyKMS:
+	default:
+		return nil, fmt.Errorf("unknown LUKS key provider '%s'", luksCfg.KeyProvider)
+	}
+	if _, err := luksCfg.luksFormatOpts.check(); err != nil {
+		return nil, fmt.Errorf("bad LUKS format settings: %s", err)
+	}
 	return luksCfg, nil
 }
 
+// LUKS key providers: ------------------------------------------------------
+
+// luksKeyProvider wraps (encrypts) and unwraps the per-volume LUKS data keys
+// with a key-encryption key (KEK) that never makes it to LightOS. the wrapped
+// data keys are stored as LightOS volume labels (see lbLabelLUKSKey), so that
+// deleting the volume, along with its snapshots, crypto-shreds its contents.
+//
+// the errors returned are gRPC status errors, ready to be passed on to the CO.
+type luksKeyProvider interface {
+	Wrap(ctx context.Context, key []byte) ([]byte, error)
+	Unwrap(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// newLUKSKeyProvider() returns the provider `name`, configured according to
+// `cfg`, or according to `secrets` in case of the "secret" provider.
+func newLUKSKeyProvider(
+	name string, cfg *luksConfig, secrets map[string]string,
+) (luksKeyProvider, error) {
+	switch name {
+	case luksKeySecret:
+		passphrase, err := staticLUKSPassphrase(secrets)
+		if err != nil {
+			return nil, err
+		}
+		return newSecretKeyProvider(passphrase), nil
+	case luksKeyFile:
+		if cfg.KeyFile == "" {
+			return nil, mkPrecond("LUKS key provider 'file' is not configured on the node")
+		}
+		raw, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, mkPrecond("failed to read LUKS KEK: %s", err)
+		}
+		kek, err := hex.DecodeString(strings.TrimSpace(string(raw)))
+		if err != nil || len(kek) != 32 {
+			return nil, mkPrecond("bad LUKS KEK in '%s': must be 32 hex-encoded bytes",
+				cfg.KeyFile)
+		}
+		return newAEADKeyProvider(kek)
+	case luksKeyKMS:
+		return newKMSKeyProvider(&cfg.KMS)
+	default:
+		return nil, mkPrecond("unknown LUKS key provider '%s'", name)
+	}
+}
+
+// staticLUKSPassphrase() returns the static host-encryption passphrase from
+// the node stage `secrets`.
+func staticLUKSPassphrase(secrets map[string]string) (string, error) {
+	passphrase, ok := secrets[volHostEncryptionPassphraseKey]
+	if !ok {
+		return "", status.Errorf(codes.InvalidArgument,
+			"missing passphrase secret for key %s",
+			volHostEncryptionPassphraseKey)
+	}
+	if len(passphrase) > volHostEncryptionPassphraseKeyMaxLen {
+		return "", status.Errorf(codes.InvalidArgument,
+			"passphrase %s for encryption must no longer than %d char but is:%d",
+			volHostEncryptionPassphraseKey, volHostEncryptionPassphraseKeyMaxLen,
+			len(passphrase))
+	}
+	return passphrase, nil
+}
+
+// prevLUKSPassphrase() returns the previous static host-encryption passphrase
+// from the node stage `secrets`, if any, or an empty string.
+func prevLUKSPassphrase(secrets map[string]string) (string, error) {
+	passphrase := secrets[volHostEncryptionPrevPassphraseKey]
+	if len(passphrase) > volHostEncryptionPassphraseKeyMaxLen {
+		return "", status.Errorf(codes.InvalidArgument,
+			"passphrase %s for encryption must no longer than %d char but is:%d",
+			volHostEncryptionPrevPassphraseKey, volHostEncryptionPassphraseKeyMaxLen,
+			len(passphrase))
+	}
+	return passphrase, nil
+}
+
+// staticLUKSPassphrases() returns both the current and the previous (if any)
+// static host-encryption passphrases.
+func staticLUKSPassphrases(secrets map[string]string) (string, string, error) {
+	passphrase, err := staticLUKSPassphrase(secrets)
+	if err != nil {
+		return "", "", err
+	}
+	prev, err := prevLUKSPassphrase(secrets)
+	if err != nil {
+		return "", "", err
+	}
+	if prev == passphrase {
+		prev = ""
+	}
+	return passphrase, prev, nil
+}
+
+// Argon2id params of the "secret" provider KEK derivation, as per the second
+// recommended option of RFC 9106 (section 4).
+const (
+	secretKEKSaltLen = 16
+	secretKEKTime    = 3
+	secretKEKMemory  = 64 * 1024 // KiB
+	secretKEKThreads = 4
+	secretKEKLen     = 32
+)
+
+// secretKeyProvider wraps the data keys with a KEK derived from the static
+// passphrase from the K8s secret. the wrapped keys end up in the volume labels,
+// readable by anyone with access to the LightOS API, and the passphrase is
+// user-chosen, so the KEK is derived with a memory-hard KDF (Argon2id) and a
+// random per-wrap salt, to make offline brute-forcing of the passphrase
+// expensive. the salt is prepended to the AES-256-GCM-sealed key (q.v.
+// aeadKeyProvider), so the clones of the volume, that inherit the label,
+// can be unwrapped just the same.
+type secretKeyProvider struct {
+	passphrase string
+}
+
+func newSecretKeyProvider(passphrase string) *secretKeyProvider {
+	return &secretKeyProvider{passphrase: passphrase}
+}
+
+func (p *secretKeyProvider) kek(salt []byte) (*aeadKeyProvider, error) {
+	return newAEADKeyProvider(argon2.IDKey([]byte(p.passphrase), salt,
+		secretKEKTime, secretKEKMemory, secretKEKThreads, secretKEKLen))
+}
+
+func (p *secretKeyProvider) Wrap(ctx context.Context, key []byte) ([]byte, error) {
+	salt := make([]byte, secretKEKSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, mkInternal("failed to generate salt: %s", err)
+	}
+	kp, err := p.kek(salt)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := kp.Wrap(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return append(salt, wrapped...), nil
+}
+
+func (p *secretKeyProvider) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < secretKEKSaltLen {
+		return nil, mkPrecond("wrapped LUKS data key is truncated")
+	}
+	kp, err := p.kek(wrapped[:secretKEKSaltLen])
+	if err != nil {
+		return nil, err
+	}
+	return kp.Unwrap(ctx, wrapped[secretKEKSaltLen:])
+}
+
+// aeadKeyProvider wraps the data keys locally, with AES-256-GCM. the nonce is
+// prepended to the sealed key.
+type aeadKeyProvider struct {
+	aead cipher.AEAD
+}
+
+func newAEADKeyProvider(kek []byte) (*aeadKeyProvider, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, mkInternal("bad LUKS KEK: %s", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, mkInternal("bad LUKS KEK: %s", err)
+	}
+	return &aeadKeyProvider{aead: aead}, nil
+}
+
+func (p *aeadKeyProvider) Wrap(_ context.Context, key []byte) ([]byte, error) {
+	nonce := make([]byte, p.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, mkInternal("failed to generate nonce: %s", err)
+	}
+	return p.aead.Seal(nonce, nonce, key, nil), nil
+}
+
+func (p *aeadKeyProvider) Unwrap(_ context.Context, wrapped []byte) ([]byte, error) {
+	n := p.aead.NonceSize()
+	if len(wrapped) < n {
+		return nil, mkPrecond("wrapped LUKS data key is truncated")
+	}
+	key, err := p.aead.Open(nil, wrapped[:n], wrapped[n:], nil)
+	if err != nil {
+		return nil, mkPrecond("failed to unwrap LUKS data key (wrong KEK?): %s", err)
+	}
+	return key, nil
+}
+
+// kmsKeyProvider has the data keys wrapped by a KMS, see kmsConfig. the wrapped
+// keys are the ciphertexts returned by the KMS, e.g. "vault:v1:...".
+type kmsKeyProvider struct {
+	cfg  kmsConfig
+	clnt *http.Client
+}
+
+func newKMSKeyProvider(cfg *kmsConfig) (*kmsKeyProvider, error) {
+	if cfg.URL == "" || cfg.KeyName == "" || cfg.TokenFile == "" {
+		return nil, mkPrecond("LUKS key provider 'kms' is not configured on the node: " +
+			"url, keyName and tokenFile are all required")
+	}
+	p := &kmsKeyProvider{cfg: *cfg}
+	if p.cfg.MountPath == "" {
+		p.cfg.MountPath = defaultKMSMountPath
+	}
+	if p.cfg.Timeout == 0 {
+		p.cfg.Timeout = defaultKMSTimeout
+	}
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CAFile != "" {
+		ca, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, mkPrecond("failed to read KMS CA bundle: %s", err)
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, mkPrecond("no certs found in KMS CA bundle '%s'", cfg.CAFile)
+		}
+	}
+	p.clnt = &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsCfg,
+	}}
+	return p, nil
+}
+
+// do() invokes transit secrets engine operation `op` on the configured key.
+func (p *kmsKeyProvider) do(ctx context.Context, op string, req, resp interface{}) error {
+	token, err := os.ReadFile(p.cfg.TokenFile)
+	if err != nil {
+		return mkPrecond("failed to read KMS token: %s", err)
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return mkInternal("failed to marshal KMS %s request: %s", op, err)
+	}
+	url := fmt.Sprintf("%s/v1/%s/%s/%s", strings.TrimSuffix(p.cfg.URL, "/"),
+		strings.Trim(p.cfg.MountPath, "/"), op, p.cfg.KeyName)
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return mkPrecond("bad KMS request: %s", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("X-Vault-Token", strings.TrimSpace(string(token)))
+	res, err := p.clnt.Do(httpReq)
+	if err != nil {
+		return mkEagain("KMS %s request failed: %s", op, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		var kmsErr struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.NewDecoder(res.Body).Decode(&kmsErr)
+		msg := fmt.Sprintf("KMS %s request failed: %s: %s", op, res.Status,
+			strings.Join(kmsErr.Errors, "; "))
+		if res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests {
+			return mkEagain("%s", msg)
+		}
+		return mkPrecond("%s", msg)
+	}
+	if err := json.NewDecoder(res.Body).Decode(resp); err != nil {
+		return mkEagain("failed to parse KMS %s response: %s", op, err)
+	}
+	return nil
+}
+
+func (p *kmsKeyProvider) Wrap(ctx context.Context, key []byte) ([]byte, error) {
+	req := struct {
+		Plaintext string `json:"plaintext"`
+	}{base64.StdEncoding.EncodeToString(key)}
+	var resp struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	if err := p.do(ctx, "encrypt", &req, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Data.Ciphertext == "" {
+		return nil, mkEagain("KMS returned no ciphertext")
+	}
+	return []byte(resp.Data.Ciphertext), nil
+}
+
+func (p *kmsKeyProvider) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	req := struct {
+		Ciphertext string `json:"ciphertext"`
+	}{string(wrapped)}
+	var resp struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	if err := p.do(ctx, "decrypt", &req, &resp); err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+	if err != nil || len(key) == 0 {
+		return nil, mkEagain("KMS returned bad plaintext")
+	}
+	return key, nil
+}
+
+// per-volume LUKS data keys: ------------------------------------------------
+
+// encodeLUKSKeyLabel() produces the value of the lbLabelLUKSKey volume label
+// for data key `wrapped` by provider `provider`: "<provider>.<wrapped>", with
+// the wrapped key base64url-encoded to fit the LightOS label value syntax.
+func encodeLUKSKeyLabel(provider string, wrapped []byte) (string, error) {
+	res := provider + "." + base64.RawURLEncoding.EncodeToString(wrapped)
+	if !lbLabelRegex.MatchString(res) {
+		return "", mkInternal("wrapped LUKS data key doesn't fit in volume label "+
+			"(%d chars)", len(res))
+	}
+	return res, nil
+}
+
+func decodeLUKSKeyLabel(val string) (provider string, wrapped []byte, err error) {
+	provider, enc, ok := strings.Cut(val, ".")
+	if ok {
+		wrapped, err = base64.RawURLEncoding.DecodeString(enc)
+	}
+	if !ok || err != nil || len(wrapped) == 0 {
+		return "", nil, mkPrecond("volume label '%s' is corrupt", lbLabelLUKSKey)
+	}
+	return provider, wrapped, nil
+}
+
+// unwrapLUKSKey() returns the LUKS passphrase of volume `vid` with
+// lbLabelLUKSKey label value `label`. the data key is unwrapped by the provider
+// it was wrapped by, whatever the node config says new volumes should use.
+//
+// the "secret" provider KEK is derived from the static passphrase, so once the
+// passphrase is rotated, the data key is unwrapped with the previous one, if
+// available, and re-wrapped with the current one. the data key itself, and
+// hence the LUKS passphrase, stays the same.
+func unwrapLUKSKey(
+	ctx context.Context, log *logrus.Entry, clnt lb.Client, vid lbResourceID,
+	cfg *luksConfig, secrets map[string]string, label string,
+) (string, error) {
+	provider, wrapped, err := decodeLUKSKeyLabel(label)
+	if err != nil {
+		return "", err
+	}
+	kp, err := newLUKSKeyProvider(provider, cfg, secrets)
+	if err != nil {
+		return "", err
+	}
+	key, err := kp.Unwrap(ctx, wrapped)
+	if status.Code(err) == codes.FailedPrecondition && provider == luksKeySecret {
+		key, err = rewrapLUKSKey(ctx, log, clnt, vid, kp, secrets, label, wrapped, err)
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// rewrapLUKSKey() is the "secret" provider passphrase rotation part of
+// unwrapLUKSKey(): `kp` is the provider with the current passphrase, that
+// failed to unwrap `wrapped` with `unwrapErr`.
+func rewrapLUKSKey(
+	ctx context.Context, log *logrus.Entry, clnt lb.Client, vid lbResourceID,
+	kp luksKeyProvider, secrets map[string]string, label string, wrapped []byte,
+	unwrapErr error,
+) ([]byte, error) {
+	prev, err := prevLUKSPassphrase(secrets)
+	if err != nil {
+		return nil, err
+	}
+	if prev == "" {
+		return nil, unwrapErr
+	}
+	log = log.WithField("luks-op", "rewrap")
+	log.Info("LUKS data key doesn't unwrap with the current passphrase, " +
+		"trying the previous one")
+	key, err := newSecretKeyProvider(prev).Unwrap(ctx, wrapped)
+	if err != nil {
+		log.Warn("LUKS data key doesn't unwrap with the previous passphrase either")
+		return nil, unwrapErr
+	}
+	rewrapped, err := kp.Wrap(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	newLabel, err := encodeLUKSKeyLabel(luksKeySecret, rewrapped)
+	if err != nil {
+		return nil, err
+	}
+	hook := func(vol *lb.Volume) (*lb.VolumeUpdate, error) {
+		if vol.Labels[lbLabelLUKSKey] != label {
+			// re-wrapped concurrently, or worse. either way, not ours.
+			return nil, nil
+		}
+		labels := make(map[string]string, len(vol.Labels))
+		for k, v := range vol.Labels {
+			labels[k] = v
+		}
+		labels[lbLabelLUKSKey] = newLabel
+		return &lb.VolumeUpdate{Labels: labels}, nil
+	}
+	if _, err = clnt.UpdateVolume(ctx, vid.uuid, vid.projName, hook); err != nil {
+		luksRekeys.WithLabelValues("failed").Inc()
+		return nil, prefixErr(err, "failed to store re-wrapped LUKS data key of volume '%s'",
+			vid)
+	}
+	luksRekeys.WithLabelValues("rewrapped").Inc()
+	log.Info("re-wrapped LUKS data key with the current passphrase")
+	return key, nil
+}
+
+// luksPassphrase() returns the passphrase to format or open the LUKS device
+// of volume `vid` with, along with the previous passphrase to re-key it from,
+// if any (see luksRekey()):
+//   - if the volume has a wrapped data key of its own - the unwrapped data key.
+//   - if the node is configured with a LUKS key provider, and the volume was not
+//     formatted yet - a freshly generated data key. the wrapped key is stored
+//     as the volume label before returning.
+//   - otherwise, the static passphrase from the node stage `secrets`, as
+//     usual. this covers the volumes formatted before the key provider was
+//     configured too. this is the only case where the previous passphrase
+//     is returned: data keys never change.
+//
+// `isFormatted` is only invoked when it matters, to check if the volume
+// device already has a LUKS header.
+func (d *Driver) luksPassphrase(
+	ctx context.Context, log *logrus.Entry, clnt lb.Client, vid lbResourceID,
+	secrets map[string]string, isFormatted func() (bool, error),
+) (string, string, error) {
+	luksCfg, err := loadLuksConfig(log, d.luksCfgFile)
+	if err != nil {
+		return "", "", mkExternal("luks config provided but is malformed or can't be "+
+			"parsed: %s", err)
+	}
+	vol, err := clnt.GetVolume(ctx, vid.uuid, vid.projName)
+	if err != nil {
+		return "", "", mungeLBErr(log, err, "failed to get volume '%s' from LB", vid)
+	}
+	var passphrase string
+	if label, ok := vol.Labels[lbLabelLUKSKey]; ok {
+		passphrase, err = unwrapLUKSKey(ctx, log, clnt, vid, luksCfg, secrets, label)
+		return passphrase, "", err
+	}
+	if luksCfg.KeyProvider == "" {
+		return staticLUKSPassphrases(secrets)
+	}
+	formatted, err := isFormatted()
+	if err != nil {
+		return "", "", mkEExec("error checking if volume %s is a luks device: %s",
+			vid.uuid, err)
+	}
+	if formatted {
+		return staticLUKSPassphrases(secrets)
+	}
+	passphrase, err = newLUKSKey(ctx, log, clnt, vid, luksCfg, secrets)
+	return passphrase, "", err
+}
+
+// newLUKSKey() generates a random data key for volume `vid`, wraps it with the
+// configured provider and stores it as the volume label. should another node
+// beat us to it, the data key it stored is used instead.
+func newLUKSKey(
+	ctx context.Context, log *logrus.Entry, clnt lb.Client, vid lbResourceID,
+	cfg *luksConfig, secrets map[string]string,
+) (string, error) {
+	kp, err := newLUKSKeyProvider(cfg.KeyProvider, cfg, secrets)
+	if err != nil {
+		return "", err
+	}
+	key := make([]byte, luksDataKeyLen)
+	if _, err := rand.Read(key); err != nil {
+		return "", mkInternal("failed to generate LUKS data key: %s", err)
+	}
+	wrapped, err := kp.Wrap(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	label, err := encodeLUKSKeyLabel(cfg.KeyProvider, wrapped)
+	if err != nil {
+		return "", err
+	}
+
+	hook := func(vol *lb.Volume) (*lb.VolumeUpdate, error) {
+		if _, ok := vol.Labels[lbLabelLUKSKey]; ok {
+			return nil, nil
+		}
+		labels := make(map[string]string, len(vol.Labels)+1)
+		for k, v := range vol.Labels {
+			labels[k] = v
+		}
+		labels[lbLabelLUKSKey] = label
+		if len(labels) > maxLBLabels {
+			return nil, mkPrecond("volume '%s' has too many labels to store its "+
+				"LUKS data key in, limit is %d", vid, maxLBLabels)
+		}
+		return &lb.VolumeUpdate{Labels: labels}, nil
+	}
+	vol, err := clnt.UpdateVolume(ctx, vid.uuid, vid.projName, hook)
+	if err != nil {
+		return "", prefixErr(err, "failed to store LUKS data key of volume '%s'", vid)
+	}
+	switch stored := vol.Labels[lbLabelLUKSKey]; stored {
+	case label:
+		log.WithField("key-provider", cfg.KeyProvider).Info("generated LUKS data key")
+		return hex.EncodeToString(key), nil
+	case "":
+		return "", mkEagain("LUKS data key of volume '%s' failed to stick", vid)
+	default:
+		return unwrapLUKSKey(ctx, log, clnt, vid, cfg, secrets, stored)
+	}
+}
+
 // Luks helper
 
-func (d *Driver) luksFormat(devicePath string, passphrase string) error {
+// luksFormat formats `devicePath` with the per-volume settings `volOpts`,
+// falling back to the node-wide ones from the luks config, and then to the
+// built-in defaults.
+func (d *Driver) luksFormat(
+	log *logrus.Entry, devicePath string, passphrase string, volOpts luksFormatOpts,
+) error {
 	luksCfg, err := loadLuksConfig(d.log, d.luksCfgFile)
 	if err != nil {
 		return mkExternal("luks config provided but is malformed or can't be parsed: %s", err)
 	}
+	opts := volOpts.or(luksCfg.luksFormatOpts).or(defaultLUKSFormatOpts)
+	if _, err := opts.check(); err != nil {
+		// each is fine on its own, but not together, e.g. SC key size
+		// with node-wide cipher.
+		return mkPrecond("bad LUKS format settings for %s: %s", devicePath, err)
+	}
+	// with integrity protection, the key is the cipher key followed by the
+	// HMAC key, and cryptsetup wants the total:
+	keySize := opts.KeySize + luksIntegrityKeySizes[opts.Integrity]
 
 	args := []string{
 		"-q",                          // don't ask for confirmation
 		"--type=" + defaultLuksFormat, // LUKS2 is default but be explicit
-		"--hash", defaultLuksHash,     // hash algorithm
-		"--cipher", defaultLuksCipher, // the cipher used
-		"--key-size", defaultLuksKeyize, // the size of the encryption key
+		"--hash", opts.Hash,           // hash algorithm
+		"--cipher", opts.Cipher, // the cipher used
+		"--key-size", strconv.Itoa(keySize), // the size of the encryption key
 		"--key-file", "/dev/stdin", // read the passphrase from stdin
-		// limit the amount of memory used to create the encrypted device
-		// according to https://gitlab.com/cryptsetup/cryptsetup/-/issues/372
-		// the memory consumption during luksFormat is calculated dynamically from the total available memory.
-		// this can lead to a situation where a encrypted volume is created on a high memory machine,
-		// but cannot opened anymore on a machine with less memory.
-		// limit the memory to 64M, given value is kb according to luksFormat help
-		fmt.Sprintf("--pbkdf-memory=%d", luksCfg.PbkdfMemory),
+	}
+	// limit the amount of memory used to create the encrypted device
+	// according to https://gitlab.com/cryptsetup/cryptsetup/-/issues/372
+	// the memory consumption during luksFormat is calculated dynamically from the total available memory.
+	// this can lead to a situation where a encrypted volume is created on a high memory machine,
+	// but cannot opened anymore on a machine with less memory.
+	// limit the memory to 64M, given value is kb according to luksFormat help
+	args = append(args, opts.pbkdfArgs(luksCfg.PbkdfMemory)...)
+	if opts.Integrity != "" && opts.Integrity != defaultLuksNone {
+		// NOTE: this makes cryptsetup wipe the whole device to initialise
+		// the integrity tags, which takes a while on large volumes.
+		args = append(args, "--integrity", opts.Integrity)
+	}
+	args = append(args,
 		"luksFormat", // format
 		devicePath,   // device to encrypt
-	}
+	)
 
-	if !isAESSupported() {
-		return mkExternal("your cpu does not support aes")
+	if err := checkAESSupport(func() string { return opts.Cipher }); err != nil {
+		return err
 	}
 
+	log.WithFields(logrus.Fields{
+		"luks-op":   "format",
+		"device":    devicePath,
+		"cipher":    opts.Cipher,
+		"key-size":  opts.KeySize,
+		"hash":      opts.Hash,
+		"pbkdf":     opts.PBKDF,
+		"integrity": opts.Integrity,
+	}).Info("formatting LUKS device")
+
 	d.log.Debugf("luksFormat with args:%v", args)
 	cmd := exec.Command(cryptsetupCmd, args...)
 	cmd.Stdin = strings.NewReader(passphrase)
@@ -215,8 +1012,9 @@ func (d *Driver) luksOpen(devicePath string, mapperFile string, passphrase strin
 		"--perf-no_write_workqueue",
 	}
 
-	if !isAESSupported() {
-		return mkExternal("your cpu does not support aes")
+	err := checkAESSupport(func() string { return d.luksCipher("luksDump", devicePath) })
+	if err != nil {
+		return err
 	}
 
 	d.log.Debugf("luksOpen with args:%v", args)
@@ -230,13 +1028,177 @@ func (d *Driver) luksOpen(devicePath string, mapperFile string, passphrase strin
 	return nil
 }
 
+// luksRekey() makes sure `passphrase` rather than `prevPassphrase` unlocks the
+// LUKS device `devicePath`, so that the volume survives the rotation of its
+// static passphrase (i.e. of the K8s secret):
+//   - if only `prevPassphrase` unlocks it, `passphrase` is added to a new key
+//     slot, then the key slot of `prevPassphrase` is wiped.
+//   - if both do (e.g. the node plugin died half way through the above), the
+//     key slot of `prevPassphrase` is wiped.
+//   - otherwise, there's nothing to do, and it's up to luksOpen to tell.
+//
+// the data is never re-encrypted: the volume key stays the same, only the key
+// slots protecting it change. the new key slot uses the PBKDF of `opts`.
+func (d *Driver) luksRekey(
+	log *logrus.Entry, devicePath string, passphrase, prevPassphrase string,
+	opts luksFormatOpts,
+) error {
+	log = log.WithFields(logrus.Fields{
+		"luks-op": "rekey",
+		"device":  devicePath,
+	})
+	prevSlot, err := d.luksTestPassphrase(devicePath, prevPassphrase)
+	if err != nil {
+		return err
+	}
+	if prevSlot < 0 {
+		log.Debug("previous passphrase unlocks no key slot, nothing to rotate")
+		return nil
+	}
+	slot, err := d.luksTestPassphrase(devicePath, passphrase)
+	if err != nil {
+		return err
+	}
+	if slot == prevSlot {
+		return nil
+	}
+	log = log.WithField("prev-key-slot", prevSlot)
+	if slot < 0 {
+		log.Info("passphrase rotated, adding current passphrase to new key slot")
+		if err = d.luksAddKey(devicePath, prevPassphrase, passphrase, opts); err != nil {
+			return err
+		}
+		slot, err = d.luksTestPassphrase(devicePath, passphrase)
+		if err != nil {
+			return err
+		}
+		if slot < 0 {
+			return mkEExec("current passphrase unlocks no key slot of %s after "+
+				"luksAddKey", devicePath)
+		}
+		log.WithField("key-slot", slot).Info("added current passphrase to key slot")
+	}
+	log = log.WithField("key-slot", slot)
+	log.Info("wiping key slot of previous passphrase")
+	if err = d.luksKillSlot(devicePath, prevSlot, passphrase); err != nil {
+		return err
+	}
+	luksRekeys.WithLabelValues("rekeyed").Inc()
+	log.Info("LUKS passphrase rotated")
+	return nil
+}
+
+// luksKeySlotRegex matches the `cryptsetup --verbose open --test-passphrase`
+// output line naming the key slot the passphrase unlocked.
+var luksKeySlotRegex = regexp.MustCompile(`Key slot (\d+) unlocked`)
+
+// luksTestPassphrase returns the key slot of `devicePath` unlocked by
+// `passphrase`, or -1 if it unlocks none.
+func (d *Driver) luksTestPassphrase(devicePath string, passphrase string) (int, error) {
+	args := []string{
+		"open",                     // open...
+		"--test-passphrase",        // ...but not really
+		"--verbose",                // to report the key slot
+		"--key-file", "/dev/stdin", // read the passphrase from stdin
+		devicePath, // device to check
+	}
+
+	d.log.Debugf("luksTestPassphrase with args:%v", args)
+	cmd := exec.Command(cryptsetupCmd, args...)
+	cmd.Stdin = strings.NewReader(passphrase)
+	stdout, err := cmd.CombinedOutput()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 { // no key available
+			return -1, nil
+		}
+		return -1, mkEExec("luksTestPassphrase out:%s error:%v", string(stdout), err)
+	}
+	match := luksKeySlotRegex.FindStringSubmatch(string(stdout))
+	if match == nil {
+		return -1, mkEExec("luksTestPassphrase: no key slot in output: %s", string(stdout))
+	}
+	slot, _ := strconv.Atoi(match[1])
+	return slot, nil
+}
+
+// luksAddKey adds `newPassphrase` to a free key slot of `devicePath`, using
+// `passphrase` to unlock the volume key. the new passphrase is passed in on
+// fd 3, as stdin is taken. the PBKDF of the new key slot is that of `volOpts`,
+// or the node-wide one, same as for luksFormat.
+func (d *Driver) luksAddKey(
+	devicePath string, passphrase, newPassphrase string, volOpts luksFormatOpts,
+) error {
+	luksCfg, err := loadLuksConfig(d.log, d.luksCfgFile)
+	if err != nil {
+		return mkExternal("luks config provided but is malformed or can't be parsed: %s", err)
+	}
+	opts := volOpts.or(luksCfg.luksFormatOpts)
+
+	args := []string{
+		"-q",                       // don't ask for confirmation
+		"--key-file", "/dev/stdin", // read the existing passphrase from stdin
+	}
+	// same as for luksFormat, see there.
+	args = append(args, opts.pbkdfArgs(luksCfg.PbkdfMemory)...)
+	args = append(args,
+		"luksAddKey", // add key
+		devicePath,   // device to add the key to
+		"/dev/fd/3",  // read the new passphrase from fd 3
+	)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return mkEExec("luksAddKey: %s", err)
+	}
+	defer r.Close()
+	// passphrases are way shorter than the pipe buffer, no need to wait
+	// for the reader:
+	_, err = w.WriteString(newPassphrase)
+	w.Close()
+	if err != nil {
+		return mkEExec("luksAddKey: %s", err)
+	}
+
+	d.log.Debugf("luksAddKey with args:%v", args)
+	cmd := exec.Command(cryptsetupCmd, args...)
+	cmd.Stdin = strings.NewReader(passphrase)
+	cmd.ExtraFiles = []*os.File{r}
+	stdout, err := cmd.CombinedOutput()
+	if err != nil {
+		return mkEExec("luksAddKey out:%s error:%v", string(stdout), err)
+	}
+	return nil
+}
+
+// luksKillSlot wipes key slot `slot` of `devicePath`, using `passphrase` of one
+// of the remaining key slots to authorise it.
+func (d *Driver) luksKillSlot(devicePath string, slot int, passphrase string) error {
+	args := []string{
+		"--key-file", "/dev/stdin", // read the remaining passphrase from stdin
+		"luksKillSlot",     // kill slot
+		devicePath,         // device to kill the key slot of
+		strconv.Itoa(slot), // key slot to kill
+	}
+
+	d.log.Debugf("luksKillSlot with args:%v", args)
+	cmd := exec.Command(cryptsetupCmd, args...)
+	cmd.Stdin = strings.NewReader(passphrase)
+	stdout, err := cmd.CombinedOutput()
+	if err != nil {
+		return mkEExec("luksKillSlot out:%s error:%v", string(stdout), err)
+	}
+	return nil
+}
+
 func (d *Driver) luksResize(devicePath string) error {
 	args := []string{
 		"resize",
 		devicePath,
 	}
-	if !isAESSupported() {
-		return mkExternal("your cpu does not support aes")
+	err := checkAESSupport(func() string { return d.luksCipher("status", devicePath) })
+	if err != nil {
+		return err
 	}
 
 	d.log.Debugf("resize with args:%v", args)
@@ -310,6 +1272,46 @@ func (d *Driver) luksIsLuks(devicePath string) (bool, error) {
 	return true, nil
 }
 
+// luksCipher() returns the cipher of LUKS device or open dm-crypt mapping
+// `path`, as reported by cryptsetup `action` (luksDump or status,
+// respectively). returns an empty string if it can't tell.
+func (d *Driver) luksCipher(action string, path string) string {
+	out, err := exec.Command(cryptsetupCmd, action, path).CombinedOutput()
+	if err != nil {
+		d.log.WithError(err).Warnf("failed to get cipher of %s, output: %s", path, out)
+		return ""
+	}
+	return parseLUKSCipher(string(out))
+}
+
+// parseLUKSCipher() extracts the cipher from the output of cryptsetup
+// luksDump (LUKS2: "cipher:" of the data segment, LUKS1: "Cipher name:") or
+// status ("cipher:"). returns an empty string if there's none.
+func parseLUKSCipher(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		for _, key := range []string{"cipher:", "Cipher name:"} {
+			if val, ok := strings.CutPrefix(line, key); ok {
+				return strings.TrimSpace(val)
+			}
+		}
+	}
+	return ""
+}
+
+// checkAESSupport() fails if the CPU doesn't support AES, unless the cipher
+// returned by `cipher` is known not to be AES-based. `cipher` is only called
+// in the former case, and may return an empty string if it can't tell.
+func checkAESSupport(cipher func() string) error {
+	if isAESSupported() {
+		return nil
+	}
+	if c := cipher(); c != "" && !strings.Contains(c, "aes") {
+		return nil
+	}
+	return mkExternal("your cpu does not support aes")
+}
+
 func isAESSupported() bool {
 	b, err := os.ReadFile("/proc/cpuinfo")
 	if err != nil {
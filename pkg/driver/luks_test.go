@@ -0,0 +1,660 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	guuid "github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v2"
+
+	"github.com/lightbitslabs/los-csi/pkg/lb"
+	"github.com/lightbitslabs/los-csi/pkg/util/endpoint"
+)
+
+const testKMSToken = "s.test-token"
+
+// fakeTransit is a local stand-in for a Vault transit secrets engine. it
+// "wraps" the keys by merely reversing them, which is good enough to tell
+// wrapped keys from unwrapped ones.
+func fakeTransit(t *testing.T, status *int) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *status != http.StatusOK {
+			w.WriteHeader(*status)
+			fmt.Fprint(w, `{"errors":["nope"]}`)
+			return
+		}
+		if r.Header.Get("X-Vault-Token") != testKMSToken {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors":["permission denied"]}`)
+			return
+		}
+		var req map[string]string
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		reverse := func(s string) string {
+			b := []byte(s)
+			for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+				b[i], b[j] = b[j], b[i]
+			}
+			return string(b)
+		}
+		var data map[string]string
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/lb-csi":
+			data = map[string]string{"ciphertext": "vault:v1:" + reverse(req["plaintext"])}
+		case "/v1/transit/decrypt/lb-csi":
+			data = map[string]string{
+				"plaintext": reverse(strings.TrimPrefix(req["ciphertext"], "vault:v1:")),
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]interface{}{"data": data}))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func mkTestLUKSConfig(t *testing.T, kmsURL string) *luksConfig {
+	dir := t.TempDir()
+	cfg := &luksConfig{
+		KeyFile: filepath.Join(dir, "kek"),
+		KMS: kmsConfig{
+			URL:       kmsURL,
+			KeyName:   "lb-csi",
+			TokenFile: filepath.Join(dir, "token"),
+		},
+	}
+	kek := "6bb32fb599aa4a4ca4e730b7787bbd666bb32fb599aa4a4ca4e730b7787bbd66\n"
+	require.NoError(t, os.WriteFile(cfg.KeyFile, []byte(kek), 0o600))
+	require.NoError(t, os.WriteFile(cfg.KMS.TokenFile, []byte(testKMSToken+"\n"), 0o600))
+	return cfg
+}
+
+func TestLUKSKeyProviders(t *testing.T) {
+	kmsStatus := http.StatusOK
+	cfg := mkTestLUKSConfig(t, fakeTransit(t, &kmsStatus).URL)
+	secrets := map[string]string{volHostEncryptionPassphraseKey: "myawesomepassphrase"}
+	key := []byte("0123456789abcdef0123456789abcdef")
+	ctx := context.Background()
+
+	for _, name := range []string{luksKeySecret, luksKeyFile, luksKeyKMS} {
+		t.Run(name, func(t *testing.T) {
+			kp, err := newLUKSKeyProvider(name, cfg, secrets)
+			require.NoError(t, err)
+			wrapped, err := kp.Wrap(ctx, key)
+			require.NoError(t, err)
+			require.NotContains(t, string(wrapped), string(key))
+			label, err := encodeLUKSKeyLabel(name, wrapped)
+			require.NoError(t, err)
+			require.True(t, lbLabelRegex.MatchString(label), "bad label '%s'", label)
+			provider, got, err := decodeLUKSKeyLabel(label)
+			require.NoError(t, err)
+			require.Equal(t, name, provider)
+			require.Equal(t, wrapped, got)
+			unwrapped, err := kp.Unwrap(ctx, got)
+			require.NoError(t, err)
+			require.Equal(t, key, unwrapped)
+		})
+	}
+
+	t.Run("wrong passphrase", func(t *testing.T) {
+		kp, err := newLUKSKeyProvider(luksKeySecret, cfg, secrets)
+		require.NoError(t, err)
+		wrapped, err := kp.Wrap(ctx, key)
+		require.NoError(t, err)
+		kp, err = newLUKSKeyProvider(luksKeySecret, cfg,
+			map[string]string{volHostEncryptionPassphraseKey: "nope"})
+		require.NoError(t, err)
+		_, err = kp.Unwrap(ctx, wrapped)
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	})
+
+	t.Run("salted passphrase KEK", func(t *testing.T) {
+		kp, err := newLUKSKeyProvider(luksKeySecret, cfg, secrets)
+		require.NoError(t, err)
+		wrapped1, err := kp.Wrap(ctx, key)
+		require.NoError(t, err)
+		wrapped2, err := kp.Wrap(ctx, key)
+		require.NoError(t, err)
+		require.NotEqual(t, wrapped1[:secretKEKSaltLen], wrapped2[:secretKEKSaltLen])
+		for _, wrapped := range [][]byte{wrapped1, wrapped2} {
+			unwrapped, err := kp.Unwrap(ctx, wrapped)
+			require.NoError(t, err)
+			require.Equal(t, key, unwrapped)
+		}
+		// the salt is part of the KEK derivation:
+		wrapped1[0] ^= 0xff
+		_, err = kp.Unwrap(ctx, wrapped1)
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+		_, err = kp.Unwrap(ctx, wrapped1[:secretKEKSaltLen-1])
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	})
+
+	t.Run("bad KEK file", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(cfg.KeyFile, []byte("abcd"), 0o600))
+		_, err := newLUKSKeyProvider(luksKeyFile, cfg, nil)
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	})
+
+	t.Run("KMS errors", func(t *testing.T) {
+		kp, err := newLUKSKeyProvider(luksKeyKMS, cfg, nil)
+		require.NoError(t, err)
+		kmsStatus = http.StatusServiceUnavailable
+		_, err = kp.Wrap(ctx, key)
+		require.Equal(t, codes.Unavailable, status.Code(err))
+		kmsStatus = http.StatusOK
+		require.NoError(t, os.WriteFile(cfg.KMS.TokenFile, []byte("s.stale"), 0o600))
+		_, err = kp.Wrap(ctx, key)
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+		require.ErrorContains(t, err, "permission denied")
+	})
+
+	t.Run("unconfigured", func(t *testing.T) {
+		_, err := newLUKSKeyProvider(luksKeyKMS, &luksConfig{}, nil)
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+		_, err = newLUKSKeyProvider(luksKeyFile, &luksConfig{}, nil)
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+		_, err = newLUKSKeyProvider(luksKeySecret, &luksConfig{}, nil)
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
+
+func TestLUKSPassphrase(t *testing.T) {
+	d, _, _ := getDriver(t, "rack01-server01", false)
+	vid := lbResourceID{
+		mgmtEPs:  endpoint.MustParseCSV("10.0.0.1:443"),
+		uuid:     guuid.MustParse("6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66"),
+		projName: "proj-a",
+	}
+	secrets := map[string]string{volHostEncryptionPassphraseKey: "myawesomepassphrase"}
+	ctx := context.Background()
+	kmsStatus := http.StatusOK
+	kmsURL := fakeTransit(t, &kmsStatus).URL
+
+	// mkClient() returns a mock whose volume labels are updated by the
+	// UpdateVolume() hooks, the way LightOS would.
+	mkClient := func(labels map[string]string) (*ClientMock, *lb.Volume) {
+		vol := &lb.Volume{UUID: vid.uuid, ProjectName: vid.projName, Labels: labels}
+		m := &ClientMock{}
+		m.On("GetVolume", mock.Anything, vid.uuid, vid.projName).Return(vol, nil)
+		m.On("UpdateVolume", mock.Anything, vid.uuid, vid.projName, mock.Anything).
+			Return(vol, nil).
+			Run(func(args mock.Arguments) {
+				hook := args.Get(3).(lb.VolumeUpdateHook)
+				update, err := hook(vol)
+				require.NoError(t, err)
+				if update != nil {
+					vol.Labels = update.Labels
+				}
+			})
+		return m, vol
+	}
+	writeCfg := func(keyProvider string) {
+		cfg := mkTestLUKSConfig(t, kmsURL)
+		cfg.KeyProvider = keyProvider
+		raw, err := yaml.Marshal(cfg)
+		require.NoError(t, err)
+		d.luksCfgFile = filepath.Join(t.TempDir(), DefaultLUKSCfgFileName)
+		require.NoError(t, os.WriteFile(d.luksCfgFile, raw, 0o600))
+	}
+	notFormatted := func() (bool, error) { return false, nil }
+	formatted := func() (bool, error) { return true, nil }
+
+	t.Run("static passphrase", func(t *testing.T) {
+		writeCfg("")
+		m, _ := mkClient(map[string]string{"team": "storage"})
+		passphrase, _, err := d.luksPassphrase(ctx, d.log, m, vid, secrets, notFormatted)
+		require.NoError(t, err)
+		require.Equal(t, "myawesomepassphrase", passphrase)
+		m.AssertNotCalled(t, "UpdateVolume", mock.Anything, mock.Anything,
+			mock.Anything, mock.Anything)
+
+		_, _, err = d.luksPassphrase(ctx, d.log, m, vid, nil, notFormatted)
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	for _, provider := range []string{luksKeySecret, luksKeyFile, luksKeyKMS} {
+		t.Run("per-volume key: "+provider, func(t *testing.T) {
+			writeCfg(provider)
+			m, vol := mkClient(map[string]string{"team": "storage"})
+			passphrase, _, err := d.luksPassphrase(ctx, d.log, m, vid, secrets, notFormatted)
+			require.NoError(t, err)
+			require.Len(t, passphrase, 2*luksDataKeyLen)
+			require.Equal(t, "storage", vol.Labels["team"])
+			require.True(t, strings.HasPrefix(vol.Labels[lbLabelLUKSKey], provider+"."),
+				"bad label '%s'", vol.Labels[lbLabelLUKSKey])
+
+			// the same data key later on, even if the node config changes:
+			writeCfg("")
+			again, _, err := d.luksPassphrase(ctx, d.log, m, vid, secrets, formatted)
+			require.NoError(t, err)
+			require.Equal(t, passphrase, again)
+			m.AssertNumberOfCalls(t, "UpdateVolume", 1)
+		})
+	}
+
+	t.Run("formatted with static passphrase", func(t *testing.T) {
+		writeCfg(luksKeyKMS)
+		m, vol := mkClient(nil)
+		passphrase, _, err := d.luksPassphrase(ctx, d.log, m, vid, secrets, formatted)
+		require.NoError(t, err)
+		require.Equal(t, "myawesomepassphrase", passphrase)
+		require.Empty(t, vol.Labels)
+	})
+
+	t.Run("lost the race", func(t *testing.T) {
+		writeCfg(luksKeyFile)
+		kp, err := newLUKSKeyProvider(luksKeyFile, mkTestLUKSConfig(t, kmsURL), nil)
+		require.NoError(t, err)
+		key := []byte("0123456789abcdef0123456789abcdef")
+		wrapped, err := kp.Wrap(ctx, key)
+		require.NoError(t, err)
+		label, err := encodeLUKSKeyLabel(luksKeyFile, wrapped)
+		require.NoError(t, err)
+
+		// another node stores its data key right after we look:
+		m, vol := mkClient(map[string]string{lbLabelLUKSKey: label})
+		m.ExpectedCalls[0].ReturnArguments = mock.Arguments{&lb.Volume{}, nil}
+		passphrase, _, err := d.luksPassphrase(ctx, d.log, m, vid, secrets, notFormatted)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("%x", key), passphrase)
+		require.Equal(t, label, vol.Labels[lbLabelLUKSKey])
+	})
+
+	t.Run("KMS unavailable", func(t *testing.T) {
+		writeCfg(luksKeyKMS)
+		m, vol := mkClient(nil)
+		kmsStatus = http.StatusBadGateway
+		defer func() { kmsStatus = http.StatusOK }()
+		_, _, err := d.luksPassphrase(ctx, d.log, m, vid, secrets, notFormatted)
+		require.Equal(t, codes.Unavailable, status.Code(err))
+		require.Empty(t, vol.Labels)
+	})
+
+	t.Run("passphrase rotation", func(t *testing.T) {
+		writeCfg("")
+		rotating := map[string]string{
+			volHostEncryptionPassphraseKey:     "newpassphrase",
+			volHostEncryptionPrevPassphraseKey: "myawesomepassphrase",
+		}
+		m, _ := mkClient(nil)
+		passphrase, prev, err := d.luksPassphrase(ctx, d.log, m, vid, rotating, formatted)
+		require.NoError(t, err)
+		require.Equal(t, "newpassphrase", passphrase)
+		require.Equal(t, "myawesomepassphrase", prev)
+
+		// same old, same old:
+		rotating[volHostEncryptionPrevPassphraseKey] = "newpassphrase"
+		_, prev, err = d.luksPassphrase(ctx, d.log, m, vid, rotating, formatted)
+		require.NoError(t, err)
+		require.Empty(t, prev)
+	})
+
+	t.Run("secret provider passphrase rotation", func(t *testing.T) {
+		writeCfg(luksKeySecret)
+		m, vol := mkClient(nil)
+		passphrase, _, err := d.luksPassphrase(ctx, d.log, m, vid, secrets, notFormatted)
+		require.NoError(t, err)
+		oldLabel := vol.Labels[lbLabelLUKSKey]
+
+		rotated := map[string]string{volHostEncryptionPassphraseKey: "newpassphrase"}
+		_, _, err = d.luksPassphrase(ctx, d.log, m, vid, rotated, formatted)
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+		rewrapped := testutil.ToFloat64(luksRekeys.WithLabelValues("rewrapped"))
+		rotated[volHostEncryptionPrevPassphraseKey] = "myawesomepassphrase"
+		again, prev, err := d.luksPassphrase(ctx, d.log, m, vid, rotated, formatted)
+		require.NoError(t, err)
+		require.Equal(t, passphrase, again, "data key must survive rotation")
+		require.Empty(t, prev)
+		require.NotEqual(t, oldLabel, vol.Labels[lbLabelLUKSKey])
+		require.Equal(t, rewrapped+1, testutil.ToFloat64(luksRekeys.WithLabelValues("rewrapped")))
+
+		delete(rotated, volHostEncryptionPrevPassphraseKey)
+		again, _, err = d.luksPassphrase(ctx, d.log, m, vid, rotated, formatted)
+		require.NoError(t, err)
+		require.Equal(t, passphrase, again)
+	})
+
+	t.Run("volume created with as many labels as it can take", func(t *testing.T) {
+		writeCfg(luksKeyFile)
+		var kvs []string
+		for i := 0; i < maxLBLabels; i++ {
+			kvs = append(kvs, fmt.Sprintf("l%d=%d", i, i))
+		}
+		scParams := map[string]string{
+			volParMgmtEPKey:      "10.0.0.1:443",
+			volParRepCntKey:      "3",
+			volHostEncryptionKey: "enabled",
+			volParLabelsKey:      strings.Join(kvs, ","),
+		}
+		_, err := parseCSICreateVolumeParams(scParams)
+		require.Equal(t, codes.InvalidArgument, status.Code(err),
+			"no room left for the data key: %v", err)
+
+		scParams[volParLabelsKey] = strings.Join(kvs[1:], ",")
+		params, err := parseCSICreateVolumeParams(scParams)
+		require.NoError(t, err)
+		require.Len(t, params.labels, maxLBLabels-1)
+		m, vol := mkClient(params.labels)
+		_, _, err = d.luksPassphrase(ctx, d.log, m, vid, secrets, notFormatted)
+		require.NoError(t, err)
+		require.Len(t, vol.Labels, maxLBLabels)
+		require.Contains(t, vol.Labels, lbLabelLUKSKey)
+	})
+
+	t.Run("corrupt label", func(t *testing.T) {
+		writeCfg(luksKeyFile)
+		bad := base64.RawURLEncoding.EncodeToString([]byte("garbage"))
+		for _, label := range []string{"file", "file.", "file." + bad, "zorro." + bad} {
+			m, _ := mkClient(map[string]string{lbLabelLUKSKey: label})
+			_, _, err := d.luksPassphrase(ctx, d.log, m, vid, secrets, formatted)
+			require.Equal(t, codes.FailedPrecondition, status.Code(err), "label: %s", label)
+		}
+	})
+}
+
+// fakeCryptsetupScript keeps the key slots of "device" <dev> in <dev>.slot<N>
+// files, holding the passphrases, and logs the invocations to "log" next to
+// itself. only the subset of cryptsetup luksFormat() and luksRekey() rely on
+// is supported.
+const fakeCryptsetupScript = `#!/bin/sh
+echo "$*" >>"$(dirname "$0")/log"
+action= dev= extra=
+for a in "$@"; do
+	if [ -z "$action" ]; then
+		case "$a" in open|luksFormat|luksAddKey|luksKillSlot) action=$a ;; esac
+		continue
+	fi
+	case "$a" in
+	-*|/dev/stdin) ;;
+	*) if [ -z "$dev" ]; then dev=$a; else extra=$a; fi ;;
+	esac
+done
+pass=$(cat)
+slot_of() {
+	for f in "$dev".slot*; do
+		[ -f "$f" ] || continue
+		if [ "$(cat "$f")" = "$1" ]; then echo "${f##*.slot}"; return 0; fi
+	done
+	return 1
+}
+case $action in
+open)
+	s=$(slot_of "$pass") || { echo "No key available with this passphrase."; exit 2; }
+	echo "Key slot $s unlocked."
+	echo "Command successful." ;;
+luksFormat)
+	printf %s "$pass" >"$dev.slot0" ;;
+luksAddKey)
+	slot_of "$pass" >/dev/null || exit 2
+	n=0
+	while [ -f "$dev.slot$n" ]; do n=$((n+1)); done
+	cat "$extra" >"$dev.slot$n" ;;
+luksKillSlot)
+	slot_of "$pass" >/dev/null || exit 2
+	rm "$dev.slot$extra" || exit 1 ;;
+*)
+	exit 1 ;;
+esac
+`
+
+// installFakeCryptsetup() puts fakeCryptsetupScript first on the PATH and
+// returns a func that returns the args of its last invocation.
+func installFakeCryptsetup(t *testing.T) (string, func() string) {
+	binDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, cryptsetupCmd),
+		[]byte(fakeCryptsetupScript), 0o755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	lastArgs := func() string {
+		log, err := os.ReadFile(filepath.Join(binDir, "log"))
+		require.NoError(t, err)
+		lines := strings.Split(strings.TrimSpace(string(log)), "\n")
+		return lines[len(lines)-1]
+	}
+	return binDir, lastArgs
+}
+
+func TestLUKSRekey(t *testing.T) {
+	d, _, _ := getDriver(t, "rack01-server01", false)
+	binDir, lastArgs := installFakeCryptsetup(t)
+
+	const oldPass, newPass = "myawesomepassphrase", "newpassphrase"
+	testCases := []struct {
+		name    string
+		slots   []string // passphrases by key slot, "" for free slots.
+		want    []string
+		rekeyed bool
+	}{
+		{name: "rotated", slots: []string{oldPass}, want: []string{"", newPass}, rekeyed: true},
+		{name: "half way", slots: []string{oldPass, newPass},
+			want: []string{"", newPass}, rekeyed: true},
+		{name: "done", slots: []string{"", newPass}, want: []string{"", newPass}},
+		{name: "other slots", slots: []string{"recovery", oldPass},
+			want: []string{"recovery", "", newPass}, rekeyed: true},
+		{name: "neither", slots: []string{"nope"}, want: []string{"nope"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dev := filepath.Join(t.TempDir(), "nvme0n1")
+			for i, pass := range tc.slots {
+				if pass != "" {
+					slot := fmt.Sprintf("%s.slot%d", dev, i)
+					require.NoError(t, os.WriteFile(slot, []byte(pass), 0o600))
+				}
+			}
+			rekeyed := testutil.ToFloat64(luksRekeys.WithLabelValues("rekeyed"))
+
+			require.NoError(t, d.luksRekey(d.log, dev, newPass, oldPass, luksFormatOpts{}))
+			for i, pass := range tc.want {
+				got, err := os.ReadFile(fmt.Sprintf("%s.slot%d", dev, i))
+				if pass == "" {
+					require.True(t, os.IsNotExist(err), "slot %d: %q", i, got)
+				} else {
+					require.NoError(t, err)
+					require.Equal(t, pass, string(got), "slot %d", i)
+				}
+			}
+			delta := 0.0
+			if tc.rekeyed {
+				delta = 1
+			}
+			require.Equal(t, rekeyed+delta, testutil.ToFloat64(luksRekeys.WithLabelValues("rekeyed")))
+		})
+	}
+
+	log, err := os.ReadFile(filepath.Join(binDir, "log"))
+	require.NoError(t, err)
+	require.NotContains(t, string(log), oldPass, "passphrases must not be on the cmdline")
+	require.NotContains(t, string(log), newPass, "passphrases must not be on the cmdline")
+	require.Contains(t, string(log), "--pbkdf-memory=65535 luksAddKey ")
+
+	// the new key slot gets the PBKDF of the volume:
+	dev := filepath.Join(t.TempDir(), "nvme0n1")
+	require.NoError(t, os.WriteFile(dev+".slot0", []byte(oldPass), 0o600))
+	require.NoError(t, d.luksRekey(d.log, dev, newPass, oldPass,
+		luksFormatOpts{PBKDF: luksPBKDF2}))
+	log, err = os.ReadFile(filepath.Join(binDir, "log"))
+	require.NoError(t, err)
+	require.Contains(t, string(log),
+		"-q --key-file /dev/stdin --pbkdf pbkdf2 luksAddKey "+dev+" /dev/fd/3")
+	require.Contains(t, lastArgs(), "luksKillSlot "+dev+" 0")
+}
+
+func TestLUKSFormat(t *testing.T) {
+	if !isAESSupported() {
+		t.Skip("no AES support, luksFormat refuses AES ciphers")
+	}
+	d, _, _ := getDriver(t, "rack01-server01", false)
+	_, lastArgs := installFakeCryptsetup(t)
+
+	testCases := []struct {
+		name    string
+		cfg     *luksFormatOpts // node-wide, nil for no luks config at all.
+		volOpts luksFormatOpts
+		args    string // sans the device.
+		code    codes.Code
+	}{
+		{
+			name: "defaults",
+			args: "-q --type=luks2 --hash sha256 --cipher aes-xts-plain64 --key-size 256 " +
+				"--key-file /dev/stdin --pbkdf-memory=65535 luksFormat",
+		},
+		{
+			name: "node-wide",
+			cfg:  &luksFormatOpts{Cipher: "serpent-xts-plain64", Hash: "sha512", PBKDF: "pbkdf2"},
+			args: "-q --type=luks2 --hash sha512 --cipher serpent-xts-plain64 --key-size 256 " +
+				"--key-file /dev/stdin --pbkdf pbkdf2 luksFormat",
+		},
+		{
+			name:    "per-volume",
+			cfg:     &luksFormatOpts{KeySize: 256, PBKDF: "pbkdf2", Integrity: "hmac-sha512"},
+			volOpts: luksFormatOpts{KeySize: 512, PBKDF: "argon2id", Integrity: "hmac-sha256"},
+			args: "-q --type=luks2 --hash sha256 --cipher aes-xts-plain64 --key-size 768 " +
+				"--key-file /dev/stdin --pbkdf argon2id --pbkdf-memory=65535 " +
+				"--integrity hmac-sha256 luksFormat",
+		},
+		{
+			name:    "per-volume no integrity",
+			cfg:     &luksFormatOpts{Integrity: "hmac-sha512"},
+			volOpts: luksFormatOpts{Integrity: "none"},
+			args: "-q --type=luks2 --hash sha256 --cipher aes-xts-plain64 --key-size 256 " +
+				"--key-file /dev/stdin --pbkdf-memory=65535 luksFormat",
+		},
+		{
+			name:    "mismatch",
+			volOpts: luksFormatOpts{KeySize: 128},
+			code:    codes.FailedPrecondition,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d.luksCfgFile = filepath.Join(t.TempDir(), DefaultLUKSCfgFileName)
+			if tc.cfg != nil {
+				raw, err := yaml.Marshal(&luksConfig{PbkdfMemory: 65535, luksFormatOpts: *tc.cfg})
+				require.NoError(t, err)
+				require.NoError(t, os.WriteFile(d.luksCfgFile, raw, 0o600))
+			}
+			dev := filepath.Join(t.TempDir(), "nvme0n1")
+			err := d.luksFormat(d.log, dev, "myawesomepassphrase", tc.volOpts)
+			require.Equal(t, tc.code, status.Code(err), "error: %s", err)
+			if tc.code == codes.OK {
+				require.Equal(t, tc.args+" "+dev, lastArgs())
+			}
+		})
+	}
+}
+
+func TestLUKSFormatOpts(t *testing.T) {
+	for _, opts := range []luksFormatOpts{
+		{},
+		{Cipher: "aes-xts-plain64", KeySize: 512, Hash: "sha512", PBKDF: "argon2id",
+			Integrity: "hmac-sha256"},
+		{PBKDF: "pbkdf2", Integrity: "none"},
+	} {
+		label := opts.label()
+		require.True(t, lbLabelRegex.MatchString(label), "label: %s", label)
+		parsed, err := parseLUKSFormatLabel(label)
+		require.NoError(t, err)
+		require.Equal(t, opts, parsed)
+	}
+	for _, label := range []string{"", "aes-xts-plain64_512", "_0___", "_x___",
+		"aes_256___", "_256_md5__", "_256__scrypt_", "____aead", "aes-xts-plain64_128___"} {
+		_, err := parseLUKSFormatLabel(label)
+		require.Error(t, err, "label: '%s'", label)
+	}
+
+	log := logrus.New().WithField("test", t.Name())
+	cfgFile := filepath.Join(t.TempDir(), DefaultLUKSCfgFileName)
+	require.NoError(t, os.WriteFile(cfgFile, []byte("cipher: aes-xts-plain64\n"+
+		"keySize: 512\npbkdf: argon2id\n"), 0o600))
+	cfg, err := loadLuksConfig(log, cfgFile)
+	require.NoError(t, err)
+	require.Equal(t, luksFormatOpts{Cipher: "aes-xts-plain64", KeySize: 512,
+		PBKDF: "argon2id"}, cfg.luksFormatOpts)
+	require.Equal(t, int64(65535), cfg.PbkdfMemory)
+	require.NoError(t, os.WriteFile(cfgFile, []byte("pbkdf: bcrypt\n"), 0o600))
+	_, err = loadLuksConfig(log, cfgFile)
+	require.ErrorContains(t, err, "bad PBKDF 'bcrypt'")
+
+	vid := lbResourceID{
+		mgmtEPs:  endpoint.MustParseCSV("10.0.0.1:443"),
+		uuid:     guuid.MustParse("6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66"),
+		projName: "proj-a",
+	}
+	for _, tc := range []struct {
+		labels map[string]string
+		want   luksFormatOpts
+		code   codes.Code
+	}{
+		{labels: nil},
+		{labels: map[string]string{lbLabelLUKSFormat: "_512__argon2id_"},
+			want: luksFormatOpts{KeySize: 512, PBKDF: "argon2id"}},
+		{labels: map[string]string{lbLabelLUKSFormat: "garbage"},
+			code: codes.FailedPrecondition},
+	} {
+		m := &ClientMock{}
+		m.On("GetVolume", mock.Anything, vid.uuid, vid.projName).Return(
+			&lb.Volume{UUID: vid.uuid, ProjectName: vid.projName, Labels: tc.labels}, nil)
+		opts, err := luksVolFormatOpts(context.Background(), log, m, vid)
+		require.Equal(t, tc.code, status.Code(err), "error: %s", err)
+		require.Equal(t, tc.want, opts)
+	}
+}
+
+func TestParseLUKSCipher(t *testing.T) {
+	testCases := []struct {
+		name string
+		out  string
+		want string
+	}{
+		{
+			name: "luks2 dump",
+			out: "LUKS header information\nVersion:       \t2\n\n" +
+				"Data segments:\n  0: crypt\n\toffset: 16777216 [bytes]\n" +
+				"\tlength: (whole device)\n\tcipher: serpent-xts-plain64\n" +
+				"\tsector: 4096 [bytes]\n\nKeyslots:\n  0: luks2\n" +
+				"\tKey:        512 bits\n\tCipher:     aes-xts-plain64\n",
+			want: "serpent-xts-plain64",
+		},
+		{
+			name: "luks1 dump",
+			out: "LUKS header information for /dev/nvme0n1\n\nVersion:       \t1\n" +
+				"Cipher name:   \ttwofish\nCipher mode:   \txts-plain64\n",
+			want: "twofish",
+		},
+		{
+			name: "status",
+			out: "/dev/mapper/lb-csi-x is active.\n  type:    LUKS2\n" +
+				"  cipher:  xchacha20,aes-adiantum-plain64\n  keysize: 256 bits\n",
+			want: "xchacha20,aes-adiantum-plain64",
+		},
+		{
+			name: "garbage",
+			out:  "Device nvme0n1 is not a valid LUKS device.\n",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, parseLUKSCipher(tc.out))
+		})
+	}
+}
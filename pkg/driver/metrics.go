@@ -0,0 +1,60 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	grpcprom "github.com/grpc-ecosystem/go-grpc-middleware/providers/prometheus"
+	"github.com/lightbitslabs/los-csi/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// the LB CSI plugin metrics are optional, and only served if Config.MetricsAddr
+// is set. the LightOS API client and client pool metrics are defined in the
+// respective packages.
+
+// rpcMetrics: the standard gRPC server metrics of the CSI RPCs served by the
+// plugin, i.e. `grpc_server_handled_total`, `grpc_server_handling_seconds`,
+// etc., by service, method and gRPC status code.
+var rpcMetrics = func() *grpcprom.ServerMetrics {
+	m := grpcprom.NewServerMetrics(grpcprom.WithServerHandlingTimeHistogram(
+		grpcprom.WithHistogramBuckets(metrics.DefBuckets)))
+	metrics.Registry.MustRegister(m)
+	return m
+}()
+
+var luksRekeys = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_csi_node_luks_rekeys_total",
+	Help: "Number of LUKS passphrase rotations carried out by the node plugin, by " +
+		"result: rekeyed, rewrapped or failed.",
+}, []string{"result"})
+
+// lockWaits: how long the node ops wait for the node-local locks, q.v.
+// lockVolume() and lockConnSet(). waits that end up being given up on are
+// counted too, and are what's worth alerting on.
+var lockWaits = metrics.Factory.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "lb_csi_node_lock_wait_seconds",
+	Help: "Time node plugin ops spent waiting for node-local locks, by lock kind " +
+		"(volume or connection) and result (acquired or aborted).",
+	Buckets: metrics.DefBuckets,
+}, []string{"kind", "result"})
+
+// registerNodeMetrics() registers the metrics describing the state of the
+// volumes on the node, as tracked by the inventory. these are only meaningful
+// for the node plugin, q.v. servesNode().
+func (d *Driver) registerNodeMetrics() {
+	metrics.Factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "lb_csi_node_volumes",
+		Help: "Number of LightOS volumes attached to, or in use on, the node.",
+	}, func() float64 {
+		vols, _ := d.inventory.counts()
+		return float64(vols)
+	})
+	metrics.Factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "lb_csi_node_luks_devices",
+		Help: "Number of open LUKS devices of LightOS volumes on the node.",
+	}, func() float64 {
+		_, mappers := d.inventory.counts()
+		return float64(mappers)
+	})
+}
@@ -0,0 +1,160 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/lightbitslabs/los-csi/pkg/lb"
+)
+
+// the secret keys that override the global LightOS API TLS settings for a
+// given CSI call, typically coming from the StorageClass secrets along with
+// the `jwt`. the certs and keys are PEM-encoded.
+const (
+	mgmtCAKey         = "mgmt-ca"
+	mgmtClientCertKey = "mgmt-client-cert"
+	mgmtClientKeyKey  = "mgmt-client-key"
+	mgmtServerNameKey = "mgmt-server-name"
+)
+
+// mgmtTLSFiles are the paths of the files the global LightOS API TLS settings
+// are loaded from, q.v. Config.MgmtCAPath and friends. empty paths are
+// ignored.
+type mgmtTLSFiles struct {
+	ca, cert, key string
+	serverName    string
+	skipVerify    bool
+}
+
+func (f mgmtTLSFiles) paths() []string {
+	var res []string
+	for _, p := range []string{f.ca, f.cert, f.key} {
+		if p != "" {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// LoadMgmtTLSConfig reads the LightOS API TLS settings from the files at the
+// specified paths (any of which may be empty) and validates them.
+func LoadMgmtTLSConfig(
+	caPath, certPath, keyPath, serverName string, skipVerify bool,
+) (*lb.TLSConfig, error) {
+	return mgmtTLSFiles{
+		ca: caPath, cert: certPath, key: keyPath,
+		serverName: serverName, skipVerify: skipVerify,
+	}.load()
+}
+
+func (f mgmtTLSFiles) load() (*lb.TLSConfig, error) {
+	res := &lb.TLSConfig{
+		ServerName:         f.serverName,
+		InsecureSkipVerify: f.skipVerify,
+	}
+	for _, file := range []struct {
+		path string
+		dst  *[]byte
+	}{
+		{f.ca, &res.CA},
+		{f.cert, &res.Cert},
+		{f.key, &res.Key},
+	} {
+		if file.path == "" {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Clean(file.path))
+		if err != nil {
+			return nil, err
+		}
+		*file.dst = b
+	}
+	if _, err := res.Build(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// reloadMgmtTLS re-reads the global LightOS API TLS settings. unlike the JWT,
+// these are not cleared on failure: falling back to some other trust settings
+// behind the admin's back is worse than sticking to the last known good ones.
+// the clients dialled with the old settings are left alone to linger in the
+// pool until reaped, the new ones are keyed by the new TLS ID.
+func (d *Driver) reloadMgmtTLS() {
+	log := d.log.WithFields(logrus.Fields{
+		"mgmt-ca-path":          d.mgmtTLSFiles.ca,
+		"mgmt-client-cert-path": d.mgmtTLSFiles.cert,
+		"mgmt-client-key-path":  d.mgmtTLSFiles.key,
+	})
+	cfg, err := d.mgmtTLSFiles.load()
+	if err != nil {
+		log.WithError(err).Error("failed to reload global LightOS API TLS " +
+			"settings, keeping the previous ones")
+		return
+	}
+	if old := d.mgmtTLS.Swap(cfg); old.ID() != cfg.ID() {
+		log.WithField("tls-id", cfg.ID()).Info("reloaded global LightOS API TLS settings")
+	}
+}
+
+func (d *Driver) monitorMgmtTLS(ctx context.Context) error {
+	for _, path := range d.mgmtTLSFiles.paths() {
+		if err := d.monitorFile(ctx, path, d.reloadMgmtTLS); err != nil {
+			return fmt.Errorf("failed to watch path '%s': %w", path, err)
+		}
+	}
+	// in case any of them changed between New() and now:
+	d.reloadMgmtTLS()
+	return nil
+}
+
+// mgmtTLSOverride returns the LightOS API TLS settings to use for a CSI call
+// with `secrets`: the global ones, with whatever is specified in `secrets`
+// overriding the corresponding global settings. the client cert and key are
+// overridden together. a CA bundle in `secrets` always turns on server cert
+// verification. returns nil if `secrets` override nothing, i.e. the global
+// settings apply as is.
+func (d *Driver) mgmtTLSOverride(secrets map[string]string) *lb.TLSConfig {
+	ca := secrets[mgmtCAKey]
+	cert := secrets[mgmtClientCertKey]
+	key := secrets[mgmtClientKeyKey]
+	serverName := secrets[mgmtServerNameKey]
+	if ca == "" && cert == "" && key == "" && serverName == "" {
+		return nil
+	}
+
+	res := &lb.TLSConfig{}
+	if global := d.mgmtTLS.Load(); global != nil {
+		*res = *global
+	}
+	if ca != "" {
+		res.CA = []byte(ca)
+		res.InsecureSkipVerify = false
+	}
+	if cert != "" || key != "" {
+		res.Cert = []byte(cert)
+		res.Key = []byte(key)
+	}
+	if serverName != "" {
+		res.ServerName = serverName
+	}
+	return res
+}
+
+type mgmtTLSCtxKey struct{}
+
+// mgmtTLSFromContext returns the per-call LightOS API TLS settings stashed in
+// `ctx` by cloneCtxWithCreds(), if any, or the global ones otherwise.
+func (d *Driver) mgmtTLSFromContext(ctx context.Context) *lb.TLSConfig {
+	if cfg, ok := ctx.Value(mgmtTLSCtxKey{}).(*lb.TLSConfig); ok {
+		return cfg
+	}
+	return d.mgmtTLS.Load()
+}
@@ -0,0 +1,94 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/lightbitslabs/los-csi/pkg/util/endpoint"
+)
+
+func mkTestCAPEM(t *testing.T) []byte {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: t.Name()},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestMgmtTLSReload(t *testing.T) {
+	d, _, _ := getDriver(t, "rack01-server01", false)
+	global := d.mgmtTLS.Load()
+	require.NotNil(t, global)
+	require.Empty(t, global.CA)
+
+	caPath := filepath.Join(t.TempDir(), "ca.crt")
+	ca := mkTestCAPEM(t)
+	require.NoError(t, os.WriteFile(caPath, ca, 0o600))
+	d.mgmtTLSFiles = mgmtTLSFiles{ca: caPath, serverName: "lb01"}
+	d.reloadMgmtTLS()
+	global = d.mgmtTLS.Load()
+	require.Equal(t, ca, global.CA)
+	require.Equal(t, "lb01", global.ServerName)
+
+	// garbage in - last known good settings stay:
+	require.NoError(t, os.WriteFile(caPath, []byte("nope"), 0o600))
+	d.reloadMgmtTLS()
+	require.Same(t, global, d.mgmtTLS.Load())
+}
+
+func TestMgmtTLSOverride(t *testing.T) {
+	d, _, _ := getDriver(t, "rack01-server01", false)
+	d.mgmtTLSFiles.skipVerify = true
+	d.reloadMgmtTLS()
+	global := d.mgmtTLS.Load()
+	require.True(t, global.InsecureSkipVerify)
+
+	// no overrides - global settings, ctx left alone:
+	ctx := d.cloneCtxWithCreds(context.Background(), map[string]string{"jwt": "x"})
+	require.Nil(t, ctx.Value(mgmtTLSCtxKey{}))
+	require.Same(t, global, d.mgmtTLSFromContext(ctx))
+
+	ca := mkTestCAPEM(t)
+	ctx = d.cloneCtxWithCreds(context.Background(), map[string]string{
+		mgmtCAKey:         string(ca),
+		mgmtServerNameKey: "lb02",
+	})
+	tlsCfg := d.mgmtTLSFromContext(ctx)
+	require.Equal(t, ca, tlsCfg.CA)
+	require.Equal(t, "lb02", tlsCfg.ServerName)
+	require.False(t, tlsCfg.InsecureSkipVerify)
+	require.NotEqual(t, global.ID(), tlsCfg.ID())
+	require.True(t, global.InsecureSkipVerify, "global settings must not change")
+
+	ctx = d.cloneCtxWithCreds(context.Background(), map[string]string{
+		mgmtClientCertKey: "not-a-cert",
+	})
+	_, err := d.GetLBClient(ctx, endpoint.MustParseCSV("10.0.0.1:443"), grpcsXport)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.ErrorContains(t, err, "without client key")
+}
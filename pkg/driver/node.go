@@ -13,11 +13,13 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	guuid "github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -25,6 +27,7 @@ import (
 
 	"github.com/lightbitslabs/los-csi/pkg/driver/backend"
 	"github.com/lightbitslabs/los-csi/pkg/lb"
+	"github.com/lightbitslabs/los-csi/pkg/tracing"
 	"github.com/lightbitslabs/los-csi/pkg/util/endpoint"
 	"github.com/lightbitslabs/los-csi/pkg/util/wait"
 )
@@ -39,9 +42,10 @@ const (
 // checks if the volume exists on the LightOS cluster and is fully accessible
 // by this host configuration-wise and in terms of target-side availability.
 // all of this might change by the time we actually try to connect/mount, of
-// course, but usually only for the worse, not for the better.
+// course, but usually only for the worse, not for the better. `tlsKey` is
+// whether the NVMe/TCP TLS PSK was supplied through the CSI secrets.
 func (d *Driver) lbVolEligible(
-	ctx context.Context, log *logrus.Entry, clnt lb.Client, vid lbResourceID,
+	ctx context.Context, log *logrus.Entry, clnt lb.Client, vid lbResourceID, tlsKey bool,
 ) error {
 	vol, err := clnt.GetVolume(ctx, vid.uuid, vid.projName)
 	if err != nil {
@@ -71,12 +75,13 @@ func (d *Driver) lbVolEligible(
 		return mkPrecond("volume '%s' is inaccessible from node '%s'", vid, d.nodeID)
 	}
 
-	st := d.be.LBVolEligible(ctx, vol)
+	st := d.be.LBVolEligible(ctx, vol, vid.nvmeTransport(d.defaultTransport), tlsKey)
 	return st.Err()
 }
 
 func queryLBforTargetEnv(
-	ctx context.Context, log *logrus.Entry, clnt lb.Client, vid lbResourceID,
+	ctx context.Context, log *logrus.Entry, clnt lb.Client, vid lbResourceID, nodeID string,
+	defXport string,
 ) (*backend.TargetEnv, error) {
 	ci, err := clnt.GetClusterInfo(ctx)
 	if err != nil {
@@ -85,37 +90,69 @@ func queryLBforTargetEnv(
 	}
 
 	res := &backend.TargetEnv{
+		Transport: vid.nvmeTransport(defXport),
 		SubsysNQN: ci.SubsysNQN,
+		TLS:       vid.nvmeTLS != "",
 	}
-	res.DiscoveryEPs, err = endpoint.ParseSliceIP(ci.DiscoveryEndpoints)
+	res.DiscoveryEPs, err = endpoint.ParseSlice(ci.DiscoveryEndpoints)
 	if err != nil {
 		return nil, mungeLBErr(log, err,
 			"got invalid discovery service endpoint from LB cluster at '%s'",
 			vid.mgmtEPs[0])
 	}
-	res.NvmeEPs, err = endpoint.ParseSliceIP(ci.NvmeEndpoints)
+	res.NvmeEPs, err = endpoint.ParseSlice(ci.NvmeEndpoints)
 	if err != nil {
 		return nil, mungeLBErr(log, err,
 			"got invalid NVMe endpoint from LB cluster at '%s'", vid.mgmtEPs[0])
 	}
 
+	// the cluster might report hostnames rather than IP addresses, but the
+	// backends (and the kernel, and the DSC) only speak IP, so resolve them
+	// right before connecting, to pick up any DNS changes since the last time:
+	if res.DiscoveryEPs, err = resolveTargetEPs(ctx, log, res.DiscoveryEPs); err != nil {
+		return nil, err
+	}
+	if res.NvmeEPs, err = resolveTargetEPs(ctx, log, res.NvmeEPs); err != nil {
+		return nil, err
+	}
+
+	secrets, err := getTrustedHostSecrets(ctx, log, clnt, vid, nodeID, ci.InBandAuth)
+	if err != nil {
+		return nil, err
+	}
+	if secrets != nil {
+		res.HostSecret = secrets.Host
+		res.CtrlSecret = secrets.Ctrl
+	}
+
+	return res, nil
+}
+
+// targetResolver is used to resolve the hostnames in the NVMe-oF target
+// endpoints, nil means the system resolver. overridden by tests.
+var targetResolver endpoint.Resolver
+
+func resolveTargetEPs(
+	ctx context.Context, log *logrus.Entry, eps endpoint.Slice,
+) (endpoint.Slice, error) {
+	res, err := eps.Resolve(ctx, targetResolver)
+	if err != nil {
+		log.WithError(err).Warnf("failed to resolve NVMe-oF target endpoints %s", eps)
+		return nil, mkEagain("failed to resolve NVMe-oF target endpoints %s: %s", eps, err)
+	}
+	if !res.Equal(eps) {
+		log.Debugf("resolved NVMe-oF target endpoints %s to %s", eps, res)
+	}
 	return res, nil
 }
 
 func (d *Driver) getDeviceUUID(device string) (string, error) {
-	devUUID, err := os.ReadFile(filepath.Join("/sys/block", device, "wwid"))
+	devUUID, err := readDevUUID(filepath.Join(sysfsRoot, "block", device))
 	if err != nil {
 		d.log.Debugf("failed to read wwid from dev: %s err: %s", device, err)
 		return "", err
 	}
-
-	devUUIDstr := strings.TrimSuffix(string(devUUID), "\n")
-	// LightOS always exposes uuid, so if we don't see a uuid identifier we
-	// can safely return a mismatch
-	if strings.Contains(devUUIDstr, "uuid") {
-		return strings.TrimPrefix(devUUIDstr, "uuid."), nil
-	}
-	return "", nil
+	return devUUID, nil
 }
 
 func (d *Driver) getDevPathByUUID(uuid guuid.UUID) (string, error) {
@@ -213,6 +250,105 @@ func IsVolumeReadOnly(capability *csi.VolumeCapability) bool {
 	return ro
 }
 
+// chkStagedVolume() checks that whatever is already mounted at the staging
+// path `tgtPath` is volume `vid`, staged the way `volCap` requires. `mounts`
+// should be the parsed contents of the mountinfo file. returns nil if
+// NodeStageVolume() can safely be treated as an idempotent retry.
+func (d *Driver) chkStagedVolume(
+	log *logrus.Entry, vid lbResourceID, tgtPath string,
+	volCap *csi.VolumeCapability, mounts []mountutils.MountInfo,
+) error {
+	// if stacked, the last mount is the one that's visible.
+	var mnt *mountutils.MountInfo
+	for i := range mounts {
+		if mounts[i].MountPoint == tgtPath {
+			mnt = &mounts[i]
+		}
+	}
+	if mnt == nil {
+		return mkEExec("failed to find what's mounted at '%s'", tgtPath)
+	}
+	major, minor := uint32(mnt.Major), uint32(mnt.Minor)
+	log.Debugf("%d:%d (%s) is already mounted at '%s'",
+		major, minor, mnt.Source, tgtPath)
+
+	// block volumes are only attached (and opened) by NodeStageVolume(),
+	// nothing is ever mounted at their staging path.
+	if volCap.GetBlock() != nil {
+		return mkEbadOp("mismatch", vid.uuid.String(),
+			"staging path '%s' of block volume is already a mount point "+
+				"of %d:%d (%s)", tgtPath, major, minor, mnt.Source)
+	}
+
+	dev, err := resolveVolDevice(major, minor)
+	if err != nil {
+		return mkEExec("failed to examine block device %d:%d mounted at '%s': %s",
+			major, minor, tgtPath, err)
+	}
+	if dev == nil {
+		if v, ok := d.inventory.get(vid.uuid); ok && contains(v.mounts, tgtPath) {
+			return mkPrecond("block device %d:%d of volume %s staged at '%s' "+
+				"is gone", major, minor, vid.uuid, tgtPath)
+		}
+		return mkPrecond("block device %d:%d mounted at '%s' is gone",
+			major, minor, tgtPath)
+	}
+
+	wantMapper := ""
+	if vid.hostCrypto != "" {
+		wantMapper = luksMapperFileName(vid.uuid)
+	}
+	if dev.mapper != wantMapper {
+		return mkEbadOp("mismatch", vid.uuid.String(),
+			"staging path '%s' has device '%s' (device-mapper: '%s') mounted, "+
+				"expected device-mapper: '%s'",
+			tgtPath, dev.name, dev.mapper, wantMapper)
+	}
+	devUUID, err := readDevUUID(dev.nvmeDir)
+	if err != nil {
+		return mkEExec("failed to get UUID of block device '%s' mounted at '%s': %s",
+			dev.nvmeDev, tgtPath, err)
+	}
+	if devUUID != vid.uuid.String() {
+		if devUUID == "" {
+			devUUID = "<not a LightOS volume>"
+		}
+		return mkEbadOp("mismatch", vid.uuid.String(),
+			"staging path '%s' has block device '%s' of volume %s mounted",
+			tgtPath, dev.nvmeDev, devUUID)
+	}
+
+	wantFSType := volCap.GetMount().GetFsType()
+	if wantFSType != "" && mnt.FsType != wantFSType {
+		return mkEbadOp("mismatch", vid.uuid.String(),
+			"requested FS '%s', but volume is staged at '%s' with FS '%s'",
+			wantFSType, tgtPath, mnt.FsType)
+	}
+
+	if isAutoRemountedRO(mounts, major, minor) {
+		return mkPrecond("FS on volume %s staged at '%s' was remounted "+
+			"read-only, most likely due to I/O errors", vid.uuid, tgtPath)
+	}
+	wantRO := IsVolumeReadOnly(volCap)
+	if isRO := contains(mnt.MountOptions, "ro"); isRO != wantRO {
+		return mkEbadOp("mismatch", vid.uuid.String(),
+			"volume requested read-only: %t, but is staged at '%s' read-only: %t",
+			wantRO, tgtPath, isRO)
+	}
+
+	d.inventory.update(vid.uuid, func(v *nodeVol) {
+		v.nvmeDev = dev.nvmeDev
+		if dev.mapper != "" {
+			v.mapper = dev.mapper
+			v.mapperDev = dev.name
+		}
+	})
+	d.inventory.addMount(vid.uuid, tgtPath)
+	log.Debugf("OK, volume already staged at '%s' from '%s' with '%s' FS",
+		tgtPath, dev.name, mnt.FsType)
+	return nil
+}
+
 // CSI Node service: ---------------------------------------------------------
 
 // NodeStageVolume obtains the necessary NVMe-oF target(s) endpoints from the
@@ -255,15 +391,27 @@ func (d *Driver) NodeStageVolume(
 	}
 	defer d.PutLBClient(clnt)
 
+	// the NVMe/TCP TLS PSK, unless it's provisioned in the node keyring:
+	tlsPSK := ""
+	if psk, ok := req.Secrets[volNvmeTLSPSKKey]; ok && vid.nvmeTLS != "" {
+		if err := checkTLSPSK("secrets."+volNvmeTLSPSKKey, psk); err != nil {
+			return nil, err
+		}
+		tlsPSK = psk
+	}
+
 	// remote/global sanity check: - - - - - - - - - - - - - - - - - - - -
 
-	err = d.lbVolEligible(ctx, log, clnt, vid)
+	err = d.lbVolEligible(ctx, log, clnt, vid, tlsPSK != "")
 	if err != nil {
 		return nil, err
 	}
 
-	d.bdl.Lock() // TODO: break up into per-volume+per-target locks!
-	defer d.bdl.Unlock()
+	unlockVol, err := d.lockVolume(ctx, log, vid.uuid)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockVol()
 
 	// node local sanity checks: - - - - - - - - - - - - - - - - - - - - -
 
@@ -281,62 +429,79 @@ func (d *Driver) NodeStageVolume(
 		return nil, mkEExec("can't examine staging path: %s", err)
 	}
 	if isMnt {
-		dev, _, err := mountutils.GetDeviceNameFromMount(d.mounter, tgtPath)
+		// presumably k8s is just calling us again for a retry of a
+		// request that may have timed out, or some such... but make
+		// sure it's indeed the right volume staged the right way before
+		// claiming success.
+		mounts, err := mountutils.ParseMountInfo(mountInfoPath)
 		if err != nil {
-			log.Debugf("failed to find what's mounted at '%s': %s", tgtPath, err)
+			return nil, mkEExec("failed to list mounts: %s", err)
+		}
+		if err := d.chkStagedVolume(log, vid, tgtPath, req.VolumeCapability, mounts); err != nil {
+			return nil, err
 		}
-		log.Debugf("'%s' is already mounted at '%s'", dev, tgtPath)
-
-		// TODO: check that the FS didn't auto-remount as RO due to
-		// disconnect/error?
-
-		// TODO: NO, not really, now we need to check that it's indeed
-		// the right volume (use client.GetNGUIDByDevPath() like
-		// NodeUnstageVolume() for this reverse mapping then compare to
-		// VolumeID), with the right FS (check against caps) and mounted
-		// with the right flags (ditto)! i.e. that presumably k8s is
-		// just calling us again for a retry of a request that may have
-		// timed out, or some such...
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
 	// get remote NVMe-oF targets info from the LB cluster:  - - - - - - -
 
-	tgtEnv, err := queryLBforTargetEnv(ctx, log, clnt, vid)
+	tgtEnv, err := queryLBforTargetEnv(ctx, log, clnt, vid, d.nodeID,
+		d.defaultTransport)
 	if err != nil {
 		return nil, err
 	}
+	tgtEnv.TLSKey = tlsPSK
 
 	// let backend connect and produce block device: - - - - - - - - - - -
 
-	if st := d.be.Attach(ctx, tgtEnv, vid.uuid); st != nil {
+	unlockConns, err := d.lockConnSet(ctx, log, tgtEnv.SubsysNQN)
+	if err != nil {
+		return nil, err
+	}
+	attachCtx, span := tracing.Start(ctx, "Backend.Attach",
+		attribute.String("lb.csi.subsys-nqn", tgtEnv.SubsysNQN))
+	st := d.be.Attach(attachCtx, tgtEnv, vid.uuid)
+	unlockConns()
+	tracing.End(span, st.Err())
+	if st != nil {
 		return nil, st.Err()
 	}
 
+	_, span = tracing.Start(ctx, "getDevicePath")
 	devPath, err := d.getDevicePath(vid.uuid)
+	tracing.End(span, err)
 	if err != nil {
 		return nil, err
 	}
+	d.inventory.update(vid.uuid, func(v *nodeVol) {
+		v.nvmeDev = filepath.Base(devPath)
+	})
 
 	if vid.hostCrypto != "" {
-		passphrase, ok := req.Secrets[volHostEncryptionPassphraseKey]
-		if !ok {
-			return nil, status.Errorf(codes.InvalidArgument,
-				"missing passphrase secret for key %s",
-				volHostEncryptionPassphraseKey)
-		}
-		if len(passphrase) > volHostEncryptionPassphraseKeyMaxLen {
-			return nil, status.Errorf(codes.InvalidArgument,
-				"passphrase %s for encryption must no longer than %d char but is:%d",
-				volHostEncryptionPassphraseKey, volHostEncryptionPassphraseKeyMaxLen,
-				len(passphrase))
-		}
-		devPath, err = d.encryptAndOpenDevice(vid.uuid, passphrase)
+		nvmeDevPath := devPath
+		passphrase, prevPassphrase, err := d.luksPassphrase(ctx, log, clnt, vid,
+			req.Secrets, func() (bool, error) { return d.luksIsLuks(nvmeDevPath) })
+		if err != nil {
+			return nil, err
+		}
+		_, span = tracing.Start(ctx, "LUKS.EncryptAndOpen")
+		volOpts := func() (luksFormatOpts, error) {
+			return luksVolFormatOpts(ctx, log, clnt, vid)
+		}
+		devPath, err = d.encryptAndOpenDevice(log, vid.uuid, passphrase, prevPassphrase,
+			volOpts)
+		tracing.End(span, err)
 		if err != nil {
 			return nil, status.Errorf(codes.Internal,
 				"error encrypting/opening volume with ID %s: %v",
 				vid.uuid, err)
 		}
+		d.inventory.update(vid.uuid, func(v *nodeVol) {
+			v.mapper = filepath.Base(devPath)
+			if realPath, err := filepath.EvalSymlinks(devPath); err == nil {
+				v.mapperDev = filepath.Base(realPath)
+			}
+		})
 	}
 
 	// turn block dev into what CO wanted: - - - - - - - - - - - - - - - -
@@ -388,10 +553,14 @@ func (d *Driver) NodeStageVolume(
 	// mismatch in FS type, so only try it if there's a reasonable chance
 	// of success (i.e. either no FS or at least the same FS type as the
 	// required one)...
+	_, span = tracing.Start(ctx, "FormatAndMount",
+		attribute.String("lb.csi.fs-type", wantFSType))
 	err = d.mounter.FormatAndMount(devPath, tgtPath, wantFSType, mntOpts)
+	tracing.End(span, err)
 	if err != nil {
 		return nil, mkEExec("format/mount failed: '%s'", err.Error())
 	}
+	d.inventory.addMount(vid.uuid, tgtPath)
 
 	// In case the volume came from a snapshot and happens to also be
 	// larger in capacity, we want to update the fs size accordingly, we
@@ -419,8 +588,18 @@ func (d *Driver) NodeUnstageVolume(
 	}
 	tgtPath := req.StagingTargetPath
 
-	d.bdl.Lock() // TODO: break up into per-volume+per-target locks!
-	defer d.bdl.Unlock()
+	log := d.log.WithFields(logrus.Fields{
+		"op":       "NodeUnstageVolume",
+		"mgmt-ep":  vid.mgmtEPs,
+		"vol-uuid": vid.uuid,
+		"project":  vid.projName,
+	})
+
+	unlockVol, err := d.lockVolume(ctx, log, vid.uuid)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockVol()
 
 	// TODO: check that staging target path indeed corresponds to the NVMe
 	// device, using client.GetNGUIDByDevPath(). same check is needed in
@@ -447,18 +626,41 @@ func (d *Driver) NodeUnstageVolume(
 			return nil, mkEExec("failed to unmount '%s': %s", tgtPath, err)
 		}
 	}
+	d.inventory.removeMount(vid.uuid, tgtPath)
 
 	if vid.hostCrypto != "" {
+		_, span := tracing.Start(ctx, "LUKS.Close")
 		err = d.closeEncryptedDevice(vid.uuid)
+		tracing.End(span, err)
 		if err != nil {
 			return nil, mkEExec("error closing host-encrypted device %s (%s)",
 				vid.uuid, err.Error())
 		}
+		d.inventory.update(vid.uuid, func(v *nodeVol) {
+			v.mapper = ""
+			v.mapperDev = ""
+		})
+	}
+
+	// the backend might disconnect from the subsystem if this is the last
+	// volume attached through it, so it must not race with Attach() of
+	// other volumes. if the volume is not known to be attached (e.g.
+	// unstage retry after success), there's nothing to disconnect, so no
+	// need for the lock either.
+	if subsysNQN, ok := d.conns.Subsys(vid.uuid); ok {
+		unlockConns, err := d.lockConnSet(ctx, log, subsysNQN)
+		if err != nil {
+			return nil, err
+		}
+		defer unlockConns()
 	}
-
-	if st := d.be.Detach(ctx, vid.uuid); st != nil {
+	detachCtx, span := tracing.Start(ctx, "Backend.Detach")
+	st := d.be.Detach(detachCtx, vid.uuid)
+	tracing.End(span, st.Err())
+	if st != nil {
 		return nil, st.Err()
 	}
+	d.inventory.remove(vid.uuid)
 
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
@@ -510,6 +712,7 @@ func (d *Driver) nodePublishVolumeForBlock(
 			status.Errorf(codes.Internal, "failed to mount '%s' at '%s': %s",
 				source, target, err)
 	}
+	d.inventory.addMount(vid.uuid, target)
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
@@ -569,6 +772,7 @@ func (d *Driver) nodePublishVolumeForFileSystem(
 	if err != nil {
 		return nil, mkEExec("failed to bind mount: %s", err)
 	}
+	d.inventory.addMount(vid.uuid, tgtPath)
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
@@ -622,8 +826,11 @@ func (d *Driver) NodePublishVolume(
 		mountOptions = append(mountOptions, "ro")
 	}
 
-	d.bdl.Lock() // TODO: break up into per-volume+per-target locks!
-	defer d.bdl.Unlock()
+	unlockVol, err := d.lockVolume(ctx, log, vid.uuid)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockVol()
 
 	// for idempotency - start in reverse order:
 	if _, err := os.Stat(req.TargetPath); err == nil {
@@ -665,9 +872,9 @@ func (d *Driver) NodePublishVolume(
 }
 
 func (d *Driver) NodeUnpublishVolume(
-	_ context.Context, req *csi.NodeUnpublishVolumeRequest,
+	ctx context.Context, req *csi.NodeUnpublishVolumeRequest,
 ) (*csi.NodeUnpublishVolumeResponse, error) {
-	_, err := parseCSIResourceIDEinval(volIDField, req.VolumeId)
+	vid, err := parseCSIResourceIDEinval(volIDField, req.VolumeId)
 	if err != nil {
 		return nil, err
 	}
@@ -675,8 +882,15 @@ func (d *Driver) NodeUnpublishVolume(
 		return nil, mkEinvalMissing("target_path")
 	}
 
-	d.bdl.Lock() // TODO: break up into per-volume+per-target locks!
-	defer d.bdl.Unlock()
+	log := d.log.WithFields(logrus.Fields{
+		"op":       "NodeUnpublishVolume",
+		"vol-uuid": vid.uuid,
+	})
+	unlockVol, err := d.lockVolume(ctx, log, vid.uuid)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockVol()
 
 	ioErr := false
 	tgtPath := req.TargetPath
@@ -696,6 +910,7 @@ func (d *Driver) NodeUnpublishVolume(
 			return nil, mkEExec("failed to unmount '%s': %s", tgtPath, err)
 		}
 	}
+	d.inventory.removeMount(vid.uuid, tgtPath)
 
 	if err = os.RemoveAll(tgtPath); err != nil {
 		return nil, mkEExec("failed to remove '%s': %s", tgtPath, err)
@@ -731,6 +946,13 @@ func (d *Driver) NodeGetCapabilities( //revive:disable-line:unused-receiver
 				},
 			},
 		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+				},
+			},
+		},
 	}
 
 	return &csi.NodeGetCapabilitiesResponse{Capabilities: capabilities}, nil
@@ -739,27 +961,32 @@ func (d *Driver) NodeGetCapabilities( //revive:disable-line:unused-receiver
 func (d *Driver) NodeGetInfo(
 	_ context.Context, _ *csi.NodeGetInfoRequest,
 ) (*csi.NodeGetInfoResponse, error) {
-	return &csi.NodeGetInfoResponse{
+	resp := &csi.NodeGetInfoResponse{
 		NodeId: d.nodeID,
-	}, nil
+	}
+	if segs := d.topology.segments(); segs != nil {
+		resp.AccessibleTopology = &csi.Topology{Segments: segs}
+	}
+	return resp, nil
 }
 
-func (d *Driver) NodeGetVolumeStats( //revive:disable-line:unused-receiver
+func (d *Driver) NodeGetVolumeStats(
 	ctx context.Context, req *csi.NodeGetVolumeStatsRequest,
 ) (*csi.NodeGetVolumeStatsResponse, error) {
 	if req.VolumePath == "" {
 		return nil, mkEinvalMissing(volPathField)
 	}
 	// preserve the order of checks to humour csi-sanity...
-	_, err := parseCSIResourceIDEnoent(volIDField, req.VolumeId)
+	vid, err := parseCSIResourceIDEnoent(volIDField, req.VolumeId)
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: before doing any actual FS/block-specific checks, the code must
-	// ascertain that the block device (or FS mounted from such block device)
-	// indeed corresponds to volume specified by `req.VolumeId` by comparing
-	// `vid.uuid` parsed above (now: `_`) with the NGUID of the NVMe block dev.
+	log := d.log.WithFields(logrus.Fields{
+		"op":       "NodeGetVolumeStats",
+		"vol-uuid": vid.uuid,
+		"vol-path": req.VolumePath,
+	})
 
 	volPath := req.VolumePath
 	stat, err := os.Stat(volPath)
@@ -768,14 +995,55 @@ func (d *Driver) NodeGetVolumeStats( //revive:disable-line:unused-receiver
 	} else if err != nil {
 		return nil, mkExternal("bad %s: %s", volPathField, err)
 	}
+	sysStat, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, mkInternal("can't get device info of %s '%s'", volPathField, volPath)
+	}
 
+	// before reporting any stats, make sure they're actually about the
+	// right volume, and that the volume is in a usable state. for mounts
+	// the device is the one the FS lives on, for block volumes - the
+	// device node itself.
+	var resp *csi.NodeGetVolumeStatsResponse
+	var cond *csi.VolumeCondition
 	if stat.Mode().IsDir() {
-		return filesystemNodeGetVolumeStats(volPath)
+		isMnt, err := IsMountPoint(volPath)
+		if err != nil {
+			return nil, mkExternal("can't tell if %s '%s' is a mount: %s",
+				volPathField, volPath, err)
+		}
+		if !isMnt {
+			return nil, mkEnoent("no volume is mounted on %s '%s'", volPathField, volPath)
+		}
+		mounts, err := mountutils.ParseMountInfo(mountInfoPath)
+		if err != nil {
+			log.Warnf("failed to parse '%s', skipping FS checks: %s", mountInfoPath, err)
+			mounts = nil
+		}
+		//nolint:unconvert // Stat_t field sizes differ between architectures.
+		dev := uint64(sysStat.Dev)
+		cond = d.nodeVolumeCondition(log, vid, unix.Major(dev), unix.Minor(dev), mounts)
+		resp, err = filesystemNodeGetVolumeStats(volPath)
 	} else if (stat.Mode() & os.ModeDevice) == os.ModeDevice {
-		return blockNodeGetVolumeStats(ctx, volPath)
+		//nolint:unconvert // Stat_t field sizes differ between architectures.
+		dev := uint64(sysStat.Rdev)
+		cond = d.nodeVolumeCondition(log, vid, unix.Major(dev), unix.Minor(dev), nil)
+		resp, err = blockNodeGetVolumeStats(ctx, volPath)
+	} else {
+		return nil, mkExternal("bad %s: '%s' is neither mount nor block device, mode='%s'",
+			volPathField, volPath, stat.Mode())
+	}
+	if err != nil {
+		if !cond.Abnormal {
+			return nil, err
+		}
+		// failing to get stats off a broken volume is par for the course,
+		// the condition is more useful to the CO than the error.
+		log.Warnf("failed to get volume stats: %s", err)
+		resp = &csi.NodeGetVolumeStatsResponse{}
 	}
-	return nil, mkExternal("bad %s: '%s' is neither mount nor block device, mode='%s'",
-		volPathField, volPath, stat.Mode())
+	resp.VolumeCondition = cond
+	return resp, nil
 }
 
 // IsMountPoint checks if the given path is mountpoint or not.
@@ -792,17 +1060,8 @@ func IsMountPoint(p string) (bool, error) {
 // filesystemNodeGetVolumeStats can be used for getting the metrics as
 // requested by the NodeGetVolumeStats CSI procedure.
 func filesystemNodeGetVolumeStats(volPath string) (*csi.NodeGetVolumeStatsResponse, error) {
-	isMnt, err := IsMountPoint(volPath)
-	if err != nil {
-		return nil, mkExternal("can't tell if %s '%s' is a mount: %s", volPathField,
-			volPath, err)
-	}
-	if !isMnt {
-		return nil, mkEnoent("no volume is mounted on %s '%s'", volPathField, volPath)
-	}
-
 	statfs := &unix.Statfs_t{}
-	err = unix.Statfs(volPath, statfs)
+	err := unix.Statfs(volPath, statfs)
 	if err != nil {
 		return nil, mkExternal("failed to collect FS info for mount '%s': %s", volPath, err)
 	}
@@ -870,7 +1129,7 @@ func blockNodeGetVolumeStats(
 }
 
 func (d *Driver) NodeExpandVolume(
-	_ context.Context, req *csi.NodeExpandVolumeRequest,
+	ctx context.Context, req *csi.NodeExpandVolumeRequest,
 ) (*csi.NodeExpandVolumeResponse, error) {
 	vid, err := parseCSIResourceIDEnoent(volIDField, req.VolumeId)
 	if err != nil {
@@ -901,8 +1160,11 @@ func (d *Driver) NodeExpandVolume(
 		return nil, err
 	}
 
-	d.bdl.Lock() // TODO: break up into per-volume+per-target locks!
-	defer d.bdl.Unlock()
+	unlockVol, err := d.lockVolume(ctx, log, vid.uuid)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockVol()
 
 	devicePath, err := d.getDevicePath(vid.uuid)
 	if err != nil {
@@ -0,0 +1,242 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	mountutils "k8s.io/mount-utils"
+)
+
+// node-local volume health checks, as reported by NodeGetVolumeStats() in the
+// form of CSI VolumeCondition. these rely purely on what the kernel has to say
+// about the block device backing the volume, the LightOS cluster is NOT
+// consulted (no secrets in NodeGetVolumeStats(), and the CO can get the
+// cluster-side view from ControllerGetVolume() anyway).
+
+var (
+	// these are vars rather than consts only to allow running the tests
+	// against fake sysfs/procfs trees.
+	sysfsRoot     = "/sys"
+	mountInfoPath = "/proc/self/mountinfo"
+)
+
+const nvmeCtrlLive = "live"
+
+// volDevice describes the local block device backing a staged or published
+// volume, as far as could be figured out from sysfs.
+type volDevice struct {
+	name    string // kernel name of the top-level device, e.g. "nvme0n1" or "dm-3".
+	mapper  string // device-mapper name, if the device is a DM one (i.e. LUKS).
+	nvmeDev string // kernel name of the underlying NVMe namespace block device.
+	nvmeDir string // sysfs dir of the underlying NVMe namespace block device.
+}
+
+// resolveVolDevice() maps a block device number to the NVMe namespace block
+// device behind it, looking through a device-mapper layer (i.e. LUKS) if
+// necessary. returns nil device and nil error if no such device exists (any
+// more).
+func resolveVolDevice(major, minor uint32) (*volDevice, error) {
+	devLink := filepath.Join(sysfsRoot, "dev", "block", fmt.Sprintf("%d:%d", major, minor))
+	devDir, err := filepath.EvalSymlinks(devLink)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	dev := &volDevice{
+		name:    filepath.Base(devDir),
+		nvmeDir: devDir,
+	}
+	dmName, err := os.ReadFile(filepath.Join(devDir, "dm", "name"))
+	if err == nil {
+		dev.mapper = strings.TrimSpace(string(dmName))
+		slaves, err := filepath.Glob(filepath.Join(devDir, "slaves", "*"))
+		if err != nil {
+			return nil, err
+		}
+		if len(slaves) != 1 {
+			return nil, fmt.Errorf("device-mapper device '%s' (%s) has %d underlying "+
+				"devices instead of one", dev.name, dev.mapper, len(slaves))
+		}
+		dev.nvmeDir, err = filepath.EvalSymlinks(slaves[0])
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	dev.nvmeDev = filepath.Base(dev.nvmeDir)
+
+	return dev, nil
+}
+
+// readDevUUID() returns the UUID of the NVMe namespace whose sysfs block
+// device dir is `devDir`, or an empty string if the namespace doesn't have a
+// UUID-based wwid (i.e. it's definitely not a LightOS volume).
+func readDevUUID(devDir string) (string, error) {
+	wwid, err := os.ReadFile(filepath.Join(devDir, "wwid"))
+	if err != nil {
+		return "", err
+	}
+
+	wwidStr := strings.TrimSuffix(string(wwid), "\n")
+	// LightOS always exposes uuid, so if we don't see a uuid identifier we
+	// can safely return a mismatch
+	if strings.Contains(wwidStr, "uuid") {
+		return strings.TrimPrefix(wwidStr, "uuid."), nil
+	}
+	return "", nil
+}
+
+// nvmePathStates() returns the states of the NVMe controllers providing the
+// paths to the NVMe namespace whose sysfs block device dir is `nvmeDir`, keyed
+// by controller name (e.g. "nvme0": "live", "nvme3": "connecting").
+func nvmePathStates(nvmeDir string) map[string]string {
+	// with native NVMe multipath, the namespace "head" device lists the
+	// per-path (hidden) block devices under `multipath/`, each with its
+	// own controller. without it - the namespace device belongs directly
+	// to a single controller.
+	var ctrlLinks []string
+	paths, _ := filepath.Glob(filepath.Join(nvmeDir, "multipath", "*"))
+	if len(paths) == 0 {
+		ctrlLinks = []string{filepath.Join(nvmeDir, "device")}
+	} else {
+		for _, path := range paths {
+			ctrlLinks = append(ctrlLinks, filepath.Join(path, "device"))
+		}
+	}
+
+	states := map[string]string{}
+	for _, link := range ctrlLinks {
+		ctrlDir, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			// the path is going away as we speak...
+			continue
+		}
+		state := "unknown"
+		if raw, err := os.ReadFile(filepath.Join(ctrlDir, "state")); err == nil {
+			state = strings.TrimSpace(string(raw))
+		}
+		states[filepath.Base(ctrlDir)] = state
+	}
+	return states
+}
+
+// isAutoRemountedRO() checks whether the FS on the device `major:minor` has
+// been remounted read-only behind our back, typically by the FS itself in
+// response to I/O errors (e.g. ext4 `errors=remount-ro`). the tell-tale sign
+// of this is the superblock being read-only while at least one of its mounts
+// isn't: volumes staged as read-only on purpose are read-only all the way.
+func isAutoRemountedRO(mounts []mountutils.MountInfo, major, minor uint32) bool {
+	sbRO := false
+	mntRW := false
+	for i := range mounts {
+		mnt := &mounts[i]
+		if mnt.Major != int(major) || mnt.Minor != int(minor) {
+			continue
+		}
+		if contains(mnt.SuperOptions, "ro") {
+			sbRO = true
+		}
+		if contains(mnt.MountOptions, "rw") {
+			mntRW = true
+		}
+	}
+	return sbRO && mntRW
+}
+
+// nodeVolumeCondition() examines the local state of volume `vid` backed by the
+// block device `major:minor`. `mounts` should be nil for block volumes, for
+// mounted volumes - the parsed contents of the mountinfo file. any findings
+// are reported as VolumeCondition, i.e. this func doesn't fail as such.
+func (d *Driver) nodeVolumeCondition(
+	log *logrus.Entry, vid lbResourceID, major, minor uint32,
+	mounts []mountutils.MountInfo,
+) *csi.VolumeCondition {
+	var issues []string
+	abnormal := false
+	note := func(format string, args ...interface{}) {
+		issues = append(issues, fmt.Sprintf(format, args...))
+	}
+	problem := func(format string, args ...interface{}) {
+		abnormal = true
+		note(format, args...)
+	}
+	mkCond := func() *csi.VolumeCondition {
+		msg := "volume is healthy"
+		if len(issues) > 0 {
+			msg = strings.Join(issues, "; ")
+		}
+		if abnormal {
+			log.Warnf("volume condition: %s", msg)
+		}
+		return &csi.VolumeCondition{Abnormal: abnormal, Message: msg}
+	}
+
+	dev, err := resolveVolDevice(major, minor)
+	if err != nil {
+		problem("failed to examine block device %d:%d backing the volume: %s",
+			major, minor, err)
+		return mkCond()
+	}
+	if dev == nil {
+		problem("block device %d:%d backing the volume is gone", major, minor)
+		return mkCond()
+	}
+
+	if dev.mapper != "" && dev.mapper != luksMapperFileName(vid.uuid) {
+		problem("device-mapper device '%s' backing the volume is '%s' instead of '%s'",
+			dev.name, dev.mapper, luksMapperFileName(vid.uuid))
+	}
+	devUUID, err := readDevUUID(dev.nvmeDir)
+	switch {
+	case err != nil:
+		problem("failed to get UUID of block device '%s' backing the volume: %s",
+			dev.nvmeDev, err)
+	case devUUID == "":
+		problem("block device '%s' backing the volume is not a LightOS volume",
+			dev.nvmeDev)
+	case devUUID != vid.uuid.String():
+		problem("block device '%s' backing the volume belongs to volume %s instead",
+			dev.nvmeDev, devUUID)
+	}
+
+	states := nvmePathStates(dev.nvmeDir)
+	var ctrls []string
+	live := 0
+	for ctrl, state := range states {
+		ctrls = append(ctrls, ctrl+": "+state)
+		if state == nvmeCtrlLive {
+			live++
+		}
+	}
+	sort.Strings(ctrls)
+	switch {
+	case len(states) == 0:
+		problem("no NVMe paths to block device '%s' found", dev.nvmeDev)
+	case live == 0:
+		problem("no live NVMe paths to block device '%s' (%s)",
+			dev.nvmeDev, strings.Join(ctrls, ", "))
+	case live < len(states):
+		// still perfectly usable, but worth mentioning...
+		note("only %d of %d NVMe paths to block device '%s' are live (%s)",
+			live, len(states), dev.nvmeDev, strings.Join(ctrls, ", "))
+	}
+
+	if mounts != nil && isAutoRemountedRO(mounts, major, minor) {
+		problem("filesystem on block device '%s' was remounted read-only, "+
+			"most likely due to I/O errors", dev.name)
+	}
+
+	return mkCond()
+}
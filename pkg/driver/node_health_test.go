@@ -0,0 +1,168 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	guuid "github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	mountutils "k8s.io/mount-utils"
+)
+
+// fakeSysfs builds a minimal sysfs-like tree under a temp dir, just enough
+// of it to keep nodeVolumeCondition() happy.
+type fakeSysfs struct {
+	t    *testing.T
+	root string
+}
+
+func newFakeSysfs(t *testing.T) *fakeSysfs {
+	root := t.TempDir()
+	origRoot := sysfsRoot
+	sysfsRoot = root
+	t.Cleanup(func() { sysfsRoot = origRoot })
+	return &fakeSysfs{t: t, root: root}
+}
+
+func (fs *fakeSysfs) write(path, content string) {
+	path = filepath.Join(fs.root, path)
+	require.NoError(fs.t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(fs.t, os.WriteFile(path, []byte(content+"\n"), 0o644))
+}
+
+func (fs *fakeSysfs) link(path, target string) {
+	path = filepath.Join(fs.root, path)
+	require.NoError(fs.t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(fs.t, os.Symlink(filepath.Join(fs.root, target), path))
+}
+
+// addNs adds a multipath NVMe namespace head device `dev` with device number
+// `devNum` and a path through each of the controllers in `ctrlStates`.
+func (fs *fakeSysfs) addNs(dev, devNum, wwid string, ctrlStates map[string]string) {
+	fs.write(filepath.Join("block", dev, "wwid"), wwid)
+	fs.link(filepath.Join("dev", "block", devNum), filepath.Join("block", dev))
+	for ctrl, state := range ctrlStates {
+		pathDev := ctrl + "c0" + dev[len("nvme0"):]
+		fs.write(filepath.Join("class", "nvme", ctrl, "state"), state)
+		fs.link(filepath.Join("block", pathDev, "device"), filepath.Join("class", "nvme", ctrl))
+		fs.link(filepath.Join("block", dev, "multipath", pathDev), filepath.Join("block", pathDev))
+	}
+}
+
+func TestNodeVolumeCondition(t *testing.T) {
+	nguid := guuid.MustParse("6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66")
+	other := guuid.MustParse("0cf0a5c4-7ec8-4a1c-a52e-1d5a3cbf6f0c")
+	vid := lbResourceID{uuid: nguid}
+
+	testCases := []struct {
+		name     string
+		setup    func(fs *fakeSysfs)
+		mounts   []mountutils.MountInfo
+		abnormal bool
+		msg      string
+	}{
+		{
+			name: "healthy",
+			setup: func(fs *fakeSysfs) {
+				fs.addNs("nvme0n1", "259:1", "uuid."+nguid.String(),
+					map[string]string{"nvme0": "live", "nvme1": "live"})
+			},
+			msg: "volume is healthy",
+		},
+		{
+			name:     "device gone",
+			setup:    func(fs *fakeSysfs) {},
+			abnormal: true,
+			msg:      "block device 259:1 backing the volume is gone",
+		},
+		{
+			name: "wrong volume",
+			setup: func(fs *fakeSysfs) {
+				fs.addNs("nvme0n1", "259:1", "uuid."+other.String(),
+					map[string]string{"nvme0": "live"})
+			},
+			abnormal: true,
+			msg:      "belongs to volume " + other.String(),
+		},
+		{
+			name: "not a LightOS volume",
+			setup: func(fs *fakeSysfs) {
+				fs.addNs("nvme0n1", "259:1", "eui.0025388b71b0a4d1",
+					map[string]string{"nvme0": "live"})
+			},
+			abnormal: true,
+			msg:      "not a LightOS volume",
+		},
+		{
+			name: "no live paths",
+			setup: func(fs *fakeSysfs) {
+				fs.addNs("nvme0n1", "259:1", "uuid."+nguid.String(),
+					map[string]string{"nvme0": "connecting", "nvme1": "resetting"})
+			},
+			abnormal: true,
+			msg:      "no live NVMe paths to block device 'nvme0n1' (nvme0: connecting, nvme1: resetting)",
+		},
+		{
+			name: "some live paths",
+			setup: func(fs *fakeSysfs) {
+				fs.addNs("nvme0n1", "259:1", "uuid."+nguid.String(),
+					map[string]string{"nvme0": "live", "nvme1": "connecting"})
+			},
+			msg: "only 1 of 2 NVMe paths",
+		},
+		{
+			name: "LUKS over the right volume",
+			setup: func(fs *fakeSysfs) {
+				fs.addNs("nvme0n2", "259:2", "uuid."+nguid.String(),
+					map[string]string{"nvme0": "live"})
+				fs.write("block/dm-0/dm/name", luksMapperFileName(nguid))
+				fs.link("block/dm-0/slaves/nvme0n2", "block/nvme0n2")
+				fs.link("dev/block/259:1", "block/dm-0")
+			},
+			msg: "volume is healthy",
+		},
+		{
+			name: "FS auto-remounted read-only",
+			setup: func(fs *fakeSysfs) {
+				fs.addNs("nvme0n1", "259:1", "uuid."+nguid.String(),
+					map[string]string{"nvme0": "live"})
+			},
+			mounts: []mountutils.MountInfo{
+				{Major: 259, Minor: 1, MountOptions: []string{"rw", "relatime"},
+					SuperOptions: []string{"ro", "errors=remount-ro"}},
+				{Major: 259, Minor: 1, MountOptions: []string{"ro", "relatime"},
+					SuperOptions: []string{"ro", "errors=remount-ro"}},
+			},
+			abnormal: true,
+			msg:      "remounted read-only",
+		},
+		{
+			name: "FS staged read-only on purpose",
+			setup: func(fs *fakeSysfs) {
+				fs.addNs("nvme0n1", "259:1", "uuid."+nguid.String(),
+					map[string]string{"nvme0": "live"})
+			},
+			mounts: []mountutils.MountInfo{
+				{Major: 259, Minor: 1, MountOptions: []string{"ro", "relatime"},
+					SuperOptions: []string{"ro"}},
+				{Major: 8, Minor: 1, MountOptions: []string{"rw"},
+					SuperOptions: []string{"ro"}},
+			},
+			msg: "volume is healthy",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.setup(newFakeSysfs(t))
+			d, _, _ := getDriver(t, "rack01-server01", false)
+			cond := d.nodeVolumeCondition(d.log, vid, 259, 1, tc.mounts)
+			require.Equal(t, tc.abnormal, cond.Abnormal, "condition: %s", cond.Message)
+			require.Contains(t, cond.Message, tc.msg)
+		})
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	guuid "github.com/google/uuid"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mountutils "k8s.io/mount-utils"
+
+	"github.com/lightbitslabs/los-csi/pkg/driver/backend"
+	"github.com/lightbitslabs/los-csi/pkg/lb"
+	"github.com/lightbitslabs/los-csi/pkg/util/endpoint"
+)
+
+func TestChkStagedVolume(t *testing.T) {
+	const stagingPath = "/var/lib/kubelet/plugins/x/globalmount"
+	nguid := guuid.MustParse("6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66")
+	other := guuid.MustParse("0cf0a5c4-7ec8-4a1c-a52e-1d5a3cbf6f0c")
+
+	mkCap := func(fsType string, ro bool) *csi.VolumeCapability {
+		mode := csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
+		if ro {
+			mode = csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY
+		}
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{FsType: fsType},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		}
+	}
+	mkMount := func(fsType string, opts, sbOpts []string) []mountutils.MountInfo {
+		return []mountutils.MountInfo{{
+			Major: 259, Minor: 1, MountPoint: stagingPath, FsType: fsType,
+			Source: "/dev/nvme0n1", MountOptions: opts, SuperOptions: sbOpts,
+		}}
+	}
+	rw := []string{"rw", "relatime"}
+	ro := []string{"ro", "relatime"}
+	addVol := func(fs *fakeSysfs) {
+		fs.addNs("nvme0n1", "259:1", "uuid."+nguid.String(),
+			map[string]string{"nvme0": "live"})
+	}
+
+	testCases := []struct {
+		name       string
+		setup      func(fs *fakeSysfs)
+		hostCrypto string
+		volCap     *csi.VolumeCapability
+		mounts     []mountutils.MountInfo
+		code       codes.Code
+		msg        string
+	}{
+		{
+			name:   "already staged",
+			setup:  addVol,
+			volCap: mkCap("ext4", false),
+			mounts: mkMount("ext4", rw, rw),
+			code:   codes.OK,
+		},
+		{
+			name:   "already staged, any FS",
+			setup:  addVol,
+			volCap: mkCap("", false),
+			mounts: mkMount("xfs", rw, rw),
+			code:   codes.OK,
+		},
+		{
+			name: "already staged with LUKS",
+			setup: func(fs *fakeSysfs) {
+				fs.addNs("nvme0n2", "259:2", "uuid."+nguid.String(),
+					map[string]string{"nvme0": "live"})
+				fs.write("block/dm-0/dm/name", luksMapperFileName(nguid))
+				fs.link("block/dm-0/slaves/nvme0n2", "block/nvme0n2")
+				fs.link("dev/block/259:1", "block/dm-0")
+			},
+			hostCrypto: "luks2",
+			volCap:     mkCap("ext4", false),
+			mounts:     mkMount("ext4", rw, rw),
+			code:       codes.OK,
+		},
+		{
+			name:   "not mounted",
+			setup:  addVol,
+			volCap: mkCap("ext4", false),
+			code:   codes.Unknown,
+			msg:    "failed to find what's mounted",
+		},
+		{
+			name:  "block volume",
+			setup: addVol,
+			volCap: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Block{
+					Block: &csi.VolumeCapability_BlockVolume{},
+				},
+			},
+			mounts: mkMount("ext4", rw, rw),
+			code:   codes.FailedPrecondition,
+		},
+		{
+			name:   "device gone",
+			setup:  func(fs *fakeSysfs) {},
+			volCap: mkCap("ext4", false),
+			mounts: mkMount("ext4", rw, rw),
+			code:   codes.FailedPrecondition,
+			msg:    "block device 259:1 mounted at '" + stagingPath + "' is gone",
+		},
+		{
+			name: "wrong volume",
+			setup: func(fs *fakeSysfs) {
+				fs.addNs("nvme0n1", "259:1", "uuid."+other.String(),
+					map[string]string{"nvme0": "live"})
+			},
+			volCap: mkCap("ext4", false),
+			mounts: mkMount("ext4", rw, rw),
+			code:   codes.FailedPrecondition,
+		},
+		{
+			name:       "LUKS expected",
+			setup:      addVol,
+			hostCrypto: "luks2",
+			volCap:     mkCap("ext4", false),
+			mounts:     mkMount("ext4", rw, rw),
+			code:       codes.FailedPrecondition,
+		},
+		{
+			name:   "wrong FS",
+			setup:  addVol,
+			volCap: mkCap("ext4", false),
+			mounts: mkMount("xfs", rw, rw),
+			code:   codes.FailedPrecondition,
+		},
+		{
+			name:   "auto-remounted read-only",
+			setup:  addVol,
+			volCap: mkCap("ext4", false),
+			mounts: mkMount("ext4", rw, []string{"ro", "errors=remount-ro"}),
+			code:   codes.FailedPrecondition,
+			msg:    "remounted read-only",
+		},
+		{
+			name:   "read-only requested",
+			setup:  addVol,
+			volCap: mkCap("ext4", true),
+			mounts: mkMount("ext4", rw, rw),
+			code:   codes.FailedPrecondition,
+		},
+		{
+			name:   "read-only on purpose",
+			setup:  addVol,
+			volCap: mkCap("ext4", true),
+			mounts: mkMount("ext4", ro, ro),
+			code:   codes.OK,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.setup(newFakeSysfs(t))
+			d, _, _ := getDriver(t, "rack01-server01", false)
+			vid := lbResourceID{uuid: nguid, hostCrypto: tc.hostCrypto}
+			err := d.chkStagedVolume(d.log, vid, stagingPath, tc.volCap, tc.mounts)
+			require.Equal(t, tc.code, status.Code(err), "error: %s", err)
+			if tc.msg != "" {
+				require.Contains(t, status.Convert(err).Message(), tc.msg)
+			}
+			if tc.code == codes.OK {
+				v, ok := d.inventory.get(nguid)
+				require.True(t, ok)
+				require.Equal(t, []string{stagingPath}, v.mounts)
+			}
+		})
+	}
+}
+
+type fakeResolver map[string][]netip.Addr
+
+func (r fakeResolver) LookupNetIP(_ context.Context, _, host string) ([]netip.Addr, error) {
+	if addrs, ok := r[host]; ok {
+		return addrs, nil
+	}
+	return nil, fmt.Errorf("no such host '%s'", host)
+}
+
+func TestQueryLBforTargetEnv(t *testing.T) {
+	targetResolver = fakeResolver{
+		"lb01.dual": {netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("2001:db8::1")},
+	}
+	t.Cleanup(func() { targetResolver = nil })
+	d, _, _ := getDriver(t, "rack01-server01", false)
+	vid := lbResourceID{mgmtEPs: endpoint.MustParseCSV("[2001:db8::1]:443")}
+
+	testCases := []struct {
+		name    string
+		discEPs []string
+		nvmeEPs []string
+		code    codes.Code
+		disc    string
+		nvme    string
+	}{
+		{
+			name:    "ipv4",
+			discEPs: []string{"10.0.0.1:8009"},
+			nvmeEPs: []string{"10.0.0.2:4420", "10.0.0.1:4420"},
+			disc:    "10.0.0.1:8009",
+			nvme:    "10.0.0.1:4420,10.0.0.2:4420",
+		},
+		{
+			name:    "ipv6",
+			discEPs: []string{"[2001:db8::1]:8009"},
+			nvmeEPs: []string{"[2001:db8::2]:4420", "10.0.0.1:4420"},
+			disc:    "[2001:db8::1]:8009",
+			nvme:    "10.0.0.1:4420,[2001:db8::2]:4420",
+		},
+		{
+			name:    "hostnames",
+			discEPs: []string{"lb01.dual:8009"},
+			nvmeEPs: []string{"lb01.dual:4420", "[2001:db8::2]:4420"},
+			disc:    "10.0.0.1:8009,[2001:db8::1]:8009",
+			nvme:    "10.0.0.1:4420,[2001:db8::1]:4420,[2001:db8::2]:4420",
+		},
+		{
+			name:    "unresolvable",
+			discEPs: []string{"lb01.dual:8009"},
+			nvmeEPs: []string{"lb02.dual:4420"},
+			code:    codes.Unavailable,
+		},
+		{
+			name:    "bad IPv6",
+			discEPs: []string{"2001:db8::1:8009"},
+			nvmeEPs: []string{"[2001:db8::2]:4420"},
+			code:    codes.Unknown,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clnt := &ClientMock{}
+			clnt.On("GetClusterInfo", mock.Anything).Return(&lb.ClusterInfo{
+				SubsysNQN:          "nqn.2016-01.com.lightbitslabs:uuid:x",
+				DiscoveryEndpoints: tc.discEPs,
+				NvmeEndpoints:      tc.nvmeEPs,
+			}, nil)
+			tgtEnv, err := queryLBforTargetEnv(context.Background(), d.log, clnt, vid, d.nodeID,
+				backend.TransportTCP)
+			if tc.code != codes.OK {
+				require.Equal(t, tc.code, status.Code(err), "error: %s", err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.disc, tgtEnv.DiscoveryEPs.String())
+			require.Equal(t, tc.nvme, tgtEnv.NvmeEPs.String())
+		})
+	}
+}
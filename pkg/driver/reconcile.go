@@ -0,0 +1,294 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	guuid "github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	mountutils "k8s.io/mount-utils"
+
+	"github.com/lightbitslabs/los-csi/pkg/driver/backend"
+)
+
+// node state reconciliation: the node plugin keeps no persistent state of its
+// own, so after a restart (crash, upgrade, etc.) it has no idea which volumes
+// it left attached, opened or mounted on the node. reconcileNodeState() is run
+// once on start-up, before serving any requests, to take stock of what's
+// there, build an in-memory inventory of the volumes, and clean up whatever
+// was clearly left behind by operations that never got to complete.
+//
+// the inventory is then kept up to date by the Node service ops themselves.
+
+var (
+	// a var rather than a const only to allow running the tests against a
+	// fake tree.
+	mapperDir = diskMapperPath
+)
+
+// nodeVol describes the traces of a volume found on the node.
+type nodeVol struct {
+	uuid      guuid.UUID
+	nvmeDev   string   // kernel name of the NVMe namespace block device, if present.
+	mapper    string   // name of the LUKS device-mapper device, if open.
+	mapperDev string   // kernel name of the LUKS device-mapper device, if open.
+	mounts    []string // mount points, including bind-mounted device nodes.
+}
+
+func (v *nodeVol) inUse() bool {
+	return len(v.mounts) > 0
+}
+
+// mapperOrphaned() returns true if the volume LUKS device is open, but the
+// NVMe namespace it was opened on top of is gone.
+func (v *nodeVol) mapperOrphaned() bool {
+	if v.mapper == "" {
+		return false
+	}
+	slaves, _ := filepath.Glob(filepath.Join(sysfsRoot, "block", v.mapperDev, "slaves", "*"))
+	for _, slave := range slaves {
+		if _, err := filepath.EvalSymlinks(slave); err == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// nodeInventory is the in-memory inventory of the volumes on the node. the
+// zero value is an empty inventory ready for use.
+type nodeInventory struct {
+	mu   sync.Mutex
+	vols map[guuid.UUID]*nodeVol
+}
+
+func (inv *nodeInventory) reset(vols map[guuid.UUID]*nodeVol) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.vols = vols
+}
+
+// get() returns a copy of the inventory entry of volume `uuid`, if any.
+func (inv *nodeInventory) get(uuid guuid.UUID) (nodeVol, bool) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	v, ok := inv.vols[uuid]
+	if !ok {
+		return nodeVol{}, false
+	}
+	res := *v
+	res.mounts = append([]string(nil), v.mounts...)
+	return res, true
+}
+
+// update() applies `fn` to the inventory entry of volume `uuid`, creating
+// it first if necessary.
+func (inv *nodeInventory) update(uuid guuid.UUID, fn func(v *nodeVol)) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	if inv.vols == nil {
+		inv.vols = make(map[guuid.UUID]*nodeVol)
+	}
+	v, ok := inv.vols[uuid]
+	if !ok {
+		v = &nodeVol{uuid: uuid}
+		inv.vols[uuid] = v
+	}
+	fn(v)
+}
+
+// remove() drops the inventory entry of volume `uuid`, if any.
+func (inv *nodeInventory) remove(uuid guuid.UUID) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	delete(inv.vols, uuid)
+}
+
+// counts() returns the number of volumes in the inventory, and how many of
+// them have their LUKS device open.
+func (inv *nodeInventory) counts() (vols, mappers int) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	for _, v := range inv.vols {
+		vols++
+		if v.mapper != "" {
+			mappers++
+		}
+	}
+	return vols, mappers
+}
+
+func (inv *nodeInventory) addMount(uuid guuid.UUID, mnt string) {
+	inv.update(uuid, func(v *nodeVol) {
+		if !contains(v.mounts, mnt) {
+			v.mounts = append(v.mounts, mnt)
+		}
+	})
+}
+
+func (inv *nodeInventory) removeMount(uuid guuid.UUID, mnt string) {
+	inv.update(uuid, func(v *nodeVol) {
+		for i, m := range v.mounts {
+			if m == mnt {
+				v.mounts = append(v.mounts[:i], v.mounts[i+1:]...)
+				break
+			}
+		}
+	})
+}
+
+func readDevNum(dev string) string {
+	return backend.ReadAttr(filepath.Join(sysfsRoot, "block", dev), "dev")
+}
+
+// scanNodeVols() scans sysfs, LUKS device-mapper devices and the mounts on the
+// node for traces of LightOS volumes.
+func scanNodeVols(log *logrus.Entry) (map[guuid.UUID]*nodeVol, error) {
+	vols := map[guuid.UUID]*nodeVol{}
+	getVol := func(uuid guuid.UUID) *nodeVol {
+		v, ok := vols[uuid]
+		if !ok {
+			v = &nodeVol{uuid: uuid}
+			vols[uuid] = v
+		}
+		return v
+	}
+
+	heads, err := filepath.Glob(filepath.Join(sysfsRoot, "block", "nvme*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range heads {
+		name := filepath.Base(dir)
+		if !backend.NSDevRegex.MatchString(name) {
+			continue
+		}
+		devUUID, err := readDevUUID(dir)
+		if err != nil || devUUID == "" {
+			continue
+		}
+		uuid, err := guuid.Parse(devUUID)
+		if err != nil {
+			continue
+		}
+		getVol(uuid).nvmeDev = name
+	}
+
+	mappers, err := filepath.Glob(filepath.Join(mapperDir, luksMapperPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range mappers {
+		name := filepath.Base(path)
+		uuid, err := guuid.Parse(strings.TrimPrefix(name, luksMapperPrefix))
+		if err != nil {
+			log.Warnf("found LUKS device '%s' with bogus volume UUID", name)
+			continue
+		}
+		v := getVol(uuid)
+		v.mapper = name
+		if realPath, err := filepath.EvalSymlinks(path); err == nil {
+			v.mapperDev = filepath.Base(realPath)
+		}
+	}
+
+	mounts, err := mountutils.ParseMountInfo(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range vols {
+		for _, dev := range []string{v.nvmeDev, v.mapperDev} {
+			if dev == "" {
+				continue
+			}
+			devNum := readDevNum(dev)
+			for i := range mounts {
+				mnt := &mounts[i]
+				// either an FS on the device, or the device node itself
+				// bind-mounted somewhere (i.e. block volumes).
+				if devNum == fmtDevNum(mnt.Major, mnt.Minor) ||
+					mnt.FsType == "devtmpfs" && mnt.Root == "/"+dev {
+					v.mounts = append(v.mounts, mnt.MountPoint)
+				}
+			}
+		}
+	}
+	return vols, nil
+}
+
+func fmtDevNum(major, minor int) string {
+	return fmt.Sprintf("%d:%d", major, minor)
+}
+
+// reconcileNodeState() rebuilds the inventory of volumes on the node and cleans
+// up the leftovers of incomplete operations. anything that might still be in
+// use, or just has a reasonable chance of being of use to the CO later on, is
+// left alone - the CO is expected to eventually come around to unstage it.
+func (d *Driver) reconcileNodeState(ctx context.Context) {
+	log := d.log.WithField("op", "reconcile")
+
+	// the volumes attached by previous incarnations of the plugin must be
+	// accounted for, lest we disconnect from under them. not fatal, but
+	// then no subsystems with volumes found attached on the node will be
+	// disconnected from until the next restart.
+	if err := d.conns.Rebuild(procMountsPath); err != nil {
+		log.Warnf("failed to find volumes already attached to node: %s", err)
+	}
+
+	vols, err := scanNodeVols(log)
+	if err != nil {
+		log.Warnf("failed to take stock of volumes on node, skipping "+
+			"reconciliation: %s", err)
+		return
+	}
+
+	present := map[guuid.UUID]bool{}
+	for uuid, v := range vols {
+		vLog := log.WithFields(logrus.Fields{
+			"vol-uuid": uuid,
+			"nvme-dev": v.nvmeDev,
+			"mapper":   v.mapper,
+			"mounts":   v.mounts,
+		})
+		if v.mapperOrphaned() {
+			if v.inUse() {
+				vLog.Warnf("LUKS device is still in use, but its NVMe " +
+					"device is gone")
+			} else {
+				vLog.Infof("closing orphaned LUKS device")
+				if err := d.luksClose(filepath.Join(mapperDir, v.mapper)); err != nil {
+					vLog.Warnf("failed to close orphaned LUKS device: %s", err)
+				} else {
+					v.mapper = ""
+					v.mapperDev = ""
+				}
+			}
+		}
+
+		switch {
+		case v.inUse():
+			vLog.Info("found volume in use")
+		case v.mapper != "":
+			vLog.Info("found open LUKS device not in use")
+		case v.nvmeDev != "":
+			vLog.Debug("found volume not in use")
+		default:
+			delete(vols, uuid)
+			continue
+		}
+		present[uuid] = v.inUse()
+	}
+	d.inventory.reset(vols)
+
+	if r, ok := d.be.(backend.Reconciler); ok {
+		if st := r.Reconcile(ctx, present); st != nil {
+			log.Warnf("backend failed to reconcile its state: %s", st.Message())
+		}
+	}
+	log.Infof("found %d volume(s) on node", len(vols))
+}
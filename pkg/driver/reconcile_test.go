@@ -0,0 +1,119 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	guuid "github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNodeVols sets up a fake mapper dir and mountinfo file on top of `fs`,
+// overriding the corresponding package vars for the duration of the test.
+func fakeNodeVols(t *testing.T, fs *fakeSysfs, mountInfo string) string {
+	dir := t.TempDir()
+	origMapperDir, origMountInfoPath := mapperDir, mountInfoPath
+	mapperDir = filepath.Join(dir, "mapper")
+	mountInfoPath = filepath.Join(dir, "mountinfo")
+	t.Cleanup(func() {
+		mapperDir, mountInfoPath = origMapperDir, origMountInfoPath
+	})
+	require.NoError(t, os.MkdirAll(mapperDir, 0o755))
+	require.NoError(t, os.WriteFile(mountInfoPath, []byte(mountInfo), 0o644))
+	return dir
+}
+
+func (fs *fakeSysfs) addMapper(name, dev, devNum string, slaves ...string) {
+	fs.write(filepath.Join("block", dev, "dev"), devNum)
+	for _, slave := range slaves {
+		fs.link(filepath.Join("block", dev, "slaves", slave), filepath.Join("block", slave))
+	}
+	require.NoError(fs.t, os.Symlink(filepath.Join(fs.root, "block", dev),
+		filepath.Join(mapperDir, name)))
+}
+
+func TestScanNodeVols(t *testing.T) {
+	fs := newFakeSysfs(t)
+	mounted := guuid.MustParse("6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66")
+	block := guuid.MustParse("0cf0a5c4-7ec8-4a1c-a52e-1d5a3cbf6f0c")
+	encrypted := guuid.MustParse("8a5b7bd4-4a4d-4a4c-8f65-24ebcf0f1b1a")
+	unused := guuid.MustParse("a1a1a1a1-0000-4000-8000-000000000001")
+	orphaned := guuid.MustParse("a1a1a1a1-0000-4000-8000-000000000002")
+
+	fakeNodeVols(t, fs,
+		"29 1 259:1 / /var/lib/kubelet/plugins/x/globalmount rw - ext4 /dev/nvme0n1 rw\n"+
+			"30 1 259:1 / /var/lib/kubelet/pods/p1/volumes/x/mount rw - ext4 /dev/nvme0n1 rw\n"+
+			"31 1 0:5 /nvme0n2 /var/lib/kubelet/pods/p2/volumeDevices/x rw - devtmpfs udev rw\n"+
+			"32 1 253:0 / /var/lib/kubelet/plugins/y/globalmount rw - xfs /dev/mapper/y rw\n"+
+			"33 1 0:22 / /proc rw - proc proc rw\n")
+
+	for i, vol := range []guuid.UUID{mounted, block, encrypted, unused} {
+		dev := "nvme0n" + string(rune('1'+i))
+		devNum := "259:" + string(rune('1'+i))
+		fs.addNs(dev, devNum, "uuid."+vol.String(), map[string]string{"nvme0": "live"})
+		fs.write(filepath.Join("block", dev, "dev"), devNum)
+	}
+	fs.addMapper(luksMapperFileName(encrypted), "dm-0", "253:0", "nvme0n3")
+	fs.addMapper(luksMapperFileName(orphaned), "dm-1", "253:1", "nvme0n9")
+	require.NoError(t, os.WriteFile(filepath.Join(mapperDir, "control"), nil, 0o644))
+
+	vols, err := scanNodeVols(logrus.New().WithField("test", t.Name()))
+	require.NoError(t, err)
+	require.Len(t, vols, 5)
+
+	require.Equal(t, "nvme0n1", vols[mounted].nvmeDev)
+	require.ElementsMatch(t, []string{
+		"/var/lib/kubelet/plugins/x/globalmount",
+		"/var/lib/kubelet/pods/p1/volumes/x/mount",
+	}, vols[mounted].mounts)
+
+	require.Equal(t, []string{"/var/lib/kubelet/pods/p2/volumeDevices/x"},
+		vols[block].mounts)
+
+	require.Equal(t, "nvme0n3", vols[encrypted].nvmeDev)
+	require.Equal(t, luksMapperFileName(encrypted), vols[encrypted].mapper)
+	require.Equal(t, "dm-0", vols[encrypted].mapperDev)
+	require.Equal(t, []string{"/var/lib/kubelet/plugins/y/globalmount"},
+		vols[encrypted].mounts)
+	require.False(t, vols[encrypted].mapperOrphaned())
+
+	require.Equal(t, "nvme0n4", vols[unused].nvmeDev)
+	require.False(t, vols[unused].inUse())
+	require.False(t, vols[unused].mapperOrphaned())
+
+	require.Empty(t, vols[orphaned].nvmeDev)
+	require.Equal(t, "dm-1", vols[orphaned].mapperDev)
+	require.True(t, vols[orphaned].mapperOrphaned())
+}
+
+func TestNodeInventory(t *testing.T) {
+	var inv nodeInventory
+	vol := guuid.MustParse("6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66")
+
+	_, ok := inv.get(vol)
+	require.False(t, ok)
+
+	inv.update(vol, func(v *nodeVol) { v.nvmeDev = "nvme0n1" })
+	inv.addMount(vol, "/staging")
+	inv.addMount(vol, "/target")
+	inv.addMount(vol, "/target")
+	v, ok := inv.get(vol)
+	require.True(t, ok)
+	require.Equal(t, "nvme0n1", v.nvmeDev)
+	require.Equal(t, []string{"/staging", "/target"}, v.mounts)
+
+	// get() returns a copy.
+	v.mounts[0] = "/bogus"
+	inv.removeMount(vol, "/target")
+	v, _ = inv.get(vol)
+	require.Equal(t, []string{"/staging"}, v.mounts)
+
+	inv.remove(vol)
+	_, ok = inv.get(vol)
+	require.False(t, ok)
+}
@@ -0,0 +1,144 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/lightbitslabs/los-csi/pkg/lb"
+	"github.com/lightbitslabs/los-csi/pkg/lb/lbgrpc"
+)
+
+// in-place volume rollback: CSI has no notion of restoring an existing volume
+// from a snapshot, the only CSI way to restore is to provision a brand new
+// volume from the snapshot and swap the PVs, which for multi-TB volumes takes
+// a while. LightOS can roll a volume back to one of its snapshots in place in
+// a matter of seconds, so this is exposed outside of CSI, through `lbcsictl`.
+
+// isPublished() returns true if the volume ACL allows access to any host.
+func isPublished(vol *lb.Volume) bool {
+	numACEs := len(vol.ACL)
+	return !(numACEs == 0 || numACEs == 1 && vol.ACL[0] == lb.ACLAllowNone)
+}
+
+func doRollbackVolume(
+	ctx context.Context, log *logrus.Entry, clnt lb.Client, vid, sid lbResourceID,
+) error {
+	if !sid.mgmtEPs.Equal(vid.mgmtEPs) || sid.projName != vid.projName {
+		return mkEinvalf(snapIDField, "snapshot %s resides on a different LightOS "+
+			"cluster or project than volume %s", sid.uuid, vid.uuid)
+	}
+
+	vol, err := clnt.GetVolume(ctx, vid.uuid, vid.projName)
+	if err != nil {
+		if isStatusNotFound(err) {
+			return mkEnoent("volume %s doesn't exist", vid.uuid)
+		}
+		return mungeLBErr(log, err, "failed to get volume %s from LB", vid.uuid)
+	}
+	switch vol.State {
+	case lb.VolumeAvailable,
+		lb.VolumeMigrating:
+		// the only states in which a volume can be rolled back.
+	case lb.VolumeRollback:
+		return mkEagain("volume %s is already being rolled back", vol.UUID)
+	case lb.VolumeCreating:
+		return mkEagain("volume %s is still being created", vol.UUID)
+	case lb.VolumeUpdating:
+		return mkEagain("volume %s is being updated", vol.UUID)
+	case lb.VolumeDeleting,
+		lb.VolumeFailed:
+		return mkEnoent("volume %s is in state '%s'", vol.UUID, vol.State)
+	default:
+		return mkInternal("found volume '%s' (%s) in unexpected state '%s' (%d)",
+			vol.Name, vol.UUID, vol.State, vol.State)
+	}
+	// rolling back a volume that's in use amounts to pulling the rug out
+	// from under the FS or app using it...
+	//
+	// TODO: this is inherently racy with a concurrent ControllerPublish(),
+	// there's no way to lock out the controller plugin from here. the whole
+	// thing is supposed to be used with the app scaled down, so it's not as
+	// bad as it sounds, but still.
+	if isPublished(vol) {
+		return mkPrecond("volume %s is published to %#q, refusing to roll it back "+
+			"while in use", vol.UUID, vol.ACL)
+	}
+
+	snap, err := clnt.GetSnapshot(ctx, sid.uuid, sid.projName)
+	if err != nil {
+		if isStatusNotFound(err) {
+			return mkEnoent("snapshot %s doesn't exist", sid.uuid)
+		}
+		return mungeLBErr(log, err, "failed to get snapshot %s from LB", sid.uuid)
+	}
+	switch snap.State {
+	case lb.SnapshotAvailable:
+	case lb.SnapshotCreating:
+		return mkEagain("snapshot %s is still being created", snap.UUID)
+	default:
+		return mkPrecond("snapshot %s is in state '%s'", snap.UUID, snap.State)
+	}
+	if snap.SrcVolUUID != vol.UUID {
+		return mkEinvalf(snapIDField, "snapshot %s was taken of volume %s, not %s",
+			snap.UUID, snap.SrcVolUUID, vol.UUID)
+	}
+
+	log.Infof("rolling back volume '%s' to snapshot '%s' taken at %s",
+		vol.Name, snap.Name, snap.CreationTime)
+	vol, err = clnt.RollbackVolume(ctx, vid.uuid, vid.projName, snap.UUID)
+	if err != nil {
+		switch status.Code(err) {
+		case codes.NotFound:
+			return mkEnoent("failed to roll back volume %s to snapshot %s: %s",
+				vid.uuid, snap.UUID, err)
+		case codes.InvalidArgument:
+			return prefixErr(err, "failed to roll back volume %s to snapshot %s",
+				vid.uuid, snap.UUID)
+		}
+		return mungeLBErr(log, err, "failed to roll back volume %s to snapshot %s",
+			vid.uuid, snap.UUID)
+	}
+	log.Infof("volume '%s' rolled back, state: %s", vol.Name, vol.State)
+	return nil
+}
+
+// RollbackVolume() rolls the volume specified by CSI volume ID `volID` back
+// to the snapshot specified by CSI snapshot ID `snapID` in place. the volume
+// must not be published to any node at the time. `jwt` is used to authenticate
+// with the LightOS cluster hosting the volume, `tlsCfg` - to authenticate the
+// cluster, if the volume ID specifies the "grpcs" scheme.
+func RollbackVolume(
+	ctx context.Context, log *logrus.Entry, volID, snapID, jwt string,
+	tlsCfg *lb.TLSConfig,
+) error {
+	vid, err := parseCSIResourceIDEinval(volIDField, volID)
+	if err != nil {
+		return err
+	}
+	sid, err := parseCSIResourceIDEinval(snapIDField, snapID)
+	if err != nil {
+		return err
+	}
+	log = log.WithFields(logrus.Fields{
+		"mgmt-ep":   vid.mgmtEPs,
+		"vol-uuid":  vid.uuid,
+		"snap-uuid": sid.uuid,
+		"project":   vid.projName,
+	})
+
+	ctx = cloneCtxWithJWT(ctx, jwt)
+	clnt, err := lbgrpc.Dial(ctx, log, vid.mgmtEPs, vid.scheme, tlsCfg)
+	if err != nil {
+		return fmt.Errorf("failed to connect to LB at '%s': %s", vid.mgmtEPs, err)
+	}
+	defer clnt.Close()
+
+	return doRollbackVolume(ctx, log, clnt, vid, sid)
+}
@@ -0,0 +1,148 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"context"
+	"testing"
+
+	guuid "github.com/google/uuid"
+	"github.com/lightbitslabs/los-csi/pkg/lb"
+	"github.com/lightbitslabs/los-csi/pkg/util/endpoint"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRollbackVolume(t *testing.T) {
+	ep := "10.19.151.24:443,10.19.151.6:443"
+	projectName := "default"
+	volUUID := guuid.MustParse("6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66")
+	otherVolUUID := guuid.MustParse("0cf0a5c4-7ec8-4a1c-a52e-1d5a3cbf6f0c")
+	snapUUID := guuid.MustParse("a1a1a1a1-0000-4000-8000-000000000001")
+	hostNQN := "nqn.2019-09.com.lightbitslabs:host:rack01-server01"
+
+	vid := lbResourceID{
+		mgmtEPs:  endpoint.MustParseCSV(ep),
+		uuid:     volUUID,
+		projName: projectName,
+		scheme:   grpcsXport,
+	}
+	sid := vid
+	sid.uuid = snapUUID
+
+	vol := func(state lb.VolumeState, acl ...string) *lb.Volume {
+		v := basicVolume("v1", volUUID, acl)
+		v.State = state
+		v.ProjectName = projectName
+		return v
+	}
+	snap := func(srcVol guuid.UUID) *lb.Snapshot {
+		return &lb.Snapshot{
+			Name:        "s1",
+			UUID:        snapUUID,
+			State:       lb.SnapshotAvailable,
+			SrcVolUUID:  srcVol,
+			ProjectName: projectName,
+		}
+	}
+
+	testCases := []struct {
+		name       string
+		sid        lbResourceID
+		clientMock func() *ClientMock
+		code       codes.Code
+		numLBCalls int
+	}{
+		{
+			name: "unpublished volume",
+			sid:  sid,
+			clientMock: func() *ClientMock {
+				m := basicClientMock(ep)
+				m.On("GetVolume", context.Background(), volUUID, projectName).
+					Return(vol(lb.VolumeAvailable, lb.ACLAllowNone), nil).Once()
+				m.On("GetSnapshot", context.Background(), snapUUID, projectName).
+					Return(snap(volUUID), nil).Once()
+				m.On("RollbackVolume", context.Background(), volUUID, projectName,
+					snapUUID).Return(vol(lb.VolumeAvailable, lb.ACLAllowNone), nil).Once()
+				return m
+			},
+			numLBCalls: 1,
+		},
+		{
+			name: "published volume",
+			sid:  sid,
+			clientMock: func() *ClientMock {
+				m := basicClientMock(ep)
+				m.On("GetVolume", context.Background(), volUUID, projectName).
+					Return(vol(lb.VolumeAvailable, hostNQN), nil).Once()
+				return m
+			},
+			code: codes.FailedPrecondition,
+		},
+		{
+			name: "volume being rolled back",
+			sid:  sid,
+			clientMock: func() *ClientMock {
+				m := basicClientMock(ep)
+				m.On("GetVolume", context.Background(), volUUID, projectName).
+					Return(vol(lb.VolumeRollback, lb.ACLAllowNone), nil).Once()
+				return m
+			},
+			code: codes.Unavailable,
+		},
+		{
+			name: "snapshot of other volume",
+			sid:  sid,
+			clientMock: func() *ClientMock {
+				m := basicClientMock(ep)
+				m.On("GetVolume", context.Background(), volUUID, projectName).
+					Return(vol(lb.VolumeAvailable, lb.ACLAllowNone), nil).Once()
+				m.On("GetSnapshot", context.Background(), snapUUID, projectName).
+					Return(snap(otherVolUUID), nil).Once()
+				return m
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "nonexistent snapshot",
+			sid:  sid,
+			clientMock: func() *ClientMock {
+				m := basicClientMock(ep)
+				m.On("GetVolume", context.Background(), volUUID, projectName).
+					Return(vol(lb.VolumeAvailable, lb.ACLAllowNone), nil).Once()
+				m.On("GetSnapshot", context.Background(), snapUUID, projectName).
+					Return((*lb.Snapshot)(nil), status.Error(codes.NotFound, "nope")).Once()
+				return m
+			},
+			code: codes.NotFound,
+		},
+		{
+			name: "snapshot in different project",
+			sid: lbResourceID{
+				mgmtEPs:  vid.mgmtEPs,
+				uuid:     snapUUID,
+				projName: "other",
+				scheme:   grpcsXport,
+			},
+			clientMock: func() *ClientMock { return basicClientMock(ep) },
+			code:       codes.InvalidArgument,
+		},
+	}
+
+	log := logrus.New().WithField("test", t.Name())
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientMock := tc.clientMock()
+			err := doRollbackVolume(context.Background(), log, clientMock, vid, tc.sid)
+			clientMock.AssertNumberOfCalls(t, "RollbackVolume", tc.numLBCalls)
+			if tc.code != codes.OK {
+				require.Equal(t, tc.code, status.Code(err), "wrong error: %v", err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"context"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	guuid "github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/lightbitslabs/los-csi/pkg/lb"
+)
+
+// CSI SnapshotMetadata service: exposes LightOS changed-block tracking to the
+// CO (in K8s - through the external-snapshot-metadata sidecar) so that backup
+// apps can copy only the allocated blocks of a snapshot, or only the blocks
+// that changed between two snapshots of the same volume, instead of reading
+// the entire volume every time.
+//
+// LightOS reports the changes in terms of LBA ranges with a bitmap of the
+// changed LBAs, these are decoded into runs of consecutive LBAs and passed
+// on to the CO as VARIABLE_LENGTH byte extents.
+
+const (
+	baseSnapIDField     = "base_snapshot_id"
+	targetSnapIDField   = "target_snapshot_id"
+	startingOffsetField = "starting_offset"
+	maxResultsField     = "max_results"
+
+	// default max number of BlockMetadata entries per response message, if
+	// the CO doesn't care. the CSI spec leaves it up to the SP, this one is
+	// a reasonable compromise between the number of messages and their size.
+	defaultMaxBlockMetadata = 1024
+)
+
+// blockMetadataBatcher accumulates the changed extents reported by LightOS,
+// coalescing the adjacent ones, and hands them over to `send` in batches of
+// up to `max` entries.
+type blockMetadataBatcher struct {
+	sectorSize  int64
+	startOffset int64 // bytes, extents ending before it are dropped.
+	max         int
+	batch       []*csi.BlockMetadata
+	send        func(batch []*csi.BlockMetadata) error
+
+	numSent int
+}
+
+func (b *blockMetadataBatcher) add(ext lb.LBAExtent) error {
+	offset := int64(ext.Start) * b.sectorSize
+	size := int64(ext.Count) * b.sectorSize
+	if size == 0 || offset+size <= b.startOffset {
+		return nil
+	}
+
+	if n := len(b.batch); n > 0 {
+		last := b.batch[n-1]
+		if last.ByteOffset+last.SizeBytes == offset {
+			last.SizeBytes += size
+			return nil
+		}
+		if n >= b.max {
+			if err := b.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	b.batch = append(b.batch, &csi.BlockMetadata{ByteOffset: offset, SizeBytes: size})
+	return nil
+}
+
+func (b *blockMetadataBatcher) flush() error {
+	if len(b.batch) == 0 {
+		return nil
+	}
+	if err := b.send(b.batch); err != nil {
+		return err
+	}
+	b.numSent += len(b.batch)
+	b.batch = nil
+	return nil
+}
+
+// getMetadataSnapshot() fetches the snapshot specified by `sid` from the LB
+// and makes sure it's in a state suitable for changed blocks listing.
+func getMetadataSnapshot(
+	ctx context.Context, log *logrus.Entry, clnt lb.Client, sid lbResourceID,
+) (*lb.Snapshot, error) {
+	snap, err := clnt.GetSnapshot(ctx, sid.uuid, sid.projName)
+	if err != nil {
+		if isStatusNotFound(err) {
+			return nil, mkEnoent("snapshot %s doesn't exist", sid.uuid)
+		}
+		return nil, mungeLBErr(log, err, "failed to get snapshot %s from LB", sid.uuid)
+	}
+
+	switch snap.State {
+	case lb.SnapshotAvailable:
+	case lb.SnapshotCreating:
+		return nil, mkEagain("snapshot %s is still being created", snap.UUID)
+	case lb.SnapshotDeleting:
+		return nil, mkEnoent("snapshot %s is being deleted", snap.UUID)
+	default:
+		return nil, mkPrecond("snapshot %s is in unexpected state '%s'",
+			snap.UUID, snap.State)
+	}
+	if snap.SectorSize == 0 {
+		// guessing would silently produce garbage offsets, and that's
+		// the last thing a backup app needs...
+		return nil, mkPrecond("LB reported no sector size for snapshot %s", snap.UUID)
+	}
+	return snap, nil
+}
+
+// streamChangedBlocks() is the common part of GetMetadataAllocated() and
+// GetMetadataDelta(): it lists the blocks of snapshot `sid` that changed
+// since snapshot `baseSid` (or all the allocated blocks if `baseSid` is nil)
+// and streams them to the CO using `send`.
+func (d *Driver) streamChangedBlocks(
+	ctx context.Context, log *logrus.Entry, sid lbResourceID, baseSid *lbResourceID,
+	startingOffset int64, maxResults int32, secrets map[string]string,
+	send func(capacity int64, batch []*csi.BlockMetadata) error,
+) error {
+	if startingOffset < 0 {
+		return mkErange("bad value of '%s': %d is negative",
+			startingOffsetField, startingOffset)
+	}
+	if maxResults < 0 {
+		return mkEinvalf(maxResultsField, "%d is negative", maxResults)
+	}
+	if maxResults == 0 {
+		maxResults = defaultMaxBlockMetadata
+	}
+
+	ctx = d.cloneCtxWithCreds(ctx, secrets)
+	clnt, err := d.GetLBClient(ctx, sid.mgmtEPs, sid.scheme)
+	if err != nil {
+		return err
+	}
+	defer d.PutLBClient(clnt)
+
+	snap, err := getMetadataSnapshot(ctx, log, clnt, sid)
+	if err != nil {
+		return err
+	}
+
+	baseSnapUUID := guuid.Nil
+	if baseSid != nil {
+		baseSnap, err := getMetadataSnapshot(ctx, log, clnt, *baseSid)
+		if err != nil {
+			return err
+		}
+		if baseSnap.SrcVolUUID != snap.SrcVolUUID {
+			return mkEinvalf(baseSnapIDField, "snapshot %s was taken of volume %s, "+
+				"while target snapshot %s was taken of volume %s",
+				baseSnap.UUID, baseSnap.SrcVolUUID, snap.UUID, snap.SrcVolUUID)
+		}
+		if baseSnap.CreationTime.After(snap.CreationTime) {
+			return mkEinvalf(baseSnapIDField, "snapshot %s was taken after "+
+				"target snapshot %s", baseSnap.UUID, snap.UUID)
+		}
+		baseSnapUUID = baseSnap.UUID
+	}
+
+	capacity := int64(snap.Capacity)
+	if startingOffset > capacity {
+		return mkErange("bad value of '%s': %d exceeds snapshot %s capacity of %d",
+			startingOffsetField, startingOffset, snap.UUID, capacity)
+	}
+
+	sectorSize := int64(snap.SectorSize)
+	batcher := blockMetadataBatcher{
+		sectorSize:  sectorSize,
+		startOffset: startingOffset,
+		max:         int(maxResults),
+		send: func(batch []*csi.BlockMetadata) error {
+			return send(capacity, batch)
+		},
+	}
+	// errors from the CO side of things must be told apart from the LB ones:
+	var sendErr error
+	err = clnt.ListChangedBlocks(ctx, snap.UUID, baseSnapUUID, sid.projName,
+		uint64(startingOffset/sectorSize),
+		func(r *lb.LBARange) error {
+			for _, ext := range r.Extents() {
+				if sendErr = batcher.add(ext); sendErr != nil {
+					return sendErr
+				}
+			}
+			return nil
+		})
+	if sendErr != nil {
+		log.WithError(sendErr).Warnf("failed to stream snapshot metadata after "+
+			"%d entries", batcher.numSent)
+		return sendErr
+	}
+	if err != nil {
+		switch status.Code(err) {
+		case codes.NotFound:
+			return mkEnoent("snapshot %s doesn't exist: %s", snap.UUID, err)
+		case codes.Unimplemented:
+			return mkPrecond("changed block tracking is not supported by the " +
+				"LightOS cluster")
+		}
+		return mungeLBErr(log, err, "failed to list changed blocks of snapshot %s on LB",
+			snap.UUID)
+	}
+	if err = batcher.flush(); err != nil {
+		log.WithError(err).Warnf("failed to stream snapshot metadata after "+
+			"%d entries", batcher.numSent)
+		return err
+	}
+
+	log.Debugf("streamed %d snapshot metadata entries", batcher.numSent)
+	return nil
+}
+
+func (d *Driver) GetMetadataAllocated(
+	req *csi.GetMetadataAllocatedRequest, stream csi.SnapshotMetadata_GetMetadataAllocatedServer,
+) error {
+	sid, err := parseCSIResourceIDEnoent(snapIDField, req.SnapshotId)
+	if err != nil {
+		return err
+	}
+
+	log := d.log.WithFields(logrus.Fields{
+		"op":        "GetMetadataAllocated",
+		"mgmt-ep":   sid.mgmtEPs,
+		"snap-uuid": sid.uuid,
+		"project":   sid.projName,
+		"offset":    req.StartingOffset,
+	})
+
+	return d.streamChangedBlocks(stream.Context(), log, sid, nil,
+		req.StartingOffset, req.MaxResults, req.Secrets,
+		func(capacity int64, batch []*csi.BlockMetadata) error {
+			return stream.Send(&csi.GetMetadataAllocatedResponse{
+				BlockMetadataType:   csi.BlockMetadataType_VARIABLE_LENGTH,
+				VolumeCapacityBytes: capacity,
+				BlockMetadata:       batch,
+			})
+		})
+}
+
+func (d *Driver) GetMetadataDelta(
+	req *csi.GetMetadataDeltaRequest, stream csi.SnapshotMetadata_GetMetadataDeltaServer,
+) error {
+	sid, err := parseCSIResourceIDEnoent(targetSnapIDField, req.TargetSnapshotId)
+	if err != nil {
+		return err
+	}
+	baseSid, err := parseCSIResourceIDEnoent(baseSnapIDField, req.BaseSnapshotId)
+	if err != nil {
+		return err
+	}
+	if !baseSid.mgmtEPs.Equal(sid.mgmtEPs) || baseSid.projName != sid.projName {
+		return mkEinvalf(baseSnapIDField, "snapshot %s resides on a different "+
+			"LightOS cluster or project than target snapshot %s",
+			baseSid.uuid, sid.uuid)
+	}
+
+	log := d.log.WithFields(logrus.Fields{
+		"op":             "GetMetadataDelta",
+		"mgmt-ep":        sid.mgmtEPs,
+		"snap-uuid":      sid.uuid,
+		"base-snap-uuid": baseSid.uuid,
+		"project":        sid.projName,
+		"offset":         req.StartingOffset,
+	})
+
+	return d.streamChangedBlocks(stream.Context(), log, sid, &baseSid,
+		req.StartingOffset, req.MaxResults, req.Secrets,
+		func(capacity int64, batch []*csi.BlockMetadata) error {
+			return stream.Send(&csi.GetMetadataDeltaResponse{
+				BlockMetadataType:   csi.BlockMetadataType_VARIABLE_LENGTH,
+				VolumeCapacityBytes: capacity,
+				BlockMetadata:       batch,
+			})
+		})
+}
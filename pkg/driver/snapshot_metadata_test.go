@@ -0,0 +1,325 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	guuid "github.com/google/uuid"
+	"github.com/lightbitslabs/los-csi/pkg/lb"
+	"github.com/lightbitslabs/los-csi/pkg/util/endpoint"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type metadataStreamMock struct {
+	grpc.ServerStream
+	blocks  [][]*csi.BlockMetadata
+	sendErr error
+}
+
+func (s *metadataStreamMock) Context() context.Context {
+	return context.Background()
+}
+
+func (s *metadataStreamMock) send(
+	typ csi.BlockMetadataType, capacity int64, blocks []*csi.BlockMetadata,
+) error {
+	if s.sendErr != nil {
+		return s.sendErr
+	}
+	if typ != csi.BlockMetadataType_VARIABLE_LENGTH || capacity != int64(GiB) {
+		return fmt.Errorf("unexpected response: type %s, capacity %d", typ, capacity)
+	}
+	s.blocks = append(s.blocks, blocks)
+	return nil
+}
+
+type allocatedStreamMock struct{ metadataStreamMock }
+
+func (s *allocatedStreamMock) Send(resp *csi.GetMetadataAllocatedResponse) error {
+	return s.send(resp.BlockMetadataType, resp.VolumeCapacityBytes, resp.BlockMetadata)
+}
+
+type deltaStreamMock struct{ metadataStreamMock }
+
+func (s *deltaStreamMock) Send(resp *csi.GetMetadataDeltaResponse) error {
+	return s.send(resp.BlockMetadataType, resp.VolumeCapacityBytes, resp.BlockMetadata)
+}
+
+func TestLBARangeExtents(t *testing.T) {
+	testCases := []struct {
+		name    string
+		r       lb.LBARange
+		extents []lb.LBAExtent
+	}{
+		{
+			name:    "no bitmap",
+			r:       lb.LBARange{Start: 64, End: 128},
+			extents: []lb.LBAExtent{{Start: 64, Count: 64}},
+		},
+		{
+			name: "empty range",
+			r:    lb.LBARange{Start: 64, End: 64},
+		},
+		{
+			name: "bitmap",
+			r: lb.LBARange{Start: 128, End: 160,
+				Bitmap: []byte{0b1000_0111, 0b1111_1111, 0, 0b0000_0010}},
+			extents: []lb.LBAExtent{{Start: 128, Count: 16}, {Start: 152, Count: 8}},
+		},
+		{
+			name: "bit order agnostic",
+			r: lb.LBARange{Start: 0, End: 24,
+				Bitmap: []byte{0b0000_0001, 0, 0b1000_0000}},
+			extents: []lb.LBAExtent{{Start: 0, Count: 8}, {Start: 16, Count: 8}},
+		},
+		{
+			name:    "partial last byte",
+			r:       lb.LBARange{Start: 64, End: 76, Bitmap: []byte{0, 0b0000_0001}},
+			extents: []lb.LBAExtent{{Start: 72, Count: 4}},
+		},
+		{
+			name:    "short bitmap",
+			r:       lb.LBARange{Start: 0, End: 64, Bitmap: []byte{0b1000_0000}},
+			extents: []lb.LBAExtent{{Start: 0, Count: 64}},
+		},
+		{
+			name:    "long bitmap",
+			r:       lb.LBARange{Start: 0, End: 8, Bitmap: []byte{0, 0b1000_0000}},
+			extents: []lb.LBAExtent{{Start: 0, Count: 8}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.extents, tc.r.Extents())
+		})
+	}
+}
+
+func TestSnapshotMetadata(t *testing.T) {
+	ep := "10.19.151.24:443,10.19.151.6:443"
+	projectName := "default"
+	volUUID1 := guuid.MustParse("6bb32fb5-99aa-4a4c-a4e7-30b7787bbd66")
+	volUUID2 := guuid.MustParse("0cf0a5c4-7ec8-4a1c-a52e-1d5a3cbf6f0c")
+	baseUUID := guuid.MustParse("a1a1a1a1-0000-4000-8000-000000000001")
+	snapUUID := guuid.MustParse("a1a1a1a1-0000-4000-8000-000000000002")
+	otherUUID := guuid.MustParse("a1a1a1a1-0000-4000-8000-000000000003")
+	resID := func(nguid guuid.UUID) string {
+		return fmt.Sprintf("mgmt:%s|nguid:%s|proj:%s|scheme:grpcs", ep, nguid, projectName)
+	}
+	now := time.Now()
+	snap := func(uuid, srcVol guuid.UUID, btime time.Time) *lb.Snapshot {
+		return &lb.Snapshot{
+			Name:         "snap-" + uuid.String(),
+			UUID:         uuid,
+			Capacity:     uint64(GiB),
+			State:        lb.SnapshotAvailable,
+			SrcVolUUID:   srcVol,
+			SectorSize:   4096,
+			CreationTime: btime,
+			ProjectName:  projectName,
+		}
+	}
+	// LBAs 0-7, 56-63 and 64-127:
+	ranges := []*lb.LBARange{
+		{Start: 0, End: 64, Bitmap: []byte{0xff, 0, 0, 0, 0, 0, 0, 0xff}},
+		{Start: 64, End: 128},
+	}
+	listChanged := func(m *ClientMock, base guuid.UUID, offsetLBA uint64) {
+		m.On("ListChangedBlocks", context.Background(), snapUUID, base, projectName,
+			offsetLBA, mock.Anything).
+			Run(func(args mock.Arguments) {
+				fn := args.Get(5).(lb.ChangedBlocksFunc)
+				for _, r := range ranges {
+					if err := fn(r); err != nil {
+						return
+					}
+				}
+			}).
+			Return(nil).Once()
+	}
+	blk := func(lba, count int64) *csi.BlockMetadata {
+		return &csi.BlockMetadata{ByteOffset: lba * 4096, SizeBytes: count * 4096}
+	}
+
+	testCases := []struct {
+		name       string
+		base       guuid.UUID // guuid.Nil for GetMetadataAllocated().
+		offset     int64
+		maxResults int32
+		sendErr    error
+		clientMock func() *ClientMock
+		blocks     [][]*csi.BlockMetadata
+		code       codes.Code
+		numLBCalls int
+	}{
+		{
+			name:       "allocated, adjacent extents merged",
+			maxResults: 1,
+			clientMock: func() *ClientMock {
+				m := basicClientMock(ep)
+				m.On("GetSnapshot", context.Background(), snapUUID, projectName).
+					Return(snap(snapUUID, volUUID1, now), nil).Once()
+				listChanged(m, guuid.Nil, 0)
+				return m
+			},
+			blocks:     [][]*csi.BlockMetadata{{blk(0, 8)}, {blk(56, 72)}},
+			numLBCalls: 1,
+		},
+		{
+			name:   "allocated, from offset",
+			offset: 9*4096 + 100,
+			clientMock: func() *ClientMock {
+				m := basicClientMock(ep)
+				m.On("GetSnapshot", context.Background(), snapUUID, projectName).
+					Return(snap(snapUUID, volUUID1, now), nil).Once()
+				listChanged(m, guuid.Nil, 9)
+				return m
+			},
+			blocks:     [][]*csi.BlockMetadata{{blk(56, 72)}},
+			numLBCalls: 1,
+		},
+		{
+			name:       "negative offset",
+			offset:     -1,
+			clientMock: func() *ClientMock { return basicClientMock(ep) },
+			code:       codes.OutOfRange,
+		},
+		{
+			name:   "offset past capacity",
+			offset: int64(GiB) + 1,
+			clientMock: func() *ClientMock {
+				m := basicClientMock(ep)
+				m.On("GetSnapshot", context.Background(), snapUUID, projectName).
+					Return(snap(snapUUID, volUUID1, now), nil).Once()
+				return m
+			},
+			code: codes.OutOfRange,
+		},
+		{
+			name: "nonexistent snapshot",
+			clientMock: func() *ClientMock {
+				m := basicClientMock(ep)
+				m.On("GetSnapshot", context.Background(), snapUUID, projectName).
+					Return((*lb.Snapshot)(nil), status.Error(codes.NotFound, "nope")).Once()
+				return m
+			},
+			code: codes.NotFound,
+		},
+		{
+			name:    "stream broken",
+			sendErr: status.Error(codes.Canceled, "gone"),
+			clientMock: func() *ClientMock {
+				m := basicClientMock(ep)
+				m.On("GetSnapshot", context.Background(), snapUUID, projectName).
+					Return(snap(snapUUID, volUUID1, now), nil).Once()
+				listChanged(m, guuid.Nil, 0)
+				return m
+			},
+			code:       codes.Canceled,
+			numLBCalls: 1,
+		},
+		{
+			name: "delta",
+			base: baseUUID,
+			clientMock: func() *ClientMock {
+				m := basicClientMock(ep)
+				m.On("GetSnapshot", context.Background(), snapUUID, projectName).
+					Return(snap(snapUUID, volUUID1, now), nil).Once()
+				m.On("GetSnapshot", context.Background(), baseUUID, projectName).
+					Return(snap(baseUUID, volUUID1, now.Add(-time.Hour)), nil).Once()
+				listChanged(m, baseUUID, 0)
+				return m
+			},
+			blocks:     [][]*csi.BlockMetadata{{blk(0, 8), blk(56, 72)}},
+			numLBCalls: 1,
+		},
+		{
+			name: "delta, base of different volume",
+			base: otherUUID,
+			clientMock: func() *ClientMock {
+				m := basicClientMock(ep)
+				m.On("GetSnapshot", context.Background(), snapUUID, projectName).
+					Return(snap(snapUUID, volUUID1, now), nil).Once()
+				m.On("GetSnapshot", context.Background(), otherUUID, projectName).
+					Return(snap(otherUUID, volUUID2, now.Add(-time.Hour)), nil).Once()
+				return m
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "delta, base newer than target",
+			base: baseUUID,
+			clientMock: func() *ClientMock {
+				m := basicClientMock(ep)
+				m.On("GetSnapshot", context.Background(), snapUUID, projectName).
+					Return(snap(snapUUID, volUUID1, now), nil).Once()
+				m.On("GetSnapshot", context.Background(), baseUUID, projectName).
+					Return(snap(baseUUID, volUUID1, now.Add(time.Hour)), nil).Once()
+				return m
+			},
+			code: codes.InvalidArgument,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientMock := tc.clientMock()
+			driver, _, _ := getDriver(t, "rack01-server01", false)
+			driver.lbclients = lb.NewClientPoolWithOptions(
+				func(
+					ctx context.Context, targets endpoint.Slice, mgmtScheme string,
+					_ *lb.TLSConfig,
+				) (lb.Client, error) {
+					return clientMock, nil
+				},
+				poolOpts,
+			)
+
+			var err error
+			var blocks [][]*csi.BlockMetadata
+			if tc.base == guuid.Nil {
+				stream := &allocatedStreamMock{metadataStreamMock{sendErr: tc.sendErr}}
+				err = driver.GetMetadataAllocated(&csi.GetMetadataAllocatedRequest{
+					SnapshotId:     resID(snapUUID),
+					StartingOffset: tc.offset,
+					MaxResults:     tc.maxResults,
+				}, stream)
+				blocks = stream.blocks
+			} else {
+				stream := &deltaStreamMock{metadataStreamMock{sendErr: tc.sendErr}}
+				err = driver.GetMetadataDelta(&csi.GetMetadataDeltaRequest{
+					BaseSnapshotId:   resID(tc.base),
+					TargetSnapshotId: resID(snapUUID),
+					StartingOffset:   tc.offset,
+					MaxResults:       tc.maxResults,
+				}, stream)
+				blocks = stream.blocks
+			}
+			clientMock.AssertNumberOfCalls(t, "ListChangedBlocks", tc.numLBCalls)
+			if tc.code != codes.OK {
+				require.Equal(t, tc.code, status.Code(err), "wrong error: %v", err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, len(tc.blocks), len(blocks))
+			for i := range tc.blocks {
+				require.Equal(t, len(tc.blocks[i]), len(blocks[i]))
+				for j := range tc.blocks[i] {
+					require.Equal(t, tc.blocks[i][j].ByteOffset, blocks[i][j].ByteOffset)
+					require.Equal(t, tc.blocks[i][j].SizeBytes, blocks[i][j].SizeBytes)
+				}
+			}
+		})
+	}
+}
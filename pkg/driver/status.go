@@ -126,3 +126,7 @@ func mkErange(format string, args ...interface{}) error {
 func mkAbort(format string, args ...interface{}) error {
 	return status.Errorf(codes.Aborted, format, args...)
 }
+
+func mkEnospc(format string, args ...interface{}) error {
+	return status.Errorf(codes.ResourceExhausted, format, args...)
+}
@@ -0,0 +1,213 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	guuid "github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// topology support: each Node plugin instance may be configured (through a
+// node-local config file) with the LightOS cluster it can reach and the
+// LightOS failure domain (FD) it is located in (e.g. rack or zone). these are
+// published by NodeGetInfo() as CSI topology segments, and the CO then feeds
+// them back to CreateVolume() as `accessibility_requirements`, where they are
+// translated into LightOS volume placement restrictions.
+//
+// nodes without topology config publish no segments at all, in which case
+// the whole thing boils down to the old, topology-oblivious behaviour.
+
+const (
+	topoKeyCluster       = "topology." + driverName + "/cluster"
+	topoKeyFailureDomain = "topology." + driverName + "/failure-domain"
+
+	DefaultTopologyCfgFileName = "topology.yaml"
+)
+
+// topologyConfig is the node-local topology config, in YAML format, e.g.:
+//
+//	cluster: 8f3a4b1e-2c5d-4a57-9e1b-7d2f0c6a9b13
+//	failureDomain: rack-07
+//
+// `cluster` is the UUID of the LightOS cluster reachable from this node,
+// `failureDomain` - the name of the LightOS FD this node shares with the
+// LightOS storage servers "closest" to it. both are optional.
+type topologyConfig struct {
+	Cluster       string `yaml:"cluster,omitempty"`
+	FailureDomain string `yaml:"failureDomain,omitempty"`
+}
+
+func loadTopologyConfig(log *logrus.Entry, cfgPath string) (*topologyConfig, error) {
+	topoCfg := &topologyConfig{}
+	if cfgPath == "" {
+		return topoCfg, nil
+	}
+
+	rawCfg, err := os.ReadFile(cfgPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read topology config: %s", err)
+		}
+		log.Infof("missing topology config file '%s', node topology will not be "+
+			"published", cfgPath)
+		return topoCfg, nil
+	}
+
+	if err := yaml.UnmarshalStrict(rawCfg, topoCfg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal topology config: %s", err)
+	}
+	if topoCfg.Cluster != "" {
+		clusterUUID, err := guuid.Parse(topoCfg.Cluster)
+		if err != nil {
+			return nil, fmt.Errorf("bad cluster UUID '%s' in topology config: %s",
+				topoCfg.Cluster, err)
+		}
+		// normalise, the segments are compared as plain strings later on:
+		topoCfg.Cluster = clusterUUID.String()
+	}
+	if topoCfg.FailureDomain != "" {
+		if !fdNameRegex.MatchString(topoCfg.FailureDomain) {
+			return nil, fmt.Errorf("bad failure domain name '%s' in topology config",
+				topoCfg.FailureDomain)
+		}
+	}
+	return topoCfg, nil
+}
+
+// segments() returns the CSI topology segments describing the node, nil if
+// the node has no topology config.
+func (tc *topologyConfig) segments() map[string]string {
+	if tc == nil {
+		return nil
+	}
+	segs := map[string]string{}
+	if tc.Cluster != "" {
+		segs[topoKeyCluster] = tc.Cluster
+	}
+	if tc.FailureDomain != "" {
+		segs[topoKeyFailureDomain] = tc.FailureDomain
+	}
+	if len(segs) == 0 {
+		return nil
+	}
+	return segs
+}
+
+// topologyPlacement() figures out where a volume should be placed given the
+// CO `accessibility_requirements`, the UUID of the LightOS cluster the volume
+// is about to be created on and the volume params from the SC. it returns the
+// LightOS FDs to restrict the volume placement to (nil for no restrictions)
+// and the CSI topology the volume will be accessible from (nil if the CO
+// didn't ask for any specific topology).
+//
+// as far as the cluster goes, `requisite` topologies (or, failing that,
+// `preferred` ones) that refer to other clusters are disregarded. if none are
+// left - the volume can't be provisioned on this cluster at all.
+//
+// `requisite` topologies only bound the placement: with WaitForFirstConsumer
+// K8s lists the topologies of all the nodes there, and puts that of the node
+// the pod was scheduled to first in `preferred`. so the volume is placed in
+// the FD of the first `preferred` topology that's eligible, if any.
+//
+// FDs are a bit trickier: LightOS can only restrict placement of single-
+// replica volumes, and any such restriction makes the volume data reside
+// exclusively in the chosen FDs, which is only reasonable if ALL the
+// suitable topologies have an FD. otherwise the FD segments are ignored and
+// the volume is placed wherever LightOS sees fit (within the cluster, which
+// is equally accessible from all the nodes that can reach it).
+func topologyPlacement(
+	req *csi.TopologyRequirement, clusterUUID guuid.UUID, params *lbCreateVolumeParams,
+) ([]string, []*csi.Topology, error) {
+	topos := req.GetRequisite()
+	if len(topos) == 0 {
+		topos = req.GetPreferred()
+	}
+	if len(topos) == 0 {
+		return params.failureDomains, nil, nil
+	}
+
+	cluster := clusterUUID.String()
+	var matching []*csi.Topology
+	haveCluster := false
+	allHaveFD := true
+	for _, topo := range topos {
+		segs := topo.GetSegments()
+		if c, ok := segs[topoKeyCluster]; ok {
+			if c != cluster {
+				continue
+			}
+			haveCluster = true
+		}
+		if segs[topoKeyFailureDomain] == "" {
+			allHaveFD = false
+		}
+		matching = append(matching, topo)
+	}
+	if len(matching) == 0 {
+		return nil, nil, mkEnospc("none of the requested topologies are served " +
+			"by LightOS cluster " + cluster)
+	}
+
+	var accessible []*csi.Topology
+	if haveCluster {
+		accessible = []*csi.Topology{{
+			Segments: map[string]string{topoKeyCluster: cluster},
+		}}
+	}
+	if !allHaveFD || params.replicaCount != 1 {
+		return params.failureDomains, accessible, nil
+	}
+
+	// only FDs that are both requested by the CO and allowed by the SC
+	// (if the SC restricts FDs at all) are eligible:
+	scFDs := map[string]bool{}
+	for _, fd := range params.failureDomains {
+		scFDs[fd] = true
+	}
+	fdSet := map[string]bool{}
+	for _, topo := range matching {
+		fd := topo.GetSegments()[topoKeyFailureDomain]
+		if len(scFDs) == 0 || scFDs[fd] {
+			fdSet[fd] = true
+		}
+	}
+	if len(fdSet) == 0 {
+		return nil, nil, mkEnospc("none of the requested topology failure domains "+
+			"are allowed by the '%s' volume param %#q",
+			volParKey(volParFDsKey), params.failureDomains)
+	}
+
+	for _, topo := range req.GetPreferred() {
+		segs := topo.GetSegments()
+		if c, ok := segs[topoKeyCluster]; ok && c != cluster {
+			continue
+		}
+		if fd := segs[topoKeyFailureDomain]; fdSet[fd] {
+			fdSet = map[string]bool{fd: true}
+			break
+		}
+	}
+
+	fds := make([]string, 0, len(fdSet))
+	for fd := range fdSet {
+		fds = append(fds, fd)
+	}
+	sort.Strings(fds)
+
+	accessible = nil
+	for _, fd := range fds {
+		segs := map[string]string{topoKeyFailureDomain: fd}
+		if haveCluster {
+			segs[topoKeyCluster] = cluster
+		}
+		accessible = append(accessible, &csi.Topology{Segments: segs})
+	}
+	return fds, accessible, nil
+}
@@ -0,0 +1,242 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	guuid "github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLoadTopologyConfig(t *testing.T) {
+	log := logrus.New().WithField("test", t.Name())
+	dir := t.TempDir()
+
+	testCases := []struct {
+		name string
+		cfg  string
+		segs map[string]string
+		err  string
+	}{
+		{
+			name: "full",
+			cfg: "cluster: 8F3A4B1E-2C5D-4A57-9E1B-7D2F0C6A9B13\n" +
+				"failureDomain: rack-07\n",
+			segs: map[string]string{
+				topoKeyCluster:       "8f3a4b1e-2c5d-4a57-9e1b-7d2f0c6a9b13",
+				topoKeyFailureDomain: "rack-07",
+			},
+		},
+		{
+			name: "FD only",
+			cfg:  "failureDomain: rack-07\n",
+			segs: map[string]string{topoKeyFailureDomain: "rack-07"},
+		},
+		{
+			name: "empty",
+			cfg:  "",
+		},
+		{
+			name: "bad cluster UUID",
+			cfg:  "cluster: cluster-1\n",
+			err:  "bad cluster UUID 'cluster-1'",
+		},
+		{
+			name: "bad FD",
+			cfg:  "failureDomain: rack 7\n",
+			err:  "bad failure domain name 'rack 7'",
+		},
+		{
+			name: "unknown key",
+			cfg:  "zone: rack-7\n",
+			err:  "failed to unmarshal topology config",
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, "topology.yaml."+string(rune('a'+i)))
+			require.NoError(t, os.WriteFile(path, []byte(tc.cfg), 0o644))
+			topoCfg, err := loadTopologyConfig(log, path)
+			if tc.err != "" {
+				require.ErrorContains(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.segs, topoCfg.segments())
+		})
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		topoCfg, err := loadTopologyConfig(log, filepath.Join(dir, "nonexistent.yaml"))
+		require.NoError(t, err)
+		require.Nil(t, topoCfg.segments())
+	})
+}
+
+func TestTopologyPlacement(t *testing.T) {
+	cluster := guuid.MustParse("8f3a4b1e-2c5d-4a57-9e1b-7d2f0c6a9b13")
+	other := "0cf0a5c4-7ec8-4a1c-a52e-1d5a3cbf6f0c"
+
+	topo := func(cluster, fd string) *csi.Topology {
+		segs := map[string]string{}
+		if cluster != "" {
+			segs[topoKeyCluster] = cluster
+		}
+		if fd != "" {
+			segs[topoKeyFailureDomain] = fd
+		}
+		return &csi.Topology{Segments: segs}
+	}
+	c := cluster.String()
+
+	testCases := []struct {
+		name       string
+		req        *csi.TopologyRequirement
+		repCnt     uint32
+		scFDs      []string
+		fds        []string
+		accessible []*csi.Topology
+		code       codes.Code
+	}{
+		{
+			name:   "no requirements",
+			req:    nil,
+			repCnt: 1,
+			scFDs:  []string{"rack-1"},
+			fds:    []string{"rack-1"},
+		},
+		{
+			name: "cluster only",
+			req: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{topo(c, ""), topo(other, "")},
+			},
+			repCnt:     3,
+			accessible: []*csi.Topology{topo(c, "")},
+		},
+		{
+			name: "wrong cluster",
+			req: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{topo(other, "rack-1")},
+			},
+			repCnt: 1,
+			code:   codes.ResourceExhausted,
+		},
+		{
+			name: "preferred used if no requisite",
+			req: &csi.TopologyRequirement{
+				Preferred: []*csi.Topology{topo(c, "rack-2"), topo(c, "rack-1")},
+			},
+			repCnt:     1,
+			fds:        []string{"rack-2"},
+			accessible: []*csi.Topology{topo(c, "rack-2")},
+		},
+		{
+			name: "placed in first preferred FD",
+			req: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{topo(c, "rack-1"), topo(c, "rack-2"),
+					topo(c, "rack-3")},
+				Preferred: []*csi.Topology{topo(c, "rack-3"), topo(c, "rack-1"),
+					topo(c, "rack-2")},
+			},
+			repCnt:     1,
+			fds:        []string{"rack-3"},
+			accessible: []*csi.Topology{topo(c, "rack-3")},
+		},
+		{
+			name: "first eligible preferred FD",
+			req: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{topo(c, "rack-1"), topo(c, "rack-2")},
+				Preferred: []*csi.Topology{topo(other, "rack-1"), topo(c, "rack-3"),
+					topo(c, "rack-2")},
+			},
+			repCnt:     1,
+			fds:        []string{"rack-2"},
+			accessible: []*csi.Topology{topo(c, "rack-2")},
+		},
+		{
+			name: "preferred FD not allowed by SC",
+			req: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{topo(c, "rack-1"), topo(c, "rack-2")},
+				Preferred: []*csi.Topology{topo(c, "rack-1"), topo(c, "rack-2")},
+			},
+			repCnt:     1,
+			scFDs:      []string{"rack-2"},
+			fds:        []string{"rack-2"},
+			accessible: []*csi.Topology{topo(c, "rack-2")},
+		},
+		{
+			name: "FDs ignored for multiple replicas",
+			req: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{topo(c, "rack-1")},
+			},
+			repCnt:     2,
+			accessible: []*csi.Topology{topo(c, "")},
+		},
+		{
+			name: "FDs ignored unless all topologies have one",
+			req: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{topo(c, "rack-1"), topo(c, "")},
+			},
+			repCnt:     1,
+			accessible: []*csi.Topology{topo(c, "")},
+		},
+		{
+			name: "FDs without cluster",
+			req: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{topo("", "rack-1"), topo("", "rack-1")},
+			},
+			repCnt:     1,
+			fds:        []string{"rack-1"},
+			accessible: []*csi.Topology{topo("", "rack-1")},
+		},
+		{
+			name: "FDs intersected with SC",
+			req: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{topo(c, "rack-1"), topo(c, "rack-2"),
+					topo(other, "rack-3")},
+			},
+			repCnt:     1,
+			scFDs:      []string{"rack-2", "rack-3"},
+			fds:        []string{"rack-2"},
+			accessible: []*csi.Topology{topo(c, "rack-2")},
+		},
+		{
+			name: "no FDs allowed by SC",
+			req: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{topo(c, "rack-1")},
+			},
+			repCnt: 1,
+			scFDs:  []string{"rack-2"},
+			code:   codes.ResourceExhausted,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			params := lbCreateVolumeParams{
+				replicaCount:   tc.repCnt,
+				failureDomains: tc.scFDs,
+			}
+			fds, accessible, err := topologyPlacement(tc.req, cluster, &params)
+			if tc.code != codes.OK {
+				require.Equal(t, tc.code, status.Code(err), "err: %v", err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.fds, fds)
+			require.Equal(t, len(tc.accessible), len(accessible))
+			for i := range tc.accessible {
+				require.Equal(t, tc.accessible[i].Segments, accessible[i].Segments)
+			}
+		})
+	}
+}
@@ -6,16 +6,22 @@ package lb
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
 	guuid "github.com/google/uuid"
 
 	"github.com/lightbitslabs/los-csi/pkg/util/endpoint"
+	"github.com/lightbitslabs/los-csi/pkg/util/strlist"
 )
 
 const (
 	unknown = "<UNKNOWN>"
+
+	// MaxListLimit is the maximum number of entries LightOS is willing to
+	// return in response to a single List*() call.
+	MaxListLimit = 1000
 )
 
 type VolumeState int32
@@ -96,6 +102,10 @@ type Volume struct {
 	Compression        bool
 	SnapshotUUID       guuid.UUID
 	QosPolicyName      string
+	// failure domains the volume placement is restricted to, if any.
+	FailureDomains []string
+	// user-defined LightOS volume labels, nil if none.
+	Labels map[string]string
 
 	ACL []string
 
@@ -181,6 +191,28 @@ func (v *Volume) ExplainDiffsFrom(other *Volume, lDescr, rDescr string, skipFiel
 		diffs.and("%sVolume %s project name %q differs from the %s volume project name %q",
 			lDescr, v.Name, v.ProjectName, rDescr, other.ProjectName)
 	}
+	if !strlist.AreEqual(v.FailureDomains, other.FailureDomains) {
+		diffs.and("%sVolume %s placement failure domains %#q differ from the %s "+
+			"volume placement failure domains %#q",
+			lDescr, v.Name, v.FailureDomains, rDescr, other.FailureDomains)
+	}
+	// labels are special: LightOS might attach labels of its own accord
+	// (e.g. clones inherit those of the source snapshot), so only the ones
+	// present on `v` are required to match:
+	keys := make([]string, 0, len(v.Labels))
+	for k := range v.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if val, ok := other.Labels[k]; !ok {
+			diffs.and("%sVolume %s label '%s' is missing from the %s volume",
+				lDescr, v.Name, k, rDescr)
+		} else if val != v.Labels[k] {
+			diffs.and("%sVolume %s label '%s' value '%s' differs from the %s "+
+				"volume label value '%s'", lDescr, v.Name, k, v.Labels[k], rDescr, val)
+		}
+	}
 	if not(SkipSnapUUID) && v.SnapshotUUID != other.SnapshotUUID {
 		diffs.and("%sVolume %s source snapshot %s differs from the %s volume source snapshot %s",
 			lDescr, v.Name, v.SnapshotUUID, rDescr, other.SnapshotUUID)
@@ -198,6 +230,9 @@ type ClusterInfo struct {
 	DiscoveryEndpoints []string
 	ApiEndpoints       []string
 	NvmeEndpoints      []string
+	// InBandAuth is true if the cluster requires NVMe in-band
+	// authentication (DH-HMAC-CHAP) of the hosts connecting to it.
+	InBandAuth bool
 }
 
 type Cluster struct {
@@ -212,6 +247,27 @@ type Cluster struct {
 
 //revive:enable:var-naming
 
+// TrustedHost is a host that LightOS knows by its NQN, for the purposes of
+// NVMe in-band authentication.
+type TrustedHost struct {
+	Name        string
+	ProjectName string
+	HostNQN     string
+}
+
+// TrustedHostSecrets are the NVMe in-band authentication (DH-HMAC-CHAP)
+// secrets of a trusted host, in the `DHHC-1:<hmac>:<base64>:` representation
+// (q.v. NVMe Base Spec, "DH-HMAC-CHAP secret representation"), as accepted by
+// `nvme connect --dhchap-secret` and friends.
+type TrustedHostSecrets struct {
+	// Host secret authenticates the host to the LightOS cluster. empty if
+	// not set.
+	Host string
+	// Ctrl secret, if set, authenticates the LightOS cluster (the NVMe
+	// controller) to the host, i.e. enables bidirectional authentication.
+	Ctrl string
+}
+
 type NodeState int32
 
 // match present LB API values. here's to API stability!
@@ -272,6 +328,15 @@ type VolumeUpdate struct {
 	ACL []string
 
 	Capacity uint64
+
+	// name of the QoS policy to switch the volume to. empty to not update.
+	QosPolicyName string
+	// nil to not update compression. NOTE: LightOS only applies the change
+	// to data written from then on, existing data is left as is.
+	Compression *bool
+	// full desired set of labels. nil or empty map to not update labels:
+	// LightOS doesn't support clearing all the labels of a volume.
+	Labels map[string]string
 }
 
 // VolumeUpdateHook is passed to Client.UpdateVolume(). it will be invoked
@@ -326,10 +391,83 @@ type Snapshot struct {
 	SrcVolCompression  bool
 	CreationTime       time.Time
 
+	// size of the snapshot logical blocks (LBAs) in bytes, same as that of
+	// the source volume.
+	SectorSize uint32
+
 	ETag        string
 	ProjectName string
+	// LightOS snapshot labels are inherited from the source volume at the
+	// time the snapshot is taken. nil if none.
+	Labels map[string]string
 }
 
+// LBARange describes the blocks in the [Start, End) LBA range of a snapshot
+// that differ from those of its base snapshot (or that contain data at all,
+// if no base snapshot was specified), as reported by LightOS: every bit of
+// Bitmap corresponds to a single LBA, and Bitmap[0] covers LBAs Start
+// through Start+7, Bitmap[1] - Start+8 through Start+15, etc.
+//
+// NOTE: the LightOS API (q.v. LBARange in durosapiv2.proto) specifies
+// neither the order of the bits within a byte, nor what an empty or short
+// bitmap means. see Extents() for how these are dealt with.
+type LBARange struct {
+	Start  uint64
+	End    uint64
+	Bitmap []byte
+}
+
+// LBAExtent is a run of Count consecutive LBAs, starting with Start.
+type LBAExtent struct {
+	Start uint64
+	Count uint64
+}
+
+// Extents() decodes the bitmap of the range into a list of maximal runs of
+// consecutive changed LBAs, in ascending order.
+//
+// the LightOS API leaves some of the bitmap format unspecified (see
+// LBARange), and under-reporting changed blocks means silently corrupt
+// backups, while over-reporting them merely means bigger ones. so the
+// decoding errs on the side of caution:
+//   - a bitmap that doesn't cover the range exactly (including an empty one)
+//     can't be relied on, and the whole range is considered changed.
+//   - the bitmap is only trusted at the byte granularity: all 8 LBAs covered
+//     by a byte with any of its bits set are considered changed, whatever
+//     the bit order might be.
+func (r *LBARange) Extents() []LBAExtent {
+	if r.End <= r.Start {
+		return nil
+	}
+	n := r.End - r.Start
+	if uint64(len(r.Bitmap)) != (n+7)/8 {
+		return []LBAExtent{{Start: r.Start, Count: n}}
+	}
+
+	var extents []LBAExtent
+	var curr *LBAExtent
+	for idx, b := range r.Bitmap {
+		if b == 0 {
+			curr = nil
+			continue
+		}
+		start := r.Start + uint64(idx)*8
+		count := min(8, r.End-start)
+		if curr == nil {
+			extents = append(extents, LBAExtent{Start: start})
+			curr = &extents[len(extents)-1]
+		}
+		curr.Count += count
+	}
+	return extents
+}
+
+// ChangedBlocksFunc is invoked by Client.ListChangedBlocks() for every LBA
+// range reported by LightOS, in ascending LBA order. returning an error from
+// it aborts the iteration, and the error is passed on to the caller of
+// ListChangedBlocks() as is.
+type ChangedBlocksFunc func(r *LBARange) error
+
 //nolint:gofumpt
 type Client interface {
 	Close()
@@ -345,7 +483,8 @@ type Client interface {
 
 	CreateVolume(ctx context.Context, name string, capacity uint64,
 		replicaCount uint32, compress bool, acl []string, projectName string,
-		snapshotID guuid.UUID, qosPolicyName string, blocking bool,
+		snapshotID guuid.UUID, qosPolicyName string, failureDomains []string,
+		labels map[string]string, blocking bool,
 	) (*Volume, error)
 	DeleteVolume(ctx context.Context, uuid guuid.UUID, projectName string, blocking bool) error
 	GetVolume(ctx context.Context, uuid guuid.UUID, projectName string) (*Volume, error)
@@ -353,6 +492,19 @@ type Client interface {
 	UpdateVolume(ctx context.Context, uuid guuid.UUID, projectName string,
 		hook VolumeUpdateHook,
 	) (*Volume, error)
+	// RollbackVolume() restores the contents of volume `uuid` in place to
+	// those of snapshot `snapUUID` of the same volume, and waits for the
+	// volume to leave the VolumeRollback state.
+	RollbackVolume(ctx context.Context, uuid guuid.UUID, projectName string,
+		snapUUID guuid.UUID,
+	) (*Volume, error)
+	// ListVolumes() returns up to `limit` volumes in project `projectName`
+	// (or in all the projects accessible to the caller, if `projectName` is
+	// empty), starting with the volume immediately following the `offset`
+	// one in the LightOS list order, or from the very first volume if
+	// `offset` is guuid.Nil.
+	ListVolumes(ctx context.Context, projectName string, offset guuid.UUID, limit uint32,
+	) ([]*Volume, error)
 
 	CreateSnapshot(ctx context.Context, name string, projectName string, srcVolUUID guuid.UUID,
 		descr string, blocking bool,
@@ -360,4 +512,27 @@ type Client interface {
 	DeleteSnapshot(ctx context.Context, uuid guuid.UUID, projectName string, blocking bool) error
 	GetSnapshot(ctx context.Context, uuid guuid.UUID, projectName string) (*Snapshot, error)
 	GetSnapshotByName(ctx context.Context, name string, projectName string) (*Snapshot, error)
+	// ListSnapshots() is the snapshot counterpart of ListVolumes(), same
+	// paging semantics apply.
+	ListSnapshots(ctx context.Context, projectName string, offset guuid.UUID, limit uint32,
+	) ([]*Snapshot, error)
+	// ListChangedBlocks() iterates over the blocks of snapshot `snapUUID`
+	// that differ from those of snapshot `baseSnapUUID` of the same volume
+	// (or over all the blocks containing data, if `baseSnapUUID` is
+	// guuid.Nil), starting with LBA `offsetLBA` (rounded down to a multiple
+	// of 64 by LightOS), invoking `fn` for each range of such blocks.
+	ListChangedBlocks(ctx context.Context, snapUUID, baseSnapUUID guuid.UUID,
+		projectName string, offsetLBA uint64, fn ChangedBlocksFunc,
+	) error
+
+	GetTrustedHost(ctx context.Context, name string, projectName string) (*TrustedHost, error)
+	CreateTrustedHost(ctx context.Context, name string, projectName string, hostNQN string,
+	) (*TrustedHost, error)
+	GetTrustedHostSecrets(ctx context.Context, name string, projectName string,
+	) (*TrustedHostSecrets, error)
+	// SetTrustedHostSecrets() replaces both secrets of trusted host `name`.
+	// an empty `Ctrl` secret disables bidirectional authentication.
+	SetTrustedHostSecrets(ctx context.Context, name string, projectName string,
+		secrets *TrustedHostSecrets,
+	) error
 }
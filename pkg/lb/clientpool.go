@@ -9,16 +9,35 @@ import (
 	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
+	"github.com/lightbitslabs/los-csi/pkg/metrics"
 	"github.com/lightbitslabs/los-csi/pkg/util/endpoint"
 )
 
+var (
+	poolClients = metrics.Factory.NewGauge(prometheus.GaugeOpts{
+		Name: "lb_csi_lb_clients",
+		Help: "Number of LightOS API clients in the client pools, including the " +
+			"ones still dialling.",
+	})
+	poolDialFailures = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Name: "lb_csi_lb_client_dial_failures_total",
+		Help: "Number of failed attempts to connect to LightOS clusters.",
+	})
+	poolReaped = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Name: "lb_csi_lb_clients_reaped_total",
+		Help: "Number of idle LightOS API clients closed by the client pool reaper.",
+	})
+)
+
 type poolMember struct {
 	dialCtx  context.Context    // dialling context only, ignored afterwards.
 	cancel   context.CancelFunc // to abort blocking dialling prematurely.
 	dialDone chan struct{}      // ...successfully or otherwise!
+	key      string             // the key of this member in ClientPool.pool.
 
 	// all of the below are protected by mu.
 	mu sync.Mutex
@@ -67,11 +86,17 @@ type ClientPoolOptions struct {
 	ReapCycle time.Duration
 }
 
-type DialFunc func(context.Context, endpoint.Slice, string) (Client, error)
+// DialFunc connects to the LB at `targets` using `mgmtScheme`. `tlsCfg` is
+// only relevant to the "grpcs" scheme, nil means the dialer defaults.
+type DialFunc func(
+	ctx context.Context, targets endpoint.Slice, mgmtScheme string, tlsCfg *TLSConfig,
+) (Client, error)
 
 // ClientPool maintains a pool of long-lived LB clients that can be reused
 // across individual RPC invocations to avoid connection/authentication
-// overheads. only one live client per target is kept.
+// overheads. only one live client per target and TLS identity is kept: clients
+// with different trust settings (e.g. CA bundles passed in via different
+// StorageClass secrets) are never shared, even if they talk to the same LB.
 type ClientPool struct {
 	opts ClientPoolOptions
 
@@ -84,7 +109,7 @@ type ClientPool struct {
 	reaperDone chan struct{}
 
 	mu     sync.Mutex             // all of the below are protected by mu.
-	pool   map[string]*poolMember // targets -> client
+	pool   map[string]*poolMember // targets + TLS ID -> client, see poolKey()
 	lut    map[string]*poolMember // client ID -> client
 	closed bool
 }
@@ -168,7 +193,9 @@ func (cp *ClientPool) reapClients() {
 			}
 
 			delete(cp.lut, id)
-			delete(cp.pool, clnt.Targets())
+			delete(cp.pool, pm.key)
+			poolClients.Add(-1)
+			poolReaped.Inc()
 			cp.mu.Unlock()
 
 			// if GetClient() managed to catch this client right at
@@ -203,14 +230,15 @@ func (cp *ClientPool) closeClients() {
 			panic(fmt.Sprintf("closeClients(): found nil client with ID '%s'", id))
 		}
 
-		tgts := clnt.Targets()
+		key := pm.key
 		pm.clnt = nil
 		pm.dialErr = status.Error(codes.Canceled, "LB client connection is closing")
 		pm.mu.Unlock()
 		clnt.Close()
 
 		cp.mu.Lock()
-		delete(cp.pool, tgts)
+		delete(cp.pool, key)
+		poolClients.Add(-1)
 	}
 	cp.mu.Unlock()
 	close(cp.reaperDone)
@@ -236,8 +264,10 @@ func (cp *ClientPool) reaper() {
 // of these GetClient() invocations may not wait until it's done, and time
 // out or get cancelled prematurely. in that case the resultant client will
 // still end up in the pool.
-func (cp *ClientPool) dial(targets endpoint.Slice, mgmtScheme string, pm *poolMember) {
-	clnt, err := cp.dialer(pm.dialCtx, targets, mgmtScheme)
+func (cp *ClientPool) dial(
+	targets endpoint.Slice, mgmtScheme string, tlsCfg *TLSConfig, pm *poolMember,
+) {
+	clnt, err := cp.dialer(pm.dialCtx, targets, mgmtScheme, tlsCfg)
 	pm.mu.Lock()
 	if err != nil {
 		clnt = nil // in case dialer was silly...
@@ -256,7 +286,9 @@ func (cp *ClientPool) dial(targets endpoint.Slice, mgmtScheme string, pm *poolMe
 		cp.lut[clnt.ID()] = pm
 	} else {
 		// don't keep clients that failed to connect in the pool:
-		delete(cp.pool, targets.String())
+		delete(cp.pool, pm.key)
+		poolClients.Add(-1)
+		poolDialFailures.Inc()
 	}
 	cp.mu.Unlock()
 	close(pm.dialDone)
@@ -270,10 +302,13 @@ func (cp *ClientPool) dial(targets endpoint.Slice, mgmtScheme string, pm *poolMe
 // only on dialling, subsequent individual requests to the client itself take
 // their own contexts.
 //
+// `tlsCfg` is passed on to the dialer as is. clients dialled with different
+// `tlsCfg` (as per TLSConfig.ID()) are kept apart in the pool.
+//
 // clients obtained from the pool using GetClient() must be returned to the
 // pool using PutClient() once the caller is done using them.
 func (cp *ClientPool) GetClient(
-	ctx context.Context, targets endpoint.Slice, mgmtScheme string,
+	ctx context.Context, targets endpoint.Slice, mgmtScheme string, tlsCfg *TLSConfig,
 ) (Client, error) {
 	if !targets.IsValid() {
 		return nil, status.Errorf(codes.InvalidArgument,
@@ -287,22 +322,24 @@ retry:
 		return nil, status.Error(codes.Canceled, "LB clients pool is closing")
 	}
 
-	tgts := targets.String()
-	pm, ok := cp.pool[tgts]
+	key := poolKey(targets, tlsCfg)
+	pm, ok := cp.pool[key]
 
 	// no LB client for target yet - create one:
 	if !ok {
 		pm = &poolMember{
 			dialDone: make(chan struct{}),
+			key:      key,
 		}
 		pm.dialCtx, pm.cancel = context.WithTimeout(cp.dialCtx, cp.opts.DialTimeout)
 
 		// from here on - it's externally searchable, even if a just dud
-		cp.pool[tgts] = pm
+		cp.pool[key] = pm
+		poolClients.Add(1)
 		cp.dialWG.Add(1)
 		go func() {
 			defer cp.dialWG.Done()
-			cp.dial(targets, mgmtScheme, pm)
+			cp.dial(targets, mgmtScheme, tlsCfg, pm)
 		}()
 	}
 	cp.mu.Unlock()
@@ -345,6 +382,15 @@ retry:
 	}
 }
 
+// poolKey returns the key of the clients for `targets` dialled with `tlsCfg`
+// in ClientPool.pool.
+func poolKey(targets endpoint.Slice, tlsCfg *TLSConfig) string {
+	if id := tlsCfg.ID(); id != "" {
+		return targets.String() + "|tls:" + id
+	}
+	return targets.String()
+}
+
 // PutClient returns a client that necessarily must have been previously
 // obtained from the receiver pool back to the pool.
 func (cp *ClientPool) PutClient(c Client) {
@@ -230,7 +230,8 @@ func (c *fakeClient) CreateVolume(
 	ctx context.Context, name string, capacity uint64,
 	replicaCount uint32, compress bool, acl []string,
 	projectName string, snapshotID guuid.UUID,
-	qosPolicyName string, blocking bool, // TODO: refactor options
+	qosPolicyName string, failureDomains []string,
+	labels map[string]string, blocking bool, // TODO: refactor options
 ) (*lb.Volume, error) {
 	return nil, nil
 }
@@ -259,6 +260,12 @@ func (c *fakeClient) UpdateVolume(
 	return nil, nil
 }
 
+func (c *fakeClient) ListVolumes(
+	ctx context.Context, projectName string, offset guuid.UUID, limit uint32,
+) ([]*lb.Volume, error) {
+	return nil, nil
+}
+
 func (c *fakeClient) CreateSnapshot(
 	ctx context.Context, name string, projectName string, srcVolUUID guuid.UUID,
 	descr string, blocking bool,
@@ -284,6 +291,49 @@ func (c *fakeClient) GetSnapshotByName(
 	return nil, nil
 }
 
+func (c *fakeClient) ListSnapshots(
+	ctx context.Context, projectName string, offset guuid.UUID, limit uint32,
+) ([]*lb.Snapshot, error) {
+	return nil, nil
+}
+
+func (c *fakeClient) RollbackVolume(
+	ctx context.Context, uuid guuid.UUID, projectName string, snapUUID guuid.UUID,
+) (*lb.Volume, error) {
+	return nil, nil
+}
+
+func (c *fakeClient) ListChangedBlocks(
+	ctx context.Context, snapUUID, baseSnapUUID guuid.UUID, projectName string,
+	offsetLBA uint64, fn lb.ChangedBlocksFunc,
+) error {
+	return nil
+}
+
+func (c *fakeClient) GetTrustedHost(
+	ctx context.Context, name string, projectName string,
+) (*lb.TrustedHost, error) {
+	return nil, nil
+}
+
+func (c *fakeClient) CreateTrustedHost(
+	ctx context.Context, name string, projectName string, hostNQN string,
+) (*lb.TrustedHost, error) {
+	return nil, nil
+}
+
+func (c *fakeClient) GetTrustedHostSecrets(
+	ctx context.Context, name string, projectName string,
+) (*lb.TrustedHostSecrets, error) {
+	return nil, nil
+}
+
+func (c *fakeClient) SetTrustedHostSecrets(
+	ctx context.Context, name string, projectName string, secrets *lb.TrustedHostSecrets,
+) error {
+	return nil
+}
+
 //revive:enable:unused-parameter,unused-receiver
 
 // Test env: -----------------------------------------------------------------
@@ -324,7 +374,7 @@ func (env *testEnv) assertTotalClients(expected int64) {
 func (env *testEnv) assertGetClient(
 	ctx context.Context, targets endpoint.Slice, format string, args ...interface{},
 ) lb.Client {
-	clnt, err := env.pool.GetClient(ctx, targets, "grpc")
+	clnt, err := env.pool.GetClient(ctx, targets, "grpc", nil)
 	if err != nil {
 		env.t.Fatalf("BUG: GetClient(%s) failed: "+format,
 			append([]interface{}{targets}, args...)...)
@@ -336,7 +386,7 @@ func (env *testEnv) assertGetNoClient(
 	ctx context.Context, targets endpoint.Slice, format string,
 	args ...interface{}, //nolint:unparam
 ) {
-	clnt, err := env.pool.GetClient(ctx, targets, "grpc")
+	clnt, err := env.pool.GetClient(ctx, targets, "grpc", nil)
 	if err == nil {
 		env.t.Fatalf("BUG: GetClient(%s) unexpectedly succeeded with client ID %s: "+
 			format, append([]interface{}{targets, clnt.ID()}, args...)...)
@@ -412,7 +462,9 @@ func runSmoke(t *testing.T, st smokeTest) {
 		poolOpts = *st.poolOpts
 	}
 	env.pool = lb.NewClientPoolWithOptions(
-		func(ctx context.Context, targets endpoint.Slice, mgmtScheme string) (lb.Client, error) {
+		func(
+			ctx context.Context, targets endpoint.Slice, mgmtScheme string, _ *lb.TLSConfig,
+		) (lb.Client, error) {
 			return fakeClientDial(ctx, &env, targets, mgmtScheme, st.clientOpts)
 		},
 		poolOpts,
@@ -460,6 +512,7 @@ var smokeTests = []smokeTest{
 	{name: "GetGetSameClusterABAB", f: testGetGetSameClusterABAB, poolOpts: quickDecayCPO},
 	{name: "GetGetDiffClustersABBA", f: testGetGetDiffClustersABBA, poolOpts: quickDecayCPO},
 	{name: "GetGetDiffClustersABAC", f: testGetGetDiffClustersABAC, poolOpts: quickDecayCPO},
+	{name: "GetGetSameClusterDiffTLS", f: testGetGetSameClusterDiffTLS, poolOpts: quickDecayCPO},
 	{name: "GetExpireGet", f: testGetExpireGet, poolOpts: quickDecayCPO},
 	{name: "2ndMouse", f: test2ndMouse, poolOpts: nil, clientOpts: fakeClientOptions{
 		minDialDelayUsec: 200 * 1000,
@@ -633,6 +686,36 @@ func testGetGetDiffClustersABBA(env *testEnv) {
 	env.assertTotalClients(2)
 }
 
+func testGetGetSameClusterDiffTLS(env *testEnv) {
+	ctx, _ := mkCtx(10 * time.Second)
+	tlsA := &lb.TLSConfig{CA: []byte("ca-a")}
+	tlsB := &lb.TLSConfig{CA: []byte("ca-b")}
+	var clnts []lb.Client
+	for _, tlsCfg := range []*lb.TLSConfig{nil, tlsA, tlsB, {CA: []byte("ca-a")}} {
+		clnt, err := env.pool.GetClient(ctx, hostA, "grpcs", tlsCfg)
+		if err != nil {
+			env.t.Fatalf("BUG: GetClient(%s, TLS ID '%s') failed: %s",
+				hostA, tlsCfg.ID(), err)
+		}
+		clnts = append(clnts, clnt)
+	}
+	if clnts[0] == clnts[1] || clnts[0] == clnts[2] || clnts[1] == clnts[2] {
+		env.t.Fatalf("BUG: GetClient(%s) returned same client for diff TLS configs",
+			hostA)
+	}
+	if clnts[1] != clnts[3] {
+		env.t.Fatalf("BUG: GetClient(%s) returned diff clients for same TLS config",
+			hostA)
+	}
+	env.assertNumClients(3)
+	for _, clnt := range clnts {
+		env.pool.PutClient(clnt)
+	}
+	time.Sleep(10 * time.Millisecond)
+	env.assertNumClients(0)
+	env.assertTotalClients(3)
+}
+
 func testGetGetDiffClustersABAC(env *testEnv) {
 	ctx, _ := mkCtx(10 * time.Second)
 	tgtAB := concat(hostA, hostB)
@@ -694,7 +777,7 @@ func fuzzOne(
 		deadline := time.Now().Add(1 * time.Millisecond)
 		tmpCtx, cancel := context.WithDeadline(ctx, deadline)
 		defer cancel()
-		_, err := env.pool.GetClient(tmpCtx, targets, "grpc")
+		_, err := env.pool.GetClient(tmpCtx, targets, "grpc", nil)
 		if err == nil {
 			env.t.Errorf("BUG: GetClient(%s) unexpectedly succeeded", targets)
 			failed <- struct{}{}
@@ -709,7 +792,7 @@ func fuzzOne(
 		deadline := time.Now().Add(100 * time.Millisecond)
 		tmpCtx, cancel := context.WithDeadline(ctx, deadline)
 		defer cancel()
-		_, err := env.pool.GetClient(tmpCtx, targets, "grpc")
+		_, err := env.pool.GetClient(tmpCtx, targets, "grpc", nil)
 		if err == nil {
 			env.t.Errorf("BUG: GetClient(%s) unexpectedly succeeded", targets)
 			failed <- struct{}{}
@@ -723,7 +806,7 @@ func fuzzOne(
 	default:
 		tmpCtx, cancel := context.WithCancel(ctx)
 		defer cancel()
-		clnt, err := env.pool.GetClient(ctx, targets, "grpc")
+		clnt, err := env.pool.GetClient(ctx, targets, "grpc", nil)
 		if err != nil {
 			if tmpCtx.Err() == nil {
 				env.t.Errorf("BUG: GetClient(%s) failed: %s", targets, err)
@@ -785,7 +868,9 @@ func TestFuzz(t *testing.T) {
 		maxOpDelayUsec:   5000, // 5 msec
 	}
 	env.pool = lb.NewClientPoolWithOptions(
-		func(ctx context.Context, targets endpoint.Slice, mgmtScheme string) (lb.Client, error) {
+		func(
+			ctx context.Context, targets endpoint.Slice, mgmtScheme string, _ *lb.TLSConfig,
+		) (lb.Client, error) {
 			return fakeClientDial(ctx, &env, targets, mgmtScheme, clientOpts)
 		},
 		poolOpts,
@@ -8,6 +8,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,7 +17,9 @@ import (
 	guuid "github.com/google/uuid"
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_logrus "github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus"
+	grpcprom "github.com/grpc-ecosystem/go-grpc-middleware/providers/prometheus"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/backoff"
 	"google.golang.org/grpc/codes"
@@ -24,12 +27,12 @@ import (
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
-	"google.golang.org/grpc/resolver"
 	"google.golang.org/grpc/status"
 
 	"github.com/lightbitslabs/los-csi/pkg/grpcutil"
 	"github.com/lightbitslabs/los-csi/pkg/lb"
 	mgmt "github.com/lightbitslabs/los-csi/pkg/lb/management"
+	"github.com/lightbitslabs/los-csi/pkg/metrics"
 	"github.com/lightbitslabs/los-csi/pkg/util/endpoint"
 	"github.com/lightbitslabs/los-csi/pkg/util/strlist"
 	"github.com/lightbitslabs/los-csi/pkg/util/wait"
@@ -50,6 +53,19 @@ var (
 		"v2.0",
 	}
 
+	// latency of the individual LightOS API calls as seen by the plugin,
+	// including any reconnection to other targets along the way, but NOT
+	// including the higher-level retries (e.g. CreateRetryOpts below).
+	//
+	// these are the standard gRPC client metrics, i.e.
+	// `grpc_client_handled_total`, `grpc_client_handling_seconds`, etc.
+	apiCallMetrics = func() *grpcprom.ClientMetrics {
+		m := grpcprom.NewClientMetrics(grpcprom.WithClientHandlingTimeHistogram(
+			grpcprom.WithHistogramBuckets(metrics.DefBuckets)))
+		metrics.Registry.MustRegister(m)
+		return m
+	}()
+
 	CreateRetryOpts = wait.Backoff{
 		Delay:      250 * time.Millisecond,
 		Factor:     2.0,
@@ -71,118 +87,15 @@ var (
 		Retries:    15,
 	}
 
-	prng = rand.New(rand.NewSource(time.Now().UnixNano())) //nolint:gosec // not crypto
-)
-
-// LightOS cluster resolver: -------------------------------------------------
-
-// lbResolver is similar to gRPC manual.Resolver in that it's primed by a number
-// of LightOS cluster member addresses. the difference is that lbResolver tries
-// to rotate this list of addresses on failures. on the one hand, it keeps the
-// client talking mostly to the same mgmt API server avoiding consistency
-// issues, but on the other it avoids some of the pathological cases of
-// "pick_first" balancer (e.g. the fact that it never even TRIES anything other
-// than the "first" if that first was inaccessible on first dial - it just
-// burns the entire deadline budget on fruitless attempts to get through to the
-// first address and then fails DialContext() on 'i/o timeout'. i guess it's
-// just an unfortunate interplay between "pick_first" and default ClientConn
-// behaviour - grep for "We can potentially spend all the time trying the
-// first address" in addrConn.resetTransport()).
-//
-// later on this can also be extended quite trivially to update the resolver
-// with the latest LightOS cluster member list at runtime based on info fetched
-// straight from the horses mouth, to accommodate for added/removed nodes.
-//
-// oh, yeah, and lbResolver "is also a resolver builder". it's traditional, you
-// know...
-type lbResolver struct {
-	// scheme is not really a URL scheme, but rather a unique per-resolver
-	// (or, equivalently, per-LightOS cluster) thing, an artefact of how
-	// the dialling gRPC machinery be looking up the resolver later.
-	scheme string
-	log    *logrus.Entry
-
-	cc resolver.ClientConn
-
-	// mu protects all things EPs related. a bit heavy handed, but trivial
-	// and no contention is expected.
-	mu   sync.Mutex
-	eps  endpoint.Slice // LightOS node EPs in the order to be tried.
-	tgts string         // cached string repr of `eps`
-
-}
-
-func newLbResolver(log *logrus.Entry, scheme string, targets endpoint.Slice) *lbResolver {
-	log = log.WithField("lb-resolver", scheme)
-	r := &lbResolver{
-		scheme: scheme,
-		eps:    targets.Clone(),
-		log:    log,
-		tgts:   targets.String(),
-	}
-	log.WithFields(logrus.Fields{
-		"targets": r.tgts,
-	}).Info("initialising...")
-	return r
-}
-
-func (r *lbResolver) Scheme() string {
-	return r.scheme
-}
-
-// updateCCState() updates the underlying ClientConn with the currently
-// known list of LightOS cluster nodes.
-func (r *lbResolver) updateCCState() {
-	r.mu.Lock()
-	addrs := make([]resolver.Address, len(r.eps))
-	for i, ep := range r.eps {
-		addrs[i].Addr = ep.String()
+	RollbackRetryOpts = wait.Backoff{
+		Delay:      250 * time.Millisecond,
+		Factor:     1.5,
+		DelayLimit: 2 * time.Second,
+		Retries:    30,
 	}
-	r.mu.Unlock()
-	r.cc.NewAddress(addrs)
-}
 
-// Build() implements (together with Scheme()) the resolver.Builder interface
-// and is the way gRPC requests to create a resolver instance when its
-// pseudo-scheme is mentioned while dialling. in case of lbResolver, each
-// resolver is unique to a LightOS cluster. lbResolver "builds" itself.
-func (r *lbResolver) Build(
-	_ resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions,
-) (resolver.Resolver, error) {
-	r.cc = cc
-	r.log.WithFields(logrus.Fields{
-		"targets": r.tgts,
-	}).Info("building...")
-	r.updateCCState()
-	return r, nil
-}
-
-// ResolveNow() rotates the current list of LightOS cluster node addresses left
-// by one and returns it. since this method is typically called when gRPC has
-// connectivity problems to the first node in the slice, this achieves the
-// effect of making dialer to try to connect to the next node, while putting
-// the offending node at the end of the list of nodes to retry.
-//
-// in the future it could, potentially, be made to trigger querying of the
-// LightOS cluster it represents for the latest list of cluster members...
-func (r *lbResolver) ResolveNow(_ resolver.ResolveNowOptions) {
-	r.mu.Lock()
-	// not particularly efficient mem-wise, but this should be rare enough
-	// event for it not to matter...
-	if len(r.eps) > 1 {
-		r.eps = append(r.eps[1:], r.eps[0])
-	}
-	r.tgts = r.eps.String()
-	r.mu.Unlock()
-	r.log.WithFields(logrus.Fields{
-		"targets": r.tgts,
-	}).Info("resolving...")
-	r.updateCCState()
-}
-
-func (r *lbResolver) Close() {
-	r.log.Info("closing...")
-}
+	prng = rand.New(rand.NewSource(time.Now().UnixNano())) //nolint:gosec // not crypto
+)
 
 // LightOS gRPC client: ------------------------------------------------------
 
@@ -216,11 +129,24 @@ type Client struct {
 // can retry the operation.
 func Dial(
 	ctx context.Context, log *logrus.Entry, targets endpoint.Slice, mgmtScheme string,
+	tlsCfg *lb.TLSConfig,
 ) (*Client, error) {
 	if !targets.IsValid() {
 		return nil, status.Errorf(codes.InvalidArgument,
 			"invalid target endpoints specified: [%s]", targets)
 	}
+	var tlsConf *tls.Config
+	if mgmtScheme == "grpcs" {
+		if tlsCfg == nil {
+			tlsCfg = &lb.TLSConfig{}
+		}
+		var err error
+		tlsConf, err = tlsCfg.Build()
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"invalid LightOS API TLS settings: %s", err)
+		}
+	}
 	id := fmt.Sprintf("%07s", strconv.FormatUint(uint64(prng.Uint32()), 36))
 	log = log.WithField("clnt-id", id)
 
@@ -241,6 +167,7 @@ func Dial(
 		grpc_logrus.WithLevels(grpcutil.LBCodeToLogrusLevel),
 	}
 	interceptors := []grpc.UnaryClientInterceptor{
+		apiCallMetrics.UnaryClientInterceptor(),
 		mkUnaryClientInterceptor(res),
 		grpc_logrus.UnaryClientInterceptor(log, logrusOpts...),
 		grpc_logrus.PayloadUnaryClientInterceptor(log,
@@ -282,6 +209,7 @@ func Dial(
 		grpc.WithUserAgent("lb-csi-plugin"), // TODO: take from config (?) + add version!
 		grpc.WithDefaultCallOptions(grpc.WaitForReady(true)),
 		grpc.WithUnaryInterceptor(grpc_middleware.ChainUnaryClient(interceptors...)),
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
 		grpc.WithKeepaliveParams(kal),
 		grpc.WithConnectParams(cp),
 		grpc.WithResolvers(lbr),
@@ -291,12 +219,18 @@ func Dial(
 		logger.Infof("connecting insecurely")
 		opts = append(opts, grpc.WithInsecure())
 	} else if mgmtScheme == "grpcs" {
-		logger.Infof("connecting securely")
-		opts = append(opts, grpc.WithTransportCredentials(
-			// TODO: one of those days, we'll add the ability to specify
-			// certs to trust on a given deployment. until then:
-			//nolint:gosec
-			credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})))
+		logger := logger.WithFields(logrus.Fields{
+			"tls-id":          tlsCfg.ID(),
+			"tls-custom-ca":   len(tlsCfg.CA) > 0,
+			"tls-client-cert": len(tlsConf.Certificates) > 0,
+			"tls-server-name": tlsCfg.ServerName,
+		})
+		if tlsConf.InsecureSkipVerify {
+			logger.Warn("connecting securely, but NOT verifying server certs!")
+		} else {
+			logger.Info("connecting securely")
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConf)))
 	}
 
 	var err error
@@ -311,6 +245,15 @@ func Dial(
 	}
 
 	res.clnt = mgmt.NewDurosAPIClient(res.conn)
+	// GetClusterInfo() is served to unauthenticated clients as well, so
+	// there's no need to drag the JWT into the background refreshing:
+	lbr.start(func(ctx context.Context) ([]string, error) {
+		ci, err := res.clnt.GetClusterInfo(ctx, &mgmt.GetClusterRequest{})
+		if err != nil {
+			return nil, err
+		}
+		return ci.ApiEndpoints, nil
+	})
 
 	logger.Info("connected!")
 	return res, nil
@@ -427,6 +370,7 @@ func (c *Client) GetClusterInfo(ctx context.Context) (*lb.ClusterInfo, error) {
 		DiscoveryEndpoints: cluster.DiscoveryEndpoints,
 		ApiEndpoints:       cluster.ApiEndpoints,
 		NvmeEndpoints:      cluster.NvmeEndpoints,
+		InBandAuth:         cluster.InBandAuthMode == mgmt.ClusterInfo_Enabled,
 	}, nil
 }
 
@@ -570,6 +514,35 @@ func lbVolumeProtectionFromGRPC(c mgmt.ProtectionStateEnum) lb.VolumeProtection
 	return lb.VolumeProtection(c)
 }
 
+// lbLabelsToGRPC converts labels to LightOS API format, sorted by key mostly
+// for the sake of tracing/debugging aesthetics.
+func lbLabelsToGRPC(labels map[string]string) []*mgmt.Label {
+	if len(labels) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	res := make([]*mgmt.Label, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, &mgmt.Label{Key: k, Value: labels[k]})
+	}
+	return res
+}
+
+func lbLabelsFromGRPC(labels []*mgmt.Label) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	res := make(map[string]string, len(labels))
+	for _, l := range labels {
+		res[l.GetKey()] = l.GetValue()
+	}
+	return res
+}
+
 // lbVolumeFromGRPC does basic sanity checks on the volume returned by
 // LightOS and converts it to the API-agnostic lb.Volume.
 //
@@ -610,17 +583,9 @@ func (c *Client) lbVolumeFromGRPC(
 		mgmt.Volume_Deleting,
 		mgmt.Volume_Updating,
 		mgmt.Volume_Migrating,
+		mgmt.Volume_Rollback,
 		mgmt.Volume_Failed:
 		// the only valid states nowadays
-	case mgmt.Volume_Rollback:
-		// TODO: Better handle Rollback state
-		c.log.WithFields(logrus.Fields{
-			"vol-name": vol.Name,
-			"vol-uuid": vol.UUID,
-		}).Warnf("LB returned volume in unsupported state '%s' (%d)", vol.State, vol.State)
-		return nil, status.Errorf(codes.Internal,
-			"got bad volume from LB: '%s' has unexpected state '%s' (%d)",
-			vol.Name, vol.State, vol.State)
 	case mgmt.Volume_Deleted:
 		// TODO: remove this case once the LightOS API drops the
 		// deprecated volume states...
@@ -685,6 +650,17 @@ func (c *Client) lbVolumeFromGRPC(
 		}
 	}
 
+	// the CSI plugin only ever uses a single 'In' expression, anything
+	// fancier was set up by someone else, so just report the FDs as is.
+	var fds []string
+	for _, expr := range vol.PlacementRestrictions {
+		for _, kv := range expr.GetLabelValueKeyPairs() {
+			if kv.GetKey() == mgmt.LabelValueKeyPair_FD {
+				fds = append(fds, kv.GetValue())
+			}
+		}
+	}
+
 	return &lb.Volume{
 		Name:               vol.Name,
 		UUID:               volUUID,
@@ -693,12 +669,14 @@ func (c *Client) lbVolumeFromGRPC(
 		ReplicaCount:       vol.ReplicaCount,
 		ACL:                strlist.CopyUniqueSorted(vol.Acl.GetValues()),
 		Capacity:           vol.Size,
-		LogicalUsedStorage: vol.Statistics.LogicalUsedStorage,
+		LogicalUsedStorage: vol.Statistics.GetLogicalUsedStorage(),
 		Compression:        compress,
 		SnapshotUUID:       snapUUID,
 		ETag:               vol.ETag,
 		ProjectName:        vol.ProjectName,
 		QosPolicyName:      vol.QosPolicyName,
+		FailureDomains:     strlist.CopyUniqueSorted(fds),
+		Labels:             lbLabelsFromGRPC(vol.Labels),
 	}, nil
 }
 
@@ -718,7 +696,7 @@ func cloneCtxWithETag(ctx context.Context, eTag string) context.Context {
 func (c *Client) CreateVolume(
 	ctx context.Context, name string, capacity uint64, replicaCount uint32,
 	compress bool, acl []string, projectName string, snapshotID guuid.UUID, qosPolicyName string,
-	blocking bool,
+	failureDomains []string, labels map[string]string, blocking bool,
 ) (*lb.Volume, error) {
 	ctx, cancel := cloneCtxWithCap(ctx)
 	defer cancel()
@@ -744,6 +722,20 @@ func (c *Client) CreateVolume(
 		ReplicaCount: replicaCount,
 		ProjectName:  projectName,
 		QosPolicyID:  qosPolicyID,
+		Labels:       lbLabelsToGRPC(labels),
+	}
+	if len(failureDomains) > 0 {
+		fds := []*mgmt.LabelValueKeyPair{}
+		for _, fd := range strlist.CopyUniqueSorted(failureDomains) {
+			fds = append(fds, &mgmt.LabelValueKeyPair{
+				Key:   mgmt.LabelValueKeyPair_FD,
+				Value: fd,
+			})
+		}
+		req.PlacementRestrictions = []*mgmt.LabelMatchExpression{{
+			Operator:           mgmt.LabelMatchExpression_In,
+			LabelValueKeyPairs: fds,
+		}}
 	}
 	if snapshotID != guuid.Nil {
 		req.SourceSnapshotUUID = snapshotID.String()
@@ -996,6 +988,53 @@ func (c *Client) GetVolumeByName(
 	return c.getVolume(ctx, &name, nil, &projectName)
 }
 
+func (c *Client) ListVolumes(
+	ctx context.Context, projectName string, offset guuid.UUID, limit uint32,
+) ([]*lb.Volume, error) {
+	ctx, cancel := cloneCtxWithCap(ctx)
+	defer cancel()
+
+	if limit == 0 || limit > lb.MaxListLimit {
+		limit = lb.MaxListLimit
+	}
+	req := mgmt.ListVolumeRequest{
+		ProjectName: projectName,
+		Limit:       int64(limit),
+	}
+	if offset != guuid.Nil {
+		req.OffsetUUID = offset.String()
+	}
+	resp, err := c.clnt.ListVolumes(ctx, &req)
+	if err != nil {
+		return nil, err
+	}
+
+	vols := make([]*lb.Volume, 0, len(resp.Volumes))
+	errs := []string{}
+	for _, vol := range resp.Volumes {
+		lbVol, err := c.lbVolumeFromGRPC(vol, nil, nil)
+		if err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			vols = append(vols, lbVol)
+		}
+	}
+
+	numErrs := len(errs)
+	if numErrs > 0 {
+		return nil, status.Errorf(codes.Unknown,
+			"got %d invalid volume entries from LB out of %d: [ %s ]",
+			numErrs, len(vols)+numErrs, strings.Join(errs, "; "))
+	}
+	if len(vols) > int(limit) {
+		return nil, status.Errorf(codes.Internal,
+			"got %d volume entries from LB while asking for at most %d",
+			len(vols), limit)
+	}
+
+	return vols, nil
+}
+
 // doUpdateVolume() implements a single cycle of GetVolume() -> patch ->
 // UpdateVolume() on behalf of the callers that are expected to do this in a
 // loop, normally using wait.WithExponentialBackoff(). hence if it returns
@@ -1043,7 +1082,8 @@ func (c *Client) doUpdateVolume(
 	case lb.VolumeCreating:
 		log.Warn("trying to update volume that's still being created")
 		fallthrough
-	case lb.VolumeUpdating:
+	case lb.VolumeUpdating,
+		lb.VolumeRollback:
 		// retry locally or return DeadlineExceeded if ctx expired for
 		// the CO to [presumably] retry.
 		return nil, nil
@@ -1104,6 +1144,26 @@ func (c *Client) doUpdateVolume(
 		log = log.WithField("capacity-src", fmt.Sprintf("%d", lbVol.Capacity))
 		log = log.WithField("capacity-tgt", fmt.Sprintf("%d", update.Capacity))
 	}
+	if update.QosPolicyName != "" {
+		required = true
+		req.QosPolicyID = &mgmt.UpdateVolumeRequest_QosPolicyName{
+			QosPolicyName: update.QosPolicyName,
+		}
+		log = log.WithField("qos-src", lbVol.QosPolicyName)
+		log = log.WithField("qos-tgt", update.QosPolicyName)
+	}
+	if update.Compression != nil {
+		required = true
+		req.Compression = strconv.FormatBool(*update.Compression)
+		log = log.WithField("compression-src", lbVol.Compression)
+		log = log.WithField("compression-tgt", *update.Compression)
+	}
+	if len(update.Labels) > 0 {
+		required = true
+		req.Labels = lbLabelsToGRPC(update.Labels)
+		log = log.WithField("labels-src", fmt.Sprintf("%v", lbVol.Labels))
+		log = log.WithField("labels-tgt", fmt.Sprintf("%v", update.Labels))
+	}
 	if !required {
 		// bug, code not updated to match some newly added lb.VolumeUpdate
 		// field, or the caller goofed and passed an empty request.
@@ -1133,6 +1193,13 @@ func (c *Client) doUpdateVolume(
 			return nil, nil
 		case codes.InvalidArgument:
 			log.Errorf("volume update refused by LB on bad arg: %s", st.Message())
+			if update.QosPolicyName != "" || len(update.Labels) > 0 {
+				// these originate with the user rather than being
+				// computed by the plugin, so it's likely their fault,
+				// e.g. a non-existent QoS policy.
+				return nil, status.Errorf(codes.InvalidArgument,
+					"failed to update volume %s on LB: %s", uuid, st.Message())
+			}
 			return nil, status.Errorf(codes.Internal,
 				"failed to update volume %s on LB: %s", uuid, st.Message())
 		case codes.FailedPrecondition:
@@ -1182,6 +1249,79 @@ func (c *Client) UpdateVolume(
 	return lbVol, nil
 }
 
+func (c *Client) RollbackVolume(
+	ctx context.Context, uuid guuid.UUID, projectName string, snapUUID guuid.UUID,
+) (*lb.Volume, error) {
+	log := c.log.WithFields(logrus.Fields{
+		"vol-uuid":  uuid,
+		"snap-uuid": snapUUID,
+	})
+
+	err := func() error {
+		ctx, cancel := cloneCtxWithCap(ctx)
+		defer cancel()
+		// currently RollbackVolume() response is empty...
+		_, err := c.clnt.RollbackVolume(
+			ctx,
+			&mgmt.RollbackVolumeRequest{
+				UUID:            uuid.String(),
+				SrcSnapshotUUID: snapUUID.String(),
+				ProjectName:     projectName,
+			},
+		)
+		return err
+	}()
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("volume rollback accepted by LB")
+
+	// TODO: this relies on LB switching the volume to 'Rollback' state
+	// before replying to RollbackVolume(), which seems to be the case, but
+	// is not formally documented anywhere. if it ever turns out otherwise,
+	// the volume ETag could be used to detect the rollback completion.
+	var lbVol *lb.Volume
+	err = wait.WithExponentialBackoff(RollbackRetryOpts, func() (bool, error) {
+		if err := ctx.Err(); err != nil {
+			return false, grpcutil.ErrFromCtxErr(err)
+		}
+
+		var err error
+		lbVol, err = c.GetVolume(ctx, uuid, projectName)
+		if err != nil {
+			if status.Code(err) == codes.Unavailable {
+				return false, nil
+			}
+			return false, err
+		}
+
+		switch lbVol.State {
+		case lb.VolumeRollback:
+			// play it again, Sam...
+			return false, nil
+		case lb.VolumeAvailable,
+			lb.VolumeMigrating,
+			lb.VolumeUpdating:
+			return true, nil
+		case lb.VolumeDeleting:
+			return false, status.Errorf(codes.NotFound,
+				"volume '%s' was deleted during rollback", lbVol.Name)
+		case lb.VolumeFailed:
+			return false, status.Errorf(codes.Internal,
+				"LB failed to roll back volume '%s'", lbVol.Name)
+		default:
+			return false, status.Errorf(codes.Internal,
+				"volume '%s' entered unexpected state while waiting for it to be "+
+					"rolled back: %s (%d)", lbVol.Name, lbVol.State, lbVol.State)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("volume rollback complete")
+	return lbVol, nil
+}
+
 func (c *Client) getSnapshot(
 	ctx context.Context, name *string, uuid *guuid.UUID, projectName string,
 ) (*lb.Snapshot, error) {
@@ -1218,6 +1358,123 @@ func (c *Client) GetSnapshotByName(
 	return c.getSnapshot(ctx, &name, nil, projectName)
 }
 
+func (c *Client) ListSnapshots(
+	ctx context.Context, projectName string, offset guuid.UUID, limit uint32,
+) ([]*lb.Snapshot, error) {
+	ctx, cancel := cloneCtxWithCap(ctx)
+	defer cancel()
+
+	if limit == 0 || limit > lb.MaxListLimit {
+		limit = lb.MaxListLimit
+	}
+	req := mgmt.ListSnapshotsRequest{
+		ProjectName: projectName,
+		Limit:       int64(limit),
+	}
+	if offset != guuid.Nil {
+		req.OffsetUUID = offset.String()
+	}
+	resp, err := c.clnt.ListSnapshots(ctx, &req)
+	if err != nil {
+		return nil, err
+	}
+
+	snaps := make([]*lb.Snapshot, 0, len(resp.Snapshots))
+	errs := []string{}
+	for _, snap := range resp.Snapshots {
+		lbSnap, err := c.lbSnapshotFromGRPC(snap, nil, nil)
+		if err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			snaps = append(snaps, lbSnap)
+		}
+	}
+
+	numErrs := len(errs)
+	if numErrs > 0 {
+		return nil, status.Errorf(codes.Unknown,
+			"got %d invalid snapshot entries from LB out of %d: [ %s ]",
+			numErrs, len(snaps)+numErrs, strings.Join(errs, "; "))
+	}
+	if len(snaps) > int(limit) {
+		return nil, status.Errorf(codes.Internal,
+			"got %d snapshot entries from LB while asking for at most %d",
+			len(snaps), limit)
+	}
+
+	return snaps, nil
+}
+
+// listChangedBlocksPage() fetches a single page of changed LBA ranges
+// from the LB, returning the LBA to continue from (0 if there are no more).
+func (c *Client) listChangedBlocksPage(
+	ctx context.Context, req *mgmt.ListChangedBlocksRequest, fn lb.ChangedBlocksFunc,
+) (uint64, error) {
+	ctx, cancel := cloneCtxWithCap(ctx)
+	defer cancel()
+
+	resp, err := c.clnt.ListChangedBlocks(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+	if resp.NextOffsetLBA != 0 && resp.NextOffsetLBA <= req.OffsetLBA {
+		// would loop forever otherwise...
+		return 0, status.Errorf(codes.Internal,
+			"got bad changed blocks list of snapshot %s from LB: next offset "+
+				"LBA %d doesn't advance past %d",
+			req.SnapshotUUID, resp.NextOffsetLBA, req.OffsetLBA)
+	}
+	for _, r := range resp.LbaRanges {
+		if r == nil {
+			continue
+		}
+		if r.LbaEnd < r.LbaStart {
+			return 0, status.Errorf(codes.Internal,
+				"got bad changed blocks list of snapshot %s from LB: invalid "+
+					"LBA range [%d, %d)", req.SnapshotUUID, r.LbaStart, r.LbaEnd)
+		}
+		err = fn(&lb.LBARange{
+			Start:  r.LbaStart,
+			End:    r.LbaEnd,
+			Bitmap: r.DataBitMap,
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return resp.NextOffsetLBA, nil
+}
+
+func (c *Client) ListChangedBlocks(
+	ctx context.Context, snapUUID, baseSnapUUID guuid.UUID, projectName string,
+	offsetLBA uint64, fn lb.ChangedBlocksFunc,
+) error {
+	req := mgmt.ListChangedBlocksRequest{
+		SnapshotUUID: snapUUID.String(),
+		ProjectName:  projectName,
+		OffsetLBA:    offsetLBA,
+	}
+	if baseSnapUUID != guuid.Nil {
+		req.BaseSnapshotUUID = baseSnapUUID.String()
+	}
+
+	// the whole thing might take a while on large volumes, so the timeout
+	// cap applies to each page separately, rather than to the whole list:
+	for {
+		if err := ctx.Err(); err != nil {
+			return grpcutil.ErrFromCtxErr(err)
+		}
+		next, err := c.listChangedBlocksPage(ctx, &req, fn)
+		if err != nil {
+			return err
+		}
+		if next == 0 {
+			return nil
+		}
+		req.OffsetLBA = next
+	}
+}
+
 func statusFromErr(
 	log *logrus.Entry, err error, format string, args ...interface{},
 ) error {
@@ -1508,7 +1765,97 @@ func (c *Client) lbSnapshotFromGRPC(
 		SrcVolCompression:  snap.Compression,
 		CreationTime:       btime,
 		State:              lbSnapshotStateFromGRPC(snap.State),
+		SectorSize:         snap.SectorSize,
 		ETag:               snap.ETag,
 		ProjectName:        snap.ProjectName,
+		Labels:             lbLabelsFromGRPC(snap.Labels),
+	}, nil
+}
+
+func lbTrustedHostFromGRPC(th *mgmt.TrustedHost, name string) (*lb.TrustedHost, error) {
+	if th == nil {
+		return nil, status.Errorf(codes.Internal,
+			"got <nil> trusted host from LB with no error")
+	}
+	if th.Name != name {
+		return nil, status.Errorf(codes.Internal,
+			"got wrong trusted host from LB: '%s' instead of '%s'", th.Name, name)
+	}
+	return &lb.TrustedHost{
+		Name:        th.Name,
+		ProjectName: th.ProjectName,
+		HostNQN:     th.HostNqn,
 	}, nil
 }
+
+func (c *Client) GetTrustedHost(
+	ctx context.Context, name string, projectName string,
+) (*lb.TrustedHost, error) {
+	ctx, cancel := cloneCtxWithCap(ctx)
+	defer cancel()
+
+	th, err := c.clnt.GetTrustedHost(ctx, &mgmt.GetTrustedHostRequest{
+		Name:        name,
+		ProjectName: projectName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lbTrustedHostFromGRPC(th, name)
+}
+
+func (c *Client) CreateTrustedHost(
+	ctx context.Context, name string, projectName string, hostNQN string,
+) (*lb.TrustedHost, error) {
+	ctx, cancel := cloneCtxWithCap(ctx)
+	defer cancel()
+
+	th, err := c.clnt.CreateTrustedHost(ctx, &mgmt.CreateTrustedHostRequest{
+		Name:        name,
+		ProjectName: projectName,
+		HostNqn:     hostNQN,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lbTrustedHostFromGRPC(th, name)
+}
+
+func (c *Client) GetTrustedHostSecrets(
+	ctx context.Context, name string, projectName string,
+) (*lb.TrustedHostSecrets, error) {
+	ctx, cancel := cloneCtxWithCap(ctx)
+	defer cancel()
+
+	resp, err := c.clnt.GetTrustedHostSecret(ctx, &mgmt.GetTrustedHostSecretsRequest{
+		Name:        name,
+		ProjectName: projectName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &lb.TrustedHostSecrets{
+		Host: resp.HostSecret,
+		Ctrl: resp.TargetSecret,
+	}, nil
+}
+
+func (c *Client) SetTrustedHostSecrets(
+	ctx context.Context, name string, projectName string, secrets *lb.TrustedHostSecrets,
+) error {
+	ctx, cancel := cloneCtxWithCap(ctx)
+	defer cancel()
+
+	req := mgmt.SetTrustedHostSecretsRequest{
+		Name:             name,
+		ProjectName:      projectName,
+		HostSecret:       secrets.Host,
+		TargetSecretType: mgmt.TargetSecretType_Disabled,
+	}
+	if secrets.Ctrl != "" {
+		req.TargetSecret = secrets.Ctrl
+		req.TargetSecretType = mgmt.TargetSecretType_Enabled
+	}
+	_, err := c.clnt.SetTrustedHostSecret(ctx, &req)
+	return err
+}
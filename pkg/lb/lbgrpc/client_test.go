@@ -257,7 +257,7 @@ func getCtx() context.Context {
 }
 
 func mkClient(t *testing.T) *lbgrpc.Client {
-	clnt, err := lbgrpc.Dial(getCtx(), log.WithField("test", t.Name()), targets, "grpcs")
+	clnt, err := lbgrpc.Dial(getCtx(), log.WithField("test", t.Name()), targets, "grpcs", nil)
 	if err != nil {
 		t.Fatalf("BUG: Dial(%s) failed: '%s'", targets, err)
 	}
@@ -387,7 +387,7 @@ func TestBadDial(t *testing.T) {
 	for _, tc := range tcs {
 		t.Run(tc.String(), func(t *testing.T) {
 			ctx := getCtxWithJwt(3 * time.Second)
-			clnt, err := lbgrpc.Dial(ctx, log.WithField("test", t.Name()), tc, "grpcs")
+			clnt, err := lbgrpc.Dial(ctx, log.WithField("test", t.Name()), tc, "grpcs", nil)
 			if err == nil || clnt != nil {
 				t.Fatalf("BUG: Dial(%s) succeeded on bogus target", tc)
 			} else {
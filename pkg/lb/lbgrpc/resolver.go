@@ -0,0 +1,295 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package lbgrpc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/lightbitslabs/los-csi/pkg/metrics"
+	"github.com/lightbitslabs/los-csi/pkg/util/endpoint"
+)
+
+const (
+	// how often lbResolver refreshes the list of LightOS cluster members
+	// from the cluster itself.
+	defaultRefreshInterval = 5 * time.Minute
+	// min time between refreshes triggered by failovers, to spare the
+	// cluster (and the logs) during prolonged outages, when gRPC can be
+	// calling ResolveNow() in a tight-ish loop.
+	defaultMinRefreshGap = 10 * time.Second
+	refreshTimeout       = 10 * time.Second
+)
+
+var resolverRefreshes = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_csi_lb_resolver_refreshes_total",
+	Help: "Number of LightOS cluster member list refreshes, by result: " +
+		"updated, unchanged or failed.",
+}, []string{"result"})
+
+// membersFunc fetches the list of the mgmt API endpoints (<host>:<port>) of
+// all the current LightOS cluster members from the cluster.
+type membersFunc func(ctx context.Context) ([]string, error)
+
+// LightOS cluster resolver: -------------------------------------------------
+
+// lbResolver is similar to gRPC manual.Resolver in that it's primed by a number
+// of LightOS cluster member addresses. the difference is that lbResolver tries
+// to rotate this list of addresses on failures. on the one hand, it keeps the
+// client talking mostly to the same mgmt API server avoiding consistency
+// issues, but on the other it avoids some of the pathological cases of
+// "pick_first" balancer (e.g. the fact that it never even TRIES anything other
+// than the "first" if that first was inaccessible on first dial - it just
+// burns the entire deadline budget on fruitless attempts to get through to the
+// first address and then fails DialContext() on 'i/o timeout'. i guess it's
+// just an unfortunate interplay between "pick_first" and default ClientConn
+// behaviour - grep for "We can potentially spend all the time trying the
+// first address" in addrConn.resetTransport()).
+//
+// the initial list of addresses (typically, the mgmt endpoints baked into the
+// volume ID at creation time) is only the seed: once connected, lbResolver
+// periodically refreshes the list straight from the horses mouth, as well as
+// shortly after failovers, to accommodate for added/removed/replaced nodes.
+// otherwise, the long-lived volumes would eventually end up pointing at mgmt
+// endpoints that are long gone. see start() and refresh(). the seed addresses
+// are never dropped though: the cluster may well report addresses that are
+// unreachable from here (internal ones, the other IP family, etc.), while the
+// seeds may be hostnames or VIPs that the cluster knows nothing about.
+//
+// oh, yeah, and lbResolver "is also a resolver builder". it's traditional, you
+// know...
+type lbResolver struct {
+	// scheme is not really a URL scheme, but rather a unique per-resolver
+	// (or, equivalently, per-LightOS cluster) thing, an artefact of how
+	// the dialling gRPC machinery be looking up the resolver later.
+	scheme string
+	log    *logrus.Entry
+
+	cc resolver.ClientConn
+
+	// mu protects all things EPs related. a bit heavy handed, but trivial
+	// and no contention is expected.
+	mu          sync.Mutex
+	eps         endpoint.Slice // LightOS node EPs in the order to be tried.
+	seeds       endpoint.Slice // initial EPs, immutable.
+	tgts        string         // cached string repr of `eps`
+	lastRefresh time.Time      // last refresh attempt, successful or not.
+
+	// cluster member refreshing, see start(). set up before start() and
+	// immutable afterwards.
+	fetch           membersFunc
+	refreshInterval time.Duration
+	minRefreshGap   time.Duration
+	kick            chan struct{} // request an out-of-band refresh.
+	done            chan struct{}
+	closeOnce       sync.Once
+}
+
+func newLbResolver(log *logrus.Entry, scheme string, targets endpoint.Slice) *lbResolver {
+	log = log.WithField("lb-resolver", scheme)
+	r := &lbResolver{
+		scheme:          scheme,
+		eps:             targets.Clone(),
+		seeds:           targets.Clone(),
+		log:             log,
+		tgts:            targets.String(),
+		refreshInterval: defaultRefreshInterval,
+		minRefreshGap:   defaultMinRefreshGap,
+		kick:            make(chan struct{}, 1),
+		done:            make(chan struct{}),
+	}
+	log.WithFields(logrus.Fields{
+		"targets": r.tgts,
+	}).Info("initialising...")
+	return r
+}
+
+func (r *lbResolver) Scheme() string {
+	return r.scheme
+}
+
+// updateCCState() updates the underlying ClientConn with the currently
+// known list of LightOS cluster nodes.
+func (r *lbResolver) updateCCState() {
+	r.mu.Lock()
+	addrs := make([]resolver.Address, len(r.eps))
+	for i, ep := range r.eps {
+		addrs[i].Addr = ep.String()
+		// verify the server certs against the name of the specific node
+		// we're connecting to, rather than the bogus "lb-resolver" target:
+		addrs[i].ServerName = ep.Host()
+	}
+	r.mu.Unlock()
+	r.cc.NewAddress(addrs)
+}
+
+// Build() implements (together with Scheme()) the resolver.Builder interface
+// and is the way gRPC requests to create a resolver instance when its
+// pseudo-scheme is mentioned while dialling. in case of lbResolver, each
+// resolver is unique to a LightOS cluster. lbResolver "builds" itself.
+func (r *lbResolver) Build(
+	_ resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions,
+) (resolver.Resolver, error) {
+	r.cc = cc
+	r.log.WithFields(logrus.Fields{
+		"targets": r.tgts,
+	}).Info("building...")
+	r.updateCCState()
+	return r, nil
+}
+
+// ResolveNow() rotates the current list of LightOS cluster node addresses left
+// by one and returns it. since this method is typically called when gRPC has
+// connectivity problems to the first node in the slice, this achieves the
+// effect of making dialer to try to connect to the next node, while putting
+// the offending node at the end of the list of nodes to retry.
+//
+// it also triggers a refresh of the cluster member list in the background,
+// as the failover might well be due to the cluster membership changes.
+func (r *lbResolver) ResolveNow(_ resolver.ResolveNowOptions) {
+	r.mu.Lock()
+	// not particularly efficient mem-wise, but this should be rare enough
+	// event for it not to matter...
+	if len(r.eps) > 1 {
+		r.eps = append(r.eps[1:], r.eps[0])
+	}
+	r.tgts = r.eps.String()
+	r.mu.Unlock()
+	r.log.WithFields(logrus.Fields{
+		"targets": r.tgts,
+	}).Info("resolving...")
+	r.updateCCState()
+
+	select {
+	case r.kick <- struct{}{}:
+	default: // one's already pending, good enough.
+	}
+}
+
+func (r *lbResolver) Close() {
+	r.log.Info("closing...")
+	r.closeOnce.Do(func() { close(r.done) })
+}
+
+// start() kicks off the background refreshing of the cluster member list
+// using `fetch`. must be called at most once, once the resolver was built.
+func (r *lbResolver) start(fetch membersFunc) {
+	r.fetch = fetch
+	go r.run()
+}
+
+func (r *lbResolver) run() {
+	ticker := time.NewTicker(r.refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.kick:
+			r.mu.Lock()
+			tooSoon := time.Since(r.lastRefresh) < r.minRefreshGap
+			r.mu.Unlock()
+			if tooSoon {
+				continue
+			}
+		case <-r.done:
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+		r.refresh(ctx) //nolint:errcheck // logged, and we'll try again later.
+		cancel()
+	}
+}
+
+// refresh() fetches the current list of cluster members and, if it differs
+// from the one the resolver has, updates the resolver and the ClientConn.
+// the failures are logged and otherwise ignored, the resolver just sticks to
+// the list it has.
+func (r *lbResolver) refresh(ctx context.Context) error {
+	r.mu.Lock()
+	r.lastRefresh = time.Now()
+	r.mu.Unlock()
+
+	apiEPs, err := r.fetch(ctx)
+	var fresh endpoint.Slice
+	if err == nil {
+		fresh, err = endpoint.ParseSlice(apiEPs)
+		if err == nil && len(fresh) == 0 {
+			err = fmt.Errorf("cluster reported no mgmt API endpoints")
+		}
+	}
+	if err != nil {
+		resolverRefreshes.WithLabelValues("failed").Inc()
+		r.log.WithError(err).Warn("failed to refresh cluster members")
+		return err
+	}
+
+	r.mu.Lock()
+	merged, added, removed := mergeEPs(r.eps, fresh, r.seeds)
+	if len(added) == 0 && len(removed) == 0 {
+		r.mu.Unlock()
+		resolverRefreshes.WithLabelValues("unchanged").Inc()
+		r.log.WithField("targets", r.tgts).Debug("cluster members unchanged")
+		return nil
+	}
+	r.eps = merged
+	r.tgts = merged.String()
+	r.mu.Unlock()
+
+	resolverRefreshes.WithLabelValues("updated").Inc()
+	r.log.WithFields(logrus.Fields{
+		"targets": merged.String(),
+		"added":   added.String(),
+		"removed": removed.String(),
+	}).Info("cluster members changed")
+	r.updateCCState()
+	return nil
+}
+
+// mergeEPs() returns the new list of EPs to try, given the current list `curr`,
+// the `fresh` list of cluster members and the resolver `seeds`: the EPs in
+// `curr` that are still members retain their order (so that the client keeps
+// talking to the same server if it's still around), followed by the new
+// members, followed by the seeds that are not members, which are always
+// kept as the last resort. the EPs that were added and removed compared to
+// `curr` are returned too.
+func mergeEPs(curr, fresh, seeds endpoint.Slice) (merged, added, removed endpoint.Slice) {
+	isFresh := make(map[endpoint.EP]bool, len(fresh))
+	for _, ep := range fresh {
+		isFresh[ep] = true
+	}
+	isSeed := make(map[endpoint.EP]bool, len(seeds))
+	for _, ep := range seeds {
+		isSeed[ep] = true
+	}
+	isCurr := make(map[endpoint.EP]bool, len(curr))
+	for _, ep := range curr {
+		isCurr[ep] = true
+		if isFresh[ep] {
+			merged = append(merged, ep)
+		} else if !isSeed[ep] {
+			removed = append(removed, ep)
+		}
+	}
+	for _, ep := range fresh {
+		if !isCurr[ep] {
+			merged = append(merged, ep)
+			added = append(added, ep)
+		}
+	}
+	for _, ep := range seeds {
+		if !isFresh[ep] {
+			merged = append(merged, ep)
+			if !isCurr[ep] {
+				added = append(added, ep)
+			}
+		}
+	}
+	return merged, added, removed
+}
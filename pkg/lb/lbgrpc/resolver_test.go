@@ -0,0 +1,243 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package lbgrpc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/lightbitslabs/los-csi/pkg/util/endpoint"
+)
+
+// fakeClientConn records the address lists lbResolver pushes to gRPC.
+type fakeClientConn struct {
+	resolver.ClientConn // not implemented, will panic if used.
+
+	mu      sync.Mutex
+	updates [][]string
+}
+
+func (cc *fakeClientConn) NewAddress(addrs []resolver.Address) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	res := make([]string, len(addrs))
+	for i, addr := range addrs {
+		res[i] = addr.Addr
+	}
+	cc.updates = append(cc.updates, res)
+}
+
+func (cc *fakeClientConn) numUpdates() int {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return len(cc.updates)
+}
+
+func (cc *fakeClientConn) last() []string {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.updates[len(cc.updates)-1]
+}
+
+// fakeMembers serves canned cluster member lists to lbResolver.
+type fakeMembers struct {
+	mu    sync.Mutex
+	eps   []string
+	err   error
+	calls chan struct{}
+}
+
+func (m *fakeMembers) fetch(context.Context) ([]string, error) {
+	m.mu.Lock()
+	eps, err := m.eps, m.err
+	m.mu.Unlock()
+	select {
+	case m.calls <- struct{}{}:
+	default:
+	}
+	return eps, err
+}
+
+func (m *fakeMembers) set(eps []string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.eps, m.err = eps, err
+}
+
+func mkTestResolver(t *testing.T, seeds string) (*lbResolver, *fakeClientConn, *fakeMembers) {
+	log := logrus.New().WithField("test", t.Name())
+	r := newLbResolver(log, "lightos-test", endpoint.MustParseCSV(seeds))
+	cc := &fakeClientConn{}
+	_, err := r.Build(resolver.Target{}, cc, resolver.BuildOptions{})
+	require.NoError(t, err)
+	m := &fakeMembers{calls: make(chan struct{}, 16)}
+	r.fetch = m.fetch
+	t.Cleanup(r.Close)
+	return r, cc, m
+}
+
+func TestMergeEPs(t *testing.T) {
+	testCases := []struct {
+		name    string
+		curr    string
+		fresh   string
+		seeds   string
+		merged  string
+		added   string
+		removed string
+	}{
+		{"same", "10.0.0.2:443,10.0.0.1:443", "10.0.0.1:443,10.0.0.2:443", "",
+			"10.0.0.2:443,10.0.0.1:443", "", ""},
+		{"added", "10.0.0.2:443,10.0.0.1:443", "10.0.0.1:443,10.0.0.2:443,10.0.0.3:443", "",
+			"10.0.0.2:443,10.0.0.1:443,10.0.0.3:443", "10.0.0.3:443", ""},
+		{"removed", "10.0.0.2:443,10.0.0.1:443", "10.0.0.1:443", "",
+			"10.0.0.1:443", "", "10.0.0.2:443"},
+		{"replaced", "10.0.0.1:443,10.0.0.2:443", "10.0.0.2:443,10.0.0.4:443", "",
+			"10.0.0.2:443,10.0.0.4:443", "10.0.0.4:443", "10.0.0.1:443"},
+		{"port change", "10.0.0.1:443", "10.0.0.1:444", "",
+			"10.0.0.1:444", "10.0.0.1:444", "10.0.0.1:443"},
+		{"seeds are members", "10.0.0.1:443", "10.0.0.1:443,10.0.0.2:443", "10.0.0.1:443",
+			"10.0.0.1:443,10.0.0.2:443", "10.0.0.2:443", ""},
+		{"seeds kept", "10.0.0.1:443,10.0.0.2:443", "10.0.0.2:443,10.0.0.3:443",
+			"10.0.0.1:443", "10.0.0.2:443,10.0.0.3:443,10.0.0.1:443", "10.0.0.3:443", ""},
+		{"no overlap with seeds", "lb.example.com:443,[2001:db8::1]:443",
+			"192.168.0.1:443,192.168.0.2:443", "lb.example.com:443,[2001:db8::1]:443",
+			"192.168.0.1:443,192.168.0.2:443,lb.example.com:443,[2001:db8::1]:443",
+			"192.168.0.1:443,192.168.0.2:443", ""},
+		{"seeds restored", "192.168.0.1:443", "192.168.0.1:443", "lb.example.com:443",
+			"192.168.0.1:443,lb.example.com:443", "lb.example.com:443", ""},
+	}
+	parse := func(s string) endpoint.Slice {
+		// preserve the order, unlike endpoint.ParseCSV():
+		var res endpoint.Slice
+		for _, ep := range strings.FieldsFunc(s, func(c rune) bool { return c == ',' }) {
+			res = append(res, endpoint.MustParse(ep))
+		}
+		return res
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			merged, added, removed := mergeEPs(parse(tc.curr), parse(tc.fresh),
+				parse(tc.seeds))
+			require.Equal(t, tc.merged, merged.String())
+			require.Equal(t, tc.added, added.String())
+			require.Equal(t, tc.removed, removed.String())
+		})
+	}
+}
+
+func TestResolverRefresh(t *testing.T) {
+	r, cc, m := mkTestResolver(t, "10.0.0.1:443,10.0.0.2:443")
+	require.Equal(t, []string{"10.0.0.1:443", "10.0.0.2:443"}, cc.last())
+	ctx := context.Background()
+
+	// node #1 replaced by #3, stick to #2 while at it, keep the #1 seed
+	// as the last resort:
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	require.Equal(t, []string{"10.0.0.2:443", "10.0.0.1:443"}, cc.last())
+	updated := testutil.ToFloat64(resolverRefreshes.WithLabelValues("updated"))
+	m.set([]string{"10.0.0.3:443", "10.0.0.2:443"}, nil)
+	require.NoError(t, r.refresh(ctx))
+	require.Equal(t, []string{"10.0.0.2:443", "10.0.0.3:443", "10.0.0.1:443"}, cc.last())
+	require.Equal(t, updated+1, testutil.ToFloat64(resolverRefreshes.WithLabelValues("updated")))
+
+	// nothing new - no updates to gRPC:
+	n := cc.numUpdates()
+	unchanged := testutil.ToFloat64(resolverRefreshes.WithLabelValues("unchanged"))
+	require.NoError(t, r.refresh(ctx))
+	require.Equal(t, n, cc.numUpdates())
+	require.Equal(t, unchanged+1, testutil.ToFloat64(resolverRefreshes.WithLabelValues("unchanged")))
+
+	// failures and garbage - stick to what we have:
+	failed := testutil.ToFloat64(resolverRefreshes.WithLabelValues("failed"))
+	for _, tc := range []struct {
+		eps []string
+		err error
+	}{
+		{nil, errors.New("boom")},
+		{nil, nil},
+		{[]string{"10.0.0.4"}, nil},
+	} {
+		m.set(tc.eps, tc.err)
+		require.Error(t, r.refresh(ctx))
+	}
+	require.Equal(t, n, cc.numUpdates())
+	require.Equal(t, failed+3, testutil.ToFloat64(resolverRefreshes.WithLabelValues("failed")))
+	require.Equal(t, "10.0.0.2:443,10.0.0.3:443,10.0.0.1:443", r.tgts)
+}
+
+func TestResolverRefreshKeepsSeeds(t *testing.T) {
+	r, cc, m := mkTestResolver(t, "lb.example.com:443,[2001:db8::1]:443")
+	ctx := context.Background()
+
+	// the cluster only reports its internal IPv4 addresses:
+	m.set([]string{"192.168.0.1:443", "192.168.0.2:443"}, nil)
+	require.NoError(t, r.refresh(ctx))
+	require.Equal(t, []string{"192.168.0.1:443", "192.168.0.2:443",
+		"[2001:db8::1]:443", "lb.example.com:443"}, cc.last())
+
+	// ...and keeps replacing them:
+	m.set([]string{"192.168.0.3:443"}, nil)
+	require.NoError(t, r.refresh(ctx))
+	require.Equal(t, []string{"192.168.0.3:443",
+		"[2001:db8::1]:443", "lb.example.com:443"}, cc.last())
+}
+
+func TestResolverRefreshLoop(t *testing.T) {
+	r, cc, m := mkTestResolver(t, "10.0.0.1:443")
+	m.set([]string{"10.0.0.1:443", "10.0.0.2:443"}, nil)
+	r.refreshInterval = time.Hour
+	r.minRefreshGap = time.Hour
+	r.start(m.fetch)
+
+	waitFetch := func() {
+		select {
+		case <-m.calls:
+		case <-time.After(5 * time.Second):
+			t.Fatal("cluster members were not refreshed")
+		}
+	}
+	noFetch := func() {
+		select {
+		case <-m.calls:
+			t.Fatal("cluster members refreshed unexpectedly")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// failover triggers a refresh...
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	waitFetch()
+	require.Eventually(t, func() bool {
+		return len(cc.last()) == 2
+	}, 5*time.Second, time.Millisecond)
+	// ...but not too often:
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	noFetch()
+
+	// periodic refreshes:
+	r.Close()
+	r, _, m = mkTestResolver(t, "10.0.0.1:443")
+	r.refreshInterval = 10 * time.Millisecond
+	r.start(m.fetch)
+	waitFetch()
+	waitFetch()
+
+	// no refreshes once closed:
+	r.Close()
+	time.Sleep(20 * time.Millisecond)
+	for len(m.calls) > 0 {
+		<-m.calls
+	}
+	noFetch()
+}
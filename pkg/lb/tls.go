@@ -0,0 +1,79 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package lb
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+)
+
+// TLSConfig describes how LB clients using the "grpcs" scheme authenticate the
+// LightOS mgmt API servers and, optionally, themselves to the servers (mTLS).
+// all the certs and keys are PEM-encoded.
+type TLSConfig struct {
+	// CA is the bundle of CA certs to verify the server certs against. if
+	// empty - the system roots are used.
+	CA []byte
+	// Cert and Key are the client cert and its private key, for mTLS. both
+	// or neither must be specified.
+	Cert []byte
+	Key  []byte
+	// ServerName, if set, overrides the name the server certs are verified
+	// against. otherwise the host part of the endpoint the client happens
+	// to be connected to at the time is used.
+	ServerName string
+	// InsecureSkipVerify disables the verification of the server certs
+	// altogether. it's there only for the benefit of the legacy deployments
+	// relying on the old behaviour while they're sorting out their certs.
+	InsecureSkipVerify bool
+}
+
+// ID returns a short fingerprint of the TLS identity and trust settings of
+// `c`, suitable for telling apart clients that must not be shared. a nil
+// `c` has an empty ID.
+func (c *TLSConfig) ID() string {
+	if c == nil {
+		return ""
+	}
+	h := sha256.New()
+	for _, b := range [][]byte{c.CA, c.Cert, c.Key, []byte(c.ServerName)} {
+		fmt.Fprintf(h, "%d:", len(b))
+		h.Write(b)
+	}
+	fmt.Fprintf(h, "%t", c.InsecureSkipVerify)
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// Build parses `c` into a Go TLS client config, or returns an error if any of
+// the certs or keys are malformed or the client cert and key don't match.
+func (c *TLSConfig) Build() (*tls.Config, error) {
+	res := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: c.ServerName,
+		//nolint:gosec // explicitly requested by the admin.
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if len(c.CA) > 0 {
+		res.RootCAs = x509.NewCertPool()
+		if !res.RootCAs.AppendCertsFromPEM(c.CA) {
+			return nil, fmt.Errorf("no valid PEM-encoded CA certs found in CA bundle")
+		}
+	}
+	switch {
+	case len(c.Cert) > 0 && len(c.Key) > 0:
+		cert, err := tls.X509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("bad client cert/key pair: %w", err)
+		}
+		res.Certificates = []tls.Certificate{cert}
+	case len(c.Cert) > 0:
+		return nil, fmt.Errorf("client cert specified without client key")
+	case len(c.Key) > 0:
+		return nil, fmt.Errorf("client key specified without client cert")
+	}
+	return res, nil
+}
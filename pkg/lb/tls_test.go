@@ -0,0 +1,103 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package lb_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lightbitslabs/los-csi/pkg/lb"
+)
+
+// mkCertPEM generates a self-signed cert and its key, PEM-encoded.
+func mkCertPEM(t *testing.T, cn string) (cert, key []byte) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestTLSConfigBuild(t *testing.T) {
+	caA, _ := mkCertPEM(t, "ca-a")
+	certB, keyB := mkCertPEM(t, "client-b")
+	_, keyC := mkCertPEM(t, "client-c")
+
+	testCases := []struct {
+		name   string
+		cfg    lb.TLSConfig
+		errStr string
+	}{
+		{name: "defaults", cfg: lb.TLSConfig{}},
+		{name: "ca", cfg: lb.TLSConfig{CA: caA, ServerName: "lb01"}},
+		{name: "mtls", cfg: lb.TLSConfig{CA: caA, Cert: certB, Key: keyB}},
+		{name: "bad ca", cfg: lb.TLSConfig{CA: []byte("nope")},
+			errStr: "no valid PEM-encoded CA certs"},
+		{name: "cert w/o key", cfg: lb.TLSConfig{Cert: certB},
+			errStr: "without client key"},
+		{name: "key w/o cert", cfg: lb.TLSConfig{Key: keyB},
+			errStr: "without client cert"},
+		{name: "mismatched key", cfg: lb.TLSConfig{Cert: certB, Key: keyC},
+			errStr: "bad client cert/key pair"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := tc.cfg.Build()
+			if tc.errStr != "" {
+				require.ErrorContains(t, err, tc.errStr)
+				return
+			}
+			require.NoError(t, err)
+			require.False(t, res.InsecureSkipVerify)
+			require.Equal(t, tc.cfg.ServerName, res.ServerName)
+			require.Equal(t, len(tc.cfg.CA) > 0, res.RootCAs != nil)
+			require.Equal(t, len(tc.cfg.Cert) > 0, len(res.Certificates) == 1)
+		})
+	}
+}
+
+func TestTLSConfigID(t *testing.T) {
+	var nilCfg *lb.TLSConfig
+	require.Empty(t, nilCfg.ID())
+
+	cfgs := []*lb.TLSConfig{
+		{},
+		{CA: []byte("ca")},
+		{Cert: []byte("ca")},
+		{CA: []byte("c"), Cert: []byte("a")},
+		{ServerName: "lb01"},
+		{InsecureSkipVerify: true},
+	}
+	seen := map[string]int{}
+	for i, cfg := range cfgs {
+		id := cfg.ID()
+		require.NotEmpty(t, id)
+		if j, ok := seen[id]; ok {
+			t.Fatalf("TLS configs #%d and #%d have the same ID '%s'", j, i, id)
+		}
+		seen[id] = i
+	}
+	require.Equal(t, cfgs[1].ID(), (&lb.TLSConfig{CA: []byte("ca")}).ID())
+}
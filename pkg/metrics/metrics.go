@@ -0,0 +1,79 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package metrics holds the Prometheus registry all the LB CSI plugin metrics
+// are registered with, and serves it over HTTP.
+//
+// the metrics themselves are defined by the packages they describe, normally
+// as package vars created through Factory. the gRPC metrics of the CSI server
+// and of the LightOS API clients are go-grpc-prometheus style ones, as
+// provided by the go-grpc-middleware Prometheus interceptors.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// Path is the HTTP path the metrics are served on.
+const Path = "/metrics"
+
+// DefBuckets are the default histogram buckets, in seconds. they're tuned for
+// the latencies of the CSI and LightOS API calls, some of which (e.g. volume
+// creation with a LightOS-side retry, or NodeStageVolume() with mkfs) can
+// take quite a few seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+var (
+	// Registry is the registry all the LB CSI plugin metrics are
+	// registered with. unlike the Prometheus client lib default one, it
+	// only has the plugin metrics and the Go runtime and process ones.
+	Registry = prometheus.NewRegistry()
+	// Factory creates metrics registered with Registry.
+	Factory = promauto.With(Registry)
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Serve serves the metrics gathered by `g` over HTTP on `addr` until `ctx` is
+// cancelled. failing to listen is reported synchronously, anything after that
+// is only logged.
+func Serve(ctx context.Context, log *logrus.Entry, g prometheus.Gatherer, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on metrics address '%s': %s", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(Path, promhttp.HandlerFor(g, promhttp.HandlerOpts{
+		ErrorLog: log,
+	}))
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close() //nolint:errcheck
+	}()
+	go func() {
+		log.WithField("addr", listener.Addr().String()).Info("serving metrics")
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("metrics server failed")
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServe(t *testing.T) {
+	r := prometheus.NewRegistry()
+	promauto.With(r).NewCounterVec(prometheus.CounterOpts{
+		Name: "test_ops_total",
+		Help: "Number of ops.",
+	}, []string{"op"}).WithLabelValues("create").Inc()
+
+	// grab a free port, Serve() only reports the address it listens on
+	// in the log:
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	log := logrus.NewEntry(logrus.New())
+	require.NoError(t, Serve(ctx, log, r, addr))
+	require.Error(t, Serve(ctx, log, r, addr), "address in use")
+
+	url := fmt.Sprintf("http://%s%s", addr, Path)
+	var resp *http.Response
+	require.Eventually(t, func() bool {
+		resp, err = http.Get(url) //nolint:gosec
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), `test_ops_total{op="create"} 1`)
+
+	cancel()
+	require.Eventually(t, func() bool {
+		_, err := http.Get(url) //nolint:gosec
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRegistry(t *testing.T) {
+	mfs, err := Registry.Gather()
+	require.NoError(t, err)
+	names := map[string]bool{}
+	for _, mf := range mfs {
+		names[mf.GetName()] = true
+	}
+	require.True(t, names["go_goroutines"])
+	require.True(t, names["process_start_time_seconds"])
+}
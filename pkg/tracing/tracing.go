@@ -0,0 +1,97 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package tracing sets up the OpenTelemetry tracing of the LB CSI plugin: the
+// spans of the CSI calls and of the LightOS API calls come from the otelgrpc
+// stats handlers, this package only adds the plumbing and a couple of helpers
+// for the plugin's own internal spans.
+//
+// the trace context is propagated in the W3C Trace Context `traceparent` gRPC
+// metadata header, both ways. the spans are sampled unless the remote parent
+// says otherwise, in which case that decision is propagated downstream too.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// the instrumentation scope name of the plugin's own spans.
+	tracerName = "github.com/lightbitslabs/los-csi"
+	// the standard OTLP/HTTP traces path, if the endpoint URL has none.
+	otlpTracesPath = "/v1/traces"
+)
+
+// NewOTLPExporter creates an exporter sending spans over OTLP/HTTP to the
+// collector at `endpoint`, e.g. "http://otel-collector:4318". the standard
+// `/v1/traces` path is appended unless `endpoint` already has a path.
+func NewOTLPExporter(endpoint string) (sdktrace.SpanExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("bad OTLP endpoint '%s': must be an http:// "+
+			"or https:// URL", endpoint)
+	}
+	path := u.Path
+	if path == "" || path == "/" {
+		path = otlpTracesPath
+	}
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithURLPath(path),
+	}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	// the exporter connects lazily, so there's nothing to wait for here.
+	return otlptracehttp.New(context.Background(), opts...)
+}
+
+// NewTracerProvider creates a tracer provider batching the spans to `exp`.
+// `res` are the attributes describing the entity producing the spans, e.g.
+// `service.name`.
+func NewTracerProvider(
+	exp sdktrace.SpanExporter, res ...attribute.KeyValue,
+) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(res...)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+	)
+}
+
+// SetTracerProvider installs `tp` as the global tracer provider, along with
+// the W3C Trace Context propagator. the otelgrpc stats handlers pick both up,
+// even if they were created earlier.
+func SetTracerProvider(tp trace.TracerProvider) {
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+}
+
+// Start starts a new internal span as a child of the current span in `ctx`,
+// if any. the returned context carries the new span. if tracing is disabled,
+// the span is a non-recording one, so End() is always safe to call.
+func Start(
+	ctx context.Context, name string, attrs ...attribute.KeyValue,
+) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records `err`, if any, on `span` and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
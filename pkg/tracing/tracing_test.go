@@ -0,0 +1,205 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// installTracer installs a tracer provider exporting to a fresh in-memory
+// exporter for the duration of the test. call the returned func to get the
+// spans exported so far.
+func installTracer(t *testing.T) func() tracetest.SpanStubs {
+	exp := tracetest.NewInMemoryExporter()
+	tp := NewTracerProvider(exp, attribute.String("service.name", "lb-csi-plugin"))
+	SetTracerProvider(tp)
+	t.Cleanup(func() {
+		SetTracerProvider(noop.NewTracerProvider())
+		tp.Shutdown(context.Background()) //nolint:errcheck
+	})
+	return func() tracetest.SpanStubs {
+		require.NoError(t, tp.ForceFlush(context.Background()))
+		return exp.GetSpans()
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	ctx, span := Start(context.Background(), "nop")
+	require.False(t, span.IsRecording())
+	require.False(t, trace.SpanContextFromContext(ctx).IsValid())
+	End(span, errors.New("boom")) // NOP.
+}
+
+func TestSpans(t *testing.T) {
+	spans := installTracer(t)
+
+	ctx, root := Start(context.Background(), "root", attribute.String("k", "v"))
+	_, child := Start(ctx, "child", attribute.Int("n", 3))
+	End(child, errors.New("boom"))
+	End(root, nil)
+
+	got := spans()
+	require.Len(t, got, 2)
+	c, r := got[0], got[1]
+	require.Equal(t, "child", c.Name)
+	require.Equal(t, trace.SpanKindInternal, c.SpanKind)
+	require.Equal(t, codes.Error, c.Status.Code)
+	require.Equal(t, "boom", c.Status.Description)
+	require.Len(t, c.Events, 1)
+	require.Equal(t, "exception", c.Events[0].Name)
+	require.Equal(t, []attribute.KeyValue{attribute.Int("n", 3)}, c.Attributes)
+	require.Equal(t, "root", r.Name)
+	require.Equal(t, codes.Unset, r.Status.Code)
+	require.True(t, r.SpanContext.IsSampled())
+	require.False(t, r.Parent.IsValid())
+	require.Equal(t, r.SpanContext.TraceID(), c.SpanContext.TraceID())
+	require.Equal(t, r.SpanContext.SpanID(), c.Parent.SpanID())
+	require.Contains(t, r.Resource.Attributes(),
+		attribute.String("service.name", "lb-csi-plugin"))
+}
+
+// healthSrv records the `traceparent` the server got along with each call.
+type healthSrv struct {
+	*health.Server
+	mu           sync.Mutex
+	traceparents []string
+}
+
+func (s *healthSrv) Check(
+	ctx context.Context, req *healthpb.HealthCheckRequest,
+) (*healthpb.HealthCheckResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.mu.Lock()
+	s.traceparents = append(s.traceparents, strings.Join(md.Get("traceparent"), ","))
+	s.mu.Unlock()
+	return s.Server.Check(ctx, req)
+}
+
+func TestGRPCPropagation(t *testing.T) {
+	spans := installTracer(t)
+
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(grpc.StatsHandler(otelgrpc.NewServerHandler()))
+	hs := &healthSrv{Server: health.NewServer()}
+	healthpb.RegisterHealthServer(srv, hs)
+	go srv.Serve(lis) //nolint:errcheck
+	defer srv.Stop()
+
+	cc, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+	)
+	require.NoError(t, err)
+	defer cc.Close()
+	clnt := healthpb.NewHealthClient(cc)
+
+	remote := func(flags trace.TraceFlags) context.Context {
+		sc := trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    trace.TraceID{0x4b, 0xf9, 0x2f, 0x35},
+			SpanID:     trace.SpanID{0x00, 0xf0, 0x67, 0xaa},
+			TraceFlags: flags,
+			Remote:     true,
+		})
+		return trace.ContextWithRemoteSpanContext(context.Background(), sc)
+	}
+
+	t.Run("root", func(t *testing.T) {
+		_, err := clnt.Check(context.Background(), &healthpb.HealthCheckRequest{})
+		require.NoError(t, err)
+		got := spans()
+		require.Len(t, got, 2)
+		srvSpan, clntSpan := got[0], got[1]
+		require.Equal(t, trace.SpanKindServer, srvSpan.SpanKind)
+		require.Equal(t, trace.SpanKindClient, clntSpan.SpanKind)
+		require.Equal(t, "grpc.health.v1.Health/Check", srvSpan.Name)
+		require.Equal(t, clntSpan.SpanContext.SpanID(), srvSpan.Parent.SpanID())
+		require.Equal(t, clntSpan.SpanContext.TraceID(), srvSpan.SpanContext.TraceID())
+		require.True(t, strings.HasSuffix(hs.traceparents[0], "-01"), hs.traceparents[0])
+	})
+
+	t.Run("sampled parent", func(t *testing.T) {
+		ctx := remote(trace.FlagsSampled)
+		n := len(spans())
+		_, err := clnt.Check(ctx, &healthpb.HealthCheckRequest{})
+		require.NoError(t, err)
+		got := spans()[n:]
+		require.Len(t, got, 2)
+		for _, s := range got {
+			require.Equal(t, trace.SpanContextFromContext(ctx).TraceID(),
+				s.SpanContext.TraceID())
+		}
+		require.True(t, strings.HasSuffix(hs.traceparents[1], "-01"), hs.traceparents[1])
+	})
+
+	t.Run("unsampled parent", func(t *testing.T) {
+		ctx := remote(0)
+		n := len(spans())
+		_, err := clnt.Check(ctx, &healthpb.HealthCheckRequest{})
+		require.NoError(t, err)
+		require.Len(t, spans()[n:], 0, "unsampled spans exported")
+		// ...and the decision is passed on downstream:
+		tp := hs.traceparents[2]
+		require.Contains(t, tp, trace.SpanContextFromContext(ctx).TraceID().String())
+		require.True(t, strings.HasSuffix(tp, "-00"), tp)
+	})
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var mu sync.Mutex
+	var paths, types []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, r.URL.Path)
+		types = append(types, r.Header.Get("Content-Type"))
+	}))
+	defer srv.Close()
+
+	for _, bad := range []string{"otel-collector:4318", "ftp://otel-collector", "http://"} {
+		_, err := NewOTLPExporter(bad)
+		require.Error(t, err, "endpoint: '%s'", bad)
+	}
+
+	for _, tc := range []struct{ endpoint, path string }{
+		{srv.URL, otlpTracesPath},
+		{srv.URL + "/", otlpTracesPath},
+		{srv.URL + "/custom/traces", "/custom/traces"},
+	} {
+		exp, err := NewOTLPExporter(tc.endpoint)
+		require.NoError(t, err)
+		tp := NewTracerProvider(exp)
+		_, span := tp.Tracer("test").Start(context.Background(), "FormatAndMount")
+		span.End()
+		require.NoError(t, tp.Shutdown(context.Background()))
+
+		mu.Lock()
+		require.Equal(t, tc.path, paths[len(paths)-1])
+		require.Equal(t, "application/x-protobuf", types[len(types)-1])
+		mu.Unlock()
+	}
+}
@@ -4,8 +4,10 @@
 package endpoint
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"net/netip"
 	"regexp"
 	"sort"
 	"strconv"
@@ -19,10 +21,13 @@ func init() {
 }
 
 type EP struct {
-	host string // either a hostname or an IP address
+	host string // either a hostname or an IP address, IPv6 - sans brackets
 	port uint16 // port number
 }
 
+// ParseStricter() parses a single `<host>:<port>` endpoint, where `<host>` is
+// a hostname, an IPv4 address, or an IPv6 address in square brackets (with an
+// optional zone, e.g. `[fe80::1%eth0]:4420`), as per RFC 3986.
 func ParseStricter(endpoint string) (EP, error) {
 	mkErr := func(format string, args ...interface{}) error {
 		return fmt.Errorf("bad endpoint '%s': "+format,
@@ -42,6 +47,13 @@ func ParseStricter(endpoint string) (EP, error) {
 	if !hostRegex.MatchString(host) {
 		return EP{}, mkErr("invalid host '%s'", host)
 	}
+	// colons only make sense in (bracketed, courtesy of SplitHostPort())
+	// IPv6 addresses, don't let any other junk through:
+	if strings.Contains(host, ":") {
+		if addr, err := netip.ParseAddr(host); err != nil || !addr.Is6() {
+			return EP{}, mkErr("invalid IPv6 address '%s'", host)
+		}
+	}
 	portNum, err := strconv.ParseUint(port, 10, 16)
 	if err != nil {
 		return EP{}, mkErr("invalid port number '%s'", port)
@@ -79,10 +91,26 @@ func ParseIP(endpoint string) (EP, error) {
 	return EP{}, fmt.Errorf("bad endpoint '%s': must be IP address", endpoint)
 }
 
+// Host() returns the host part of the endpoint: either a hostname or an IP
+// address. IPv6 addresses are returned without the square brackets, as
+// expected by most of the NVMe-oF tooling.
 func (ep EP) Host() string {
 	return ep.host
 }
 
+// IsIP() returns true if the host part of the endpoint is an IP address, as
+// opposed to a hostname that needs to be resolved before use.
+func (ep EP) IsIP() bool {
+	_, err := netip.ParseAddr(ep.host)
+	return err == nil
+}
+
+// IsIPv6() returns true if the host part of the endpoint is an IPv6 address.
+func (ep EP) IsIPv6() bool {
+	addr, err := netip.ParseAddr(ep.host)
+	return err == nil && addr.Is6() && !addr.Is4In6()
+}
+
 func (ep EP) Port() uint16 {
 	return ep.port
 }
@@ -128,6 +156,45 @@ func (eps Slice) Equal(rhs Slice) bool {
 	return true
 }
 
+// Resolver looks up the IP addresses of a host. *net.Resolver satisfies it.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// Resolve() returns a canonicalized (sorted and deduped) copy of `eps` with the
+// endpoints that have hostnames replaced by the endpoints with the same port
+// for each of the IPv4 and IPv6 addresses these hostnames resolve to. the
+// endpoints that already have IP addresses are left as is. it fails if any of
+// the hostnames fails to resolve. if `r` is nil, net.DefaultResolver is used.
+func (eps Slice) Resolve(ctx context.Context, r Resolver) (Slice, error) {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	uniq := make(map[EP]bool, len(eps))
+	for _, ep := range eps {
+		if ep.IsIP() {
+			uniq[ep] = true
+			continue
+		}
+		addrs, err := r.LookupNetIP(ctx, "ip", ep.host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve endpoint '%s': %w", ep, err)
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("failed to resolve endpoint '%s': no addresses", ep)
+		}
+		for _, addr := range addrs {
+			uniq[EP{host: addr.Unmap().String(), port: ep.port}] = true
+		}
+	}
+	res := make(Slice, 0, len(uniq))
+	for ep := range uniq {
+		res = append(res, ep)
+	}
+	sort.Sort(res)
+	return res, nil
+}
+
 func (eps Slice) IsValid() bool {
 	for _, ep := range eps {
 		if !ep.IsValid() {
@@ -185,6 +252,7 @@ func ParseSliceIP(targets []string) (Slice, error) {
 // it does NOT attempt to resolve the names present in the endpoints nor does
 // it try to connect to any of the targets. `targets` must be in a format:
 //     <host>:<port>[,<host>:<port>...]
+// where IPv6 <host> addresses must be enclosed in square brackets.
 func ParseCSV(endpoints string) (Slice, error) {
 	return canonicalize(strings.Split(endpoints, ","), ParseStricter)
 }
@@ -5,7 +5,9 @@
 package endpoint_test
 
 import (
+	"context"
 	"fmt"
+	"net/netip"
 	"strings"
 	"testing"
 
@@ -21,6 +23,7 @@ func TestStrictness(t *testing.T) {
 		strictEP endpoint.EP
 	}
 	epA80 := endpoint.MustParse("a:80")
+	ep6 := endpoint.MustParse("[2001:db8::1]:443")
 	tcs := []testCase{
 		{"", nilEP, nilEP},
 		{" ", nilEP, nilEP},
@@ -59,6 +62,16 @@ func TestStrictness(t *testing.T) {
 		{"user@host.com/path", nilEP, nilEP},
 		{"1.1.1.1:80000", nilEP, nilEP},
 		{"2001:0db8:0a0b:12f0:0000:0000:0000:0001:443", nilEP, nilEP},
+		{"[2001:db8::1]:443", ep6, ep6},
+		{" [2001:db8::1]:443 ", ep6, nilEP},
+		{"[2001:db8::1] :443", nilEP, nilEP},
+		{"[2001:db8::1]", nilEP, nilEP},
+		{"[2001:db8::1]:", nilEP, nilEP},
+		{"[2001:db8::g]:443", nilEP, nilEP},
+		{"[a:b]:443", nilEP, nilEP},
+		{"[1.2.3.4:5]:443", nilEP, nilEP},
+		{"[::ffff:1.2.3.4]:443", endpoint.MustParse("[::ffff:1.2.3.4]:443"),
+			endpoint.MustParse("[::ffff:1.2.3.4]:443")},
 	}
 
 	chkRes := func(
@@ -380,3 +393,86 @@ func TestParseSliceIPAddys(t *testing.T) {
 		})
 	}
 }
+
+func TestIPv6Format(t *testing.T) {
+	ep := endpoint.MustParse("[fe80::1%eth0]:4420")
+	if ep.Host() != "fe80::1%eth0" || ep.Port() != 4420 {
+		t.Errorf("BUG: bad host/port: '%s'/%d", ep.Host(), ep.Port())
+	}
+	if ep.String() != "[fe80::1%eth0]:4420" {
+		t.Errorf("BUG: bad string repr: '%s'", ep)
+	}
+	if !ep.IsIP() || !ep.IsIPv6() {
+		t.Errorf("BUG: '%s' not recognised as an IPv6 address", ep)
+	}
+	for _, tgt := range []string{"10.0.0.1:80", "[::ffff:10.0.0.1]:80", "lb01:80"} {
+		if endpoint.MustParse(tgt).IsIPv6() {
+			t.Errorf("BUG: '%s' mistaken for an IPv6 address", tgt)
+		}
+	}
+	if endpoint.MustParse("lb01:80").IsIP() {
+		t.Errorf("BUG: 'lb01:80' mistaken for an IP address")
+	}
+
+	eps := endpoint.MustParseCSV("[2001:db8::2]:443,10.0.0.1:443,[2001:db8::1]:443")
+	const csv = "10.0.0.1:443,[2001:db8::1]:443,[2001:db8::2]:443"
+	if eps.String() != csv {
+		t.Errorf("BUG: bad CSV repr: '%s'", eps)
+	}
+	if !endpoint.MustParseCSV(csv).Equal(eps) {
+		t.Errorf("BUG: '%s' didn't survive the round trip", csv)
+	}
+}
+
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupNetIP(_ context.Context, _, host string) ([]netip.Addr, error) {
+	ips, ok := r[host]
+	if !ok {
+		return nil, fmt.Errorf("no such host '%s'", host)
+	}
+	var res []netip.Addr
+	for _, ip := range ips {
+		res = append(res, netip.MustParseAddr(ip))
+	}
+	return res, nil
+}
+
+func TestResolve(t *testing.T) {
+	r := fakeResolver{
+		"lb01":   {"10.0.0.1", "2001:db8::1"},
+		"lb02":   {"::ffff:10.0.0.2"},
+		"lb03":   {"10.0.0.1"},
+		"nohost": {},
+	}
+	tcs := []struct {
+		tgts string
+		res  string
+	}{
+		{"10.0.0.9:4420", "10.0.0.9:4420"},
+		{"[2001:db8::9]:4420", "[2001:db8::9]:4420"},
+		{"lb01:4420", "10.0.0.1:4420,[2001:db8::1]:4420"},
+		{"lb02:4420,lb01:4420", "10.0.0.1:4420,10.0.0.2:4420,[2001:db8::1]:4420"},
+		{"lb01:4420,lb03:4420,10.0.0.1:4420", "10.0.0.1:4420,[2001:db8::1]:4420"},
+		{"lb01:4420,lb03:8009", "10.0.0.1:4420,10.0.0.1:8009,[2001:db8::1]:4420"},
+		{"lb01:4420,lb04:4420", ""},
+		{"nohost:4420", ""},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tgts, func(t *testing.T) {
+			eps, err := endpoint.MustParseCSV(tc.tgts).Resolve(context.Background(), r)
+			if tc.res == "" {
+				if err == nil {
+					t.Errorf("BUG: Resolve(%s) succeeded: [%s]", tc.tgts, eps)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("BUG: Resolve(%s) failed: %s", tc.tgts, err)
+			} else if eps.String() != tc.res {
+				t.Errorf("BUG: Resolve(%s) => bad result:\nEXP:%s\nGOT:%s",
+					tc.tgts, tc.res, eps)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package nlock provides sets of named mutual exclusion locks, created on
+// demand on first use and discarded once no longer held or waited for.
+package nlock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Set is a set of named locks. the zero value is an empty set ready for use.
+// a Set must not be copied after first use.
+type Set struct {
+	mu    sync.Mutex
+	locks map[string]*entry
+}
+
+type entry struct {
+	// a single-slot semaphore rather than a sync.Mutex, so that waiting for
+	// it can be abandoned on context cancellation.
+	sem chan struct{}
+	// number of holders + waiters, the entry is discarded once it drops to 0.
+	refs int
+}
+
+// Lock acquires the lock named `name`, blocking until it's available or `ctx`
+// is done, whichever comes first. on success it returns a function that must
+// be called to release the lock, along with the time spent waiting for it.
+// on failure it returns the context error (and the time wasted waiting).
+func (s *Set) Lock(ctx context.Context, name string) (func(), time.Duration, error) {
+	start := time.Now()
+
+	s.mu.Lock()
+	if s.locks == nil {
+		s.locks = make(map[string]*entry)
+	}
+	e, ok := s.locks[name]
+	if !ok {
+		e = &entry{sem: make(chan struct{}, 1)}
+		s.locks[name] = e
+	}
+	e.refs++
+	s.mu.Unlock()
+
+	select {
+	case e.sem <- struct{}{}:
+	case <-ctx.Done():
+		s.release(name, e)
+		return nil, time.Since(start), ctx.Err()
+	}
+
+	var once sync.Once
+	unlock := func() {
+		once.Do(func() {
+			<-e.sem
+			s.release(name, e)
+		})
+	}
+	return unlock, time.Since(start), nil
+}
+
+func (s *Set) release(name string, e *entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.refs--
+	if e.refs == 0 {
+		delete(s.locks, name)
+	}
+}
+
+// Len returns the number of locks currently held or waited for.
+func (s *Set) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.locks)
+}
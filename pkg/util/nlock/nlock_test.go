@@ -0,0 +1,106 @@
+// Copyright (C) 2016--2020 Lightbits Labs Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package nlock
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnrelatedNamesDontBlock(t *testing.T) {
+	var s Set
+	ctx := context.Background()
+
+	unlockA, _, err := s.Lock(ctx, "a")
+	require.NoError(t, err)
+	unlockB, waited, err := s.Lock(ctx, "b")
+	require.NoError(t, err)
+	require.Less(t, waited, time.Second)
+	require.Equal(t, 2, s.Len())
+
+	unlockA()
+	unlockB()
+	require.Equal(t, 0, s.Len())
+}
+
+func TestSameNameExcludes(t *testing.T) {
+	var s Set
+	ctx := context.Background()
+
+	const numWorkers = 8
+	const numIters = 100
+	var wg sync.WaitGroup
+	inside := 0
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < numIters; j++ {
+				unlock, _, err := s.Lock(ctx, "vol")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				inside++
+				if inside != 1 {
+					t.Errorf("%d holders of the same lock", inside)
+				}
+				inside--
+				unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 0, s.Len())
+}
+
+func TestLockCancel(t *testing.T) {
+	var s Set
+	unlock, _, err := s.Lock(context.Background(), "vol")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, waited, err := s.Lock(ctx, "vol")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.GreaterOrEqual(t, waited, 20*time.Millisecond)
+	require.Equal(t, 1, s.Len())
+
+	// double unlock must be harmless:
+	unlock()
+	unlock()
+	require.Equal(t, 0, s.Len())
+
+	unlock, waited, err = s.Lock(context.Background(), "vol")
+	require.NoError(t, err)
+	require.Less(t, waited, time.Second)
+	unlock()
+}
+
+func TestWaiterGetsLock(t *testing.T) {
+	var s Set
+	unlock, _, err := s.Lock(context.Background(), "vol")
+	require.NoError(t, err)
+
+	done := make(chan time.Duration)
+	go func() {
+		unlock2, waited, err := s.Lock(context.Background(), "vol")
+		if err != nil {
+			t.Error(err)
+		} else {
+			unlock2()
+		}
+		done <- waited
+	}()
+
+	time.Sleep(30 * time.Millisecond)
+	unlock()
+	waited := <-done
+	require.GreaterOrEqual(t, waited, 30*time.Millisecond)
+	require.Equal(t, 0, s.Len())
+}
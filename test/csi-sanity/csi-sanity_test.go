@@ -43,7 +43,6 @@ func TestCSISanity(t *testing.T) {
 		LogRole:       "node",
 		LogFormat:     "json",
 		LogTimestamps: false,
-		Transport:     "tcp",
 		SquelchPanics: false,
 		PrettyJSON:    true,
 	}